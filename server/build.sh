@@ -111,8 +111,9 @@ build_for() {
         echo -e "${YELLOW}Note: Cross-compiling requires CGO cross-compiler${NC}"
     fi
     
-    # Build with CGO enabled (required for SQLite)
+    # Build with CGO enabled (required for SQLite), with FTS5 for search
     CGO_ENABLED=1 GOOS=$GOOS GOARCH=$GOARCH go build \
+        -tags sqlite_fts5 \
         -ldflags="${LDFLAGS}" \
         -o "${OUTPUT_DIR}/${OUTPUT_NAME}" \
         ./cmd/server
@@ -0,0 +1,107 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/openflix/openflix-server/internal/artwork"
+	"github.com/openflix/openflix-server/internal/logger"
+)
+
+// ============ Artwork Handlers ============
+
+// serveArtwork serves an image from source, stored at path, in the width the
+// client asked for
+func (s *Server) serveArtwork(c *gin.Context, source, path string) {
+	width, _ := strconv.Atoi(c.Query("width"))
+	path = s.artwork.Variant(source, path, width)
+
+	info, err := os.Stat(path)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Artwork not found"})
+		return
+	}
+
+	etag := fmt.Sprintf(`"%s-%d-%x-%x"`, artwork.Key(source)[:16], artwork.VariantWidth(width), info.ModTime().Unix(), info.Size())
+	c.Header("ETag", etag)
+	c.Header("Cache-Control", "public, max-age=86400")
+	if match := c.GetHeader("If-None-Match"); match != "" && strings.Contains(match, etag) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+	c.File(path)
+}
+
+// serveRemoteArtwork serves the cached copy of remote artwork, downloading it
+// first if needed. It reports false when the artwork couldn't be fetched.
+func (s *Server) serveRemoteArtwork(c *gin.Context, remoteURL string) bool {
+	path, err := s.artwork.Fetch(remoteURL)
+	if err != nil {
+		logger.Debugf("Failed to cache artwork %s: %v", remoteURL, err)
+		return false
+	}
+	s.serveArtwork(c, remoteURL, path)
+	return true
+}
+
+// getArtwork handles /artwork?url=...&width=..., serving cast headshots,
+// recording posters and other artwork that isn't an item's own thumb or art
+func (s *Server) getArtwork(c *gin.Context) {
+	source := c.Query("url")
+	if source == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "url is required"})
+		return
+	}
+	if strings.HasPrefix(source, "/library/") {
+		c.Redirect(http.StatusTemporaryRedirect, source)
+		return
+	}
+
+	remoteURL := artwork.RemoteURL(source, "w500")
+	if remoteURL == "" || !s.artwork.Referenced(source) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Artwork not found"})
+		return
+	}
+	if !s.serveRemoteArtwork(c, remoteURL) {
+		c.Redirect(http.StatusTemporaryRedirect, remoteURL)
+	}
+}
+
+// artworkURL returns the URL clients should load artwork from: remote
+// artwork goes through the local cache
+func artworkURL(source string) string {
+	if artwork.RemoteURL(source, "w500") == "" {
+		return source
+	}
+	return "/artwork?url=" + url.QueryEscape(source)
+}
+
+// itemArtworkURL returns the URL of an item's thumb or art. Remote artwork is
+// served from the cache through the item's own endpoint.
+func itemArtworkURL(itemID uint, kind, source string, version int64) string {
+	if artwork.RemoteURL(source, "w500") == "" {
+		return source
+	}
+	if version > 0 {
+		return fmt.Sprintf("/library/metadata/%d/%s/%d", itemID, kind, version)
+	}
+	return fmt.Sprintf("/library/metadata/%d/%s", itemID, kind)
+}
+
+// adminCollectArtwork removes cached artwork nothing refers to any more
+func (s *Server) adminCollectArtwork(c *gin.Context) {
+	removed, freed, err := s.artwork.Collect()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to collect artwork: " + err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"removed": removed,
+		"freed":   freed,
+	})
+}
@@ -0,0 +1,94 @@
+package api
+
+import (
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/openflix/openflix-server/internal/library"
+	"github.com/openflix/openflix-server/internal/models"
+)
+
+// ============ Chapter Handlers ============
+
+// chaptersToJSON converts the chapters of a file to their Plex representation
+func chaptersToJSON(chapters []models.MediaChapter) []gin.H {
+	list := make([]gin.H, len(chapters))
+	for i, chapter := range chapters {
+		entry := gin.H{
+			"id":              chapter.ID,
+			"index":           chapter.Index,
+			"tag":             chapter.Title,
+			"startTimeOffset": chapter.StartTime,
+			"endTimeOffset":   chapter.EndTime,
+		}
+		if chapter.Thumb != "" {
+			entry["thumb"] = chapter.Thumb
+		}
+		list[i] = entry
+	}
+	return list
+}
+
+// recordingChapters makes chapters of the program blocks between a
+// recording's commercials, so clients can jump from block to block
+func recordingChapters(r *models.Recording, segments []models.CommercialSegment) []gin.H {
+	if len(segments) == 0 {
+		return nil
+	}
+	length := r.EndTime.Sub(r.StartTime).Milliseconds()
+	segments = append([]models.CommercialSegment(nil), segments...)
+	sort.Slice(segments, func(i, j int) bool { return segments[i].StartTime < segments[j].StartTime })
+
+	var chapters []gin.H
+	var start int64
+	addBlock := func(end int64) {
+		// Gaps of a few seconds between back-to-back breaks aren't blocks
+		if end-start < 10000 {
+			return
+		}
+		chapters = append(chapters, gin.H{
+			"index":           len(chapters) + 1,
+			"tag":             "Part " + strconv.Itoa(len(chapters)+1),
+			"startTimeOffset": start,
+			"endTimeOffset":   end,
+		})
+	}
+	for _, segment := range segments {
+		addBlock(int64(segment.StartTime * 1000))
+		start = int64(segment.EndTime * 1000)
+	}
+	if length > start {
+		addBlock(length)
+	}
+	return chapters
+}
+
+// getChapterThumb serves the thumbnail of a chapter
+func (s *Server) getChapterThumb(c *gin.Context) {
+	partID, err := strconv.ParseUint(c.Param("partId"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid part ID"})
+		return
+	}
+	index, err := strconv.Atoi(c.Param("index"))
+	if err != nil || index < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chapter"})
+		return
+	}
+
+	var chapter models.MediaChapter
+	if err := s.db.Where("media_file_id = ? AND `index` = ?", partID, index).First(&chapter).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Chapter not found"})
+		return
+	}
+	path := library.ChapterThumbPath(s.config.GetDataDir(), chapter.MediaFileID, chapter.Index)
+	if _, err := os.Stat(path); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Chapter thumbnail not found"})
+		return
+	}
+	c.Header("Cache-Control", "public, max-age=86400")
+	c.File(path)
+}
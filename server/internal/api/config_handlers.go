@@ -535,7 +535,10 @@ func (s *Server) importConfig(c *gin.Context) {
 		if s.db.Where("title = ?", lib.Title).First(&existing).Error == nil {
 			existing.Type = lib.Type
 			existing.Agent = lib.Agent
+			existing.Agents = lib.Agents
+			existing.AgentRules = lib.AgentRules
 			existing.Scanner = lib.Scanner
+			existing.EpisodeOrder = lib.EpisodeOrder
 			existing.Language = lib.Language
 			existing.Hidden = lib.Hidden
 			if err := s.db.Save(&existing).Error; err != nil {
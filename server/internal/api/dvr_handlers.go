@@ -14,6 +14,7 @@ import (
 	"github.com/openflix/openflix-server/internal/dvr"
 	"github.com/openflix/openflix-server/internal/logger"
 	"github.com/openflix/openflix-server/internal/models"
+	"github.com/openflix/openflix-server/internal/search"
 	"gorm.io/gorm"
 )
 
@@ -29,6 +30,7 @@ type CommercialResponse struct {
 type RecordingResponse struct {
 	models.Recording
 	Commercials []CommercialResponse `json:"commercials"`
+	Chapters    []gin.H              `json:"chapters,omitempty"` // program blocks between commercials
 }
 
 // toRecordingResponse converts a Recording with CommercialSegments to Android-compatible format
@@ -40,11 +42,16 @@ func toRecordingResponse(r models.Recording) RecordingResponse {
 			End:   int64(c.EndTime * 1000),
 		}
 	}
+	chapters := recordingChapters(&r, r.Commercials)
 	// Clear the original commercials to avoid duplicate data
 	r.Commercials = nil
+	// Artwork is served from the local cache
+	r.Thumb = artworkURL(r.Thumb)
+	r.Art = artworkURL(r.Art)
 	return RecordingResponse{
 		Recording:   r,
 		Commercials: commercials,
+		Chapters:    chapters,
 	}
 }
 
@@ -218,6 +225,7 @@ func (s *Server) scheduleRecording(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create recording"})
 		return
 	}
+	search.IndexRecording(s.db, &recording)
 
 	// Enrich recording with TMDB metadata in background
 	if s.dvrEnricher != nil {
@@ -316,6 +324,7 @@ func (s *Server) recordFromProgram(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create recording"})
 		return
 	}
+	search.IndexRecording(s.db, &recording)
 
 	// Enrich recording with TMDB metadata in background (to get higher quality artwork)
 	if s.dvrEnricher != nil {
@@ -343,8 +352,8 @@ func (s *Server) recordFromProgram(c *gin.Context) {
 		"endTime":      recording.EndTime,
 		"status":       recording.Status,
 		"seriesRecord": recording.SeriesRecord,
-		"thumb":        recording.Thumb,
-		"art":          recording.Art,
+		"thumb":        artworkURL(recording.Thumb),
+		"art":          artworkURL(recording.Art),
 		"hasConflict":  len(conflicts) > 0,
 		"conflicts":    conflicts,
 	}
@@ -392,7 +401,9 @@ func (s *Server) scheduleFutureSeriesRecordings(userID uint, channelID string, s
 		var channel models.Channel
 		if s.db.Where("channel_id = ?", channelID).First(&channel).Error == nil {
 			recording.ChannelID = channel.ID
-			s.db.Create(&recording)
+			if s.db.Create(&recording).Error == nil {
+				search.IndexRecording(s.db, &recording)
+			}
 		}
 	}
 }
@@ -407,12 +418,17 @@ func (s *Server) getRecording(c *gin.Context) {
 	}
 
 	var recording models.Recording
-	if err := s.db.Where("user_id = ?", userID).First(&recording, id).Error; err != nil {
+	err = s.db.Where("user_id = ?", userID).
+		Preload("Commercials", func(db *gorm.DB) *gorm.DB {
+			return db.Order("start_time ASC")
+		}).
+		First(&recording, id).Error
+	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Recording not found"})
 		return
 	}
 
-	c.JSON(http.StatusOK, recording)
+	c.JSON(http.StatusOK, toRecordingResponse(recording))
 }
 
 // deleteRecording deletes a recording
@@ -447,6 +463,7 @@ func (s *Server) deleteRecording(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete recording"})
 		return
 	}
+	search.RemoveRecording(s.db, recording.ID)
 
 	c.JSON(http.StatusOK, gin.H{"message": "Recording deleted"})
 }
@@ -16,10 +16,14 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
+	"github.com/openflix/openflix-server/internal/artwork"
 	"github.com/openflix/openflix-server/internal/auth"
 	"github.com/openflix/openflix-server/internal/library"
 	"github.com/openflix/openflix-server/internal/logger"
+	"github.com/openflix/openflix-server/internal/metadata"
 	"github.com/openflix/openflix-server/internal/models"
+	"github.com/openflix/openflix-server/internal/playback"
+	"github.com/openflix/openflix-server/internal/search"
 	"github.com/openflix/openflix-server/internal/transcode"
 	"gorm.io/gorm"
 )
@@ -198,10 +202,12 @@ func (s *Server) getTranscodeInfo(c *gin.Context) {
 
 	transcodeEnabled := s.transcoder != nil
 	activeSessions := 0
+	sessionLoad := 0
 	var sessions []map[string]interface{}
 
 	if s.transcoder != nil {
 		activeSessions = s.transcoder.GetActiveSessions()
+		sessionLoad = s.transcoder.GetSessionLoad()
 		sessions = s.transcoder.GetSessionInfo()
 	}
 
@@ -229,6 +235,7 @@ func (s *Server) getTranscodeInfo(c *gin.Context) {
 		},
 		"sessions": gin.H{
 			"active":  activeSessions,
+			"load":    sessionLoad,
 			"max":     s.config.Transcode.MaxSessions,
 			"details": sessions,
 		},
@@ -916,28 +923,40 @@ func (s *Server) getLibraryContent(c *gin.Context) {
 	}
 
 	// Determine what type of items to fetch based on library type
-	var itemTypes []string
-	switch lib.Type {
-	case "movie":
-		itemTypes = []string{"movie"}
-	case "show":
-		itemTypes = []string{"show"} // For shows, return top-level shows
-	default:
-		itemTypes = []string{lib.Type}
+	itemTypes := libraryItemTypes(lib.Type)
+
+	// Optional filter expression and sort, shared with smart collections/playlists
+	filter, err := library.ParseFilter(c.Query("filter"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	order, err := library.ParseSort(c.Query("sort"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
 
+	base := s.db.Model(&models.MediaItem{}).Where("media_items.library_id = ?", libraryID)
+	if !filter.HasField("type") {
+		base = base.Where("media_items.type IN ?", itemTypes)
+		// Photo libraries are browsed like folders, starting at the top level
+		if lib.Type == "photo" {
+			base = base.Where("media_items.parent_id IS NULL")
+		}
+	}
+	base = filter.Apply(base, c.GetUint("userID"), c.GetUint("profileID")).Session(&gorm.Session{})
+
 	// Get total count
 	var totalCount int64
-	s.db.Model(&models.MediaItem{}).
-		Where("library_id = ? AND type IN ?", libraryID, itemTypes).
-		Count(&totalCount)
+	base.Count(&totalCount)
 
 	// Get paginated items
 	var items []models.MediaItem
-	query := s.db.Where("library_id = ? AND type IN ?", libraryID, itemTypes).
+	query := base.
 		Preload("MediaFiles").
 		Preload("Genres").
-		Order("sort_title ASC").
+		Order(order).
 		Offset(offset).
 		Limit(limit)
 
@@ -969,6 +988,12 @@ func (s *Server) getLibraryFilters(c *gin.Context) {
 		{"filter": "year", "filterType": "integer", "title": "Year"},
 		{"filter": "contentRating", "filterType": "string", "title": "Content Rating"},
 		{"filter": "resolution", "filterType": "string", "title": "Resolution"},
+		{"filter": "decade", "filterType": "integer", "title": "Decade"},
+		{"filter": "rating", "filterType": "integer", "title": "Rating"},
+		{"filter": "studio", "filterType": "string", "title": "Studio"},
+		{"filter": "addedAt", "filterType": "date", "title": "Date Added"},
+		{"filter": "unwatched", "filterType": "boolean", "title": "Unwatched"},
+		{"filter": "inProgress", "filterType": "boolean", "title": "In Progress"},
 	}
 	s.respondWithDirectory(c, filters, len(filters))
 }
@@ -979,6 +1004,9 @@ func (s *Server) getLibrarySorts(c *gin.Context) {
 		{"key": "addedAt:desc", "title": "Date Added"},
 		{"key": "year:desc", "title": "Release Date"},
 		{"key": "rating:desc", "title": "Rating"},
+		{"key": "audienceRating:desc", "title": "Audience Rating"},
+		{"key": "duration:desc", "title": "Duration"},
+		{"key": "random", "title": "Randomly"},
 	}
 	s.respondWithDirectory(c, sorts, len(sorts))
 }
@@ -992,30 +1020,40 @@ func (s *Server) getLibraryCollections(c *gin.Context) {
 
 	// Get user collections from database
 	var collections []models.Collection
-	s.db.Where("library_id = ?", libraryID).Find(&collections)
+	s.db.Where("library_id = ?", libraryID).Order("title ASC").Find(&collections)
 
 	// Convert to response format
 	result := make([]gin.H, len(collections))
-	for i, col := range collections {
-		result[i] = gin.H{
-			"ratingKey":        col.ID,
-			"key":              fmt.Sprintf("/library/collections/%d/children", col.ID),
-			"guid":             col.UUID,
-			"type":             "collection",
-			"title":            col.Title,
-			"summary":          col.Summary,
-			"thumb":            col.Thumb,
-			"art":              col.Art,
-			"childCount":       col.ChildCount,
-			"librarySectionID": col.LibraryID,
-			"addedAt":          col.AddedAt.Unix(),
-			"updatedAt":        col.UpdatedAt.Unix(),
-		}
+	for i := range collections {
+		result[i] = collectionToMetadata(&collections[i])
 	}
 
 	s.respondWithMediaContainer(c, result, len(result), len(result), 0)
 }
 
+// collectionToMetadata converts a Collection to Plex-compatible metadata format
+func collectionToMetadata(col *models.Collection) gin.H {
+	metadata := gin.H{
+		"ratingKey":        col.ID,
+		"key":              fmt.Sprintf("/library/collections/%d/children", col.ID),
+		"guid":             col.UUID,
+		"type":             "collection",
+		"title":            col.Title,
+		"summary":          col.Summary,
+		"childCount":       col.ChildCount,
+		"librarySectionID": col.LibraryID,
+		"addedAt":          col.AddedAt.Unix(),
+		"updatedAt":        col.UpdatedAt.Unix(),
+	}
+	if col.Thumb != "" {
+		metadata["thumb"] = col.Thumb
+	}
+	if col.Art != "" {
+		metadata["art"] = col.Art
+	}
+	return metadata
+}
+
 func (s *Server) refreshLibrary(c *gin.Context) {
 	libraryID, err := strconv.ParseUint(c.Param("id"), 10, 32)
 	if err != nil {
@@ -1030,11 +1068,9 @@ func (s *Server) refreshLibrary(c *gin.Context) {
 	}
 
 	// Trigger scan in background
-	go func() {
-		s.scanner.ScanLibrary(lib)
-	}()
+	job := s.scanner.StartScan(lib)
 
-	c.JSON(http.StatusOK, gin.H{"status": "scanning"})
+	c.JSON(http.StatusOK, gin.H{"status": "scanning", "jobId": job.ID})
 }
 
 // getLibraryFolders returns the folder structure for a library
@@ -1254,11 +1290,27 @@ func (s *Server) getLibraryHubs(c *gin.Context) {
 		})
 	}
 
-	// 6. Streaming Service Hubs (Netflix, Disney+, etc.) - get top 8
+	// 6. Collections Hub
+	collectionItems := s.getCollectionHubItems(uint(libraryID), hubLimit)
+	if len(collectionItems) > 0 {
+		hubs = append(hubs, gin.H{
+			"key":           fmt.Sprintf("/library/sections/%d/collections", libraryID),
+			"hubIdentifier": "collections",
+			"type":          "collection",
+			"title":         "Collections",
+			"context":       "hub.collections",
+			"size":          len(collectionItems),
+			"more":          len(collectionItems) >= hubLimit,
+			"style":         "shelf",
+			"Metadata":      collectionItems,
+		})
+	}
+
+	// 7. Streaming Service Hubs (Netflix, Disney+, etc.) - get top 8
 	serviceHubs := s.getStreamingServiceHubs(uint(libraryID), lib.Type, hubLimit, 8)
 	hubs = append(hubs, serviceHubs...)
 
-	// 7. By Genre Hubs (get top 3 genres)
+	// 8. By Genre Hubs (get top 3 genres)
 	genreHubs := s.getGenreHubs(uint(libraryID), lib.Type, hubLimit, 3)
 	hubs = append(hubs, genreHubs...)
 
@@ -1422,6 +1474,20 @@ func (s *Server) getTopRatedItems(libraryID uint, libType string, limit int) []g
 	return result
 }
 
+func (s *Server) getCollectionHubItems(libraryID uint, limit int) []gin.H {
+	var collections []models.Collection
+	s.db.Where("library_id = ? AND child_count > 0", libraryID).
+		Order("updated_at DESC").
+		Limit(limit).
+		Find(&collections)
+
+	result := make([]gin.H, len(collections))
+	for i := range collections {
+		result[i] = collectionToMetadata(&collections[i])
+	}
+	return result
+}
+
 func (s *Server) getGenreHubs(libraryID uint, libType string, itemLimit int, genreLimit int) []gin.H {
 	itemType := libType
 	if libType == "show" {
@@ -1645,6 +1711,9 @@ func (s *Server) mediaItemToMetadata(item *models.MediaItem, lib *models.Library
 	if item.Tagline != "" {
 		metadata["tagline"] = item.Tagline
 	}
+	if item.Subtype != "" {
+		metadata["subtype"] = item.Subtype
+	}
 	if item.ContentRating != "" {
 		metadata["contentRating"] = item.ContentRating
 	}
@@ -1654,6 +1723,9 @@ func (s *Server) mediaItemToMetadata(item *models.MediaItem, lib *models.Library
 	if item.Year > 0 {
 		metadata["year"] = item.Year
 	}
+	if item.OriginallyAvailableAt != nil {
+		metadata["originallyAvailableAt"] = item.OriginallyAvailableAt.Format("2006-01-02")
+	}
 	if item.Duration > 0 {
 		metadata["duration"] = item.Duration
 	}
@@ -1664,13 +1736,13 @@ func (s *Server) mediaItemToMetadata(item *models.MediaItem, lib *models.Library
 		metadata["audienceRating"] = item.AudienceRating
 	}
 	if item.Thumb != "" {
-		metadata["thumb"] = item.Thumb
+		metadata["thumb"] = itemArtworkURL(item.ID, "thumb", item.Thumb, item.UpdatedAt.Unix())
 	} else {
 		// Generate placeholder thumb URL
 		metadata["thumb"] = fmt.Sprintf("/library/metadata/%d/thumb", item.ID)
 	}
 	if item.Art != "" {
-		metadata["art"] = item.Art
+		metadata["art"] = itemArtworkURL(item.ID, "art", item.Art, item.UpdatedAt.Unix())
 	}
 
 	// Add hierarchy info for episodes/seasons
@@ -1688,6 +1760,9 @@ func (s *Server) mediaItemToMetadata(item *models.MediaItem, lib *models.Library
 	if item.ParentIndex > 0 {
 		metadata["parentIndex"] = item.ParentIndex
 	}
+	if item.AbsoluteIndex > 0 {
+		metadata["absoluteIndex"] = item.AbsoluteIndex
+	}
 	if item.ParentTitle != "" {
 		metadata["parentTitle"] = item.ParentTitle
 	}
@@ -1696,9 +1771,15 @@ func (s *Server) mediaItemToMetadata(item *models.MediaItem, lib *models.Library
 	}
 	if item.ParentThumb != "" {
 		metadata["parentThumb"] = item.ParentThumb
+		if item.ParentID != nil {
+			metadata["parentThumb"] = itemArtworkURL(*item.ParentID, "thumb", item.ParentThumb, 0)
+		}
 	}
 	if item.GrandparentThumb != "" {
 		metadata["grandparentThumb"] = item.GrandparentThumb
+		if item.GrandparentID != nil {
+			metadata["grandparentThumb"] = itemArtworkURL(*item.GrandparentID, "thumb", item.GrandparentThumb, 0)
+		}
 	}
 
 	// Add child/leaf counts for shows/seasons
@@ -1725,16 +1806,17 @@ func (s *Server) mediaItemToMetadata(item *models.MediaItem, lib *models.Library
 	if len(item.Cast) > 0 {
 		var directors, writers, roles []gin.H
 		for _, cast := range item.Cast {
+			thumb := artworkURL(cast.Thumb)
 			entry := gin.H{
 				"tag":   cast.Tag,
 				"role":  cast.Role,
-				"thumb": cast.Thumb,
+				"thumb": thumb,
 			}
 			switch cast.Role {
 			case "Director":
-				directors = append(directors, gin.H{"tag": cast.Tag, "thumb": cast.Thumb})
+				directors = append(directors, gin.H{"tag": cast.Tag, "thumb": thumb})
 			case "Writer", "Screenplay", "Story":
-				writers = append(writers, gin.H{"tag": cast.Tag, "thumb": cast.Thumb})
+				writers = append(writers, gin.H{"tag": cast.Tag, "thumb": thumb})
 			default:
 				// Regular cast member (actor)
 				roles = append(roles, entry)
@@ -1775,13 +1857,39 @@ func (s *Server) mediaItemToMetadata(item *models.MediaItem, lib *models.Library
 					},
 				},
 			}
+			if file.Height > 0 {
+				media[i]["videoResolution"] = videoResolution(file.Height)
+			}
+			if file.Edition != "" {
+				media[i]["editionTitle"] = file.Edition
+			}
 		}
 		metadata["Media"] = media
+
+		// Chapters of the file played by default
+		if chapters := item.MediaFiles[0].Chapters; len(chapters) > 0 {
+			metadata["Chapter"] = chaptersToJSON(chapters)
+		}
 	}
 
 	return metadata
 }
 
+// videoResolution is the Plex name of a video height: "4k", "1080", "sd"...
+func videoResolution(height int) string {
+	switch {
+	case height >= 2160:
+		return "4k"
+	case height >= 1080:
+		return "1080"
+	case height >= 720:
+		return "720"
+	case height >= 480:
+		return "480"
+	}
+	return "sd"
+}
+
 // ============ Metadata Handlers ============
 
 func (s *Server) getMetadata(c *gin.Context) {
@@ -1792,21 +1900,53 @@ func (s *Server) getMetadata(c *gin.Context) {
 	}
 
 	var item models.MediaItem
-	if err := s.db.Preload("MediaFiles").Preload("Genres").Preload("Cast").First(&item, key).Error; err != nil {
+	err = s.db.Preload("MediaFiles").
+		Preload("MediaFiles.Chapters", func(db *gorm.DB) *gorm.DB {
+			return db.Order("`index` ASC")
+		}).
+		Preload("MediaFiles.Streams").
+		Preload("Genres").Preload("Cast").First(&item, key).Error
+	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Item not found"})
 		return
 	}
+	item.MediaFiles = s.bestVersionFirst(c, item.MediaFiles)
 
 	lib, _ := s.libraryService.GetLibrary(item.LibraryID)
 
+	metadata := s.mediaItemToMetadata(&item, lib)
+	s.addPartStreams(metadata)
+	s.addMarkers(metadata)
+	s.addGuids(metadata, item.ID)
+	if item.Type == "photo" {
+		s.addPhotoExif(metadata, item.ID)
+	}
+	if c.Query("includeExtras") == "1" {
+		extras := s.itemExtras(item.ID, lib)
+		metadata["Extras"] = gin.H{"size": len(extras), "Metadata": extras}
+	}
+
 	c.JSON(http.StatusOK, gin.H{
 		"MediaContainer": gin.H{
 			"size":     1,
-			"Metadata": []gin.H{s.mediaItemToMetadata(&item, lib)},
+			"Metadata": []gin.H{metadata},
 		},
 	})
 }
 
+// addGuids lists the item's IDs in other databases, e.g. "imdb://tt0133093"
+func (s *Server) addGuids(entry gin.H, itemID uint) {
+	guids := metadata.ItemGuids(s.db, itemID)
+	if len(guids) == 0 {
+		return
+	}
+	list := make([]gin.H, len(guids))
+	for i, guid := range guids {
+		list[i] = gin.H{"id": guid}
+	}
+	entry["Guid"] = list
+}
+
 func (s *Server) getMetadataChildren(c *gin.Context) {
 	key, err := strconv.ParseUint(c.Param("key"), 10, 32)
 	if err != nil {
@@ -1823,11 +1963,22 @@ func (s *Server) getMetadataChildren(c *gin.Context) {
 
 	lib, _ := s.libraryService.GetLibrary(parent.LibraryID)
 
-	// Get children (seasons for shows, episodes for seasons)
+	// Get children (seasons for shows, episodes for seasons, albums for
+	// artists, tracks for albums, sub-albums then photos for photo albums)
+	order := "`index` ASC"
+	switch parent.Type {
+	case "artist":
+		order = "year ASC, sort_title ASC"
+	case "album":
+		order = "parent_index ASC, `index` ASC"
+	case "photoalbum":
+		order = "type DESC, originally_available_at ASC, sort_title ASC"
+	}
+
 	var children []models.MediaItem
-	if err := s.db.Where("parent_id = ?", key).
+	if err := s.db.Where("parent_id = ? AND type <> ?", key, "extra").
 		Preload("MediaFiles").
-		Order("`index` ASC").
+		Order(order).
 		Find(&children).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -1864,6 +2015,50 @@ func (s *Server) getMetadataChildren(c *gin.Context) {
 	})
 }
 
+// getMetadataExtras lists the trailers, featurettes and other extras of a
+// movie or show
+func (s *Server) getMetadataExtras(c *gin.Context) {
+	key, err := strconv.ParseUint(c.Param("key"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid metadata key"})
+		return
+	}
+
+	var parent models.MediaItem
+	if err := s.db.First(&parent, key).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Item not found"})
+		return
+	}
+	lib, _ := s.libraryService.GetLibrary(parent.LibraryID)
+
+	metadata := s.itemExtras(parent.ID, lib)
+	c.JSON(http.StatusOK, gin.H{
+		"MediaContainer": gin.H{
+			"size":             len(metadata),
+			"key":              fmt.Sprintf("/library/metadata/%d/extras", key),
+			"parentRatingKey":  parent.ID,
+			"parentTitle":      parent.Title,
+			"librarySectionID": parent.LibraryID,
+			"Metadata":         metadata,
+		},
+	})
+}
+
+// itemExtras returns the extras of an item, trailers first
+func (s *Server) itemExtras(itemID uint, lib *models.Library) []gin.H {
+	var extras []models.MediaItem
+	s.db.Where("parent_id = ? AND type = ?", itemID, "extra").
+		Preload("MediaFiles").
+		Order("CASE WHEN subtype = 'trailer' THEN 0 ELSE 1 END, subtype ASC, sort_title ASC").
+		Find(&extras)
+
+	metadata := make([]gin.H, len(extras))
+	for i := range extras {
+		metadata[i] = s.mediaItemToMetadata(&extras[i], lib)
+	}
+	return metadata
+}
+
 // setMetadataPrefs sets audio/subtitle preferences for a media item
 func (s *Server) setMetadataPrefs(c *gin.Context) {
 	key := c.Param("key")
@@ -2079,70 +2274,218 @@ func (s *Server) search(c *gin.Context) {
 		}
 	}
 
-	// Search pattern for LIKE queries
-	searchPattern := "%" + strings.ToLower(query) + "%"
-
-	// Search for movies
-	var movies []models.MediaItem
-	s.db.Preload("Genres").
-		Where("type = ? AND (LOWER(title) LIKE ? OR LOWER(original_title) LIKE ? OR LOWER(summary) LIKE ?)",
-			"movie", searchPattern, searchPattern, searchPattern).
-		Limit(limit).
-		Find(&movies)
-
-	// Search for TV shows
-	var shows []models.MediaItem
-	s.db.Preload("Genres").
-		Where("type = ? AND (LOWER(title) LIKE ? OR LOWER(original_title) LIKE ? OR LOWER(summary) LIKE ?)",
-			"show", searchPattern, searchPattern, searchPattern).
-		Limit(limit).
-		Find(&shows)
-
-	// Build hubs (grouped results by type)
+	// Build hubs (grouped results by type), skipping empty ones
 	hubs := []gin.H{}
-
-	// Movie hub
-	if len(movies) > 0 {
-		movieMetadata := make([]gin.H, len(movies))
-		for i, movie := range movies {
-			var lib models.Library
-			s.db.First(&lib, movie.LibraryID)
-			movieMetadata[i] = s.mediaItemToMetadata(&movie, &lib)
+	total := 0
+	addHub := func(hubType, identifier, title string, metadata []gin.H) {
+		if len(metadata) == 0 {
+			return
 		}
 		hubs = append(hubs, gin.H{
-			"type":          "movie",
-			"hubIdentifier": "movie",
-			"title":         "Movies",
-			"size":          len(movies),
-			"Metadata":      movieMetadata,
+			"type":          hubType,
+			"hubIdentifier": identifier,
+			"title":         title,
+			"size":          len(metadata),
+			"Metadata":      metadata,
 		})
+		total += len(metadata)
 	}
 
-	// TV Shows hub
-	if len(shows) > 0 {
-		showMetadata := make([]gin.H, len(shows))
-		for i, show := range shows {
-			var lib models.Library
-			s.db.First(&lib, show.LibraryID)
-			showMetadata[i] = s.mediaItemToMetadata(&show, &lib)
-		}
-		hubs = append(hubs, gin.H{
-			"type":          "show",
-			"hubIdentifier": "show",
-			"title":         "TV Shows",
-			"size":          len(shows),
-			"Metadata":      showMetadata,
-		})
-	}
+	addHub("movie", "movie", "Movies", s.searchMediaHub(query, search.KindMovie, limit))
+	addHub("show", "show", "TV Shows", s.searchMediaHub(query, search.KindShow, limit))
+	addHub("episode", "episode", "Episodes", s.searchMediaHub(query, search.KindEpisode, limit))
+	addHub("person", "person", "People", s.searchPeopleHub(query, limit))
+	addHub("program", "program", "On Now / Upcoming", s.searchProgramHub(query, limit))
+	addHub("recording", "recording", "Recordings", s.searchRecordingHub(c, query, limit))
 
 	c.JSON(http.StatusOK, gin.H{
 		"MediaContainer": gin.H{
-			"size": len(movies) + len(shows),
+			"size": total,
 			"Hub":  hubs,
 		},
 	})
 }
 
+// searchHitIDs runs a search and returns the matching record IDs in rank order
+func (s *Server) searchHitIDs(query, kind string, limit int) []uint {
+	hits, err := search.Query(s.db, query, kind, limit)
+	if err != nil {
+		logger.Warnf("Search for %q (%s) failed: %v", query, kind, err)
+		return nil
+	}
+
+	ids := make([]uint, 0, len(hits))
+	for _, hit := range hits {
+		if id, err := strconv.ParseUint(hit.Ref, 10, 32); err == nil {
+			ids = append(ids, uint(id))
+		}
+	}
+	return ids
+}
+
+// searchMediaHub returns movies, shows or episodes matching a query
+func (s *Server) searchMediaHub(query, kind string, limit int) []gin.H {
+	ids := s.searchHitIDs(query, kind, limit)
+	if len(ids) == 0 {
+		return nil
+	}
+
+	var items []models.MediaItem
+	s.db.Preload("Genres").Where("id IN ? AND type = ?", ids, kind).Find(&items)
+	itemMap := make(map[uint]*models.MediaItem, len(items))
+	for i := range items {
+		itemMap[items[i].ID] = &items[i]
+	}
+
+	libs := make(map[uint]*models.Library)
+	metadata := make([]gin.H, 0, len(items))
+	for _, id := range ids {
+		item, ok := itemMap[id]
+		if !ok {
+			continue
+		}
+		lib, ok := libs[item.LibraryID]
+		if !ok {
+			lib, _ = s.libraryService.GetLibrary(item.LibraryID)
+			libs[item.LibraryID] = lib
+		}
+		metadata = append(metadata, s.mediaItemToMetadata(item, lib))
+	}
+	return metadata
+}
+
+// searchPeopleHub returns cast and crew matching a query
+func (s *Server) searchPeopleHub(query string, limit int) []gin.H {
+	hits, err := search.Query(s.db, query, search.KindPerson, limit)
+	if err != nil || len(hits) == 0 {
+		return nil
+	}
+
+	metadata := make([]gin.H, 0, len(hits))
+	for _, hit := range hits {
+		var credits []models.CastMember
+		s.db.Where("tag = ?", hit.Ref).Order("id ASC").Find(&credits)
+		if len(credits) == 0 {
+			continue // No longer credited anywhere
+		}
+
+		person := gin.H{
+			"type":  "person",
+			"tag":   hit.Ref,
+			"title": hit.Ref,
+			"count": len(credits),
+		}
+		for _, credit := range credits {
+			if credit.Thumb != "" {
+				person["thumb"] = artworkURL(credit.Thumb)
+				break
+			}
+		}
+		ratingKeys := make([]uint, len(credits))
+		for i, credit := range credits {
+			ratingKeys[i] = credit.MediaItemID
+		}
+		person["ratingKeys"] = ratingKeys
+		metadata = append(metadata, person)
+	}
+	return metadata
+}
+
+// searchProgramHub returns EPG programs that are on now or coming up
+func (s *Server) searchProgramHub(query string, limit int) []gin.H {
+	// Over-fetch since ended programs are dropped
+	ids := s.searchHitIDs(query, search.KindProgram, limit*3)
+	if len(ids) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	var programs []models.Program
+	s.db.Where("id IN ? AND end > ?", ids, now).Find(&programs)
+	programMap := make(map[uint]*models.Program, len(programs))
+	for i := range programs {
+		programMap[programs[i].ID] = &programs[i]
+	}
+
+	metadata := make([]gin.H, 0, limit)
+	for _, id := range ids {
+		p, ok := programMap[id]
+		if !ok {
+			continue
+		}
+		metadata = append(metadata, gin.H{
+			"type":      "program",
+			"id":        p.ID,
+			"title":     p.Title,
+			"subtitle":  p.Subtitle,
+			"summary":   p.Description,
+			"channelId": p.ChannelID,
+			"callSign":  p.CallSign,
+			"channelNo": p.ChannelNo,
+			"thumb":     p.Icon,
+			"art":       p.Art,
+			"category":  p.Category,
+			"start":     p.Start.Unix(),
+			"end":       p.End.Unix(),
+			"onNow":     !p.Start.After(now),
+			"isMovie":   p.IsMovie,
+			"isSports":  p.IsSports,
+			"isNew":     p.IsNew,
+			"isLive":    p.IsLive,
+		})
+		if len(metadata) >= limit {
+			break
+		}
+	}
+	return metadata
+}
+
+// searchRecordingHub returns DVR recordings the current user can see
+func (s *Server) searchRecordingHub(c *gin.Context, query string, limit int) []gin.H {
+	ids := s.searchHitIDs(query, search.KindRecording, limit*2)
+	if len(ids) == 0 {
+		return nil
+	}
+
+	// Admins see all recordings, users see their own and system (user_id=0) recordings
+	dbQuery := s.db.Where("id IN ?", ids)
+	if !c.GetBool("isAdmin") {
+		dbQuery = dbQuery.Where("user_id IN ?", []uint{c.GetUint("userID"), 0})
+	}
+	var recordings []models.Recording
+	dbQuery.Find(&recordings)
+	recordingMap := make(map[uint]*models.Recording, len(recordings))
+	for i := range recordings {
+		recordingMap[recordings[i].ID] = &recordings[i]
+	}
+
+	metadata := make([]gin.H, 0, limit)
+	for _, id := range ids {
+		r, ok := recordingMap[id]
+		if !ok {
+			continue
+		}
+		metadata = append(metadata, gin.H{
+			"type":        "recording",
+			"id":          r.ID,
+			"key":         fmt.Sprintf("/dvr/recordings/%d", r.ID),
+			"title":       r.Title,
+			"subtitle":    r.Subtitle,
+			"summary":     r.Description,
+			"thumb":       artworkURL(r.Thumb),
+			"art":         artworkURL(r.Art),
+			"status":      r.Status,
+			"channelName": r.ChannelName,
+			"startTime":   r.StartTime.Unix(),
+			"endTime":     r.EndTime.Unix(),
+		})
+		if len(metadata) >= limit {
+			break
+		}
+	}
+	return metadata
+}
+
 // ============ Playback Handlers ============
 
 func (s *Server) markWatched(c *gin.Context) {
@@ -2503,6 +2846,11 @@ func (s *Server) getPlaylists(c *gin.Context) {
 			"addedAt":      p.AddedAt.Unix(),
 			"updatedAt":    p.UpdatedAt.Unix(),
 		}
+		if p.Smart {
+			metadata[i]["filter"] = p.Filter
+			metadata[i]["sort"] = p.Sort
+			metadata[i]["limit"] = p.Limit
+		}
 	}
 
 	s.respondWithMediaContainer(c, metadata, len(metadata), len(metadata), 0)
@@ -2527,17 +2875,31 @@ func (s *Server) createPlaylist(c *gin.Context) {
 		UserID:       userID,
 		Title:        title,
 		PlaylistType: playlistType,
+		Smart:        c.Query("smart") == "1",
 		AddedAt:      time.Now(),
 		UpdatedAt:    time.Now(),
 	}
 
+	if playlist.Smart {
+		if sectionID, err := strconv.ParseUint(c.Query("sectionId"), 10, 32); err == nil {
+			playlist.LibraryID = uint(sectionID)
+		}
+		playlist.Filter = c.Query("filter")
+		playlist.Sort = c.Query("sort")
+		playlist.Limit, _ = strconv.Atoi(c.Query("limit"))
+		if err := validateSmartRules(playlist.Filter, playlist.Sort); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
 	if err := s.db.Create(&playlist).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
 	// If items provided, add them
-	if uri := c.Query("uri"); uri != "" {
+	if uri := c.Query("uri"); uri != "" && !playlist.Smart {
 		// Parse server://uuid/com.plexapp.plugins.library/library/metadata/123
 		// or just the key number
 		parts := strings.Split(uri, "/")
@@ -2566,6 +2928,7 @@ func (s *Server) createPlaylist(c *gin.Context) {
 				"type":         "playlist",
 				"title":        playlist.Title,
 				"playlistType": playlist.PlaylistType,
+				"smart":        playlist.Smart,
 				"leafCount":    playlist.LeafCount,
 			}},
 		},
@@ -2600,10 +2963,77 @@ func (s *Server) getPlaylist(c *gin.Context) {
 		"addedAt":      playlist.AddedAt.Unix(),
 		"updatedAt":    playlist.UpdatedAt.Unix(),
 	}}
+	if playlist.Smart {
+		metadata[0]["filter"] = playlist.Filter
+		metadata[0]["sort"] = playlist.Sort
+		metadata[0]["limit"] = playlist.Limit
+		if playlist.LibraryID > 0 {
+			metadata[0]["librarySectionID"] = playlist.LibraryID
+		}
+	}
 
 	s.respondWithMediaContainer(c, metadata, 1, 1, 0)
 }
 
+// updatePlaylist updates a playlist's title and summary, and the rules of a smart playlist
+func (s *Server) updatePlaylist(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid playlist ID"})
+		return
+	}
+
+	userID := c.GetUint("userID")
+
+	var playlist models.Playlist
+	if err := s.db.Where("id = ? AND user_id = ?", id, userID).First(&playlist).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Playlist not found"})
+		return
+	}
+
+	updates := map[string]interface{}{"updated_at": time.Now()}
+	if title, ok := c.GetQuery("title"); ok {
+		if title == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Title cannot be empty"})
+			return
+		}
+		updates["title"] = title
+	}
+	if summary, ok := c.GetQuery("summary"); ok {
+		updates["summary"] = summary
+	}
+
+	if playlist.Smart {
+		filter, sort := playlist.Filter, playlist.Sort
+		if value, ok := c.GetQuery("filter"); ok {
+			filter = value
+			updates["filter"] = value
+		}
+		if value, ok := c.GetQuery("sort"); ok {
+			sort = value
+			updates["sort"] = value
+		}
+		if value, ok := c.GetQuery("limit"); ok {
+			updates["limit"], _ = strconv.Atoi(value)
+		}
+		if value, ok := c.GetQuery("sectionId"); ok {
+			sectionID, _ := strconv.ParseUint(value, 10, 32)
+			updates["library_id"] = uint(sectionID)
+		}
+		if err := validateSmartRules(filter, sort); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	if err := s.db.Model(&playlist).Updates(updates).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
 func (s *Server) getPlaylistItems(c *gin.Context) {
 	idStr := c.Param("id")
 	id, err := strconv.Atoi(idStr)
@@ -2612,6 +3042,17 @@ func (s *Server) getPlaylistItems(c *gin.Context) {
 		return
 	}
 
+	var playlist models.Playlist
+	if err := s.db.First(&playlist, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Playlist not found"})
+		return
+	}
+
+	if playlist.Smart {
+		s.respondWithSmartPlaylist(c, &playlist)
+		return
+	}
+
 	var items []models.PlaylistItem
 	s.db.Where("playlist_id = ?", id).Order("`order` ASC").Find(&items)
 
@@ -2628,7 +3069,7 @@ func (s *Server) getPlaylistItems(c *gin.Context) {
 
 	// Fetch media items
 	var mediaItems []models.MediaItem
-	s.db.Preload("Files").Where("id IN ?", itemIDs).Find(&mediaItems)
+	s.db.Preload("MediaFiles").Where("id IN ?", itemIDs).Find(&mediaItems)
 
 	// Build map for lookup
 	mediaMap := make(map[uint]models.MediaItem)
@@ -2651,6 +3092,50 @@ func (s *Server) getPlaylistItems(c *gin.Context) {
 	s.respondWithMediaContainer(c, metadata, len(metadata), len(metadata), 0)
 }
 
+// respondWithSmartPlaylist evaluates a smart playlist's rules for the current user
+func (s *Server) respondWithSmartPlaylist(c *gin.Context, playlist *models.Playlist) {
+	var itemTypes []string
+	switch playlist.PlaylistType {
+	case "audio":
+		itemTypes = []string{"track"}
+	case "photo":
+		itemTypes = []string{"photo"}
+	default:
+		itemTypes = []string{"movie", "episode"}
+	}
+
+	mediaItems, err := s.querySmartItems(playlist.Filter, playlist.Sort, playlist.Limit,
+		playlist.LibraryID, itemTypes, c.GetUint("userID"), c.GetUint("profileID"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	libs := make(map[uint]*models.Library)
+	metadata := make([]gin.H, 0, len(mediaItems))
+	var duration int64
+	for i := range mediaItems {
+		mi := &mediaItems[i]
+		lib, ok := libs[mi.LibraryID]
+		if !ok {
+			lib, _ = s.libraryService.GetLibrary(mi.LibraryID)
+			libs[mi.LibraryID] = lib
+		}
+		metadata = append(metadata, s.mediaItemToMetadata(mi, lib))
+		duration += mi.Duration
+	}
+
+	// Keep cached counts in step with the latest evaluation
+	if playlist.LeafCount != len(metadata) || playlist.Duration != duration {
+		s.db.Model(playlist).UpdateColumns(map[string]interface{}{
+			"leaf_count": len(metadata),
+			"duration":   duration,
+		})
+	}
+
+	s.respondWithMediaContainer(c, metadata, len(metadata), len(metadata), 0)
+}
+
 func (s *Server) addToPlaylist(c *gin.Context) {
 	idStr := c.Param("id")
 	id, err := strconv.Atoi(idStr)
@@ -2674,6 +3159,16 @@ func (s *Server) addToPlaylist(c *gin.Context) {
 		return
 	}
 
+	var playlist models.Playlist
+	if err := s.db.First(&playlist, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Playlist not found"})
+		return
+	}
+	if playlist.Smart {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Smart playlist items are defined by its filter"})
+		return
+	}
+
 	// Get current max order
 	var maxOrder int
 	s.db.Model(&models.PlaylistItem{}).Where("playlist_id = ?", id).Select("COALESCE(MAX(`order`), -1)").Scan(&maxOrder)
@@ -2687,8 +3182,6 @@ func (s *Server) addToPlaylist(c *gin.Context) {
 	s.db.Create(&item)
 
 	// Update playlist counts
-	var playlist models.Playlist
-	s.db.First(&playlist, id)
 	s.db.Model(&playlist).Updates(map[string]interface{}{
 		"leaf_count": playlist.LeafCount + 1,
 		"updated_at": time.Now(),
@@ -2805,26 +3298,549 @@ func (s *Server) deletePlaylist(c *gin.Context) {
 // ============ Collection Handlers ============
 
 func (s *Server) getCollectionItems(c *gin.Context) {
-	s.respondWithMediaContainer(c, []gin.H{}, 0, 0, 0)
-}
-
-func (s *Server) createCollection(c *gin.Context) {
-	c.JSON(http.StatusCreated, gin.H{"ratingKey": "1"})
-}
-
-func (s *Server) addToCollection(c *gin.Context) {
-	c.JSON(http.StatusOK, gin.H{"status": "ok"})
-}
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid collection ID"})
+		return
+	}
 
-func (s *Server) removeFromCollection(c *gin.Context) {
-	c.JSON(http.StatusOK, gin.H{"status": "ok"})
-}
+	var collection models.Collection
+	if err := s.db.First(&collection, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Collection not found"})
+		return
+	}
 
-func (s *Server) deleteCollection(c *gin.Context) {
-	c.JSON(http.StatusOK, gin.H{"status": "ok"})
-}
+	lib, _ := s.libraryService.GetLibrary(collection.LibraryID)
 
-// ============ Watchlist Handlers ============
+	var mediaItems []models.MediaItem
+	if collection.Smart {
+		// Smart collections are evaluated on every fetch
+		var itemTypes []string
+		if lib != nil {
+			itemTypes = libraryItemTypes(lib.Type)
+		}
+		mediaItems, err = s.querySmartItems(collection.Filter, collection.Sort, collection.Limit,
+			collection.LibraryID, itemTypes, c.GetUint("userID"), c.GetUint("profileID"))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if len(mediaItems) != collection.ChildCount {
+			s.db.Model(&collection).UpdateColumn("child_count", len(mediaItems))
+		}
+	} else {
+		mediaItems = s.orderedCollectionMedia(collection.ID)
+	}
+
+	// Build response in collection order
+	metadata := make([]gin.H, 0, len(mediaItems))
+	for i := range mediaItems {
+		metadata = append(metadata, s.mediaItemToMetadata(&mediaItems[i], lib))
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"MediaContainer": gin.H{
+			"size":             len(metadata),
+			"key":              fmt.Sprintf("/library/collections/%d/children", collection.ID),
+			"title":            collection.Title,
+			"summary":          collection.Summary,
+			"thumb":            collection.Thumb,
+			"art":              collection.Art,
+			"smart":            collection.Smart,
+			"librarySectionID": collection.LibraryID,
+			"Metadata":         metadata,
+		},
+	})
+}
+
+// orderedCollectionMedia returns the media items of a regular collection in collection order
+func (s *Server) orderedCollectionMedia(collectionID uint) []models.MediaItem {
+	var items []models.CollectionItem
+	s.db.Where("collection_id = ?", collectionID).Order("`order` ASC, id ASC").Find(&items)
+	if len(items) == 0 {
+		return nil
+	}
+
+	// Get media item IDs
+	itemIDs := make([]uint, len(items))
+	for i, item := range items {
+		itemIDs[i] = item.MediaItemID
+	}
+
+	// Fetch media items
+	var mediaItems []models.MediaItem
+	s.db.Preload("MediaFiles").Preload("Genres").Where("id IN ?", itemIDs).Find(&mediaItems)
+
+	mediaMap := make(map[uint]models.MediaItem)
+	for _, m := range mediaItems {
+		mediaMap[m.ID] = m
+	}
+
+	ordered := make([]models.MediaItem, 0, len(items))
+	for _, item := range items {
+		if mi, ok := mediaMap[item.MediaItemID]; ok {
+			ordered = append(ordered, mi)
+		}
+	}
+	return ordered
+}
+
+func (s *Server) createCollection(c *gin.Context) {
+	title := c.Query("title")
+	if title == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Title is required"})
+		return
+	}
+
+	itemIDs := parseMetadataURIKeys(c.Query("uri"))
+
+	// Library comes from sectionId, or from the first item being added
+	var libraryID uint
+	if sectionID, err := strconv.ParseUint(c.Query("sectionId"), 10, 32); err == nil {
+		libraryID = uint(sectionID)
+	} else if len(itemIDs) > 0 {
+		var first models.MediaItem
+		if err := s.db.First(&first, itemIDs[0]).Error; err == nil {
+			libraryID = first.LibraryID
+		}
+	}
+	if libraryID == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "sectionId is required"})
+		return
+	}
+	if _, err := s.libraryService.GetLibrary(libraryID); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Library not found"})
+		return
+	}
+
+	collection := models.Collection{
+		UUID:      uuid.New().String(),
+		LibraryID: libraryID,
+		Title:     title,
+		Summary:   c.Query("summary"),
+		Thumb:     c.Query("thumb"),
+		Art:       c.Query("art"),
+		Smart:     c.Query("smart") == "1",
+		AddedAt:   time.Now(),
+		UpdatedAt: time.Now(),
+	}
+
+	if collection.Smart {
+		collection.Filter = c.Query("filter")
+		collection.Sort = c.Query("sort")
+		collection.Limit, _ = strconv.Atoi(c.Query("limit"))
+		if err := validateSmartRules(collection.Filter, collection.Sort); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	if err := s.db.Create(&collection).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if collection.Smart {
+		s.refreshSmartCollectionCount(&collection)
+	} else if len(itemIDs) > 0 {
+		if err := s.appendCollectionItems(&collection, itemIDs); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		s.db.First(&collection, collection.ID)
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"MediaContainer": gin.H{
+			"size":     1,
+			"Metadata": []gin.H{collectionToMetadata(&collection)},
+		},
+	})
+}
+
+// updateCollection updates a collection's title, summary, poster and art
+func (s *Server) updateCollection(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid collection ID"})
+		return
+	}
+
+	var collection models.Collection
+	if err := s.db.First(&collection, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Collection not found"})
+		return
+	}
+
+	updates := map[string]interface{}{"updated_at": time.Now()}
+	for param, column := range map[string]string{
+		"title":   "title",
+		"summary": "summary",
+		"thumb":   "thumb",
+		"art":     "art",
+	} {
+		if value, ok := c.GetQuery(param); ok {
+			updates[column] = value
+		}
+	}
+	if title, ok := updates["title"]; ok && title == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Title cannot be empty"})
+		return
+	}
+
+	// Smart collections can also change their rules
+	if collection.Smart {
+		filter, sort := collection.Filter, collection.Sort
+		if value, ok := c.GetQuery("filter"); ok {
+			filter = value
+			updates["filter"] = value
+		}
+		if value, ok := c.GetQuery("sort"); ok {
+			sort = value
+			updates["sort"] = value
+		}
+		if value, ok := c.GetQuery("limit"); ok {
+			updates["limit"], _ = strconv.Atoi(value)
+		}
+		if err := validateSmartRules(filter, sort); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	if err := s.db.Model(&collection).Updates(updates).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Franchise syncing keeps what was set here
+	var edited []string
+	for _, field := range []string{"title", "summary", "thumb", "art"} {
+		if _, ok := updates[field]; ok {
+			edited = append(edited, field)
+		}
+	}
+	if len(edited) > 0 {
+		metadata.LockCollectionFields(s.db, &collection, edited...)
+	}
+
+	s.db.First(&collection, id)
+	if collection.Smart {
+		s.refreshSmartCollectionCount(&collection)
+	}
+	s.respondWithMediaContainer(c, []gin.H{collectionToMetadata(&collection)}, 1, 1, 0)
+}
+
+func (s *Server) addToCollection(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid collection ID"})
+		return
+	}
+
+	itemIDs := parseMetadataURIKeys(c.Query("uri"))
+	if len(itemIDs) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "URI is required"})
+		return
+	}
+
+	var collection models.Collection
+	if err := s.db.First(&collection, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Collection not found"})
+		return
+	}
+
+	if collection.Smart {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Smart collection items are defined by its filter"})
+		return
+	}
+
+	if err := s.appendCollectionItems(&collection, itemIDs); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+func (s *Server) removeFromCollection(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid collection ID"})
+		return
+	}
+
+	itemID, err := strconv.Atoi(c.Param("itemId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid item ID"})
+		return
+	}
+
+	result := s.db.Where("collection_id = ? AND media_item_id = ?", id, itemID).Delete(&models.CollectionItem{})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": result.Error.Error()})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Item not in collection"})
+		return
+	}
+
+	s.recomputeCollectionChildCount(uint(id))
+
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// moveCollectionItem moves an item after another item in the collection (or to the front)
+func (s *Server) moveCollectionItem(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid collection ID"})
+		return
+	}
+
+	itemID, err := strconv.Atoi(c.Param("itemId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid item ID"})
+		return
+	}
+	afterID, _ := strconv.Atoi(c.Query("after"))
+
+	var items []models.CollectionItem
+	s.db.Where("collection_id = ?", id).Order("`order` ASC, id ASC").Find(&items)
+
+	// Pull the moved item out of the current ordering
+	var moved *models.CollectionItem
+	ordered := make([]models.CollectionItem, 0, len(items))
+	for i := range items {
+		if items[i].MediaItemID == uint(itemID) {
+			moved = &items[i]
+			continue
+		}
+		ordered = append(ordered, items[i])
+	}
+	if moved == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Item not in collection"})
+		return
+	}
+
+	// Re-insert it after the requested item
+	pos := 0
+	if afterID > 0 {
+		for i, item := range ordered {
+			if item.MediaItemID == uint(afterID) {
+				pos = i + 1
+				break
+			}
+		}
+	}
+	ordered = append(ordered[:pos], append([]models.CollectionItem{*moved}, ordered[pos:]...)...)
+
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		for i, item := range ordered {
+			if item.Order == i {
+				continue
+			}
+			if err := tx.Model(&models.CollectionItem{}).Where("id = ?", item.ID).Update("order", i).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Model(&models.Collection{}).Where("id = ?", id).Update("updated_at", time.Now()).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+func (s *Server) deleteCollection(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid collection ID"})
+		return
+	}
+
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("collection_id = ?", id).Delete(&models.CollectionItem{}).Error; err != nil {
+			return err
+		}
+		result := tx.Delete(&models.Collection{}, id)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		return nil
+	})
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Collection not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// appendCollectionItems adds media items to the end of a collection, skipping
+// items that are already present or belong to another library
+func (s *Server) appendCollectionItems(collection *models.Collection, itemIDs []uint) error {
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var existing []uint
+		tx.Model(&models.CollectionItem{}).Where("collection_id = ?", collection.ID).Pluck("media_item_id", &existing)
+		present := make(map[uint]bool, len(existing))
+		for _, id := range existing {
+			present[id] = true
+		}
+
+		var valid []uint
+		tx.Model(&models.MediaItem{}).Where("id IN ? AND library_id = ?", itemIDs, collection.LibraryID).Pluck("id", &valid)
+		inLibrary := make(map[uint]bool, len(valid))
+		for _, id := range valid {
+			inLibrary[id] = true
+		}
+
+		var maxOrder int
+		tx.Model(&models.CollectionItem{}).Where("collection_id = ?", collection.ID).Select("COALESCE(MAX(`order`), -1)").Scan(&maxOrder)
+
+		for _, itemID := range itemIDs {
+			if present[itemID] || !inLibrary[itemID] {
+				continue
+			}
+			maxOrder++
+			item := models.CollectionItem{
+				CollectionID: collection.ID,
+				MediaItemID:  itemID,
+				Order:        maxOrder,
+			}
+			if err := tx.Create(&item).Error; err != nil {
+				return err
+			}
+			present[itemID] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	s.recomputeCollectionChildCount(collection.ID)
+	return nil
+}
+
+// recomputeCollectionChildCount refreshes the cached child count of a collection
+func (s *Server) recomputeCollectionChildCount(collectionID uint) {
+	var count int64
+	s.db.Model(&models.CollectionItem{}).
+		Joins("JOIN media_items ON media_items.id = collection_items.media_item_id AND media_items.deleted_at IS NULL").
+		Where("collection_items.collection_id = ?", collectionID).
+		Count(&count)
+
+	s.db.Model(&models.Collection{}).Where("id = ?", collectionID).Updates(map[string]interface{}{
+		"child_count": count,
+		"updated_at":  time.Now(),
+	})
+}
+
+// refreshSmartCollectionCount re-evaluates a smart collection to cache its child count
+func (s *Server) refreshSmartCollectionCount(collection *models.Collection) {
+	var itemTypes []string
+	if lib, err := s.libraryService.GetLibrary(collection.LibraryID); err == nil {
+		itemTypes = libraryItemTypes(lib.Type)
+	}
+
+	items, err := s.querySmartItems(collection.Filter, collection.Sort, collection.Limit, collection.LibraryID, itemTypes, 0, 0)
+	if err != nil {
+		return
+	}
+	collection.ChildCount = len(items)
+	s.db.Model(collection).UpdateColumn("child_count", collection.ChildCount)
+}
+
+// validateSmartRules checks a smart list's filter expression and sort
+func validateSmartRules(filter, sort string) error {
+	if _, err := library.ParseFilter(filter); err != nil {
+		return err
+	}
+	if _, err := library.ParseSort(sort); err != nil {
+		return err
+	}
+	return nil
+}
+
+// querySmartItems evaluates a filter expression against the library. Item types
+// are only restricted when the filter does not choose them itself.
+func (s *Server) querySmartItems(expr, sort string, limit int, libraryID uint, itemTypes []string, userID, profileID uint) ([]models.MediaItem, error) {
+	filter, err := library.ParseFilter(expr)
+	if err != nil {
+		return nil, err
+	}
+	order, err := library.ParseSort(sort)
+	if err != nil {
+		return nil, err
+	}
+
+	query := s.db.Model(&models.MediaItem{})
+	if libraryID > 0 {
+		query = query.Where("media_items.library_id = ?", libraryID)
+	}
+	if len(itemTypes) > 0 && !filter.HasField("type") {
+		query = query.Where("media_items.type IN ?", itemTypes)
+	}
+	query = filter.Apply(query, userID, profileID).
+		Preload("MediaFiles").
+		Preload("Genres").
+		Order(order)
+	if limit > 0 {
+		query = query.Limit(limit)
+	}
+
+	var items []models.MediaItem
+	if err := query.Find(&items).Error; err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// libraryItemTypes returns the top-level item types listed for a library type
+func libraryItemTypes(libType string) []string {
+	switch libType {
+	case "movie":
+		return []string{"movie"}
+	case "show":
+		return []string{"show"} // For shows, return top-level shows
+	case "music", "artist":
+		return []string{"artist"} // Music libraries list artists
+	case "photo":
+		return []string{"photoalbum", "photo"}
+	default:
+		return []string{libType}
+	}
+}
+
+// parseMetadataURIKeys extracts media item IDs from a Plex-style URI such as
+// server://uuid/com.plexapp.plugins.library/library/metadata/12,13,14
+func parseMetadataURIKeys(uri string) []uint {
+	if uri == "" {
+		return nil
+	}
+
+	parts := strings.Split(uri, "/")
+	var ids []uint
+	for _, keyStr := range strings.Split(parts[len(parts)-1], ",") {
+		if key, err := strconv.ParseUint(strings.TrimSpace(keyStr), 10, 32); err == nil && key > 0 {
+			ids = append(ids, uint(key))
+		}
+	}
+	return ids
+}
+
+// ============ Watchlist Handlers ============
 
 func (s *Server) getWatchlist(c *gin.Context) {
 	userID := c.GetUint("userID")
@@ -3017,6 +4033,26 @@ func (s *Server) streamMedia(c *gin.Context) {
 		contentType = "video/webm"
 	case "ts", "m2ts":
 		contentType = "video/mp2t"
+	case "mp3":
+		contentType = "audio/mpeg"
+	case "flac":
+		contentType = "audio/flac"
+	case "m4a":
+		contentType = "audio/mp4"
+	case "aac":
+		contentType = "audio/aac"
+	case "ogg", "oga", "opus":
+		contentType = "audio/ogg"
+	case "wav":
+		contentType = "audio/wav"
+	case "jpg", "jpeg":
+		contentType = "image/jpeg"
+	case "png":
+		contentType = "image/png"
+	case "heic", "heif":
+		contentType = "image/heic"
+	case "cr2", "cr3", "nef", "arw", "dng", "orf", "rw2", "raf", "pef", "srw":
+		contentType = "application/octet-stream"
 	}
 
 	// Set headers for streaming
@@ -3443,53 +4479,120 @@ func (s *Server) transcodeStart(c *gin.Context) {
 		return
 	}
 
-	// Get parameters
-	path := c.Query("path")
-	if path == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Path is required"})
-		return
-	}
+	// The file is given by its ID, or is the version of an item that plays
+	// best on the device
+	var item models.MediaItem
+	var file models.MediaFile
+	if fileID, _ := strconv.Atoi(c.Query("fileId")); fileID > 0 {
+		if err := s.db.Preload("Streams").First(&file, fileID).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "No media file found"})
+			return
+		}
+		if err := s.db.First(&item, file.MediaItemID).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Media not found"})
+			return
+		}
+	} else {
+		path := c.Query("path")
+		if path == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Path is required"})
+			return
+		}
 
-	// Parse media key from path (e.g., /library/metadata/123)
-	parts := strings.Split(path, "/")
-	var mediaKey int
-	for i, p := range parts {
-		if p == "metadata" && i+1 < len(parts) {
-			mediaKey, _ = strconv.Atoi(parts[i+1])
-			break
+		// Parse media key from path (e.g., /library/metadata/123)
+		parts := strings.Split(path, "/")
+		var mediaKey int
+		for i, p := range parts {
+			if p == "metadata" && i+1 < len(parts) {
+				mediaKey, _ = strconv.Atoi(parts[i+1])
+				break
+			}
 		}
-	}
 
-	if mediaKey == 0 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid path"})
-		return
-	}
+		if mediaKey == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid path"})
+			return
+		}
 
-	// Get media item
-	var item models.MediaItem
-	if err := s.db.First(&item, mediaKey).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Media not found"})
-		return
-	}
+		// Get media item
+		if err := s.db.First(&item, mediaKey).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Media not found"})
+			return
+		}
 
-	// Get media file
-	var file models.MediaFile
-	if err := s.db.Where("media_item_id = ?", mediaKey).First(&file).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "No media file found"})
-		return
+		var files []models.MediaFile
+		s.db.Where("media_item_id = ?", mediaKey).Preload("Streams").Order("id ASC").Find(&files)
+		if len(files) == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "No media file found"})
+			return
+		}
+		file = files[s.bestVersion(c, files)]
 	}
 
 	// Get quality/offset parameters
 	offset, _ := strconv.ParseInt(c.Query("offset"), 10, 64)
 	quality := c.DefaultQuery("videoQuality", "original")
 
-	// Start transcode session
-	session, err := s.transcoder.StartSession(file.ID, file.FilePath, offset, quality)
+	// The audio and subtitle played, and what the client shows: HDR it
+	// can't is tone mapped
+	var tracks transcode.Tracks
+	var decision *playback.PlaybackDecision
+	if item.Type != "track" {
+		tracks = s.transcodeTracks(c, &file)
+		decision = playback.DecidePlayback(playbackMediaInfo(&file), s.deviceCapabilities(c))
+	}
+	source := transcode.SourceInfo{
+		Width:      file.Width,
+		Height:     file.Height,
+		HasAudio:   file.AudioCodec != "",
+		VideoCodec: normalizeCodec(file.VideoCodec),
+		Bitrate:    file.Bitrate,
+		ToneMap:    decision != nil && decision.ToneMap,
+		Duration:   file.Duration,
+	}
+
+	// A direct stream copies the video when the client plays its codec,
+	// converting only what the client doesn't take. Burning in a subtitle
+	// needs the video encoded.
+	directStream, audioCodec := false, transcode.AudioCopy
+	if c.Query("directStream") == "1" && decision != nil && quality == transcode.QualityOriginal && !tracks.BurnsSubtitle() {
+		if decision.VideoDecision == "copy" {
+			directStream = true
+			if decision.AudioDecision == "transcode" {
+				audioCodec = decision.SuggestedAudioCodec
+			}
+		}
+	}
+
+	// Start transcode session; music gets an audio-only stream, and "auto"
+	// a ladder of renditions
+	var session *transcode.Session
+	var err error
+	switch {
+	case item.Type == "track":
+		bitrate, _ := strconv.Atoi(c.Query("musicBitrate"))
+		session, err = s.transcoder.StartAudioSession(file.ID, file.FilePath, offset, bitrate)
+	case quality == transcode.QualityAuto:
+		session, err = s.transcoder.StartABRSession(file.ID, file.FilePath, offset, source, tracks)
+	case directStream:
+		session, err = s.transcoder.StartDirectStreamSession(file.ID, file.FilePath, offset, source, audioCodec, tracks)
+	default:
+		session, err = s.transcoder.StartSession(file.ID, file.FilePath, offset, quality, source, tracks)
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
+	// The master playlist of a ladder, a direct stream, a seekable stream
+	// or a stream with subtitles is known up front. The playlists it lists
+	// are fetched from the session like segments.
+	if session.HasMasterPlaylist() {
+		master := session.MasterPlaylist(fmt.Sprintf("session/%s/", session.ID))
+		c.Data(http.StatusOK, "application/vnd.apple.mpegurl", []byte(master))
+		return
+	}
+
 	// Wait a moment for transcoding to start and generate initial segment
 	time.Sleep(500 * time.Millisecond)
 
@@ -3520,6 +4623,39 @@ func (s *Server) transcodeSegment(c *gin.Context) {
 
 	// Get segment path
 	segmentPath := s.transcoder.GetSegmentPath(sessionID, segment)
+	contentType := "video/mp2t"
+	switch filepath.Ext(segment) {
+	case ".m3u8":
+		contentType = "application/vnd.apple.mpegurl"
+	case ".m4s":
+		contentType = "video/iso.segment"
+	case ".mp4":
+		contentType = "video/mp4"
+	case ".vtt":
+		contentType = "text/vtt; charset=utf-8"
+	}
+
+	// A seekable session's playlists list the whole file, and a segment
+	// far from the encoder restarts it there within the session
+	if session.Seekable() {
+		if playlist, ok := session.MediaPlaylist(segment); ok {
+			c.Data(http.StatusOK, contentType, []byte(playlist))
+			return
+		}
+		segmentPath, err := s.transcoder.AwaitSegment(session, segment, 30*time.Second)
+		switch {
+		case err == nil:
+			c.Header("Content-Type", contentType)
+			c.File(segmentPath)
+		case errors.Is(err, transcode.ErrSegmentTimeout):
+			c.JSON(http.StatusRequestTimeout, gin.H{"error": "Segment not available"})
+		case errors.Is(err, transcode.ErrSegmentNotFound), errors.Is(err, transcode.ErrSessionStopped):
+			c.JSON(http.StatusNotFound, gin.H{"error": "Segment not found"})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Transcode failed"})
+		}
+		return
+	}
 
 	// Wait for segment to be available (with timeout)
 	timeout := time.After(30 * time.Second)
@@ -3533,7 +4669,7 @@ func (s *Server) transcodeSegment(c *gin.Context) {
 			return
 		case <-ticker.C:
 			if _, err := os.Stat(segmentPath); err == nil {
-				c.Header("Content-Type", "video/mp2t")
+				c.Header("Content-Type", contentType)
 				c.File(segmentPath)
 				return
 			}
@@ -3544,7 +4680,7 @@ func (s *Server) transcodeSegment(c *gin.Context) {
 			}
 			// Check one more time
 			if _, err := os.Stat(segmentPath); err == nil {
-				c.Header("Content-Type", "video/mp2t")
+				c.Header("Content-Type", contentType)
 				c.File(segmentPath)
 				return
 			}
@@ -3592,16 +4728,37 @@ func (s *Server) getThumb(c *gin.Context) {
 
 	if _, err := os.Stat(localPath); err == nil {
 		// Serve local file
-		c.Header("Cache-Control", "public, max-age=86400")
-		c.File(localPath)
+		s.serveArtwork(c, localPath, localPath)
+		return
+	}
+
+	// Photos have cached thumbnails in several sizes
+	if item.Type == "photo" {
+		s.servePhotoThumb(c, &item)
+		return
+	}
+
+	// Tracks share their album's cover, photo albums their first photo's
+	if strings.HasPrefix(item.Thumb, "/library/") {
+		if item.Thumb == c.Request.URL.Path {
+			c.JSON(http.StatusNotFound, gin.H{"error": "No poster available"})
+			return
+		}
+		target := item.Thumb
+		if c.Request.URL.RawQuery != "" {
+			target += "?" + c.Request.URL.RawQuery
+		}
+		c.Redirect(http.StatusTemporaryRedirect, target)
 		return
 	}
 
-	// Redirect to TMDB URL
-	// Convert relative TMDB path to full URL if needed
-	posterURL := item.Thumb
-	if strings.HasPrefix(posterURL, "/") {
-		posterURL = "https://image.tmdb.org/t/p/w500" + posterURL
+	// Serve the cached copy, falling back to the remote URL if it can't be
+	// downloaded. Relative TMDB paths are expanded.
+	posterURL := artwork.RemoteURL(item.Thumb, "w500")
+	if posterURL == "" {
+		posterURL = item.Thumb
+	} else if s.serveRemoteArtwork(c, posterURL) {
+		return
 	}
 
 	c.Redirect(http.StatusTemporaryRedirect, posterURL)
@@ -3634,16 +4791,23 @@ func (s *Server) getArt(c *gin.Context) {
 
 	if _, err := os.Stat(localPath); err == nil {
 		// Serve local file
-		c.Header("Cache-Control", "public, max-age=86400")
-		c.File(localPath)
+		s.serveArtwork(c, localPath, localPath)
 		return
 	}
 
-	// Redirect to TMDB URL
-	// Convert relative TMDB path to full URL if needed
-	artURL := item.Art
-	if strings.HasPrefix(artURL, "/") {
-		artURL = "https://image.tmdb.org/t/p/original" + artURL
+	// Local artwork whose copy has gone missing
+	if strings.HasPrefix(item.Art, "/library/") {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No art available"})
+		return
+	}
+
+	// Serve the cached copy, falling back to the remote URL if it can't be
+	// downloaded. Relative TMDB paths are expanded.
+	artURL := artwork.RemoteURL(item.Art, "original")
+	if artURL == "" {
+		artURL = item.Art
+	} else if s.serveRemoteArtwork(c, artURL) {
+		return
 	}
 
 	c.Redirect(http.StatusTemporaryRedirect, artURL)
@@ -3666,18 +4830,21 @@ func (s *Server) adminGetLibraries(c *gin.Context) {
 		}
 
 		result[i] = gin.H{
-			"id":        lib.ID,
-			"uuid":      lib.UUID,
-			"title":     lib.Title,
-			"type":      lib.Type,
-			"agent":     lib.Agent,
-			"scanner":   lib.Scanner,
-			"language":  lib.Language,
-			"hidden":    lib.Hidden,
-			"paths":     paths,
-			"itemCount": s.libraryService.GetMediaItemCount(lib.ID),
-			"createdAt": lib.CreatedAt.Unix(),
-			"updatedAt": lib.UpdatedAt.Unix(),
+			"id":           lib.ID,
+			"uuid":         lib.UUID,
+			"title":        lib.Title,
+			"type":         lib.Type,
+			"agent":        lib.Agent,
+			"scanner":      lib.Scanner,
+			"episodeOrder": lib.EpisodeOrder,
+			"language":     lib.Language,
+			"agents":       library.LibraryAgents(&lib),
+			"agentRules":   library.LibraryRules(&lib),
+			"hidden":       lib.Hidden,
+			"paths":        paths,
+			"itemCount":    s.libraryService.GetMediaItemCount(lib.ID),
+			"createdAt":    lib.CreatedAt.Unix(),
+			"updatedAt":    lib.UpdatedAt.Unix(),
 		}
 		if lib.ScannedAt != nil {
 			result[i]["scannedAt"] = lib.ScannedAt.Unix()
@@ -3687,6 +4854,13 @@ func (s *Server) adminGetLibraries(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"libraries": result})
 }
 
+// refreshWatcher makes the filesystem watcher pick up library path changes
+func (s *Server) refreshWatcher() {
+	if s.watcher != nil {
+		go s.watcher.Refresh()
+	}
+}
+
 func (s *Server) adminCreateLibrary(c *gin.Context) {
 	var input library.CreateLibraryInput
 	if err := c.ShouldBindJSON(&input); err != nil {
@@ -3696,9 +4870,15 @@ func (s *Server) adminCreateLibrary(c *gin.Context) {
 
 	lib, err := s.libraryService.CreateLibrary(input)
 	if err != nil {
+		if errors.Is(err, library.ErrInvalidAgent) || errors.Is(err, library.ErrInvalidRule) ||
+			errors.Is(err, library.ErrInvalidEpisodeOrder) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	s.refreshWatcher()
 
 	paths := make([]gin.H, len(lib.Paths))
 	for i, p := range lib.Paths {
@@ -3706,14 +4886,17 @@ func (s *Server) adminCreateLibrary(c *gin.Context) {
 	}
 
 	c.JSON(http.StatusCreated, gin.H{
-		"id":       lib.ID,
-		"uuid":     lib.UUID,
-		"title":    lib.Title,
-		"type":     lib.Type,
-		"agent":    lib.Agent,
-		"scanner":  lib.Scanner,
-		"language": lib.Language,
-		"paths":    paths,
+		"id":           lib.ID,
+		"uuid":         lib.UUID,
+		"title":        lib.Title,
+		"type":         lib.Type,
+		"agent":        lib.Agent,
+		"scanner":      lib.Scanner,
+		"episodeOrder": lib.EpisodeOrder,
+		"language":     lib.Language,
+		"agents":       library.LibraryAgents(lib),
+		"agentRules":   library.LibraryRules(lib),
+		"paths":        paths,
 	})
 }
 
@@ -3740,16 +4923,19 @@ func (s *Server) adminGetLibrary(c *gin.Context) {
 	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"id":        lib.ID,
-		"uuid":      lib.UUID,
-		"title":     lib.Title,
-		"type":      lib.Type,
-		"agent":     lib.Agent,
-		"scanner":   lib.Scanner,
-		"language":  lib.Language,
-		"hidden":    lib.Hidden,
-		"paths":     paths,
-		"itemCount": s.libraryService.GetMediaItemCount(lib.ID),
+		"id":           lib.ID,
+		"uuid":         lib.UUID,
+		"title":        lib.Title,
+		"type":         lib.Type,
+		"agent":        lib.Agent,
+		"scanner":      lib.Scanner,
+		"episodeOrder": lib.EpisodeOrder,
+		"language":     lib.Language,
+		"agents":       library.LibraryAgents(lib),
+		"agentRules":   library.LibraryRules(lib),
+		"hidden":       lib.Hidden,
+		"paths":        paths,
+		"itemCount":    s.libraryService.GetMediaItemCount(lib.ID),
 	})
 }
 
@@ -3772,17 +4958,25 @@ func (s *Server) adminUpdateLibrary(c *gin.Context) {
 			c.JSON(http.StatusNotFound, gin.H{"error": "Library not found"})
 			return
 		}
+		if errors.Is(err, library.ErrInvalidAgent) || errors.Is(err, library.ErrInvalidRule) ||
+			errors.Is(err, library.ErrInvalidEpisodeOrder) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"id":       lib.ID,
-		"uuid":     lib.UUID,
-		"title":    lib.Title,
-		"type":     lib.Type,
-		"language": lib.Language,
-		"hidden":   lib.Hidden,
+		"id":           lib.ID,
+		"uuid":         lib.UUID,
+		"title":        lib.Title,
+		"type":         lib.Type,
+		"episodeOrder": lib.EpisodeOrder,
+		"language":     lib.Language,
+		"agents":       library.LibraryAgents(lib),
+		"agentRules":   library.LibraryRules(lib),
+		"hidden":       lib.Hidden,
 	})
 }
 
@@ -3802,6 +4996,7 @@ func (s *Server) adminDeleteLibrary(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	s.refreshWatcher()
 
 	c.JSON(http.StatusOK, gin.H{"status": "ok"})
 }
@@ -3838,6 +5033,7 @@ func (s *Server) adminAddLibraryPath(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	s.refreshWatcher()
 
 	// Return updated library
 	lib, _ := s.libraryService.GetLibrary(uint(id))
@@ -3871,6 +5067,7 @@ func (s *Server) adminRemoveLibraryPath(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	s.refreshWatcher()
 
 	c.JSON(http.StatusOK, gin.H{"status": "ok"})
 }
@@ -3892,21 +5089,8 @@ func (s *Server) adminScanLibrary(c *gin.Context) {
 		return
 	}
 
-	// Run scan (this could be async in production)
-	result, err := s.scanner.ScanLibrary(lib)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
-	}
-
-	c.JSON(http.StatusOK, gin.H{
-		"libraryId":    result.LibraryID,
-		"filesFound":   result.FilesFound,
-		"filesAdded":   result.FilesAdded,
-		"filesUpdated": result.FilesUpdated,
-		"filesRemoved": result.FilesRemoved,
-		"errors":       result.Errors,
-	})
+	// The scan runs as a job, followed through /admin/scans
+	c.JSON(http.StatusAccepted, s.scanner.StartScan(lib))
 }
 
 // adminGetLibraryStats returns statistics for a library
@@ -3938,7 +5122,7 @@ func (s *Server) adminGetLibraryStats(c *gin.Context) {
 	var totalSize int64
 	s.db.Model(&models.MediaFile{}).
 		Joins("JOIN media_items ON media_items.id = media_files.media_item_id").
-		Where("media_items.library_id = ?", lib.ID).
+		Where("media_items.library_id = ? AND media_items.type <> ?", lib.ID, "extra").
 		Select("COALESCE(SUM(media_files.file_size), 0)").
 		Scan(&totalSize)
 
@@ -3946,13 +5130,13 @@ func (s *Server) adminGetLibraryStats(c *gin.Context) {
 	var fileCount int64
 	s.db.Model(&models.MediaFile{}).
 		Joins("JOIN media_items ON media_items.id = media_files.media_item_id").
-		Where("media_items.library_id = ?", lib.ID).
+		Where("media_items.library_id = ? AND media_items.type <> ?", lib.ID, "extra").
 		Count(&fileCount)
 
 	// Calculate total duration
 	var totalDuration int64
 	s.db.Model(&models.MediaItem{}).
-		Where("library_id = ? AND duration > 0", lib.ID).
+		Where("library_id = ? AND type <> ? AND duration > 0", lib.ID, "extra").
 		Select("COALESCE(SUM(duration), 0)").
 		Scan(&totalDuration)
 
@@ -4132,6 +5316,7 @@ func sortFileEntries(entries []FileSystemEntry) {
 type ServerSettings struct {
 	TMDBApiKey   string `json:"tmdb_api_key,omitempty"`
 	TVDBApiKey   string `json:"tvdb_api_key,omitempty"`
+	OMDbApiKey   string `json:"omdb_api_key,omitempty"`
 	MetadataLang string `json:"metadata_lang,omitempty"`
 	ScanInterval int    `json:"scan_interval,omitempty"`
 	VODAPIURL    string `json:"vod_api_url,omitempty"`
@@ -4142,6 +5327,7 @@ func (s *Server) adminGetSettings(c *gin.Context) {
 	settings := ServerSettings{
 		TMDBApiKey:   maskAPIKey(s.config.Library.TMDBApiKey),
 		TVDBApiKey:   maskAPIKey(s.config.Library.TVDBApiKey),
+		OMDbApiKey:   maskAPIKey(s.config.Library.OMDbApiKey),
 		MetadataLang: s.config.Library.MetadataLang,
 		ScanInterval: s.config.Library.ScanInterval,
 		VODAPIURL:    s.config.VOD.APIURL,
@@ -4180,6 +5366,11 @@ func (s *Server) adminUpdateSettings(c *gin.Context) {
 	}
 	if input.TVDBApiKey != "" && !strings.HasPrefix(input.TVDBApiKey, "****") {
 		s.config.Library.TVDBApiKey = input.TVDBApiKey
+		s.reinitializeAgents()
+	}
+	if input.OMDbApiKey != "" && !strings.HasPrefix(input.OMDbApiKey, "****") {
+		s.config.Library.OMDbApiKey = input.OMDbApiKey
+		s.reinitializeAgents()
 	}
 	if input.MetadataLang != "" {
 		s.config.Library.MetadataLang = input.MetadataLang
@@ -4198,6 +5389,7 @@ func (s *Server) adminUpdateSettings(c *gin.Context) {
 		"settings": ServerSettings{
 			TMDBApiKey:   maskAPIKey(s.config.Library.TMDBApiKey),
 			TVDBApiKey:   maskAPIKey(s.config.Library.TVDBApiKey),
+			OMDbApiKey:   maskAPIKey(s.config.Library.OMDbApiKey),
 			MetadataLang: s.config.Library.MetadataLang,
 			ScanInterval: s.config.Library.ScanInterval,
 			VODAPIURL:    s.config.VOD.APIURL,
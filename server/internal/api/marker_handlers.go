@@ -0,0 +1,132 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/openflix/openflix-server/internal/models"
+)
+
+// ============ Intro & Credits Marker Handlers ============
+
+// addMarkers lists the intro and credits markers of each part. The item gets
+// those of its first part, which is where Plex clients look for them.
+func (s *Server) addMarkers(metadata gin.H) {
+	media, _ := metadata["Media"].([]gin.H)
+	var fileIDs []uint
+	for _, m := range media {
+		parts, _ := m["Part"].([]gin.H)
+		for _, part := range parts {
+			if id, ok := part["id"].(uint); ok {
+				fileIDs = append(fileIDs, id)
+			}
+		}
+	}
+	if len(fileIDs) == 0 {
+		return
+	}
+
+	var markers []models.MediaMarker
+	s.db.Where("media_file_id IN ?", fileIDs).Order("start_time ASC").Find(&markers)
+	byFile := make(map[uint][]gin.H)
+	for _, marker := range markers {
+		byFile[marker.MediaFileID] = append(byFile[marker.MediaFileID], markerToJSON(&marker))
+	}
+
+	for _, m := range media {
+		parts, _ := m["Part"].([]gin.H)
+		for _, part := range parts {
+			if id, ok := part["id"].(uint); ok && len(byFile[id]) > 0 {
+				part["Marker"] = byFile[id]
+			}
+		}
+	}
+	if first := byFile[fileIDs[0]]; len(first) > 0 {
+		metadata["Marker"] = first
+	}
+}
+
+// markerToJSON converts a marker to its Plex representation
+func markerToJSON(marker *models.MediaMarker) gin.H {
+	return gin.H{
+		"id":              marker.ID,
+		"type":            marker.Type,
+		"startTimeOffset": marker.StartTime,
+		"endTimeOffset":   marker.EndTime,
+	}
+}
+
+// getRecordingMarkers returns the intro and credits markers of a recording
+func (s *Server) getRecordingMarkers(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid recording ID"})
+		return
+	}
+
+	query := s.db.Select("id")
+	if !c.GetBool("isAdmin") {
+		query = query.Where("user_id IN ?", []uint{c.GetUint("userID"), 0})
+	}
+	var recording models.Recording
+	if err := query.First(&recording, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Recording not found"})
+		return
+	}
+
+	var markers []models.MediaMarker
+	if err := s.db.Where("recording_id = ?", recording.ID).Order("start_time ASC").Find(&markers).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch markers"})
+		return
+	}
+	list := make([]gin.H, len(markers))
+	for i := range markers {
+		list[i] = markerToJSON(&markers[i])
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"recordingId": recording.ID,
+		"Marker":      list,
+	})
+}
+
+// adminRedetectMarkers throws away the markers of an episode, or of every
+// episode of a season or show, and looks for them again
+func (s *Server) adminRedetectMarkers(c *gin.Context) {
+	if s.markers == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Intro and credits detection is disabled"})
+		return
+	}
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid media ID"})
+		return
+	}
+	var item models.MediaItem
+	if err := s.db.First(&item, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Media not found"})
+		return
+	}
+
+	itemIDs := []uint{item.ID}
+	switch item.Type {
+	case "show":
+		s.db.Model(&models.MediaItem{}).Where("grandparent_id = ? AND type = ?", item.ID, "episode").Pluck("id", &itemIDs)
+	case "season":
+		s.db.Model(&models.MediaItem{}).Where("parent_id = ? AND type = ?", item.ID, "episode").Pluck("id", &itemIDs)
+	case "episode":
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Markers are only detected for TV shows"})
+		return
+	}
+
+	var fileIDs []uint
+	if len(itemIDs) > 0 {
+		s.db.Model(&models.MediaFile{}).Where("media_item_id IN ?", itemIDs).Pluck("id", &fileIDs)
+	}
+	if err := s.markers.Redetect(fileIDs); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reset markers: " + err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"files": len(fileIDs)})
+}
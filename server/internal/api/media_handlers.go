@@ -2,36 +2,44 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
 
 	"github.com/gin-gonic/gin"
+	"github.com/openflix/openflix-server/internal/auth"
+	"github.com/openflix/openflix-server/internal/library"
+	"github.com/openflix/openflix-server/internal/logger"
+	"github.com/openflix/openflix-server/internal/metadata"
 	"github.com/openflix/openflix-server/internal/models"
+	"github.com/openflix/openflix-server/internal/search"
+	"gorm.io/gorm"
 )
 
 // AdminMediaItem represents a media item for admin management
 type AdminMediaItem struct {
-	ID            uint    `json:"id"`
-	UUID          string  `json:"uuid"`
-	Type          string  `json:"type"`
-	Title         string  `json:"title"`
-	SortTitle     string  `json:"sort_title"`
-	OriginalTitle string  `json:"original_title,omitempty"`
-	Year          int     `json:"year,omitempty"`
-	Thumb         string  `json:"thumb,omitempty"`
-	Art           string  `json:"art,omitempty"`
-	Summary       string  `json:"summary,omitempty"`
-	Rating        float64 `json:"rating,omitempty"`
-	ContentRating string  `json:"content_rating,omitempty"`
-	Studio        string  `json:"studio,omitempty"`
-	Duration      int64   `json:"duration,omitempty"`
-	AddedAt       string  `json:"added_at"`
-	UpdatedAt     string  `json:"updated_at"`
-	LibraryID     uint    `json:"library_id"`
-	LibraryName   string  `json:"library_name,omitempty"`
-	TMDBID        string  `json:"tmdb_id,omitempty"`
-	ChildCount    int     `json:"child_count,omitempty"`
+	ID            uint     `json:"id"`
+	UUID          string   `json:"uuid"`
+	Type          string   `json:"type"`
+	Title         string   `json:"title"`
+	SortTitle     string   `json:"sort_title"`
+	OriginalTitle string   `json:"original_title,omitempty"`
+	Year          int      `json:"year,omitempty"`
+	Thumb         string   `json:"thumb,omitempty"`
+	Art           string   `json:"art,omitempty"`
+	Summary       string   `json:"summary,omitempty"`
+	Rating        float64  `json:"rating,omitempty"`
+	ContentRating string   `json:"content_rating,omitempty"`
+	Studio        string   `json:"studio,omitempty"`
+	Duration      int64    `json:"duration,omitempty"`
+	AddedAt       string   `json:"added_at"`
+	UpdatedAt     string   `json:"updated_at"`
+	LibraryID     uint     `json:"library_id"`
+	LibraryName   string   `json:"library_name,omitempty"`
+	TMDBID        string   `json:"tmdb_id,omitempty"`
+	ChildCount    int      `json:"child_count,omitempty"`
+	LockedFields  []string `json:"locked_fields"`
 }
 
 // adminGetMedia returns a paginated list of media items for admin management
@@ -111,6 +119,7 @@ func (s *Server) adminGetMedia(c *gin.Context) {
 			LibraryName:   libraryNames[item.LibraryID],
 			TMDBID:        item.UUID, // Use UUID as identifier
 			ChildCount:    item.ChildCount,
+			LockedFields:  metadata.LockedList(&item),
 		}
 	}
 
@@ -138,12 +147,17 @@ func (s *Server) adminUpdateMedia(c *gin.Context) {
 	}
 
 	var updates struct {
-		Title         *string `json:"title"`
-		SortTitle     *string `json:"sort_title"`
-		Year          *int    `json:"year"`
-		Summary       *string `json:"summary"`
-		Studio        *string `json:"studio"`
-		ContentRating *string `json:"content_rating"`
+		Title         *string           `json:"title"`
+		SortTitle     *string           `json:"sort_title"`
+		Year          *int              `json:"year"`
+		Summary       *string           `json:"summary"`
+		Studio        *string           `json:"studio"`
+		ContentRating *string           `json:"content_rating"`
+		Thumb         *string           `json:"thumb"`
+		Art           *string           `json:"art"`
+		Genres        []string          `json:"genres"`
+		Cast          []metadata.Credit `json:"cast"`  // In billing order
+		Locks         map[string]bool   `json:"locks"` // e.g. {"summary": false} to let agents update it again
 	}
 
 	if err := c.ShouldBindJSON(&updates); err != nil {
@@ -151,29 +165,55 @@ func (s *Server) adminUpdateMedia(c *gin.Context) {
 		return
 	}
 
-	// Apply updates
-	updateMap := make(map[string]interface{})
+	// Each edit is recorded in the item's history and locks the field
+	edits := make(map[string]string)
 	if updates.Title != nil {
-		updateMap["title"] = *updates.Title
+		edits["title"] = *updates.Title
 	}
 	if updates.SortTitle != nil {
-		updateMap["sort_title"] = *updates.SortTitle
+		edits["sort_title"] = *updates.SortTitle
 	}
 	if updates.Year != nil {
-		updateMap["year"] = *updates.Year
+		edits["year"] = strconv.Itoa(*updates.Year)
 	}
 	if updates.Summary != nil {
-		updateMap["summary"] = *updates.Summary
+		edits["summary"] = *updates.Summary
 	}
 	if updates.Studio != nil {
-		updateMap["studio"] = *updates.Studio
+		edits["studio"] = *updates.Studio
 	}
 	if updates.ContentRating != nil {
-		updateMap["content_rating"] = *updates.ContentRating
+		edits["content_rating"] = *updates.ContentRating
+	}
+	if updates.Thumb != nil {
+		edits["thumb"] = *updates.Thumb
+	}
+	if updates.Art != nil {
+		edits["art"] = *updates.Art
+	}
+	if updates.Genres != nil {
+		genres, _ := json.Marshal(updates.Genres)
+		edits["genres"] = string(genres)
+	}
+	if updates.Cast != nil {
+		cast, _ := json.Marshal(updates.Cast)
+		edits["cast"] = string(cast)
+	}
+
+	userID, username := editor(c)
+	for field, value := range edits {
+		if err := metadata.EditField(s.db, &item, field, value, userID, username); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update media item"})
+			return
+		}
 	}
 
-	if len(updateMap) > 0 {
-		if err := s.db.Model(&item).Updates(updateMap).Error; err != nil {
+	if len(updates.Locks) > 0 {
+		if err := metadata.SetLocks(s.db, &item, updates.Locks); err != nil {
+			if err == metadata.ErrUnknownField {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update media item"})
 			return
 		}
@@ -181,6 +221,7 @@ func (s *Server) adminUpdateMedia(c *gin.Context) {
 
 	// Reload and return updated item
 	s.db.First(&item, id)
+	search.IndexMediaItem(s.db, &item)
 	c.JSON(http.StatusOK, AdminMediaItem{
 		ID:            item.ID,
 		UUID:          item.UUID,
@@ -201,10 +242,137 @@ func (s *Server) adminUpdateMedia(c *gin.Context) {
 		LibraryID:     item.LibraryID,
 		TMDBID:        item.UUID,
 		ChildCount:    item.ChildCount,
+		LockedFields:  metadata.LockedList(&item),
+	})
+}
+
+// editor returns the ID and name of the user making a request
+func editor(c *gin.Context) (uint, string) {
+	if claims, ok := c.Get("claims"); ok {
+		if cl, ok := claims.(*auth.Claims); ok {
+			return cl.UserID, cl.Username
+		}
+	}
+	return 0, "local"
+}
+
+// adminGetMediaHistory returns the edit history of a media item, newest first
+func (s *Server) adminGetMediaHistory(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+
+	var edits []models.MetadataEdit
+	s.db.Where("media_item_id = ?", id).Order("created_at DESC, id DESC").Find(&edits)
+
+	c.JSON(http.StatusOK, gin.H{"edits": edits})
+}
+
+// adminRevertMediaEdit restores the value a field had before an edit. The
+// revert is itself recorded, and the field stays locked.
+func (s *Server) adminRevertMediaEdit(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+	editID, err := strconv.ParseUint(c.Param("editId"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid edit ID"})
+		return
+	}
+
+	var item models.MediaItem
+	if err := s.db.First(&item, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Media item not found"})
+		return
+	}
+	var edit models.MetadataEdit
+	if err := s.db.Where("id = ? AND media_item_id = ?", editID, item.ID).First(&edit).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Edit not found"})
+		return
+	}
+
+	userID, username := editor(c)
+	if err := metadata.EditField(s.db, &item, edit.Field, edit.OldValue, userID, username); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revert edit"})
+		return
+	}
+
+	s.db.First(&item, id)
+	search.IndexMediaItem(s.db, &item)
+	c.JSON(http.StatusOK, gin.H{
+		"message":       "Edit reverted",
+		"field":         edit.Field,
+		"locked_fields": metadata.LockedList(&item),
 	})
 }
 
-// adminRefreshMediaMetadata refreshes metadata for a media item from TMDB
+// adminSplitMedia gives every version of a movie but the first a movie of
+// its own, for files that were wrongly grouped
+func (s *Server) adminSplitMedia(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+
+	created, err := s.scanner.SplitItem(uint(id))
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Media item not found"})
+		return
+	case errors.Is(err, library.ErrNotMovie), errors.Is(err, library.ErrSingleVersion):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to split media item: " + err.Error()})
+		return
+	}
+
+	ids := make([]uint, len(created))
+	for i, item := range created {
+		ids[i] = item.ID
+	}
+	c.JSON(http.StatusOK, gin.H{"id": id, "created": ids})
+}
+
+// adminMergeMedia makes the files of other movies versions of this one
+func (s *Server) adminMergeMedia(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+	var req struct {
+		IDs []uint `json:"ids" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || len(req.IDs) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "ids is required"})
+		return
+	}
+
+	err = s.scanner.MergeItems(uint(id), req.IDs)
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Media item not found"})
+		return
+	case errors.Is(err, library.ErrNotMovie), errors.Is(err, library.ErrMixedLibrary):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to merge media items: " + err.Error()})
+		return
+	}
+
+	var versions int64
+	s.db.Model(&models.MediaFile{}).Where("media_item_id = ?", id).Count(&versions)
+	c.JSON(http.StatusOK, gin.H{"id": id, "versions": versions})
+}
+
+// adminRefreshMediaMetadata runs a media item's metadata agents again
 func (s *Server) adminRefreshMediaMetadata(c *gin.Context) {
 	idStr := c.Param("id")
 	id, err := strconv.ParseUint(idStr, 10, 64)
@@ -219,19 +387,15 @@ func (s *Server) adminRefreshMediaMetadata(c *gin.Context) {
 		return
 	}
 
-	// Check if TMDB agent is available
-	tmdbAgent := s.scanner.GetTMDBAgent()
-	if tmdbAgent == nil {
-		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "TMDB agent not configured"})
+	if item.Type != "movie" && item.Type != "show" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Metadata can only be refreshed for movies and shows"})
 		return
 	}
 
-	// Trigger metadata refresh
+	// Run the library's agents again
 	go func() {
-		if item.Type == "movie" {
-			tmdbAgent.UpdateMovieMetadata(&item)
-		} else if item.Type == "show" {
-			tmdbAgent.UpdateShowMetadata(&item)
+		if err := s.scanner.RefreshMetadata(&item); err != nil {
+			logger.Warnf("Failed to refresh metadata for %s: %v", item.Title, err)
 		}
 	}()
 
@@ -240,13 +404,6 @@ func (s *Server) adminRefreshMediaMetadata(c *gin.Context) {
 
 // adminRefreshAllMissingMetadata refreshes metadata for all items missing it
 func (s *Server) adminRefreshAllMissingMetadata(c *gin.Context) {
-	// Check if TMDB agent is available
-	tmdbAgent := s.scanner.GetTMDBAgent()
-	if tmdbAgent == nil {
-		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "TMDB agent not configured"})
-		return
-	}
-
 	// Find all movies and shows without poster (thumb) - indicates missing metadata
 	var items []models.MediaItem
 	s.db.Where("type IN ? AND (thumb IS NULL OR thumb = '')", []string{"movie", "show"}).Find(&items)
@@ -260,10 +417,8 @@ func (s *Server) adminRefreshAllMissingMetadata(c *gin.Context) {
 	go func() {
 		for _, item := range items {
 			itemCopy := item
-			if itemCopy.Type == "movie" {
-				tmdbAgent.UpdateMovieMetadata(&itemCopy)
-			} else if itemCopy.Type == "show" {
-				tmdbAgent.UpdateShowMetadata(&itemCopy)
+			if err := s.scanner.RefreshMetadata(&itemCopy); err != nil {
+				logger.Warnf("Failed to refresh metadata for %s: %v", itemCopy.Title, err)
 			}
 		}
 	}()
@@ -389,6 +544,8 @@ func (s *Server) adminApplyMediaMatch(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update media item"})
 		return
 	}
+	// The chosen match replaces any TMDB ID read from an .nfo
+	metadata.SaveGuids(s.db, item.ID, []string{item.UUID})
 
 	// Trigger metadata refresh using TMDB agent
 	tmdbAgent := s.scanner.GetTMDBAgent()
@@ -405,6 +562,22 @@ func (s *Server) adminApplyMediaMatch(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"message": "Match applied, metadata refresh started"})
 }
 
+// adminRebuildSearchIndex re-indexes the library, EPG, recordings and people in the background
+func (s *Server) adminRebuildSearchIndex(c *gin.Context) {
+	if !search.Available(s.db) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Search index is not available for this database"})
+		return
+	}
+
+	go func() {
+		if err := search.Rebuild(s.db); err != nil {
+			logger.Errorf("Failed to rebuild search index: %v", err)
+		}
+	}()
+
+	c.JSON(http.StatusOK, gin.H{"message": "Search index rebuild started"})
+}
+
 // TrendingItem represents a trending item for API response
 type TrendingItem struct {
 	ID           int     `json:"id"`
@@ -420,7 +593,7 @@ type TrendingItem struct {
 
 // getTrending returns trending movies/shows from TMDB
 func (s *Server) getTrending(c *gin.Context) {
-	mediaType := c.DefaultQuery("media_type", "all") // all, movie, tv
+	mediaType := c.DefaultQuery("media_type", "all")    // all, movie, tv
 	timeWindow := c.DefaultQuery("time_window", "week") // day, week
 
 	// Validate media_type
@@ -0,0 +1,143 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/openflix/openflix-server/internal/library"
+	"github.com/openflix/openflix-server/internal/models"
+)
+
+// ============ Photo Handlers ============
+
+// servePhotoThumb serves the smallest cached thumbnail that covers the
+// requested width/height, or the largest one if none does
+func (s *Server) servePhotoThumb(c *gin.Context, item *models.MediaItem) {
+	want, _ := strconv.Atoi(c.Query("width"))
+	if h, _ := strconv.Atoi(c.Query("height")); h > want {
+		want = h
+	}
+
+	size := library.PhotoThumbSizes[len(library.PhotoThumbSizes)-1]
+	for _, candidate := range library.PhotoThumbSizes {
+		if candidate >= want {
+			size = candidate
+			break
+		}
+	}
+
+	path := library.PhotoThumbPath(s.config.GetDataDir(), item.ID, size)
+	if _, err := os.Stat(path); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No thumbnail available"})
+		return
+	}
+
+	c.Header("Cache-Control", "public, max-age=86400")
+	c.File(path)
+}
+
+// addPhotoExif adds camera, exposure and location details to a photo's metadata
+func (s *Server) addPhotoExif(metadata gin.H, itemID uint) {
+	var exif models.PhotoExif
+	if err := s.db.Where("media_item_id = ?", itemID).First(&exif).Error; err != nil {
+		return
+	}
+
+	if exif.TakenAt != nil {
+		metadata["originallyAvailableAt"] = exif.TakenAt.Format("2006-01-02")
+		metadata["takenAt"] = exif.TakenAt.Unix()
+	}
+	if exif.Orientation > 0 {
+		metadata["orientation"] = exif.Orientation
+	}
+	if exif.Latitude != nil && exif.Longitude != nil {
+		metadata["latitude"] = *exif.Latitude
+		metadata["longitude"] = *exif.Longitude
+		if exif.Altitude != nil {
+			metadata["altitude"] = *exif.Altitude
+		}
+	}
+
+	// Plex reports camera details on the Media element
+	media, _ := metadata["Media"].([]gin.H)
+	for _, m := range media {
+		if exif.Make != "" {
+			m["make"] = exif.Make
+		}
+		if exif.Model != "" {
+			m["model"] = exif.Model
+		}
+		if exif.Lens != "" {
+			m["lens"] = exif.Lens
+		}
+		if exif.FNumber > 0 {
+			m["aperture"] = fmt.Sprintf("f/%g", exif.FNumber)
+		}
+		if exif.ExposureTime != "" {
+			m["exposure"] = exif.ExposureTime + "s"
+		}
+		if exif.ISO > 0 {
+			m["iso"] = exif.ISO
+		}
+		if exif.FocalLength > 0 {
+			m["focalLength"] = exif.FocalLength
+		}
+	}
+}
+
+// getLibraryTimeline groups the photos of a library into one album per month
+// taken, newest first. Each album links to the matching photos in /all.
+func (s *Server) getLibraryTimeline(c *gin.Context) {
+	libraryID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid library ID"})
+		return
+	}
+
+	var photos []models.MediaItem
+	if err := s.db.Select("id", "thumb", "originally_available_at").
+		Where("library_id = ? AND type = ? AND originally_available_at IS NOT NULL", libraryID, "photo").
+		Order("originally_available_at DESC").
+		Find(&photos).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	var albums []gin.H
+	var current time.Time
+	for _, photo := range photos {
+		taken := *photo.OriginallyAvailableAt
+		month := time.Date(taken.Year(), taken.Month(), 1, 0, 0, 0, 0, time.UTC)
+
+		if len(albums) == 0 || !month.Equal(current) {
+			current = month
+			query := url.Values{}
+			query.Set("filter", fmt.Sprintf("type=photo AND takenAt>=%s AND takenAt<%s",
+				month.Format("2006-01-02"), month.AddDate(0, 1, 0).Format("2006-01-02")))
+			query.Set("sort", "takenAt")
+
+			albums = append(albums, gin.H{
+				"key":              fmt.Sprintf("/library/sections/%d/all?%s", libraryID, query.Encode()),
+				"type":             "photoalbum",
+				"title":            month.Format("January 2006"),
+				"year":             month.Year(),
+				"index":            int(month.Month()),
+				"librarySectionID": libraryID,
+				"leafCount":        0,
+			})
+		}
+
+		album := albums[len(albums)-1]
+		album["leafCount"] = album["leafCount"].(int) + 1
+		if _, ok := album["thumb"]; !ok && photo.Thumb != "" {
+			album["thumb"] = photo.Thumb
+		}
+	}
+
+	s.respondWithMediaContainer(c, albums, len(albums), len(albums), 0)
+}
@@ -118,36 +118,7 @@ func (s *Server) getPlaybackDecision(c *gin.Context) {
 		caps = playback.DefaultClientCapabilities(platform)
 	}
 
-	// Build media info from file
-	mediaInfo := &playback.MediaInfo{
-		Container:    file.Container,
-		VideoCodec:   normalizeCodec(file.VideoCodec),
-		VideoProfile: file.VideoProfile,
-		AudioCodec:   normalizeCodec(file.AudioCodec),
-		Width:        file.Width,
-		Height:       file.Height,
-		Bitrate:      file.Bitrate / 1000, // Convert to kbps
-	}
-
-	// Check for HDR/DV in video streams
-	for _, stream := range file.Streams {
-		if stream.StreamType == 1 { // Video stream
-			if strings.Contains(strings.ToLower(stream.Title), "hdr") ||
-				strings.Contains(strings.ToLower(stream.DisplayTitle), "hdr") {
-				mediaInfo.HasHDR = true
-			}
-			if strings.Contains(strings.ToLower(stream.Title), "dolby vision") ||
-				strings.Contains(strings.ToLower(stream.DisplayTitle), "dv") {
-				mediaInfo.HasDolbyVision = true
-			}
-		}
-		if stream.StreamType == 2 { // Audio stream
-			if strings.Contains(strings.ToLower(stream.Codec), "truehd") &&
-				strings.Contains(strings.ToLower(stream.Title), "atmos") {
-				mediaInfo.HasAtmos = true
-			}
-		}
-	}
+	mediaInfo := playbackMediaInfo(&file)
 
 	// Get the decision
 	decision := playback.DecidePlayback(mediaInfo, caps)
@@ -193,32 +164,16 @@ func (s *Server) getMediaPlaybackOptions(c *gin.Context) {
 	}
 
 	// Get client capabilities
-	var caps *playback.ClientCapabilities
-	deviceID := c.GetHeader("X-Device-ID")
-	if deviceID != "" {
-		clientCapMutex.RLock()
-		caps = clientCapabilities[deviceID]
-		clientCapMutex.RUnlock()
-	}
-	if caps == nil {
-		platform := c.DefaultQuery("platform", c.GetHeader("X-Device-Platform"))
-		caps = playback.DefaultClientCapabilities(platform)
-	}
+	caps := s.deviceCapabilities(c)
 
 	// Analyze each file
 	options := make([]gin.H, len(files))
-	for i, file := range files {
-		mediaInfo := &playback.MediaInfo{
-			Container:    file.Container,
-			VideoCodec:   normalizeCodec(file.VideoCodec),
-			VideoProfile: file.VideoProfile,
-			AudioCodec:   normalizeCodec(file.AudioCodec),
-			Width:        file.Width,
-			Height:       file.Height,
-			Bitrate:      file.Bitrate / 1000,
-		}
+	versions := make([]*playback.MediaInfo, len(files))
+	for i := range files {
+		file := &files[i]
+		versions[i] = playbackMediaInfo(file)
 
-		decision := playback.DecidePlayback(mediaInfo, caps)
+		decision := playback.DecidePlayback(versions[i], caps)
 
 		options[i] = gin.H{
 			"fileId":     file.ID,
@@ -229,20 +184,115 @@ func (s *Server) getMediaPlaybackOptions(c *gin.Context) {
 			"decision":   decision,
 			"playbackUrl": buildPlaybackUrl(file.ID, decision),
 		}
+		if file.Edition != "" {
+			options[i]["edition"] = file.Edition
+		}
 	}
 
-	// Sort by preference: direct_play first, then direct_stream, then transcode
-	// (Already in a reasonable order based on file listing)
-
-	c.JSON(http.StatusOK, gin.H{
+	// The version that plays best on this client
+	response := gin.H{
 		"mediaId": mediaID,
 		"options": options,
 		"clientPlatform": caps.Platform,
-	})
+	}
+	if best, _ := playback.DecideVersion(versions, caps); best >= 0 {
+		options[best]["recommended"] = true
+		response["recommendedFileId"] = files[best].ID
+	}
+
+	c.JSON(http.StatusOK, response)
 }
 
 // Helper functions
 
+// bestVersion is the index of the version of an item that plays best on the
+// requesting device, or -1 when there are none
+func (s *Server) bestVersion(c *gin.Context, files []models.MediaFile) int {
+	versions := make([]*playback.MediaInfo, len(files))
+	for i := range files {
+		versions[i] = playbackMediaInfo(&files[i])
+	}
+	best, _ := playback.DecideVersion(versions, s.deviceCapabilities(c))
+	return best
+}
+
+// bestVersionFirst moves the version that plays best on the requesting
+// device to the front. Clients play the first version, and its chapters and
+// markers are shown as the item's.
+func (s *Server) bestVersionFirst(c *gin.Context, files []models.MediaFile) []models.MediaFile {
+	best := s.bestVersion(c, files)
+	if best <= 0 {
+		return files
+	}
+	ordered := make([]models.MediaFile, 0, len(files))
+	ordered = append(ordered, files[best])
+	ordered = append(ordered, files[:best]...)
+	return append(ordered, files[best+1:]...)
+}
+
+// deviceCapabilities returns the capabilities the requesting device
+// registered, or its platform's defaults
+func (s *Server) deviceCapabilities(c *gin.Context) *playback.ClientCapabilities {
+	if deviceID := c.GetHeader("X-Device-ID"); deviceID != "" {
+		clientCapMutex.RLock()
+		caps := clientCapabilities[deviceID]
+		clientCapMutex.RUnlock()
+		if caps != nil {
+			return caps
+		}
+	}
+	platform := c.DefaultQuery("platform", c.GetHeader("X-Device-Platform"))
+	return playback.DefaultClientCapabilities(platform)
+}
+
+// playbackMediaInfo describes a file for playback decisions, looking through
+// its streams for HDR, Dolby Vision and Atmos
+func playbackMediaInfo(file *models.MediaFile) *playback.MediaInfo {
+	mediaInfo := &playback.MediaInfo{
+		Container:    file.Container,
+		VideoCodec:   normalizeCodec(file.VideoCodec),
+		VideoProfile: file.VideoProfile,
+		AudioCodec:   normalizeCodec(file.AudioCodec),
+		Width:        file.Width,
+		Height:       file.Height,
+		Bitrate:      file.Bitrate / 1000, // Convert to kbps
+	}
+
+	for _, stream := range file.Streams {
+		if stream.StreamType == 1 { // Video stream
+			if isHDRStream(&stream) ||
+				strings.Contains(strings.ToLower(stream.Title), "hdr") ||
+				strings.Contains(strings.ToLower(stream.DisplayTitle), "hdr") {
+				mediaInfo.HasHDR = true
+			}
+			if stream.DOVIProfile > 0 ||
+				strings.Contains(strings.ToLower(stream.Title), "dolby vision") ||
+				strings.Contains(strings.ToLower(stream.DisplayTitle), "dv") {
+				mediaInfo.HasDolbyVision = true
+			}
+		}
+		if stream.StreamType == 2 { // Audio stream
+			if strings.Contains(strings.ToLower(stream.Codec), "truehd") &&
+				strings.Contains(strings.ToLower(stream.Title), "atmos") {
+				mediaInfo.HasAtmos = true
+			}
+		}
+	}
+	return mediaInfo
+}
+
+// isHDRStream reports whether a video stream is HDR10 or HLG: a PQ or HLG
+// transfer, or BT.2020 color at 10 bits or more when the transfer isn't known
+func isHDRStream(stream *models.MediaStream) bool {
+	switch strings.ToLower(stream.ColorTrc) {
+	case "smpte2084", "arib-std-b67":
+		return true
+	case "", "unknown":
+		return strings.HasPrefix(strings.ToLower(stream.ColorSpace), "bt2020") && stream.BitDepth >= 10
+	}
+	return false
+}
+
 func normalizeCodec(codec string) string {
 	codec = strings.ToLower(codec)
 
@@ -258,10 +308,10 @@ func normalizeCodec(codec string) string {
 		return "av1"
 	case strings.Contains(codec, "aac"):
 		return "aac"
-	case strings.Contains(codec, "ac3") || strings.Contains(codec, "a52"):
-		return "ac3"
 	case strings.Contains(codec, "eac3") || strings.Contains(codec, "ec3"):
 		return "eac3"
+	case strings.Contains(codec, "ac3") || strings.Contains(codec, "a52"):
+		return "ac3"
 	case strings.Contains(codec, "dts"):
 		return "dts"
 	case strings.Contains(codec, "truehd"):
@@ -296,9 +346,9 @@ func buildPlaybackUrl(fileID uint, decision *playback.PlaybackDecision) string {
 	case playback.ModeDirectPlay:
 		return "/library/parts/" + strconv.FormatUint(uint64(fileID), 10) + "/file"
 	case playback.ModeDirectStream:
-		return "/library/parts/" + strconv.FormatUint(uint64(fileID), 10) + "/file?directStream=1"
+		return "/video/-/transcode/universal/start.m3u8?directStream=1&fileId=" + strconv.FormatUint(uint64(fileID), 10)
 	case playback.ModeTranscode:
-		return "/video/:/transcode/universal/start?fileId=" + strconv.FormatUint(uint64(fileID), 10)
+		return "/video/-/transcode/universal/start.m3u8?fileId=" + strconv.FormatUint(uint64(fileID), 10)
 	default:
 		return "/library/parts/" + strconv.FormatUint(uint64(fileID), 10) + "/file"
 	}
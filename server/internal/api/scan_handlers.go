@@ -0,0 +1,73 @@
+package api
+
+import (
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/openflix/openflix-server/internal/library"
+)
+
+// ============ Scan Job Handlers ============
+
+// adminGetScans lists the running and recently finished library scans
+func (s *Server) adminGetScans(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"scans": s.scanner.ScanJobs()})
+}
+
+// adminGetScan returns the progress of a library scan
+func (s *Server) adminGetScan(c *gin.Context) {
+	job, err := s.scanner.ScanJob(c.Param("jobId"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Scan not found"})
+		return
+	}
+	c.JSON(http.StatusOK, job)
+}
+
+// adminCancelScan stops a library scan
+func (s *Server) adminCancelScan(c *gin.Context) {
+	err := s.scanner.CancelScan(c.Param("jobId"))
+	switch {
+	case errors.Is(err, library.ErrScanNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Scan not found"})
+		return
+	case errors.Is(err, library.ErrScanFinished):
+		c.JSON(http.StatusConflict, gin.H{"error": "Scan has already finished"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "cancelling"})
+}
+
+// adminScanEvents streams the progress of library scans as server-sent
+// events. Running scans are sent first so a client starts out up to date.
+func (s *Server) adminScanEvents(c *gin.Context) {
+	events, stop := s.scanner.SubscribeScans()
+	defer stop()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+
+	for _, job := range s.scanner.ScanJobs() {
+		if job.FinishedAt == nil {
+			c.SSEvent("progress", job)
+		}
+	}
+	c.Writer.Flush()
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-c.Request.Context().Done():
+			return false
+		case job, ok := <-events:
+			if !ok {
+				return false
+			}
+			c.SSEvent("progress", job)
+			return true
+		}
+	})
+}
@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/openflix/openflix-server/internal/artwork"
 	"github.com/openflix/openflix-server/internal/auth"
 	"github.com/openflix/openflix-server/internal/config"
 	"github.com/openflix/openflix-server/internal/dvr"
@@ -17,8 +18,10 @@ import (
 	"github.com/openflix/openflix-server/internal/logger"
 	"github.com/openflix/openflix-server/internal/metadata"
 	"github.com/openflix/openflix-server/internal/transcode"
+	"github.com/openflix/openflix-server/internal/trickplay"
 	"github.com/openflix/openflix-server/internal/instant"
 	"github.com/openflix/openflix-server/internal/multiview"
+	"github.com/openflix/openflix-server/internal/search"
 	"github.com/openflix/openflix-server/internal/sports"
 	"github.com/openflix/openflix-server/internal/commercial"
 	limiter "github.com/ulule/limiter/v3"
@@ -48,12 +51,21 @@ type Server struct {
 	remoteAccess       *livetv.RemoteAccessManager
 	prebuffer          *instant.PrebufferManager
 	multiviewManager   *multiview.MultiviewManager
+	watcher            *library.Watcher
+	artwork            *artwork.Store
+	trickplay          *trickplay.Generator
+	markers            *commercial.MarkerDetector
 }
 
 // NewServer creates a new API server
 func NewServer(cfg *config.Config, db *gorm.DB) *Server {
 	dataDir := cfg.GetDataDir()
-	scanner := library.NewScanner(db)
+	scanner := library.NewScanner(db, dataDir)
+	scanner.SetScanWorkers(cfg.Library.ScanWorkers, cfg.Library.ScanIOFriendly)
+
+	// Cache remote artwork locally, collecting unused images once a day
+	artworkStore := artwork.NewStore(db, dataDir, cfg.Transcode.FFmpegPath, 24)
+	artworkStore.Start()
 
 	// Initialize TMDB agent and metadata scheduler if API key is configured
 	var metadataScheduler *metadata.Scheduler
@@ -62,6 +74,7 @@ func NewServer(cfg *config.Config, db *gorm.DB) *Server {
 	if cfg.Library.TMDBApiKey != "" {
 		tmdbAgent := metadata.NewTMDBAgent(cfg.Library.TMDBApiKey, db, dataDir)
 		scanner.SetTMDBAgent(tmdbAgent)
+		artworkStore.SetDownloader(tmdbAgent)
 		logger.Info("TMDB metadata agent enabled")
 
 		// Start automatic metadata scheduler (checks every 2 minutes)
@@ -77,6 +90,14 @@ func NewServer(cfg *config.Config, db *gorm.DB) *Server {
 		dvrEnricher = dvr.NewEnricher(db, tmdbAgent)
 		logger.Info("DVR metadata enrichment enabled")
 	}
+	if cfg.Library.TVDBApiKey != "" {
+		scanner.SetAgent(metadata.NewTVDBAgent(cfg.Library.TVDBApiKey, cfg.Library.MetadataLang))
+		logger.Info("TVDB metadata agent enabled")
+	}
+	if cfg.Library.OMDbApiKey != "" {
+		scanner.SetAgent(metadata.NewOMDbAgent(cfg.Library.OMDbApiKey))
+		logger.Info("OMDb metadata agent enabled")
+	}
 
 	// Initialize transcoder
 	var transcoder *transcode.Transcoder
@@ -111,6 +132,31 @@ func NewServer(cfg *config.Config, db *gorm.DB) *Server {
 		}
 	}
 
+	// Generate seek preview thumbnails while transcodes and recordings leave
+	// the CPU idle
+	var trickplayGenerator *trickplay.Generator
+	if cfg.Transcode.Trickplay {
+		trickplayGenerator = trickplay.NewGenerator(db, dataDir, cfg.Transcode.FFmpegPath, cfg.Transcode.TrickplayInterval)
+		trickplayGenerator.SetBusy(func() bool {
+			return (transcoder != nil && transcoder.GetActiveSessions() > 0) ||
+				(recorder != nil && len(recorder.GetActiveRecordings()) > 0)
+		})
+		trickplayGenerator.Start()
+	}
+
+	// Find intros and credits for skip buttons the same way
+	var markerDetector *commercial.MarkerDetector
+	if cfg.Library.DetectMarkers {
+		detectorConfig := commercial.DefaultDetectorConfig()
+		detectorConfig.FFmpegPath = cfg.Transcode.FFmpegPath
+		markerDetector = commercial.NewMarkerDetector(db, detectorConfig)
+		markerDetector.SetBusy(func() bool {
+			return (transcoder != nil && transcoder.GetActiveSessions() > 0) ||
+				(recorder != nil && len(recorder.GetActiveRecordings()) > 0)
+		})
+		markerDetector.Start()
+	}
+
 	// Initialize EPG service
 	epgService := NewEPGService()
 
@@ -159,6 +205,18 @@ func NewServer(cfg *config.Config, db *gorm.DB) *Server {
 	prebuffer := instant.NewPrebufferManager(6, 500, dataDir)
 	logger.Info("Instant Switch Prebuffer Manager initialized")
 
+	// Build the search index in the background on first start
+	go search.RebuildIfEmpty(db)
+
+	// Watch library paths so new and changed files show up without a full scan
+	var watcher *library.Watcher
+	if cfg.Library.Watch {
+		watcher = library.NewWatcher(db, scanner,
+			time.Duration(cfg.Library.WatchDelay)*time.Second,
+			time.Duration(cfg.Library.PollInterval)*time.Minute)
+		watcher.Start()
+	}
+
 	s := &Server{
 		config:            cfg,
 		db:                db,
@@ -177,6 +235,10 @@ func NewServer(cfg *config.Config, db *gorm.DB) *Server {
 		dvrEnricher:       dvrEnricher,
 		remoteAccess:      remoteAccess,
 		prebuffer:         prebuffer,
+		watcher:           watcher,
+		artwork:           artworkStore,
+		trickplay:         trickplayGenerator,
+		markers:           markerDetector,
 	}
 	s.setupRouter()
 
@@ -194,12 +256,20 @@ func (s *Server) Run() error {
 	return s.router.Run(addr)
 }
 
+// reinitializeAgents replaces the TVDB and OMDb agents after their API keys
+// change
+func (s *Server) reinitializeAgents() {
+	s.scanner.SetAgent(metadata.NewTVDBAgent(s.config.Library.TVDBApiKey, s.config.Library.MetadataLang))
+	s.scanner.SetAgent(metadata.NewOMDbAgent(s.config.Library.OMDbApiKey))
+}
+
 // reinitializeTMDBAgent creates or updates the TMDB agent with a new API key
 func (s *Server) reinitializeTMDBAgent() {
 	if s.config.Library.TMDBApiKey != "" {
 		dataDir := s.config.GetDataDir()
 		tmdbAgent := metadata.NewTMDBAgent(s.config.Library.TMDBApiKey, s.db, dataDir)
 		s.scanner.SetTMDBAgent(tmdbAgent)
+		s.artwork.SetDownloader(tmdbAgent)
 
 		// Update or start metadata scheduler
 		if s.metadataScheduler != nil {
@@ -221,6 +291,7 @@ func (s *Server) reinitializeTMDBAgent() {
 		logger.Info("EPG artwork enrichment enabled")
 	} else {
 		s.scanner.SetTMDBAgent(nil)
+		s.artwork.SetDownloader(nil)
 		if s.metadataScheduler != nil {
 			s.metadataScheduler.SetTMDBAgent(nil)
 		}
@@ -324,6 +395,12 @@ func (s *Server) setupRouter() {
 		admin.POST("/libraries/:id/scan", s.adminScanLibrary)
 		admin.GET("/libraries/:id/stats", s.adminGetLibraryStats)
 
+		// Scan jobs (admin only)
+		admin.GET("/scans", s.adminGetScans)
+		admin.GET("/scans/events", s.adminScanEvents)
+		admin.GET("/scans/:jobId", s.adminGetScan)
+		admin.POST("/scans/:jobId/cancel", s.adminCancelScan)
+
 		// Filesystem browser (admin only)
 		admin.GET("/filesystem/browse", s.adminBrowseFilesystem)
 
@@ -334,10 +411,19 @@ func (s *Server) setupRouter() {
 		// Media management (admin only)
 		admin.GET("/media", s.adminGetMedia)
 		admin.PUT("/media/:id", s.adminUpdateMedia)
+		admin.GET("/media/:id/history", s.adminGetMediaHistory)
+		admin.POST("/media/:id/history/:editId/revert", s.adminRevertMediaEdit)
+		admin.POST("/media/:id/markers/detect", s.adminRedetectMarkers)
+		admin.POST("/media/:id/split", s.adminSplitMedia)
+		admin.POST("/media/:id/merge", s.adminMergeMedia)
 		admin.POST("/media/:id/refresh", s.adminRefreshMediaMetadata)
 		admin.POST("/media/refresh-missing", s.adminRefreshAllMissingMetadata)
 		admin.GET("/media/search-tmdb", s.adminSearchTMDB)
 		admin.POST("/media/:id/match", s.adminApplyMediaMatch)
+		admin.POST("/artwork/collect", s.adminCollectArtwork)
+
+		// Search index (admin only)
+		admin.POST("/search/rebuild", s.adminRebuildSearchIndex)
 	}
 
 	// ============ Library API ============
@@ -352,14 +438,17 @@ func (s *Server) setupRouter() {
 		libraryGroup.GET("/sections/:id/collections", s.getLibraryCollections)
 		libraryGroup.GET("/sections/:id/refresh", s.refreshLibrary)
 		libraryGroup.GET("/sections/:id/folder", s.getLibraryFolders)
+		libraryGroup.GET("/sections/:id/timeline", s.getLibraryTimeline)
 
 		// Metadata
 		libraryGroup.GET("/metadata/:key", s.getMetadata)
 		libraryGroup.GET("/metadata/:key/children", s.getMetadataChildren)
+		libraryGroup.GET("/metadata/:key/extras", s.getMetadataExtras)
 		libraryGroup.PUT("/metadata/:key/prefs", s.setMetadataPrefs)
 
 		// Parts (for stream selection)
 		libraryGroup.PUT("/parts/:id", s.selectStreams)
+		libraryGroup.GET("/streams/:id", s.getSubtitleStream)
 
 		// Browsing
 		libraryGroup.GET("/recentlyAdded", s.getRecentlyAdded)
@@ -368,8 +457,10 @@ func (s *Server) setupRouter() {
 		// Collections
 		libraryGroup.GET("/collections/:id/children", s.getCollectionItems)
 		libraryGroup.POST("/collections", s.createCollection)
+		libraryGroup.PUT("/collections/:id", s.updateCollection)
 		libraryGroup.PUT("/collections/:id/items", s.addToCollection)
 		libraryGroup.DELETE("/collections/:id/items/:itemId", s.removeFromCollection)
+		libraryGroup.PUT("/collections/:id/items/:itemId/move", s.moveCollectionItem)
 		libraryGroup.DELETE("/collections/:id", s.deleteCollection)
 	}
 
@@ -421,6 +512,7 @@ func (s *Server) setupRouter() {
 		playlists.GET("", s.getPlaylists)
 		playlists.POST("", s.createPlaylist)
 		playlists.GET("/:id", s.getPlaylist)
+		playlists.PUT("/:id", s.updatePlaylist)
 		playlists.GET("/:id/items", s.getPlaylistItems)
 		playlists.PUT("/:id/items", s.addToPlaylist)
 		playlists.DELETE("/:id/items/:itemId", s.removeFromPlaylist)
@@ -595,6 +687,7 @@ func (s *Server) setupRouter() {
 		// Commercial Detection
 		dvrGroup.GET("/commercials/status", s.getCommercialDetectionStatus)
 		dvrGroup.GET("/recordings/:id/commercials", s.getCommercialSegments)
+		dvrGroup.GET("/recordings/:id/markers", s.getRecordingMarkers)
 		dvrGroup.POST("/recordings/:id/commercials/detect", s.rerunCommercialDetection)
 		dvrGroup.POST("/recordings/:id/reprocess", s.reprocessRecording)
 
@@ -603,6 +696,8 @@ func (s *Server) setupRouter() {
 		dvrGroup.GET("/recordings/:id/stream", s.getRecordingStreamUrl)
 		dvrGroup.GET("/recordings/:id/hls/master.m3u8", s.getRecordingHLSPlaylist)
 		dvrGroup.GET("/recordings/:id/hls/:segment", s.getRecordingHLSSegment)
+		dvrGroup.GET("/recordings/:id/trickplay.vtt", s.getRecordingTrickplay)
+		dvrGroup.GET("/recordings/:id/trickplay/:sheet", s.getRecordingTrickplaySheet)
 		dvrGroup.PUT("/recordings/:id/progress", s.updateRecordingProgress)
 
 		// Stream Validation (validates stream before scheduling)
@@ -772,10 +867,16 @@ func (s *Server) setupRouter() {
 	// Direct file access
 	r.GET("/library/parts/:partId/file", s.authRequired(), s.streamMedia)
 	r.GET("/library/parts/:partId/file.:ext", s.authRequired(), s.streamMedia)
+	r.GET("/library/parts/:partId/trickplay.vtt", s.authRequired(), s.getPartTrickplay)
+	r.GET("/library/parts/:partId/trickplay/:sheet", s.authRequired(), s.getPartTrickplaySheet)
+	r.GET("/library/parts/:partId/chapters/:index/thumb", s.authRequired(), s.getChapterThumb)
 
 	// Transcode - using /video/-/transcode instead of /video/:/transcode
 	r.GET("/video/-/transcode/universal/start.m3u8", s.authRequired(), s.transcodeStart)
 	r.GET("/video/-/transcode/universal/session/:sessionId/:segment", s.authRequired(), s.transcodeSegment)
+	// Music tracks transcode to audio-only HLS
+	r.GET("/music/-/transcode/universal/start.m3u8", s.authRequired(), s.transcodeStart)
+	r.GET("/music/-/transcode/universal/session/:sessionId/:segment", s.authRequired(), s.transcodeSegment)
 	// Alternative routes
 	r.GET("/transcode/universal/start.m3u8", s.authRequired(), s.transcodeStart)
 	r.GET("/transcode/universal/session/:sessionId/:segment", s.authRequired(), s.transcodeSegment)
@@ -801,6 +902,7 @@ func (s *Server) setupRouter() {
 	r.GET("/library/metadata/:key/thumb", s.getThumbSimple)
 	r.GET("/library/metadata/:key/art/:artId", s.getArt)
 	r.GET("/library/metadata/:key/art", s.getArtSimple)
+	r.GET("/artwork", s.getArtwork)
 
 	s.router = r
 }
@@ -0,0 +1,311 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/openflix/openflix-server/internal/library"
+	"github.com/openflix/openflix-server/internal/models"
+	"github.com/openflix/openflix-server/internal/subtitle"
+	"github.com/openflix/openflix-server/internal/transcode"
+)
+
+// ============ Stream Handlers ============
+
+// Content types of sidecar subtitles served as they are
+var subtitleContentTypes = map[string]string{
+	"srt": "application/x-subrip; charset=utf-8",
+	"vtt": "text/vtt; charset=utf-8",
+	"ass": "text/x-ssa; charset=utf-8",
+	"ssa": "text/x-ssa; charset=utf-8",
+	"pgs": "application/octet-stream",
+}
+
+// addPartStreams lists the streams of each part, with a key for external
+// subtitles that clients can download
+func (s *Server) addPartStreams(metadata gin.H) {
+	media, _ := metadata["Media"].([]gin.H)
+	var fileIDs []uint
+	for _, m := range media {
+		if id, ok := m["id"].(uint); ok {
+			fileIDs = append(fileIDs, id)
+		}
+	}
+	if len(fileIDs) == 0 {
+		return
+	}
+
+	var streams []models.MediaStream
+	s.db.Where("media_file_id IN ?", fileIDs).Order("stream_type ASC, id ASC").Find(&streams)
+	byFile := make(map[uint][]gin.H)
+	for _, stream := range streams {
+		byFile[stream.MediaFileID] = append(byFile[stream.MediaFileID], mediaStreamToJSON(&stream))
+	}
+
+	for _, m := range media {
+		parts, _ := m["Part"].([]gin.H)
+		for _, part := range parts {
+			if id, ok := part["id"].(uint); ok && len(byFile[id]) > 0 {
+				part["Stream"] = byFile[id]
+			}
+		}
+	}
+}
+
+// mediaStreamToJSON converts a stream to its Plex representation
+func mediaStreamToJSON(stream *models.MediaStream) gin.H {
+	entry := gin.H{
+		"id":         stream.ID,
+		"streamType": stream.StreamType,
+		"codec":      stream.Codec,
+		"index":      stream.Index,
+		"selected":   stream.Selected,
+		"default":    stream.Default,
+		"forced":     stream.Forced,
+	}
+	if stream.Language != "" {
+		entry["language"] = stream.Language
+	}
+	if stream.LanguageCode != "" {
+		entry["languageCode"] = stream.LanguageCode
+	}
+	if stream.Title != "" {
+		entry["title"] = stream.Title
+	}
+	if stream.DisplayTitle != "" {
+		entry["displayTitle"] = stream.DisplayTitle
+	}
+
+	switch stream.StreamType {
+	case 1:
+		entry["width"] = stream.Width
+		entry["height"] = stream.Height
+		if stream.BitDepth > 0 {
+			entry["bitDepth"] = stream.BitDepth
+		}
+		if stream.ColorSpace != "" {
+			entry["colorSpace"] = stream.ColorSpace
+		}
+		if stream.ColorTrc != "" {
+			entry["colorTrc"] = stream.ColorTrc
+		}
+		if stream.DOVIProfile > 0 {
+			entry["DOVIPresent"] = true
+			entry["DOVIProfile"] = stream.DOVIProfile
+		}
+		if stream.FrameRate > 0 {
+			entry["frameRate"] = stream.FrameRate
+		}
+	case 2:
+		if stream.Channels > 0 {
+			entry["channels"] = stream.Channels
+		}
+		if stream.ChannelLayout != "" {
+			entry["audioChannelLayout"] = stream.ChannelLayout
+		}
+		if stream.SamplingRate > 0 {
+			entry["samplingRate"] = stream.SamplingRate
+		}
+	case 3:
+		if stream.HearingImpaired {
+			entry["hearingImpaired"] = true
+		}
+		if stream.Key != "" {
+			entry["key"] = fmt.Sprintf("/library/streams/%d", stream.ID)
+			entry["format"] = stream.Codec
+		}
+	}
+	return entry
+}
+
+// getSubtitleStream serves an external subtitle. With ?format=vtt or
+// ?format=srt text subtitles are converted on the fly; otherwise the file is
+// served as it is.
+func (s *Server) getSubtitleStream(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid stream ID"})
+		return
+	}
+
+	var stream models.MediaStream
+	if err := s.db.First(&stream, id).Error; err != nil || stream.StreamType != 3 || stream.Key == "" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Subtitle not found"})
+		return
+	}
+
+	format := strings.ToLower(c.Query("format"))
+	if format == "webvtt" {
+		format = "vtt"
+	}
+	if format != "" && format != "vtt" && format != "srt" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unsupported format, use vtt or srt"})
+		return
+	}
+
+	if format == "" || format == stream.Codec {
+		if _, err := os.Stat(stream.Key); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Subtitle file not found"})
+			return
+		}
+		if contentType, ok := subtitleContentTypes[stream.Codec]; ok {
+			c.Header("Content-Type", contentType)
+		}
+		c.File(stream.Key)
+		return
+	}
+
+	data, err := os.ReadFile(stream.Key)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Subtitle file not found"})
+		return
+	}
+	cues, err := subtitle.Parse(data, stream.Codec)
+	if err != nil {
+		if errors.Is(err, subtitle.ErrUnsupported) {
+			c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Image based subtitles can't be converted to text"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if format == "vtt" {
+		c.Header("Content-Type", subtitleContentTypes["vtt"])
+		subtitle.WriteVTT(c.Writer, cues)
+	} else {
+		c.Header("Content-Type", subtitleContentTypes["srt"])
+		subtitle.WriteSRT(c.Writer, cues)
+	}
+}
+
+// ============ Transcode Tracks ============
+
+// transcodeTracks picks the audio and subtitle a transcode of a file plays:
+// those asked for with audioStreamID and subtitleStreamID, then those
+// selected for the file, then those the profile's languages prefer. With
+// subtitles=burn a text subtitle is burned in rather than sent as WebVTT.
+func (s *Server) transcodeTracks(c *gin.Context, file *models.MediaFile) transcode.Tracks {
+	var streams []models.MediaStream
+	s.db.Where("media_file_id = ? AND stream_type IN ?", file.ID, []int{2, 3}).Order("id").Find(&streams)
+	var audio, subtitles []*models.MediaStream
+	for i := range streams {
+		if streams[i].StreamType == 2 {
+			audio = append(audio, &streams[i])
+		} else {
+			subtitles = append(subtitles, &streams[i])
+		}
+	}
+
+	var profile *models.UserProfile
+	if profileID := c.GetUint("profileID"); profileID > 0 {
+		var p models.UserProfile
+		if s.db.First(&p, profileID).Error == nil {
+			profile = &p
+		}
+	}
+
+	var tracks transcode.Tracks
+	chosenAudio := pickAudioStream(audio, c.Query("audioStreamID"), profile)
+	// Files scanned before each audio stream was recorded have one, whose
+	// index isn't known
+	if chosenAudio != nil && len(audio) > 1 {
+		tracks.Audio = chosenAudio.Index
+	}
+
+	if sub := pickSubtitleStream(subtitles, c.Query("subtitleStreamID"), profile, chosenAudio); sub != nil {
+		track := &transcode.SubtitleTrack{
+			Index:    sub.Index,
+			Path:     sub.Key,
+			Codec:    sub.Codec,
+			Language: sub.LanguageCode,
+			Name:     sub.DisplayTitle,
+			Burn:     c.Query("subtitles") == "burn",
+		}
+		for _, other := range subtitles {
+			if other.Key == "" && other.Index < sub.Index {
+				track.Position++
+			}
+		}
+		tracks.Subtitle = track
+	}
+	return tracks
+}
+
+// pickAudioStream picks the audio asked for, the one selected, the first in
+// the profile's language, or the default, in that order
+func pickAudioStream(audio []*models.MediaStream, requested string, profile *models.UserProfile) *models.MediaStream {
+	if id, err := strconv.ParseUint(requested, 10, 32); err == nil {
+		if stream := findStream(audio, func(s *models.MediaStream) bool { return s.ID == uint(id) }); stream != nil {
+			return stream
+		}
+	}
+	if stream := findStream(audio, func(s *models.MediaStream) bool { return s.Selected }); stream != nil {
+		return stream
+	}
+	if profile != nil && profile.AutoSelectAudio && profile.DefaultAudioLanguage != "" {
+		want := library.LanguageCode(profile.DefaultAudioLanguage)
+		if stream := findStream(audio, func(s *models.MediaStream) bool { return streamLanguage(s) == want }); stream != nil {
+			return stream
+		}
+	}
+	return findStream(audio, func(s *models.MediaStream) bool { return s.Default })
+}
+
+// pickSubtitleStream picks the subtitle asked for ("0" being none), the one
+// selected, or one in the profile's language. Profiles show subtitles
+// always (2), with audio in another language (1; forced subtitles only
+// otherwise), or when picked by hand (0).
+func pickSubtitleStream(subtitles []*models.MediaStream, requested string, profile *models.UserProfile, audio *models.MediaStream) *models.MediaStream {
+	if requested == "0" {
+		return nil
+	}
+	if id, err := strconv.ParseUint(requested, 10, 32); err == nil {
+		if stream := findStream(subtitles, func(s *models.MediaStream) bool { return s.ID == uint(id) }); stream != nil {
+			return stream
+		}
+	}
+	if stream := findStream(subtitles, func(s *models.MediaStream) bool { return s.Selected }); stream != nil {
+		return stream
+	}
+	if profile == nil || profile.AutoSelectSubtitle == 0 || profile.DefaultSubtitleLanguage == "" {
+		return nil
+	}
+
+	want := library.LanguageCode(profile.DefaultSubtitleLanguage)
+	forcedOnly := profile.AutoSelectSubtitle == 1 && audio != nil && streamLanguage(audio) == want
+	var match *models.MediaStream
+	for _, stream := range subtitles {
+		if streamLanguage(stream) != want || (forcedOnly && !stream.Forced) {
+			continue
+		}
+		// Full subtitles over forced ones, unless only forced are wanted
+		if match == nil || (match.Forced && !stream.Forced) {
+			match = stream
+		}
+	}
+	return match
+}
+
+// findStream returns the first stream matching
+func findStream(streams []*models.MediaStream, match func(*models.MediaStream) bool) *models.MediaStream {
+	for _, stream := range streams {
+		if match(stream) {
+			return stream
+		}
+	}
+	return nil
+}
+
+// streamLanguage is the ISO 639-2/B code of a stream's language
+func streamLanguage(stream *models.MediaStream) string {
+	if stream.LanguageCode != "" {
+		return library.LanguageCode(stream.LanguageCode)
+	}
+	return library.LanguageCode(stream.Language)
+}
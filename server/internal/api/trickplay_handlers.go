@@ -0,0 +1,128 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/openflix/openflix-server/internal/models"
+	"github.com/openflix/openflix-server/internal/trickplay"
+)
+
+// ============ Trickplay Handlers ============
+
+// getPartTrickplay returns the WebVTT thumbnail track of a media file
+func (s *Server) getPartTrickplay(c *gin.Context) {
+	if id, ok := s.trickplayPart(c); ok {
+		s.serveTrickplayTrack(c, trickplay.KindPart, id)
+	}
+}
+
+// getPartTrickplaySheet returns a sprite sheet of a media file
+func (s *Server) getPartTrickplaySheet(c *gin.Context) {
+	if id, ok := s.trickplayPart(c); ok {
+		s.serveTrickplaySheet(c, trickplay.KindPart, id)
+	}
+}
+
+// getRecordingTrickplay returns the WebVTT thumbnail track of a recording
+func (s *Server) getRecordingTrickplay(c *gin.Context) {
+	if id, ok := s.trickplayRecording(c); ok {
+		s.serveTrickplayTrack(c, trickplay.KindRecording, id)
+	}
+}
+
+// getRecordingTrickplaySheet returns a sprite sheet of a recording
+func (s *Server) getRecordingTrickplaySheet(c *gin.Context) {
+	if id, ok := s.trickplayRecording(c); ok {
+		s.serveTrickplaySheet(c, trickplay.KindRecording, id)
+	}
+}
+
+// trickplayPart looks up the media file of a request
+func (s *Server) trickplayPart(c *gin.Context) (uint, bool) {
+	if s.trickplay == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Trickplay thumbnails are disabled"})
+		return 0, false
+	}
+	partID, err := strconv.ParseUint(c.Param("partId"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid part ID"})
+		return 0, false
+	}
+	var file models.MediaFile
+	if err := s.db.Select("id").First(&file, partID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Media file not found"})
+		return 0, false
+	}
+	return file.ID, true
+}
+
+// trickplayRecording looks up a recording the user may watch
+func (s *Server) trickplayRecording(c *gin.Context) (uint, bool) {
+	if s.trickplay == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Trickplay thumbnails are disabled"})
+		return 0, false
+	}
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid recording ID"})
+		return 0, false
+	}
+
+	query := s.db.Select("id")
+	if !c.GetBool("isAdmin") {
+		query = query.Where("user_id IN ?", []uint{c.GetUint("userID"), 0})
+	}
+	var recording models.Recording
+	if err := query.First(&recording, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Recording not found"})
+		return 0, false
+	}
+	return recording.ID, true
+}
+
+// serveTrickplayTrack writes the thumbnail track. Sheets are linked relative
+// to the track, with the request's query so a token in it still applies.
+func (s *Server) serveTrickplayTrack(c *gin.Context, kind string, id uint) {
+	manifest, err := s.trickplay.Manifest(kind, id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Trickplay thumbnails are not ready"})
+		return
+	}
+
+	query := ""
+	if c.Request.URL.RawQuery != "" {
+		query = "?" + c.Request.URL.RawQuery
+	}
+	track := trickplay.WebVTT(manifest, func(sheet int) string {
+		return fmt.Sprintf("trickplay/%d.jpg%s", sheet, query)
+	})
+
+	c.Header("Cache-Control", "public, max-age=86400")
+	c.Data(http.StatusOK, "text/vtt; charset=utf-8", []byte(track))
+}
+
+// serveTrickplaySheet serves one sprite sheet, e.g. "3.jpg"
+func (s *Server) serveTrickplaySheet(c *gin.Context, kind string, id uint) {
+	sheet, err := strconv.Atoi(strings.TrimSuffix(c.Param("sheet"), ".jpg"))
+	if err != nil || sheet < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid sheet"})
+		return
+	}
+	if _, err := s.trickplay.Manifest(kind, id); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Trickplay thumbnails are not ready"})
+		return
+	}
+
+	path := s.trickplay.SheetPath(kind, id, sheet)
+	if _, err := os.Stat(path); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Sheet not found"})
+		return
+	}
+	c.Header("Cache-Control", "public, max-age=86400")
+	c.File(path)
+}
@@ -0,0 +1,418 @@
+// Package artwork keeps local copies of remote posters, backdrops and
+// headshots, along with smaller copies for clients that ask for them.
+package artwork
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/openflix/openflix-server/internal/logger"
+	"gorm.io/gorm"
+)
+
+// Widths are the sizes variants are made in. A request is served by the
+// smallest width at least as wide as asked for; anything wider than the
+// last gets the original.
+var Widths = []int{150, 300, 500, 780, 1280, 1920}
+
+// maxImageSize is the largest image that is downloaded
+const maxImageSize = 20 << 20
+
+const tmdbImageURL = "https://image.tmdb.org/t/p"
+
+// ErrNotRemote is returned when asked to download something that isn't an
+// http(s) URL
+var ErrNotRemote = errors.New("artwork is not a remote URL")
+
+// Downloader fetches an image, e.g. metadata.TMDBAgent
+type Downloader interface {
+	DownloadImage(url string) ([]byte, error)
+}
+
+// Store keeps artwork under <data dir>/artwork. Originals are named after
+// the SHA-1 of their URL and variants after the original and their width.
+type Store struct {
+	db         *gorm.DB
+	dir        string
+	dataDir    string
+	ffmpegBin  string
+	client     *http.Client
+	downloader Downloader
+	locks      [64]sync.Mutex
+	interval   time.Duration
+	running    bool
+	stopChan   chan struct{}
+	mu         sync.Mutex
+}
+
+// NewStore creates an artwork store that collects unused images every
+// intervalHours
+func NewStore(db *gorm.DB, dataDir, ffmpegBin string, intervalHours int) *Store {
+	if ffmpegBin == "" {
+		ffmpegBin = "ffmpeg"
+	}
+	if intervalHours < 1 {
+		intervalHours = 24
+	}
+	return &Store{
+		db:        db,
+		dir:       filepath.Join(dataDir, "artwork"),
+		dataDir:   dataDir,
+		ffmpegBin: ffmpegBin,
+		client: &http.Client{
+			Timeout: 30 * time.Second,
+		},
+		interval: time.Duration(intervalHours) * time.Hour,
+		stopChan: make(chan struct{}),
+	}
+}
+
+// SetDownloader sets what images are downloaded through. With none they are
+// fetched directly.
+func (s *Store) SetDownloader(d Downloader) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.downloader = d
+}
+
+// Key is the name artwork from a source is stored under
+func Key(source string) string {
+	sum := sha1.Sum([]byte(source))
+	return hex.EncodeToString(sum[:])
+}
+
+// IsRemote reports whether artwork is a URL on another server
+func IsRemote(source string) bool {
+	return strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://")
+}
+
+// RemoteURL returns the URL of artwork, expanding bare TMDB image paths such
+// as "/abc.jpg" to the given TMDB size. Local artwork returns "".
+func RemoteURL(source, tmdbSize string) string {
+	if IsRemote(source) {
+		return source
+	}
+	if strings.HasPrefix(source, "/") && !strings.HasPrefix(source, "/library/") && !strings.Contains(source[1:], "/") {
+		return tmdbImageURL + "/" + tmdbSize + source
+	}
+	return ""
+}
+
+// lock serializes work on one key without keeping a lock per image
+func (s *Store) lock(key string) *sync.Mutex {
+	n, _ := strconv.ParseUint(key[:2], 16, 8)
+	return &s.locks[n%uint64(len(s.locks))]
+}
+
+func (s *Store) originalPath(key string) string {
+	return filepath.Join(s.dir, key[:2], key)
+}
+
+func (s *Store) variantPath(key string, width int) string {
+	return filepath.Join(s.dir, key[:2], fmt.Sprintf("%s-%d.jpg", key, width))
+}
+
+// Fetch returns the local copy of a remote image, downloading it the first
+// time it is asked for
+func (s *Store) Fetch(url string) (string, error) {
+	if !IsRemote(url) {
+		return "", ErrNotRemote
+	}
+	key := Key(url)
+	path := s.originalPath(key)
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+
+	l := s.lock(key)
+	l.Lock()
+	defer l.Unlock()
+	// Someone else may have downloaded it while we waited
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+
+	data, err := s.download(url)
+	if err != nil {
+		return "", err
+	}
+	if err := writeFile(path, data); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// download fetches an image through the downloader if there is one
+func (s *Store) download(url string) ([]byte, error) {
+	s.mu.Lock()
+	downloader := s.downloader
+	s.mu.Unlock()
+
+	var data []byte
+	var err error
+	if downloader != nil {
+		data, err = downloader.DownloadImage(url)
+	} else {
+		data, err = s.get(url)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxImageSize {
+		return nil, fmt.Errorf("image too large: %d bytes", len(data))
+	}
+	if !strings.HasPrefix(http.DetectContentType(data), "image/") {
+		return nil, fmt.Errorf("not an image: %s", url)
+	}
+	return data, nil
+}
+
+func (s *Store) get(url string) ([]byte, error) {
+	resp, err := s.client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to download image: %d", resp.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxImageSize+1))
+}
+
+// VariantWidth returns the width a request for width is served at, or 0 for
+// the original
+func VariantWidth(width int) int {
+	if width <= 0 {
+		return 0
+	}
+	for _, w := range Widths {
+		if w >= width {
+			return w
+		}
+	}
+	return 0
+}
+
+// Variant returns a copy of the image at path, from source, no wider than the
+// variant width for width. Images are never scaled up. The original is
+// returned when no variant is wanted or one can't be made.
+func (s *Store) Variant(source, path string, width int) string {
+	width = VariantWidth(width)
+	if width == 0 {
+		return path
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return path
+	}
+
+	key := Key(source)
+	variant := s.variantPath(key, width)
+	// A variant older than its original was made from artwork since replaced
+	if v, err := os.Stat(variant); err == nil && !v.ModTime().Before(info.ModTime()) {
+		return variant
+	}
+
+	l := s.lock(key)
+	l.Lock()
+	defer l.Unlock()
+	if v, err := os.Stat(variant); err == nil && !v.ModTime().Before(info.ModTime()) {
+		return variant
+	}
+
+	if err := os.MkdirAll(filepath.Dir(variant), 0755); err != nil {
+		return path
+	}
+	tmp := variant + ".tmp.jpg"
+	cmd := exec.Command(s.ffmpegBin,
+		"-y", "-v", "quiet",
+		"-i", path,
+		"-vf", fmt.Sprintf("scale='min(iw,%d)':-2", width),
+		"-frames:v", "1",
+		"-q:v", "3",
+		tmp,
+	)
+	if err := cmd.Run(); err != nil {
+		os.Remove(tmp)
+		logger.Debugf("Failed to resize artwork %s: %v", source, err)
+		return path
+	}
+	if err := os.Rename(tmp, variant); err != nil {
+		os.Remove(tmp)
+		return path
+	}
+	return variant
+}
+
+// writeFile writes a file through a temporary file so a partial download is
+// never served
+func writeFile(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Referenced reports whether artwork is used by the library, recordings or
+// collections. URLs from clients are checked so the store can't be used to
+// fetch arbitrary URLs.
+func (s *Store) Referenced(source string) bool {
+	var count int64
+	for _, ref := range references {
+		s.db.Table(ref.table).Where(ref.column+" = ?", source).Count(&count)
+		if count > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// references are the columns that hold artwork
+var references = []struct {
+	table  string
+	column string
+}{
+	{"media_items", "thumb"},
+	{"media_items", "art"},
+	{"media_items", "parent_thumb"},
+	{"media_items", "grandparent_thumb"},
+	{"media_items", "grandparent_art"},
+	{"cast_members", "thumb"},
+	{"recordings", "thumb"},
+	{"recordings", "art"},
+	{"collections", "thumb"},
+	{"collections", "art"},
+}
+
+// usedKeys returns the keys of all artwork in use: every referenced source,
+// and the posters and backdrops copied into the data directory
+func (s *Store) usedKeys() (map[string]bool, error) {
+	used := make(map[string]bool)
+	for _, ref := range references {
+		var sources []string
+		err := s.db.Table(ref.table).
+			Where(ref.column+" <> ''").
+			Distinct(ref.column).
+			Pluck(ref.column, &sources).Error
+		if err != nil {
+			return nil, err
+		}
+		for _, source := range sources {
+			used[Key(source)] = true
+			for _, size := range []string{"w500", "original"} {
+				if url := RemoteURL(source, size); url != "" {
+					used[Key(url)] = true
+				}
+			}
+		}
+	}
+
+	for _, kind := range []string{"posters", "backdrops"} {
+		dir := filepath.Join(s.dataDir, "metadata", kind)
+		entries, _ := os.ReadDir(dir)
+		for _, entry := range entries {
+			used[Key(filepath.Join(dir, entry.Name()))] = true
+		}
+	}
+	return used, nil
+}
+
+// Collect removes artwork nothing refers to any more, and returns how many
+// files were removed and how many bytes that freed
+func (s *Store) Collect() (int, int64, error) {
+	used, err := s.usedKeys()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	removed := 0
+	var freed int64
+	err = filepath.WalkDir(s.dir, func(path string, entry os.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil
+		}
+		name := entry.Name()
+		key := name
+		if i := strings.IndexAny(name, "-."); i >= 0 {
+			key = name[:i]
+		}
+		if strings.Contains(name, ".tmp") {
+			// Temporary files are only left behind by a crash
+			if time.Since(info.ModTime()) < time.Hour {
+				return nil
+			}
+		} else if used[key] {
+			return nil
+		}
+		if os.Remove(path) == nil {
+			removed++
+			freed += info.Size()
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return removed, freed, err
+	}
+	return removed, freed, nil
+}
+
+// Start begins collecting unused artwork in the background
+func (s *Store) Start() {
+	s.mu.Lock()
+	if s.running {
+		s.mu.Unlock()
+		return
+	}
+	s.running = true
+	s.mu.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				removed, freed, err := s.Collect()
+				if err != nil {
+					logger.Warnf("Failed to collect unused artwork: %v", err)
+				} else if removed > 0 {
+					logger.Infof("Removed %d unused artwork files (%d KB)", removed, freed/1024)
+				}
+			case <-s.stopChan:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops collecting unused artwork
+func (s *Store) Stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running {
+		close(s.stopChan)
+		s.running = false
+	}
+}
@@ -2,7 +2,6 @@ package commercial
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"os"
 	"os/exec"
@@ -380,31 +379,7 @@ func (cd *CommercialDetector) overallConfidence(breaks []CommercialBreak) float6
 
 // getVideoDuration gets video duration using ffprobe
 func (cd *CommercialDetector) getVideoDuration(ctx context.Context, videoPath string) float64 {
-	cmd := exec.CommandContext(ctx, "ffprobe",
-		"-v", "quiet",
-		"-show_entries", "format=duration",
-		"-of", "json",
-		videoPath,
-	)
-
-	output, err := cmd.Output()
-	if err != nil {
-		return 0
-	}
-
-	var result struct {
-		Format struct {
-			Duration string `json:"duration"`
-		} `json:"format"`
-	}
-
-	if err := json.Unmarshal(output, &result); err != nil {
-		return 0
-	}
-
-	var duration float64
-	fmt.Sscanf(result.Format.Duration, "%f", &duration)
-	return duration
+	return videoDuration(ctx, "ffprobe", videoPath)
 }
 
 // GetCommercials returns detected commercials for a recording
@@ -0,0 +1,258 @@
+package commercial
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/bits"
+	"math/cmplx"
+	"os/exec"
+)
+
+// Audio is fingerprinted as 8 kHz mono. Each frame of 1024 samples is split
+// into bands between 300 and 2000 Hz, and each bit of a frame's fingerprint
+// tells whether the energy difference between two neighbouring bands grew or
+// shrank since the previous frame. The same audio gives nearly the same bits
+// even after being encoded differently.
+const (
+	sampleRate    = 8000
+	frameSize     = 1024
+	frameHop      = 256
+	fingerBands   = 33
+	minBandFreq   = 300.0
+	maxBandFreq   = 2000.0
+	matchWindow   = 32 // frames bit errors are averaged over
+	maxBitErrors  = 11 // average bit errors of matching audio; unrelated audio averages 16
+	maxMatchGap   = 16 // frames of mismatch tolerated inside a match
+	maxHashOffset = 5  // candidate alignments tried per pair
+)
+
+// frameSeconds is the time between two fingerprint frames
+const frameSeconds = float64(frameHop) / sampleRate
+
+// Fingerprint is the audio fingerprint of part of a file, one value per frame
+type Fingerprint []uint32
+
+// Seconds returns the time of a frame from the start of the fingerprint
+func (f Fingerprint) Seconds(frame int) float64 {
+	return float64(frame) * frameSeconds
+}
+
+// AudioMatch is audio two fingerprints share
+type AudioMatch struct {
+	StartA int // first frame in the first fingerprint
+	StartB int // first frame in the second fingerprint
+	Length int // frames
+}
+
+// Duration returns the length of a match in seconds
+func (m AudioMatch) Duration() float64 {
+	return float64(m.Length) * frameSeconds
+}
+
+// FingerprintAudio decodes length seconds of a file's audio from start and
+// fingerprints it
+func FingerprintAudio(ctx context.Context, ffmpegPath, path string, start, length float64) (Fingerprint, error) {
+	cmd := exec.CommandContext(ctx, ffmpegPath,
+		"-v", "quiet",
+		"-ss", fmt.Sprintf("%.3f", start),
+		"-i", path,
+		"-t", fmt.Sprintf("%.3f", length),
+		"-vn", "-sn", "-dn",
+		"-ac", "1",
+		"-ar", fmt.Sprint(sampleRate),
+		"-f", "s16le",
+		"-",
+	)
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode audio: %w", err)
+	}
+
+	samples := make([]float64, len(out)/2)
+	for i := range samples {
+		samples[i] = float64(int16(binary.LittleEndian.Uint16(out[i*2:])))
+	}
+	return fingerprintSamples(samples), nil
+}
+
+// fingerprintSamples fingerprints 8 kHz mono samples
+func fingerprintSamples(samples []float64) Fingerprint {
+	if len(samples) < frameSize {
+		return nil
+	}
+
+	window := make([]float64, frameSize)
+	for i := range window {
+		window[i] = 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(frameSize-1))
+	}
+	edges := make([]int, fingerBands+1)
+	for i := range edges {
+		freq := minBandFreq * math.Pow(maxBandFreq/minBandFreq, float64(i)/fingerBands)
+		edges[i] = int(freq * frameSize / sampleRate)
+	}
+
+	frames := (len(samples)-frameSize)/frameHop + 1
+	fp := make(Fingerprint, 0, frames)
+	buf := make([]complex128, frameSize)
+	prev := make([]float64, fingerBands)
+	energy := make([]float64, fingerBands)
+	for n := 0; n < frames; n++ {
+		offset := n * frameHop
+		for i := range buf {
+			buf[i] = complex(samples[offset+i]*window[i], 0)
+		}
+		fft(buf)
+
+		for b := 0; b < fingerBands; b++ {
+			energy[b] = 0
+			for k := edges[b]; k < edges[b+1] || k == edges[b]; k++ {
+				mag := cmplx.Abs(buf[k])
+				energy[b] += mag * mag
+			}
+		}
+
+		if n > 0 {
+			var hash uint32
+			for b := 0; b < fingerBands-1; b++ {
+				if (energy[b]-energy[b+1])-(prev[b]-prev[b+1]) > 0 {
+					hash |= 1 << uint(b)
+				}
+			}
+			fp = append(fp, hash)
+		}
+		copy(prev, energy)
+	}
+	return fp
+}
+
+// fft is an in-place radix-2 fast Fourier transform. len(x) must be a power
+// of two.
+func fft(x []complex128) {
+	n := len(x)
+	for i, j := 1, 0; i < n; i++ {
+		bit := n >> 1
+		for ; j&bit != 0; bit >>= 1 {
+			j ^= bit
+		}
+		j ^= bit
+		if i < j {
+			x[i], x[j] = x[j], x[i]
+		}
+	}
+	for size := 2; size <= n; size <<= 1 {
+		step := cmplx.Exp(complex(0, -2*math.Pi/float64(size)))
+		for start := 0; start < n; start += size {
+			w := complex(1, 0)
+			for k := 0; k < size/2; k++ {
+				even, odd := x[start+k], x[start+k+size/2]*w
+				x[start+k] = even + odd
+				x[start+k+size/2] = even - odd
+				w *= step
+			}
+		}
+	}
+}
+
+// LongestMatch finds the longest stretch of audio two fingerprints share. It
+// reports false if they share nothing.
+func LongestMatch(a, b Fingerprint) (AudioMatch, bool) {
+	if len(a) < matchWindow || len(b) < matchWindow {
+		return AudioMatch{}, false
+	}
+
+	// Frames with identical hashes vote for the alignment of the two. Hashes
+	// that repeat a lot, such as those of silence, say nothing.
+	index := make(map[uint32][]int)
+	for j, hash := range b {
+		index[hash] = append(index[hash], j)
+	}
+	votes := make(map[int]int)
+	for i, hash := range a {
+		positions := index[hash]
+		if len(positions) > 20 {
+			continue
+		}
+		for _, j := range positions {
+			votes[j-i]++
+		}
+	}
+
+	var best AudioMatch
+	for _, offset := range topOffsets(votes, maxHashOffset) {
+		if m := matchAt(a, b, offset); m.Length > best.Length {
+			best = m
+		}
+	}
+	return best, best.Length > 0
+}
+
+// topOffsets returns the alignments with the most votes, best first
+func topOffsets(votes map[int]int, n int) []int {
+	var top []int
+	for offset, count := range votes {
+		if count < 3 {
+			continue
+		}
+		i := len(top)
+		for i > 0 && (votes[top[i-1]] < count || (votes[top[i-1]] == count && top[i-1] > offset)) {
+			i--
+		}
+		if i >= n {
+			continue
+		}
+		top = append(top, 0)
+		copy(top[i+1:], top[i:])
+		top[i] = offset
+		if len(top) > n {
+			top = top[:n]
+		}
+	}
+	return top
+}
+
+// matchAt finds the longest match with frame i of a aligned to frame
+// i+offset of b. A frame matches when the bit errors averaged over the
+// window around it are low.
+func matchAt(a, b Fingerprint, offset int) AudioMatch {
+	first := 0
+	if offset < 0 {
+		first = -offset
+	}
+	last := len(a)
+	if len(b)-offset < last {
+		last = len(b) - offset
+	}
+	n := last - first
+	if n < matchWindow {
+		return AudioMatch{}
+	}
+
+	distance := make([]int, n)
+	for i := range distance {
+		distance[i] = bits.OnesCount32(a[first+i] ^ b[first+i+offset])
+	}
+
+	var best AudioMatch
+	runStart, lastGood, sum := -1, -1, 0
+	for i := 0; i < n; i++ {
+		sum += distance[i]
+		if i >= matchWindow {
+			sum -= distance[i-matchWindow]
+		}
+		if i < matchWindow-1 || sum > maxBitErrors*matchWindow {
+			continue
+		}
+		// The window ending at i is centred on frame center
+		center := i - matchWindow/2
+		if runStart < 0 || center-lastGood > maxMatchGap {
+			runStart = center
+		}
+		lastGood = center
+		if length := center + 1 - runStart; length > best.Length {
+			best = AudioMatch{StartA: first + runStart, StartB: first + runStart + offset, Length: length}
+		}
+	}
+	return best
+}
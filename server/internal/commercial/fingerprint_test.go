@@ -0,0 +1,108 @@
+package commercial
+
+import (
+	"math"
+	"math/cmplx"
+	"math/rand"
+	"testing"
+)
+
+// noise returns n samples of white noise
+func noise(rng *rand.Rand, n int) []float64 {
+	samples := make([]float64, n)
+	for i := range samples {
+		samples[i] = rng.NormFloat64() * 3000
+	}
+	return samples
+}
+
+// jingle returns n samples of a tune of short chords between the
+// fingerprinted frequencies over a drum roll, the same for the same seed
+func jingle(seed int64, n int) []float64 {
+	rng := rand.New(rand.NewSource(seed))
+	samples := noise(rng, n)
+	freqs := make([]float64, 6)
+	for i := range samples {
+		if i%(sampleRate/10) == 0 {
+			for j := range freqs {
+				freqs[j] = minBandFreq + rng.Float64()*(maxBandFreq-minBandFreq)
+			}
+		}
+		for _, freq := range freqs {
+			samples[i] += 3000 * math.Sin(2*math.Pi*freq*float64(i)/sampleRate)
+		}
+	}
+	return samples
+}
+
+// concat joins sample buffers
+func concat(parts ...[]float64) []float64 {
+	var samples []float64
+	for _, part := range parts {
+		samples = append(samples, part...)
+	}
+	return samples
+}
+
+func TestFFT(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	x := make([]complex128, 64)
+	for i := range x {
+		x[i] = complex(rng.Float64(), rng.Float64())
+	}
+
+	// Against the discrete Fourier transform by its definition
+	want := make([]complex128, len(x))
+	for k := range want {
+		for n, v := range x {
+			want[k] += v * cmplx.Exp(complex(0, -2*math.Pi*float64(k*n)/float64(len(x))))
+		}
+	}
+	got := append([]complex128(nil), x...)
+	fft(got)
+	for k := range got {
+		if cmplx.Abs(got[k]-want[k]) > 1e-9 {
+			t.Fatalf("fft()[%d] = %v, want %v", k, got[k], want[k])
+		}
+	}
+}
+
+func TestLongestMatch(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+
+	// The same ten seconds of tune after 64 frames of noise in one and 160 in
+	// the other, each with a little noise of its own over it
+	const leadA, leadB = 64, 160
+	tune := jingle(2, 10*sampleRate)
+	withHiss := func(samples []float64) []float64 {
+		hissed := make([]float64, len(samples))
+		for i, v := range samples {
+			hissed[i] = v + rng.NormFloat64()*200
+		}
+		return hissed
+	}
+	a := fingerprintSamples(concat(noise(rng, leadA*frameHop), withHiss(tune), noise(rng, 3*sampleRate)))
+	b := fingerprintSamples(concat(noise(rng, leadB*frameHop), withHiss(tune), noise(rng, sampleRate)))
+
+	match, ok := LongestMatch(a, b)
+	if !ok {
+		t.Fatal("LongestMatch() found no match")
+	}
+	if match.StartB-match.StartA != leadB-leadA {
+		t.Errorf("match at %d and %d, want %d frames apart", match.StartA, match.StartB, leadB-leadA)
+	}
+	if match.StartA < leadA-matchWindow/2 || match.StartA > leadA+matchWindow/2 {
+		t.Errorf("match starts at frame %d, want about %d", match.StartA, leadA)
+	}
+	if d := match.Duration(); d < 9 || d > 11 {
+		t.Errorf("match lasts %.1fs, want about 10s", d)
+	}
+
+	// Unrelated audio shares nothing
+	if match, ok := LongestMatch(a, fingerprintSamples(noise(rng, 15*sampleRate))); ok {
+		t.Errorf("LongestMatch() of unrelated audio = %+v", match)
+	}
+	if match, ok := LongestMatch(a, fingerprintSamples(jingle(3, 15*sampleRate))); ok {
+		t.Errorf("LongestMatch() of another tune = %+v", match)
+	}
+}
@@ -0,0 +1,559 @@
+package commercial
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/openflix/openflix-server/internal/logger"
+	"github.com/openflix/openflix-server/internal/models"
+	"gorm.io/gorm"
+)
+
+// Marker types
+const (
+	MarkerIntro   = "intro"
+	MarkerCredits = "credits"
+)
+
+// Ways markers are found
+const (
+	MethodFingerprint = "fingerprint" // audio shared with other episodes
+	MethodBlackFrame  = "blackframe"  // a black frame over silence near the end
+)
+
+const (
+	introSearch   = 10 * 60.0 // seconds from the start an intro is looked for in
+	creditsSearch = 5 * 60.0  // seconds from the end shared credits are looked for in
+	cutSearch     = 3 * 60.0  // seconds from the end a cut to the credits is looked for in
+	minIntro      = 15.0
+	maxIntro      = 150.0
+	minCredits    = 15.0
+	// maxReferences is how many other episodes each episode is compared with
+	maxReferences = 4
+	// markerPoll is how long the detector rests once everything is done
+	markerPoll = 15 * time.Minute
+	// busyCheck is how often a busy server is checked again
+	busyCheck = 30 * time.Second
+)
+
+// MarkerDetector finds the intros and credits of TV episodes and DVR series
+// in the background. Intros are the longest stretch of audio an episode
+// shares with others of its season near the start; credits are audio shared
+// near the end or, failing that, the last cut to black over silence.
+type MarkerDetector struct {
+	db       *gorm.DB
+	Config   DetectorConfig
+	busy     func() bool
+	wake     chan struct{}
+	running  bool
+	stopChan chan struct{}
+	cancel   context.CancelFunc
+	mu       sync.Mutex
+}
+
+// markerSource is an episode or recording markers are looked for in
+type markerSource struct {
+	fileID      uint
+	recordingID uint
+	path        string
+	duration    float64 // seconds, 0 if it has to be probed
+	scanned     bool
+	hasIntro    bool
+	hasCredits  bool
+	head        Fingerprint
+	tail        Fingerprint
+	failed      bool
+}
+
+// NewMarkerDetector creates a marker detector
+func NewMarkerDetector(db *gorm.DB, config DetectorConfig) *MarkerDetector {
+	if config.FFmpegPath == "" {
+		config.FFmpegPath = "ffmpeg"
+	}
+	return &MarkerDetector{
+		db:       db,
+		Config:   config,
+		wake:     make(chan struct{}, 1),
+		stopChan: make(chan struct{}),
+	}
+}
+
+// SetBusy sets a check for work that should have the CPU first, such as
+// transcodes and recordings
+func (d *MarkerDetector) SetBusy(busy func() bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.busy = busy
+}
+
+// Start begins looking for markers in the background
+func (d *MarkerDetector) Start() {
+	d.mu.Lock()
+	if d.running {
+		d.mu.Unlock()
+		return
+	}
+	d.running = true
+	ctx, cancel := context.WithCancel(context.Background())
+	d.cancel = cancel
+	d.mu.Unlock()
+
+	logger.Info("Intro and credits detection started")
+	go d.run(ctx)
+}
+
+// Stop stops the detector, abandoning the group in progress
+func (d *MarkerDetector) Stop() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.running {
+		close(d.stopChan)
+		d.cancel()
+		d.running = false
+	}
+}
+
+// Redetect forgets the markers of media files so they are looked for again
+func (d *MarkerDetector) Redetect(fileIDs []uint) error {
+	if len(fileIDs) == 0 {
+		return nil
+	}
+	err := d.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("media_file_id IN ?", fileIDs).Delete(&models.MediaMarker{}).Error; err != nil {
+			return err
+		}
+		return tx.Model(&models.MediaFile{}).Where("id IN ?", fileIDs).Update("markers_scanned_at", nil).Error
+	})
+	if err != nil {
+		return err
+	}
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (d *MarkerDetector) run(ctx context.Context) {
+	for {
+		for _, group := range d.pendingGroups() {
+			if !d.waitIdle() {
+				return
+			}
+			d.detectGroup(ctx, group)
+			if ctx.Err() != nil {
+				return
+			}
+		}
+
+		select {
+		case <-time.After(markerPoll):
+		case <-d.wake:
+		case <-d.stopChan:
+			logger.Info("Intro and credits detection stopped")
+			return
+		}
+	}
+}
+
+// waitIdle blocks until nothing more important needs the CPU. It returns
+// false if the detector was stopped while waiting.
+func (d *MarkerDetector) waitIdle() bool {
+	for {
+		d.mu.Lock()
+		busy := d.busy
+		d.mu.Unlock()
+		if busy == nil || !busy() {
+			return true
+		}
+
+		select {
+		case <-time.After(busyCheck):
+		case <-d.stopChan:
+			return false
+		}
+	}
+}
+
+// pendingGroups returns the seasons and recorded series with episodes that
+// haven't been looked at yet. Each group holds all of its episodes, since
+// the new ones are compared with those already done.
+func (d *MarkerDetector) pendingGroups() [][]*markerSource {
+	var groups [][]*markerSource
+
+	var files []struct {
+		ID               uint
+		FilePath         string
+		Duration         int64
+		MarkersScannedAt *time.Time
+		ParentID         *uint
+	}
+	d.db.Table("media_files").
+		Select("media_files.id, media_files.file_path, media_files.duration, media_files.markers_scanned_at, media_items.parent_id").
+		Joins("JOIN media_items ON media_items.id = media_files.media_item_id").
+		Where("media_items.type = ? AND media_files.is_remote = ? AND media_files.duration > 0", "episode", false).
+		Order("media_items.parent_id, media_items.`index`, media_files.id").
+		Scan(&files)
+
+	seasons := make(map[uint][]*markerSource)
+	var order []uint
+	for _, f := range files {
+		if f.ParentID == nil {
+			continue
+		}
+		if _, ok := seasons[*f.ParentID]; !ok {
+			order = append(order, *f.ParentID)
+		}
+		seasons[*f.ParentID] = append(seasons[*f.ParentID], &markerSource{
+			fileID:   f.ID,
+			path:     f.FilePath,
+			duration: float64(f.Duration) / 1000,
+			scanned:  f.MarkersScannedAt != nil,
+		})
+	}
+	for _, season := range order {
+		groups = append(groups, seasons[season])
+	}
+
+	var recordings []models.Recording
+	d.db.Select("id", "title", "file_path", "series_rule_id", "series_parent_id", "markers_scanned_at").
+		Where("status = ? AND file_path <> ''", "completed").
+		Order("start_time, id").
+		Find(&recordings)
+
+	series := make(map[string][]*markerSource)
+	var seriesOrder []string
+	for _, r := range recordings {
+		key := seriesKey(&r)
+		if _, ok := series[key]; !ok {
+			seriesOrder = append(seriesOrder, key)
+		}
+		series[key] = append(series[key], &markerSource{
+			recordingID: r.ID,
+			path:        r.FilePath,
+			scanned:     r.MarkersScannedAt != nil,
+		})
+	}
+	for _, key := range seriesOrder {
+		groups = append(groups, series[key])
+	}
+
+	var pending [][]*markerSource
+	for _, group := range groups {
+		for _, s := range group {
+			if !s.scanned {
+				d.loadExisting(group)
+				pending = append(pending, group)
+				break
+			}
+		}
+	}
+	return pending
+}
+
+// seriesKey groups recordings of the same series: by series rule, then by
+// the recording that started the series, then by title
+func seriesKey(r *models.Recording) string {
+	if r.SeriesRuleID != nil {
+		return fmt.Sprintf("rule:%d", *r.SeriesRuleID)
+	}
+	if r.SeriesParentID != nil {
+		return fmt.Sprintf("parent:%d", *r.SeriesParentID)
+	}
+	return "title:" + strings.ToLower(strings.TrimSpace(r.Title))
+}
+
+// loadExisting notes which markers the episodes of a group already have
+func (d *MarkerDetector) loadExisting(group []*markerSource) {
+	var fileIDs, recordingIDs []uint
+	for _, s := range group {
+		if s.fileID != 0 {
+			fileIDs = append(fileIDs, s.fileID)
+		} else {
+			recordingIDs = append(recordingIDs, s.recordingID)
+		}
+	}
+
+	var markers []models.MediaMarker
+	query := d.db.Select("media_file_id", "recording_id", "type")
+	if len(fileIDs) > 0 {
+		query = query.Where("media_file_id IN ?", fileIDs)
+	} else {
+		query = query.Where("recording_id IN ?", recordingIDs)
+	}
+	query.Find(&markers)
+
+	for _, s := range group {
+		for _, m := range markers {
+			if (s.fileID != 0 && m.MediaFileID == s.fileID) || (s.recordingID != 0 && m.RecordingID == s.recordingID) {
+				s.hasIntro = s.hasIntro || m.Type == MarkerIntro
+				s.hasCredits = s.hasCredits || m.Type == MarkerCredits
+			}
+		}
+	}
+}
+
+// detectGroup looks for the markers of the new episodes of a group, and for
+// the intros of earlier ones that had nothing to be compared with
+func (d *MarkerDetector) detectGroup(ctx context.Context, group []*markerSource) {
+	for i, s := range group {
+		if s.scanned && (s.hasIntro || len(group) < 2) {
+			continue
+		}
+		if !d.waitIdle() {
+			return
+		}
+
+		markers := d.detect(ctx, group, i)
+		if ctx.Err() != nil {
+			return
+		}
+		if err := d.save(s, markers); err != nil {
+			logger.Warnf("Failed to save markers for %s: %v", s.path, err)
+			continue
+		}
+		if len(markers) > 0 {
+			logger.Debugf("Found %d markers in %s", len(markers), s.path)
+		}
+	}
+}
+
+// detect finds the markers an episode is missing
+func (d *MarkerDetector) detect(ctx context.Context, group []*markerSource, i int) []models.MediaMarker {
+	s := group[i]
+	if s.duration <= 0 {
+		s.duration = videoDuration(ctx, "ffprobe", s.path)
+		if s.duration <= 0 {
+			s.failed = true
+			return nil
+		}
+	}
+
+	var markers []models.MediaMarker
+	refs := references(group, i)
+
+	if !s.hasIntro {
+		var best AudioMatch
+		for _, ref := range refs {
+			a, b := d.head(ctx, s), d.head(ctx, ref)
+			if a == nil || b == nil {
+				continue
+			}
+			if m, ok := LongestMatch(a, b); ok && m.Duration() >= minIntro && m.Duration() <= maxIntro && m.Length > best.Length {
+				best = m
+			}
+		}
+		if best.Length > 0 {
+			start := s.head.Seconds(best.StartA)
+			markers = append(markers, newMarker(MarkerIntro, MethodFingerprint, start, start+best.Duration()))
+		}
+	}
+
+	if !s.hasCredits {
+		var best AudioMatch
+		for _, ref := range refs {
+			a, b := d.tail(ctx, s), d.tail(ctx, ref)
+			if a == nil || b == nil {
+				continue
+			}
+			if m, ok := LongestMatch(a, b); ok && m.Duration() >= minCredits && m.Length > best.Length {
+				best = m
+			}
+		}
+		if best.Length > 0 {
+			start := s.duration - tailLength(s.duration) + s.tail.Seconds(best.StartA)
+			end := start + best.Duration()
+			if s.duration-end < 10 {
+				end = s.duration
+			}
+			markers = append(markers, newMarker(MarkerCredits, MethodFingerprint, start, end))
+		} else if !s.scanned {
+			// Nothing to compare with, or credits that differ every episode
+			if start, ok := d.findCreditsCut(ctx, s.path, s.duration); ok {
+				markers = append(markers, newMarker(MarkerCredits, MethodBlackFrame, start, s.duration))
+			}
+		}
+	}
+	return markers
+}
+
+// references returns the episodes of a group nearest to episode i
+func references(group []*markerSource, i int) []*markerSource {
+	var refs []*markerSource
+	for dist := 1; len(refs) < maxReferences && (i-dist >= 0 || i+dist < len(group)); dist++ {
+		for _, j := range []int{i + dist, i - dist} {
+			if j >= 0 && j < len(group) && !group[j].failed && len(refs) < maxReferences {
+				refs = append(refs, group[j])
+			}
+		}
+	}
+	return refs
+}
+
+func newMarker(kind, method string, start, end float64) models.MediaMarker {
+	return models.MediaMarker{
+		Type:      kind,
+		Method:    method,
+		StartTime: int64(start * 1000),
+		EndTime:   int64(end * 1000),
+	}
+}
+
+// head returns the fingerprint of the start of an episode, where intros are
+// looked for
+func (d *MarkerDetector) head(ctx context.Context, s *markerSource) Fingerprint {
+	if s.head == nil && !s.failed {
+		length := introSearch
+		if s.duration > 0 && s.duration/2 < length {
+			length = s.duration / 2
+		}
+		s.head = d.fingerprint(ctx, s, 0, length)
+	}
+	return s.head
+}
+
+// tail returns the fingerprint of the end of an episode, where credits are
+// looked for
+func (d *MarkerDetector) tail(ctx context.Context, s *markerSource) Fingerprint {
+	if s.tail == nil && !s.failed {
+		if s.duration <= 0 {
+			s.duration = videoDuration(ctx, "ffprobe", s.path)
+		}
+		if s.duration <= 0 {
+			s.failed = true
+			return nil
+		}
+		length := tailLength(s.duration)
+		s.tail = d.fingerprint(ctx, s, s.duration-length, length)
+	}
+	return s.tail
+}
+
+func tailLength(duration float64) float64 {
+	if duration/3 < creditsSearch {
+		return duration / 3
+	}
+	return creditsSearch
+}
+
+func (d *MarkerDetector) fingerprint(ctx context.Context, s *markerSource, start, length float64) Fingerprint {
+	fp, err := FingerprintAudio(ctx, d.Config.FFmpegPath, s.path, start, length)
+	if err != nil || len(fp) == 0 {
+		if ctx.Err() == nil {
+			logger.Debugf("Failed to fingerprint %s: %v", s.path, err)
+			s.failed = true
+		}
+		return nil
+	}
+	return fp
+}
+
+var (
+	blackRe        = regexp.MustCompile(`black_start:\s*([\d.]+)\s+black_end:\s*([\d.]+)`)
+	silenceStartRe = regexp.MustCompile(`silence_start:\s*(-?[\d.]+)`)
+	silenceEndRe   = regexp.MustCompile(`silence_end:\s*([\d.]+)`)
+)
+
+// findCreditsCut looks near the end of a file for the first black frame
+// over silence that leaves room for credits, and returns where it ends
+func (d *MarkerDetector) findCreditsCut(ctx context.Context, path string, duration float64) (float64, bool) {
+	window := cutSearch
+	if duration/10 < window {
+		window = duration / 10
+	}
+	start := duration - window
+
+	cmd := exec.CommandContext(ctx, d.Config.FFmpegPath,
+		"-hide_banner", "-nostats",
+		"-ss", fmt.Sprintf("%.3f", start),
+		"-i", path,
+		"-vf", fmt.Sprintf("blackdetect=d=0.3:pix_th=%.2f", d.Config.BlackFrameThreshold),
+		"-af", fmt.Sprintf("silencedetect=noise=%.0fdB:d=0.3", d.Config.SilenceThreshold),
+		"-f", "null",
+		"-",
+	)
+	output, _ := cmd.CombinedOutput() // ffmpeg outputs to stderr
+
+	type span struct{ start, end float64 }
+	var blacks, silences []span
+	silenceStart := -1.0
+	for _, line := range strings.Split(string(output), "\n") {
+		if m := blackRe.FindStringSubmatch(line); m != nil {
+			s, _ := strconv.ParseFloat(m[1], 64)
+			e, _ := strconv.ParseFloat(m[2], 64)
+			blacks = append(blacks, span{s, e})
+		} else if m := silenceStartRe.FindStringSubmatch(line); m != nil {
+			silenceStart, _ = strconv.ParseFloat(m[1], 64)
+		} else if m := silenceEndRe.FindStringSubmatch(line); m != nil && silenceStart >= 0 {
+			e, _ := strconv.ParseFloat(m[1], 64)
+			silences = append(silences, span{silenceStart, e})
+			silenceStart = -1
+		}
+	}
+
+	sort.Slice(blacks, func(i, j int) bool { return blacks[i].start < blacks[j].start })
+	for _, b := range blacks {
+		if duration-(start+b.end) < minCredits {
+			break
+		}
+		for _, s := range silences {
+			if s.start <= b.end+1 && s.end >= b.start-1 {
+				return start + b.end, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// save stores the markers found in an episode and notes it was looked at
+func (d *MarkerDetector) save(s *markerSource, markers []models.MediaMarker) error {
+	now := time.Now()
+	return d.db.Transaction(func(tx *gorm.DB) error {
+		for i := range markers {
+			markers[i].MediaFileID = s.fileID
+			markers[i].RecordingID = s.recordingID
+			if err := tx.Create(&markers[i]).Error; err != nil {
+				return err
+			}
+		}
+		if s.fileID != 0 {
+			return tx.Model(&models.MediaFile{}).Where("id = ?", s.fileID).Update("markers_scanned_at", now).Error
+		}
+		return tx.Model(&models.Recording{}).Where("id = ?", s.recordingID).Update("markers_scanned_at", now).Error
+	})
+}
+
+// videoDuration gets video duration using ffprobe
+func videoDuration(ctx context.Context, ffprobePath, videoPath string) float64 {
+	cmd := exec.CommandContext(ctx, ffprobePath,
+		"-v", "quiet",
+		"-show_entries", "format=duration",
+		"-of", "json",
+		videoPath,
+	)
+
+	output, err := cmd.Output()
+	if err != nil {
+		return 0
+	}
+
+	var result struct {
+		Format struct {
+			Duration string `json:"duration"`
+		} `json:"format"`
+	}
+	if err := json.Unmarshal(output, &result); err != nil {
+		return 0
+	}
+
+	duration, _ := strconv.ParseFloat(result.Format.Duration, 64)
+	return duration
+}
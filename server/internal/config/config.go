@@ -66,10 +66,17 @@ type AuthConfig struct {
 
 // LibraryConfig holds media library settings
 type LibraryConfig struct {
-	ScanInterval int      `yaml:"scan_interval"` // minutes
-	MetadataLang string   `yaml:"metadata_lang"`
-	TMDBApiKey   string   `yaml:"tmdb_api_key"`
-	TVDBApiKey   string   `yaml:"tvdb_api_key"`
+	ScanInterval   int    `yaml:"scan_interval"` // minutes
+	MetadataLang   string `yaml:"metadata_lang"`
+	TMDBApiKey     string `yaml:"tmdb_api_key"`
+	TVDBApiKey     string `yaml:"tvdb_api_key"`
+	OMDbApiKey     string `yaml:"omdb_api_key"`
+	Watch          bool   `yaml:"watch"`            // rescan folders as files change
+	WatchDelay     int    `yaml:"watch_delay"`      // seconds a folder must be quiet before it is scanned
+	PollInterval   int    `yaml:"poll_interval"`    // minutes between checks of paths that can't be watched
+	DetectMarkers  bool   `yaml:"detect_markers"`   // find the intros and credits of TV episodes and DVR series
+	ScanWorkers    int    `yaml:"scan_workers"`     // files probed at once while scanning
+	ScanIOFriendly bool   `yaml:"scan_io_friendly"` // probe one file per disk at a time, for spinning disks
 }
 
 // LiveTVConfig holds IPTV/Live TV settings
@@ -106,6 +113,8 @@ type TranscodeConfig struct {
 	HardwareAccel     string `yaml:"hardware_accel"` // none, nvenc, qsv, vaapi, videotoolbox
 	TempDir           string `yaml:"temp_dir"`
 	MaxSessions       int    `yaml:"max_sessions"`
+	Trickplay         bool   `yaml:"trickplay"`          // generate seek preview thumbnails while idle
+	TrickplayInterval int    `yaml:"trickplay_interval"` // seconds between preview thumbnails
 }
 
 // DefaultConfig returns configuration with sensible defaults
@@ -132,8 +141,13 @@ func DefaultConfig() *Config {
 			AllowLocalAccess: true, // Allow local network access without login
 		},
 		Library: LibraryConfig{
-			ScanInterval: 60,
-			MetadataLang: "en",
+			ScanInterval:  60,
+			MetadataLang:  "en",
+			Watch:         true,
+			WatchDelay:    10,
+			PollInterval:  5,
+			DetectMarkers: true,
+			ScanWorkers:   4,
 		},
 		LiveTV: LiveTVConfig{
 			Enabled:     true,
@@ -153,11 +167,13 @@ func DefaultConfig() *Config {
 			APIURL:  "", // Must be configured in settings
 		},
 		Transcode: TranscodeConfig{
-			Enabled:       true,
-			FFmpegPath:    "ffmpeg",
-			HardwareAccel: "auto",
-			TempDir:       filepath.Join(dataDir, "transcode"),
-			MaxSessions:   3,
+			Enabled:           true,
+			FFmpegPath:        "ffmpeg",
+			HardwareAccel:     "auto",
+			TempDir:           filepath.Join(dataDir, "transcode"),
+			MaxSessions:       3,
+			Trickplay:         true,
+			TrickplayInterval: 10,
 		},
 		Logging: LoggingConfig{
 			Level:      "debug",
@@ -226,6 +242,20 @@ func loadEnvOverrides(cfg *Config) {
 	if tvdb := os.Getenv("OPENFLIX_TVDB_API_KEY"); tvdb != "" {
 		cfg.Library.TVDBApiKey = tvdb
 	}
+	if omdb := os.Getenv("OPENFLIX_OMDB_API_KEY"); omdb != "" {
+		cfg.Library.OMDbApiKey = omdb
+	}
+	if detectMarkers := os.Getenv("OPENFLIX_DETECT_MARKERS"); detectMarkers != "" {
+		cfg.Library.DetectMarkers = detectMarkers == "true" || detectMarkers == "1"
+	}
+	if scanWorkers := os.Getenv("OPENFLIX_SCAN_WORKERS"); scanWorkers != "" {
+		if n, err := strconv.Atoi(scanWorkers); err == nil {
+			cfg.Library.ScanWorkers = n
+		}
+	}
+	if ioFriendly := os.Getenv("OPENFLIX_SCAN_IO_FRIENDLY"); ioFriendly != "" {
+		cfg.Library.ScanIOFriendly = ioFriendly == "true" || ioFriendly == "1"
+	}
 	if ffmpeg := os.Getenv("OPENFLIX_FFMPEG_PATH"); ffmpeg != "" {
 		cfg.Transcode.FFmpegPath = ffmpeg
 	}
@@ -247,6 +277,9 @@ func loadEnvOverrides(cfg *Config) {
 			cfg.Transcode.MaxSessions = s
 		}
 	}
+	if trickplay := os.Getenv("OPENFLIX_TRICKPLAY"); trickplay != "" {
+		cfg.Transcode.Trickplay = trickplay == "true" || trickplay == "1"
+	}
 	// DVR settings
 	if recordingDir := os.Getenv("OPENFLIX_RECORDING_DIR"); recordingDir != "" {
 		cfg.DVR.RecordingDir = recordingDir
@@ -5,6 +5,7 @@ import (
 
 	"github.com/openflix/openflix-server/internal/config"
 	"github.com/openflix/openflix-server/internal/models"
+	"github.com/openflix/openflix-server/internal/search"
 	"gorm.io/driver/postgres"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
@@ -17,10 +18,13 @@ func Initialize(cfg config.DatabaseConfig) (*gorm.DB, error) {
 
 	switch cfg.Driver {
 	case "sqlite":
-		// Add WAL mode for better concurrent read access during EPG updates
+		// Add WAL mode for better concurrent read access during EPG updates.
+		// Transactions take the write lock when they begin, so one that reads
+		// before writing, like a scan batch, waits for other writers instead
+		// of failing with "database is locked".
 		dsn := cfg.DSN
 		if dsn != "" && dsn != ":memory:" {
-			dsn = dsn + "?_journal_mode=WAL&_busy_timeout=5000"
+			dsn = dsn + "?_journal_mode=WAL&_busy_timeout=5000&_txlock=immediate"
 		}
 		dialector = sqlite.Open(dsn)
 	case "postgres":
@@ -47,7 +51,7 @@ func Initialize(cfg config.DatabaseConfig) (*gorm.DB, error) {
 
 // Migrate runs database migrations
 func Migrate(db *gorm.DB) error {
-	return db.AutoMigrate(
+	err := db.AutoMigrate(
 		// Users
 		&models.User{},
 		&models.UserProfile{},
@@ -62,6 +66,11 @@ func Migrate(db *gorm.DB) error {
 		&models.MediaStream{},
 		&models.Genre{},
 		&models.CastMember{},
+		&models.PhotoExif{},
+		&models.MediaGuid{},
+		&models.MetadataEdit{},
+		&models.MediaMarker{},
+		&models.MediaChapter{},
 
 		// User activity
 		&models.WatchHistory{},
@@ -102,4 +111,10 @@ func Migrate(db *gorm.DB) error {
 		// Settings
 		&models.Setting{},
 	)
+	if err != nil {
+		return err
+	}
+
+	// Full-text search index (FTS5/FTS4 virtual table or tsvector)
+	return search.Migrate(db)
 }
@@ -9,6 +9,7 @@ import (
 
 	"github.com/openflix/openflix-server/internal/metadata"
 	"github.com/openflix/openflix-server/internal/models"
+	"github.com/openflix/openflix-server/internal/search"
 	"github.com/sirupsen/logrus"
 	"gorm.io/gorm"
 )
@@ -254,7 +255,11 @@ func (e *Enricher) enrichMovieRecording(recording *models.Recording, title strin
 	}
 
 	// Save updates
-	return e.db.Save(recording).Error
+	if err := e.db.Save(recording).Error; err != nil {
+		return err
+	}
+	search.IndexRecording(e.db, recording)
+	return nil
 }
 
 // enrichTVRecording fetches TV show metadata from TMDB
@@ -330,7 +335,11 @@ func (e *Enricher) enrichTVRecording(recording *models.Recording, title string,
 		recording.Summary = details.Overview
 	}
 
-	return e.db.Save(recording).Error
+	if err := e.db.Save(recording).Error; err != nil {
+		return err
+	}
+	search.IndexRecording(e.db, recording)
+	return nil
 }
 
 // enrichEpisodeInfo fetches episode-specific metadata
@@ -15,6 +15,7 @@ import (
 
 	"github.com/openflix/openflix-server/internal/logger"
 	"github.com/openflix/openflix-server/internal/models"
+	"github.com/openflix/openflix-server/internal/search"
 	"gorm.io/gorm"
 )
 
@@ -228,7 +229,9 @@ func (r *Recorder) processSeriesRules() {
 				SeriesRuleID: &rule.ID,
 			}
 
-			r.db.Create(&recording)
+			if r.db.Create(&recording).Error == nil {
+				search.IndexRecording(r.db, &recording)
+			}
 		}
 
 		// Clean up old recordings if KeepCount is set
@@ -245,6 +248,7 @@ func (r *Recorder) processSeriesRules() {
 					os.Remove(rec.FilePath)
 				}
 				r.db.Delete(&rec)
+				search.RemoveRecording(r.db, rec.ID)
 			}
 		}
 	}
@@ -339,6 +343,7 @@ func (r *Recorder) processTeamPassesForUser(userID uint) int {
 				logger.Log.Errorf("Failed to create team pass recording: %v", err)
 				continue
 			}
+			search.IndexRecording(r.db, &recording)
 
 			logger.Log.Infof("Team pass scheduled recording: %s on %s at %s",
 				prog.Title, channel.Name, prog.Start.Format("2006-01-02 15:04"))
@@ -361,6 +366,7 @@ func (r *Recorder) processTeamPassesForUser(userID uint) int {
 					os.Remove(rec.FilePath)
 				}
 				r.db.Delete(&rec)
+				search.RemoveRecording(r.db, rec.ID)
 			}
 		}
 	}
@@ -0,0 +1,210 @@
+package library
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/openflix/openflix-server/internal/logger"
+	"github.com/openflix/openflix-server/internal/metadata"
+	"github.com/openflix/openflix-server/internal/models"
+)
+
+// Episode orders of show libraries: how their episode files are numbered
+const (
+	EpisodeOrderAired    = "aired"    // "Show S01E05"
+	EpisodeOrderAbsolute = "absolute" // "[Group] Show - 137 [1080p]", as anime is
+)
+
+var ErrInvalidEpisodeOrder = errors.New("invalid episode order")
+
+// absoluteOrderTTL is how long a show's absolute order is kept
+const absoluteOrderTTL = time.Hour
+
+var (
+	// "[Group]", "[1080p]", "[ABCD1234]", "(BD 1080p)" and a bare "1080p",
+	// but not "(2019)"
+	releaseTagPattern = regexp.MustCompile(`\[[^\]]*\]|\((?:[^)]*[^\d)][^)]*|\d{1,3}|\d{5,})\)|(?i)\b\d{3,4}p\b`)
+	// "Show - 137", "Show - 01v2", "Show - 01-02"
+	absolutePattern = regexp.MustCompile(`(?i)\s-\s*(?:E|EP|#)?(\d{1,4})(?:v\d)?(?:\s*-\s*(\d{1,4})(?:v\d)?)?(?:\s|$)`)
+	// "Show 137" or "Show E7", as a last resort
+	trailingNumberPattern = regexp.MustCompile(`(?i)\s(E|EP|Episode\s*)?(\d{1,4})(?:v\d)?$`)
+	// "Show - OVA", "Show - SP01", "Show Special 2"
+	specialPattern = regexp.MustCompile(`(?i)(?:^|\s|-)(?:OVA|OAD|ONA|SP|Specials?)\s*(\d{1,3})?(?:v\d)?(?:\s|$)`)
+	// A special numbered like an episode: "Show OVA - 02"
+	specialSuffixPattern = regexp.MustCompile(`(?i)\s(?:OVA|OAD|ONA|SP|Specials?)$`)
+	// A number that reads as a year
+	bareYearPattern = regexp.MustCompile(`^(?:19|20)\d{2}$`)
+)
+
+// formatEpisodeOrder checks an episode order, defaulting to aired
+func formatEpisodeOrder(order string) (string, error) {
+	switch strings.ToLower(order) {
+	case "", EpisodeOrderAired:
+		return EpisodeOrderAired, nil
+	case EpisodeOrderAbsolute:
+		return EpisodeOrderAbsolute, nil
+	}
+	return "", ErrInvalidEpisodeOrder
+}
+
+// stripReleaseTags removes the bracketed release group, resolution, codec
+// and checksum tags anime releases carry
+func stripReleaseTags(name string) string {
+	return strings.Join(strings.Fields(releaseTagPattern.ReplaceAllString(name, " ")), " ")
+}
+
+// parseAbsolute reads an absolute episode number or a special from a name
+// with its release tags stripped. Numbered episodes go in season 1 until
+// the show's agent places them; specials go in season 0.
+func parseAbsolute(name string, parsed *ParsedFilename) bool {
+	if m := absolutePattern.FindStringSubmatchIndex(name); m != nil {
+		number, _ := strconv.Atoi(name[m[2]:m[3]])
+		if m[4] >= 0 {
+			parsed.EpisodeEnd, _ = strconv.Atoi(name[m[4]:m[5]])
+		}
+		title := strings.TrimSpace(name[:m[0]])
+		if special := specialSuffixPattern.FindStringIndex(title); special != nil {
+			parsed.Title = strings.TrimSpace(title[:special[0]])
+			parsed.Season, parsed.Episode = 0, number
+			return true
+		}
+		parsed.Title = title
+		parsed.Season, parsed.Episode, parsed.Absolute = 1, number, number
+		return true
+	}
+
+	if m := specialPattern.FindStringSubmatchIndex(name); m != nil && m[0] > 0 {
+		parsed.Title = strings.TrimRight(strings.TrimSpace(name[:m[0]]), " -")
+		parsed.Season, parsed.Episode = 0, 1
+		if m[2] >= 0 {
+			parsed.Episode, _ = strconv.Atoi(name[m[2]:m[3]])
+		}
+		return true
+	}
+
+	// Without a marker a single digit or a year is more likely part of the
+	// title, as in "Rocky 2" or "Blade Runner 2049"
+	if m := trailingNumberPattern.FindStringSubmatchIndex(name); m != nil && m[0] > 0 {
+		digits := name[m[4]:m[5]]
+		if m[2] < 0 && (len(digits) < 2 || bareYearPattern.MatchString(digits)) {
+			return false
+		}
+		number, _ := strconv.Atoi(digits)
+		parsed.Title = strings.TrimSpace(name[:m[0]])
+		parsed.Season, parsed.Episode, parsed.Absolute = 1, number, number
+		return true
+	}
+	return false
+}
+
+// absoluteOrder is a show's absolute episode order as an agent gave it
+type absoluteOrder struct {
+	refs    []metadata.EpisodeRef
+	fetched time.Time
+}
+
+// absoluteEpisode returns the season and episode of a show's absolute episode
+// number, from the first of the library's agents that knows the show's order
+func (s *Scanner) absoluteEpisode(library *models.Library, show *models.MediaItem, absolute int) (metadata.EpisodeRef, bool) {
+	for _, name := range LibraryAgents(library) {
+		agent := s.onlineAgent(name)
+		orderer, ok := agent.(metadata.AbsoluteOrderer)
+		if !ok {
+			continue
+		}
+		showID := s.showID(show, agent)
+		if showID == "" {
+			continue
+		}
+		refs := s.showAbsoluteOrder(name, showID, orderer)
+		if absolute <= len(refs) && refs[absolute-1].Season > 0 {
+			return refs[absolute-1], true
+		}
+	}
+	return metadata.EpisodeRef{}, false
+}
+
+// showAbsoluteOrder fetches a show's absolute order, or returns the one
+// fetched lately. Every episode of a new show asks, so they wait for the
+// first to fetch it.
+func (s *Scanner) showAbsoluteOrder(agent, showID string, orderer metadata.AbsoluteOrderer) []metadata.EpisodeRef {
+	s.orderMu.Lock()
+	defer s.orderMu.Unlock()
+
+	key := agent + ":" + showID
+	if order, ok := s.orders[key]; ok && time.Since(order.fetched) < absoluteOrderTTL {
+		return order.refs
+	}
+
+	refs, err := orderer.AbsoluteOrder(showID)
+	if err != nil {
+		logger.Warnf("%s absolute episode order of show %s failed: %v", strings.ToUpper(agent), showID, err)
+	}
+	if s.orders == nil {
+		s.orders = make(map[string]*absoluteOrder)
+	}
+	s.orders[key] = &absoluteOrder{refs: refs, fetched: time.Now()}
+	return refs
+}
+
+// placeAbsoluteEpisode moves an episode numbered from the start of its show
+// to the season and episode its agent gives, and returns its season
+func (s *Scanner) placeAbsoluteEpisode(library *models.Library, show, season, episode *models.MediaItem, filePath string) *models.MediaItem {
+	if library.EpisodeOrder != EpisodeOrderAbsolute || episode.AbsoluteIndex <= 0 {
+		return season
+	}
+	ref, ok := s.absoluteEpisode(library, show, episode.AbsoluteIndex)
+	if !ok || (ref.Season == season.Index && ref.Episode == episode.Index) {
+		return season
+	}
+
+	s.placeMu.Lock()
+	defer s.placeMu.Unlock()
+
+	target, err := s.findOrCreateSeason(library, show, ref.Season, filePath)
+	if err != nil {
+		logger.Warnf("Failed to place episode %d of %s: %v", episode.AbsoluteIndex, show.Title, err)
+		return season
+	}
+	err = s.db.Model(episode).Updates(map[string]interface{}{
+		"parent_id": target.ID,
+		"index":     ref.Episode,
+	}).Error
+	if err != nil {
+		logger.Warnf("Failed to place episode %d of %s: %v", episode.AbsoluteIndex, show.Title, err)
+		return season
+	}
+	episode.ParentID = &target.ID
+	episode.Index = ref.Episode
+
+	// The season the episode was waiting in goes once it's empty
+	var left int64
+	s.db.Model(&models.MediaItem{}).Where("parent_id = ? AND type = ?", season.ID, "episode").Count(&left)
+	if left == 0 {
+		s.removeItemIfEmpty(season.ID)
+	}
+	return target
+}
+
+// placeAbsoluteEpisodes places the episodes of a show numbered from its start
+func (s *Scanner) placeAbsoluteEpisodes(library *models.Library, show *models.MediaItem) {
+	if library.EpisodeOrder != EpisodeOrderAbsolute {
+		return
+	}
+
+	var episodes []models.MediaItem
+	s.db.Where("grandparent_id = ? AND type = ? AND absolute_index > 0", show.ID, "episode").Order("absolute_index").Find(&episodes)
+	for i := range episodes {
+		episode := &episodes[i]
+		var season models.MediaItem
+		var file models.MediaFile
+		if episode.ParentID == nil || s.db.First(&season, *episode.ParentID).Error != nil ||
+			s.db.Where("media_item_id = ?", episode.ID).First(&file).Error != nil {
+			continue
+		}
+		s.placeAbsoluteEpisode(library, show, &season, episode, file.FilePath)
+	}
+}
@@ -0,0 +1,38 @@
+package library
+
+import "testing"
+
+func TestParseAbsolute(t *testing.T) {
+	tests := []struct {
+		name     string
+		stripped string
+		ok       bool
+		want     ParsedFilename
+	}{
+		{"[Group] Show - 137 [1080p]", "Show - 137", true, ParsedFilename{Title: "Show", Season: 1, Episode: 137, Absolute: 137}},
+		{"[Group] Show - 01v2 [ABCD1234]", "Show - 01v2", true, ParsedFilename{Title: "Show", Season: 1, Episode: 1, Absolute: 1}},
+		{"Show - 01-02 (BD 1080p)", "Show - 01-02", true, ParsedFilename{Title: "Show", Season: 1, Episode: 1, EpisodeEnd: 2, Absolute: 1}},
+		{"[Group] Show - OVA", "Show - OVA", true, ParsedFilename{Title: "Show", Season: 0, Episode: 1}},
+		{"Show - SP01 [720p]", "Show - SP01", true, ParsedFilename{Title: "Show", Season: 0, Episode: 1}},
+		{"Show OVA - 02", "Show OVA - 02", true, ParsedFilename{Title: "Show", Season: 0, Episode: 2}},
+		{"[Group] Show (2019) - 05", "Show (2019) - 05", true, ParsedFilename{Title: "Show (2019)", Season: 1, Episode: 5, Absolute: 5}},
+		{"Show 137", "Show 137", true, ParsedFilename{Title: "Show", Season: 1, Episode: 137, Absolute: 137}},
+		{"Show E7 1080p", "Show E7", true, ParsedFilename{Title: "Show", Season: 1, Episode: 7, Absolute: 7}},
+		{"Show (2019)", "Show (2019)", false, ParsedFilename{}},
+		{"Show 2019", "Show 2019", false, ParsedFilename{}},
+		{"Blade Runner 2049", "Blade Runner 2049", false, ParsedFilename{}},
+		{"Rocky 2", "Rocky 2", false, ParsedFilename{}},
+	}
+	for _, tt := range tests {
+		stripped := stripReleaseTags(tt.name)
+		if stripped != tt.stripped {
+			t.Errorf("stripReleaseTags(%q) = %q, want %q", tt.name, stripped, tt.stripped)
+			continue
+		}
+		var parsed ParsedFilename
+		ok := parseAbsolute(stripped, &parsed)
+		if ok != tt.ok || parsed != tt.want {
+			t.Errorf("parseAbsolute(%q) = %+v, %v, want %+v, %v", stripped, parsed, ok, tt.want, tt.ok)
+		}
+	}
+}
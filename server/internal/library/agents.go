@@ -0,0 +1,441 @@
+package library
+
+import (
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/openflix/openflix-server/internal/logger"
+	"github.com/openflix/openflix-server/internal/metadata"
+	"github.com/openflix/openflix-server/internal/models"
+)
+
+// Metadata agents a library can use
+const (
+	AgentLocal = "local" // .nfo files and artwork next to the media
+	AgentTMDB  = "tmdb"
+	AgentTVDB  = "tvdb"
+	AgentOMDb  = "omdb"
+)
+
+// DefaultAgents is the agent order of libraries that don't choose one. Online
+// agents without an API key are skipped.
+var DefaultAgents = []string{AgentLocal, AgentTMDB, AgentTVDB, AgentOMDb}
+
+var knownAgents = map[string]bool{AgentLocal: true, AgentTMDB: true, AgentTVDB: true, AgentOMDb: true}
+
+// DefaultMergeRules keep the titles of movies and shows as they were scanned
+// or as their .nfo gives them
+var DefaultMergeRules = map[string][]string{
+	"movie.title": {AgentLocal},
+	"show.title":  {AgentLocal},
+}
+
+// Item types a merge rule can be limited to, as in "episode.title"
+var ruleTypes = map[string]bool{"movie": true, "show": true, "season": true, "episode": true}
+
+// Season folders between a show folder and its episodes
+var seasonFolderPattern = regexp.MustCompile(`(?i)^(season|series|staffel|saison|s)[\s._-]*\d+$|^specials$`)
+
+// LibraryAgents returns a library's metadata agents, highest priority first
+func LibraryAgents(library *models.Library) []string {
+	if library.Agents == "" {
+		return DefaultAgents
+	}
+	return strings.Split(library.Agents, ",")
+}
+
+// LibraryRules returns the agents each field is taken from, by field name or
+// by item type and field name. Fields without a rule follow the library's
+// agent order.
+func LibraryRules(library *models.Library) map[string][]string {
+	rules := make(map[string][]string, len(DefaultMergeRules))
+	for key, agents := range DefaultMergeRules {
+		rules[key] = agents
+	}
+	if library.AgentRules != "" {
+		var custom map[string][]string
+		if err := json.Unmarshal([]byte(library.AgentRules), &custom); err == nil {
+			for key, agents := range custom {
+				rules[key] = agents
+			}
+		}
+	}
+	return rules
+}
+
+// formatAgents validates an agent order and returns it as stored
+func formatAgents(agents []string) (string, error) {
+	seen := make(map[string]bool, len(agents))
+	var order []string
+	for _, agent := range agents {
+		agent = strings.ToLower(strings.TrimSpace(agent))
+		if !knownAgents[agent] {
+			return "", ErrInvalidAgent
+		}
+		if !seen[agent] {
+			seen[agent] = true
+			order = append(order, agent)
+		}
+	}
+	return strings.Join(order, ","), nil
+}
+
+// formatRules validates merge rules and returns them as stored
+func formatRules(rules map[string][]string) (string, error) {
+	if len(rules) == 0 {
+		return "", nil
+	}
+
+	fields := make(map[string]bool, len(metadata.Fields))
+	for _, field := range metadata.Fields {
+		fields[field] = true
+	}
+
+	clean := make(map[string][]string, len(rules))
+	for key, agents := range rules {
+		key = strings.ToLower(strings.TrimSpace(key))
+		field := key
+		if itemType, name, ok := strings.Cut(key, "."); ok {
+			if !ruleTypes[itemType] {
+				return "", ErrInvalidRule
+			}
+			field = name
+		}
+		if !fields[field] {
+			return "", ErrInvalidRule
+		}
+		order, err := formatAgents(agents)
+		if err != nil {
+			return "", err
+		}
+		clean[key] = strings.Split(order, ",")
+	}
+
+	data, err := json.Marshal(clean)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// SetAgent adds an online metadata agent, replacing any with the same name
+func (s *Scanner) SetAgent(agent metadata.MetadataAgent) {
+	s.agentMu.Lock()
+	defer s.agentMu.Unlock()
+	if s.agents == nil {
+		s.agents = make(map[string]metadata.MetadataAgent)
+	}
+	s.agents[agent.Name()] = agent
+}
+
+// onlineAgent returns a configured online agent, or nil
+func (s *Scanner) onlineAgent(name string) metadata.MetadataAgent {
+	s.agentMu.RLock()
+	defer s.agentMu.RUnlock()
+	agent := s.agents[name]
+	if agent == nil || !agent.IsConfigured() {
+		return nil
+	}
+	return agent
+}
+
+// remoteLookup fetches an item from an online agent, given the IDs known so
+// far by provider. A nil result means the agent can't tell.
+type remoteLookup func(agent metadata.MetadataAgent, ids map[string]string) (*metadata.Result, error)
+
+// runAgents applies a library's agents to an item. Each field is taken from
+// the first agent that knows it, in the order of the library's merge rules.
+func (s *Scanner) runAgents(library *models.Library, item *models.MediaItem, local func() *metadata.Result, remote remoteLookup) {
+	agents := LibraryAgents(library)
+	ids := metadata.GuidMap(metadata.ItemGuids(s.db, item.ID))
+	results := make(map[string]*metadata.Result, len(agents))
+
+	// Local files come first whatever their priority: an .nfo's IDs let the
+	// online agents look the item up directly
+	if local != nil && hasAgent(agents, AgentLocal) {
+		if result := local(); result != nil {
+			results[AgentLocal] = result
+			for provider, id := range metadata.GuidMap(result.Guids) {
+				ids[provider] = id
+			}
+			if result.Title != "" {
+				// Search by the title the .nfo gives
+				item.Title = result.Title
+			}
+		}
+	}
+
+	for _, name := range agents {
+		agent := s.onlineAgent(name)
+		if agent == nil || remote == nil {
+			continue
+		}
+		result, err := remote(agent, ids)
+		if err != nil {
+			logger.Warnf("%s metadata for %s failed: %v", strings.ToUpper(name), item.Title, err)
+			continue
+		}
+		if result == nil {
+			continue
+		}
+		results[name] = result
+		// IDs found by one agent let the next look the item up directly
+		for provider, id := range metadata.GuidMap(result.Guids) {
+			if _, ok := ids[provider]; !ok {
+				ids[provider] = id
+			}
+		}
+	}
+
+	if len(results) > 0 {
+		rules := LibraryRules(library)
+		merged := metadata.Merge(results, func(field string) []string {
+			if order, ok := rules[item.Type+"."+field]; ok {
+				return order
+			}
+			if order, ok := rules[field]; ok {
+				return order
+			}
+			return agents
+		})
+		if err := metadata.ApplyResult(s.db, item, merged); err != nil {
+			logger.Warnf("Failed to save metadata for %s: %v", item.Title, err)
+		}
+
+		if tmdb, ok := s.onlineAgent(AgentTMDB).(*metadata.TMDBAgent); ok && item.Type == "movie" && results[AgentTMDB] != nil {
+			tmdb.SyncCollection(item, results[AgentTMDB])
+		}
+	}
+	s.local.PruneArtwork(item)
+}
+
+// hasAgent reports whether an agent is in a list
+func hasAgent(agents []string, agent string) bool {
+	for _, a := range agents {
+		if a == agent {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteItem looks a movie or show up by a known ID, or else by title
+func remoteItem(kind string, item *models.MediaItem) remoteLookup {
+	return func(agent metadata.MetadataAgent, ids map[string]string) (*metadata.Result, error) {
+		id := ids[agent.Provider()]
+		if id == "" {
+			matches, err := agent.Search(kind, item.Title, item.Year)
+			if err != nil {
+				return nil, err
+			}
+			if len(matches) == 0 {
+				return nil, errors.New("no results found")
+			}
+			id = matches[0].ID
+		}
+		return metadata.Lookup(agent, kind, id)
+	}
+}
+
+// showID returns a show's ID with an agent, or "" when the agent hasn't
+// matched the show
+func (s *Scanner) showID(show *models.MediaItem, agent metadata.MetadataAgent) string {
+	return metadata.GuidMap(metadata.ItemGuids(s.db, show.ID))[agent.Provider()]
+}
+
+// markShowPending records that a new show's metadata is being fetched. Its
+// seasons and episodes wait for it, since they are looked up by the show's
+// IDs.
+func (s *Scanner) markShowPending(showID uint) {
+	s.pendingMu.Lock()
+	defer s.pendingMu.Unlock()
+	if s.pendingShows == nil {
+		s.pendingShows = make(map[uint]bool)
+	}
+	s.pendingShows[showID] = true
+}
+
+func (s *Scanner) clearShowPending(showID uint) {
+	s.pendingMu.Lock()
+	defer s.pendingMu.Unlock()
+	delete(s.pendingShows, showID)
+}
+
+func (s *Scanner) showPending(showID uint) bool {
+	s.pendingMu.Lock()
+	defer s.pendingMu.Unlock()
+	return s.pendingShows[showID]
+}
+
+// inBackground runs a metadata fetch in the background once the items it is
+// for are written, keeping count of the fetches still running for each
+// library so its scans can report on them
+func (s *Scanner) inBackground(library *models.Library, fetch func(s *Scanner)) {
+	libraryID := library.ID
+	s.afterWrite(func(s *Scanner) {
+		s.addMetadataPending(libraryID, 1)
+		go func() {
+			defer s.addMetadataPending(libraryID, -1)
+			fetch(s)
+		}()
+	})
+}
+
+// addMetadataPending counts metadata fetches of a library starting or ending
+func (s *Scanner) addMetadataPending(libraryID uint, n int64) {
+	s.metadataMu.Lock()
+	defer s.metadataMu.Unlock()
+	if s.metadataPending == nil {
+		s.metadataPending = make(map[uint]int64)
+	}
+	if s.metadataPending[libraryID] += n; s.metadataPending[libraryID] <= 0 {
+		delete(s.metadataPending, libraryID)
+	}
+}
+
+// pendingMetadata is the number of metadata fetches of a library still running
+func (s *Scanner) pendingMetadata(libraryID uint) int64 {
+	s.metadataMu.Lock()
+	defer s.metadataMu.Unlock()
+	return s.metadataPending[libraryID]
+}
+
+// fetchMovieMetadata fetches metadata for a new movie in the background
+func (s *Scanner) fetchMovieMetadata(library *models.Library, item *models.MediaItem, filePath string) {
+	s.inBackground(library, func(s *Scanner) { s.updateMovieMetadata(library, item, filePath) })
+}
+
+func (s *Scanner) updateMovieMetadata(library *models.Library, item *models.MediaItem, filePath string) {
+	s.runAgents(library, item, func() *metadata.Result {
+		return s.local.MovieResult(item, s.local.MovieNFO(filePath), filePath)
+	}, remoteItem(metadata.KindMovie, item))
+}
+
+// fetchShowMetadata fetches metadata for a new show, and then its seasons and
+// episodes, in the background
+func (s *Scanner) fetchShowMetadata(library *models.Library, show *models.MediaItem, filePath string) {
+	s.markShowPending(show.ID)
+	showDir := showDirectory(filePath)
+	s.inBackground(library, func(s *Scanner) { s.updateShowMetadata(library, show, showDir) })
+}
+
+func (s *Scanner) updateShowMetadata(library *models.Library, show *models.MediaItem, showDir string) {
+	s.runAgents(library, show, func() *metadata.Result {
+		return s.local.ShowResult(show, s.local.ShowNFO(showDir), showDir)
+	}, remoteItem(metadata.KindShow, show))
+
+	// Seasons and episodes added from here on fetch their own metadata
+	s.clearShowPending(show.ID)
+	s.updateShowChildren(library, show, showDir)
+}
+
+// updateShowChildren fetches metadata for a show's seasons and episodes
+func (s *Scanner) updateShowChildren(library *models.Library, show *models.MediaItem, showDir string) {
+	// With the show matched, episodes numbered from its start can be placed
+	s.placeAbsoluteEpisodes(library, show)
+
+	var seasons []models.MediaItem
+	s.db.Where("parent_id = ? AND type = ?", show.ID, "season").Order("id").Find(&seasons)
+	for i := range seasons {
+		season := &seasons[i]
+		seasonDir := showDir
+
+		var episodes []models.MediaItem
+		s.db.Where("parent_id = ? AND type = ?", season.ID, "episode").Order("id").Find(&episodes)
+		for j := range episodes {
+			var file models.MediaFile
+			if err := s.db.Where("media_item_id = ?", episodes[j].ID).First(&file).Error; err != nil {
+				continue
+			}
+			seasonDir = filepath.Dir(file.FilePath)
+			s.updateEpisodeMetadata(library, show, season, &episodes[j], file.FilePath)
+		}
+		s.updateSeasonMetadata(library, show, season, showDir, seasonDir)
+	}
+}
+
+// fetchSeasonMetadata fetches metadata for a new season of a known show in
+// the background
+func (s *Scanner) fetchSeasonMetadata(library *models.Library, show, season *models.MediaItem, filePath string) {
+	if s.showPending(show.ID) {
+		return
+	}
+	s.inBackground(library, func(s *Scanner) {
+		s.updateSeasonMetadata(library, show, season, showDirectory(filePath), filepath.Dir(filePath))
+	})
+}
+
+func (s *Scanner) updateSeasonMetadata(library *models.Library, show, season *models.MediaItem, showDir, seasonDir string) {
+	s.runAgents(library, season, func() *metadata.Result {
+		return s.local.SeasonResult(season, showDir, seasonDir)
+	}, func(agent metadata.MetadataAgent, _ map[string]string) (*metadata.Result, error) {
+		showID := s.showID(show, agent)
+		if showID == "" {
+			return nil, nil
+		}
+		return agent.Season(showID, season.Index)
+	})
+}
+
+// fetchEpisodeMetadata fetches metadata for a new episode of a known show in
+// the background
+func (s *Scanner) fetchEpisodeMetadata(library *models.Library, show, season, episode *models.MediaItem, filePath string) {
+	if s.showPending(show.ID) {
+		return
+	}
+	s.inBackground(library, func(s *Scanner) { s.updateEpisodeMetadata(library, show, season, episode, filePath) })
+}
+
+func (s *Scanner) updateEpisodeMetadata(library *models.Library, show, season, episode *models.MediaItem, filePath string) {
+	season = s.placeAbsoluteEpisode(library, show, season, episode, filePath)
+	s.runAgents(library, episode, func() *metadata.Result {
+		return s.local.EpisodeResult(episode, s.local.EpisodeNFO(filePath, episode.Index), filePath)
+	}, func(agent metadata.MetadataAgent, _ map[string]string) (*metadata.Result, error) {
+		showID := s.showID(show, agent)
+		if showID == "" {
+			return nil, nil
+		}
+		return agent.Episode(showID, season.Index, episode.Index)
+	})
+}
+
+// RefreshMetadata runs a library's agents again for a movie or show, and a
+// show's seasons and episodes
+func (s *Scanner) RefreshMetadata(item *models.MediaItem) error {
+	var library models.Library
+	if err := s.db.First(&library, item.LibraryID).Error; err != nil {
+		return err
+	}
+
+	switch item.Type {
+	case "movie":
+		var file models.MediaFile
+		if err := s.db.Where("media_item_id = ?", item.ID).First(&file).Error; err != nil {
+			return err
+		}
+		s.updateMovieMetadata(&library, item, file.FilePath)
+	case "show":
+		var file models.MediaFile
+		if err := s.db.Joins("JOIN media_items ON media_items.id = media_files.media_item_id").
+			Where("media_items.grandparent_id = ?", item.ID).
+			First(&file).Error; err != nil {
+			return err
+		}
+		s.updateShowMetadata(&library, item, showDirectory(file.FilePath))
+	default:
+		return errors.New("metadata can only be refreshed for movies and shows")
+	}
+	return nil
+}
+
+// showDirectory returns the folder of the show an episode file belongs to
+func showDirectory(filePath string) string {
+	dir := filepath.Dir(filePath)
+	if seasonFolderPattern.MatchString(filepath.Base(dir)) {
+		return filepath.Dir(dir)
+	}
+	return dir
+}
@@ -0,0 +1,105 @@
+package library
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+
+	"github.com/openflix/openflix-server/internal/logger"
+	"github.com/openflix/openflix-server/internal/models"
+)
+
+// ChapterInfo is a chapter as ffprobe reports it
+type ChapterInfo struct {
+	Title string
+	Start int64 // milliseconds
+	End   int64 // milliseconds
+}
+
+// chapterThumbWidth is the width chapter thumbnails are extracted at
+const chapterThumbWidth = 320
+
+// ChapterThumbDir is where the chapter thumbnails of a media file are kept
+func ChapterThumbDir(dataDir string, fileID uint) string {
+	return filepath.Join(dataDir, "chapters", strconv.FormatUint(uint64(fileID), 10))
+}
+
+// ChapterThumbPath is where the thumbnail of a chapter is kept
+func ChapterThumbPath(dataDir string, fileID uint, index int) string {
+	return filepath.Join(ChapterThumbDir(dataDir, fileID), fmt.Sprintf("%d.jpg", index))
+}
+
+// createChapters stores the chapters of a file. Thumbnails of video chapters
+// are extracted in the background.
+func (s *Scanner) createChapters(file *models.MediaFile, mediaInfo MediaInfo) {
+	if len(mediaInfo.Chapters) == 0 {
+		return
+	}
+
+	chapters := make([]models.MediaChapter, len(mediaInfo.Chapters))
+	for i, chapter := range mediaInfo.Chapters {
+		title := chapter.Title
+		if title == "" {
+			title = fmt.Sprintf("Chapter %d", i+1)
+		}
+		chapters[i] = models.MediaChapter{
+			MediaFileID: file.ID,
+			Index:       i + 1,
+			Title:       title,
+			StartTime:   chapter.Start,
+			EndTime:     chapter.End,
+		}
+	}
+	if err := s.db.Create(&chapters).Error; err != nil {
+		logger.Warnf("Failed to save chapters of %s: %v", file.FilePath, err)
+		return
+	}
+
+	if mediaInfo.VideoCodec != "" {
+		s.afterWrite(func(s *Scanner) {
+			go s.extractChapterThumbs(file.ID, file.FilePath, chapters)
+		})
+	}
+}
+
+// extractChapterThumbs saves a frame of each chapter, taken a little way in
+// to get past the fade many chapters open with
+func (s *Scanner) extractChapterThumbs(fileID uint, filePath string, chapters []models.MediaChapter) {
+	s.chapterMu.Lock()
+	defer s.chapterMu.Unlock()
+
+	if err := os.MkdirAll(ChapterThumbDir(s.dataDir, fileID), 0755); err != nil {
+		return
+	}
+	for i := range chapters {
+		chapter := &chapters[i]
+		offset := (chapter.EndTime - chapter.StartTime) / 2
+		if offset > 10000 {
+			offset = 10000
+		}
+
+		cmd := exec.Command(s.ffmpegBin,
+			"-y", "-v", "quiet",
+			"-ss", fmt.Sprintf("%.3f", float64(chapter.StartTime+offset)/1000),
+			"-i", filePath,
+			"-frames:v", "1",
+			"-vf", fmt.Sprintf("scale=%d:-2", chapterThumbWidth),
+			"-q:v", "4",
+			ChapterThumbPath(s.dataDir, fileID, chapter.Index),
+		)
+		if err := cmd.Run(); err != nil {
+			logger.Debugf("Failed to extract thumbnail of chapter %d of %s: %v", chapter.Index, filePath, err)
+			continue
+		}
+		thumb := fmt.Sprintf("/library/parts/%d/chapters/%d/thumb", fileID, chapter.Index)
+		s.db.Model(chapter).Update("thumb", thumb)
+	}
+}
+
+// removeChapters deletes the chapters of a file and their thumbnails
+func (s *Scanner) removeChapters(fileID uint) {
+	s.db.Where("media_file_id = ?", fileID).Delete(&models.MediaChapter{})
+	os.RemoveAll(ChapterThumbDir(s.dataDir, fileID))
+}
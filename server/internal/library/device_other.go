@@ -0,0 +1,10 @@
+//go:build !unix
+
+package library
+
+import "os"
+
+// Files can't be told apart by device here, so they all count as one disk
+func fileDevice(info os.FileInfo) uint64 {
+	return 0
+}
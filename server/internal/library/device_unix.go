@@ -0,0 +1,16 @@
+//go:build unix
+
+package library
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileDevice returns the device a file is stored on
+func fileDevice(info os.FileInfo) uint64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Dev)
+	}
+	return 0
+}
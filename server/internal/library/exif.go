@@ -0,0 +1,300 @@
+package library
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/openflix/openflix-server/internal/models"
+)
+
+// EXIF lives in a TIFF structure: at the start of TIFF-based RAW files, after
+// an "Exif\0\0" marker in JPEG APP1 segments and HEIC items, or in a PNG eXIf
+// chunk. The metadata is close to the start of the file in practice, so only
+// the first exifReadLimit bytes are read.
+const exifReadLimit = 1 << 20
+
+var errNoExif = errors.New("no EXIF data")
+
+// TIFF tags read from the main, EXIF and GPS directories
+const (
+	tagMake             = 0x010F
+	tagModel            = 0x0110
+	tagOrientation      = 0x0112
+	tagDateTime         = 0x0132
+	tagExifIFD          = 0x8769
+	tagGPSIFD           = 0x8825
+	tagExposureTime     = 0x829A
+	tagFNumber          = 0x829D
+	tagISO              = 0x8827
+	tagDateTimeOriginal = 0x9003
+	tagOffsetOriginal   = 0x9011
+	tagFocalLength      = 0x920A
+	tagPixelWidth       = 0xA002
+	tagPixelHeight      = 0xA003
+	tagLensModel        = 0xA434
+	tagGPSLatitudeRef   = 0x0001
+	tagGPSLatitude      = 0x0002
+	tagGPSLongitudeRef  = 0x0003
+	tagGPSLongitude     = 0x0004
+	tagGPSAltitudeRef   = 0x0005
+	tagGPSAltitude      = 0x0006
+)
+
+// tiffEntry is a directory entry with its value bytes resolved
+type tiffEntry struct {
+	typ  uint16
+	data []byte
+}
+
+// tiffReader decodes directory entries from a TIFF block
+type tiffReader struct {
+	buf   []byte
+	order binary.ByteOrder
+}
+
+// Photo dimensions are not part of models.PhotoExif and are returned separately
+type exifResult struct {
+	models.PhotoExif
+	Width  int
+	Height int
+}
+
+// readExif reads the EXIF data of a photo
+func readExif(filePath string) (*exifResult, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(io.LimitReader(f, exifReadLimit))
+	if err != nil {
+		return nil, err
+	}
+
+	tiff := findTIFF(data)
+	if tiff == nil {
+		return nil, errNoExif
+	}
+	return parseTIFF(tiff)
+}
+
+// findTIFF locates the TIFF block holding the EXIF data
+func findTIFF(data []byte) []byte {
+	if isTIFFHeader(data) {
+		return data
+	}
+	if i := bytes.Index(data, []byte("Exif\x00\x00")); i >= 0 && isTIFFHeader(data[i+6:]) {
+		return data[i+6:]
+	}
+	if i := bytes.Index(data, []byte("eXIf")); i >= 0 && isTIFFHeader(data[i+4:]) {
+		return data[i+4:]
+	}
+	// Canon CR3 and other ISO media based RAW formats embed a bare TIFF
+	// block. Elsewhere the same bytes may just be image data.
+	if len(data) < 8 || string(data[4:8]) != "ftyp" {
+		return nil
+	}
+	for _, header := range [][]byte{[]byte("II*\x00"), []byte("MM\x00*")} {
+		if i := bytes.Index(data, header); i >= 0 && isTIFFHeader(data[i:]) {
+			return data[i:]
+		}
+	}
+	return nil
+}
+
+func isTIFFHeader(b []byte) bool {
+	return len(b) >= 8 && (bytes.HasPrefix(b, []byte("II*\x00")) || bytes.HasPrefix(b, []byte("MM\x00*")))
+}
+
+// parseTIFF reads the tags we care about from a TIFF block
+func parseTIFF(buf []byte) (*exifResult, error) {
+	r := &tiffReader{buf: buf, order: binary.LittleEndian}
+	if buf[0] == 'M' {
+		r.order = binary.BigEndian
+	}
+
+	ifd0 := r.readIFD(r.order.Uint32(buf[4:8]))
+	if len(ifd0) == 0 {
+		return nil, errNoExif
+	}
+
+	result := &exifResult{}
+	result.Make = r.str(ifd0[tagMake])
+	result.Model = strings.TrimSpace(strings.TrimPrefix(r.str(ifd0[tagModel]), result.Make+" "))
+	result.Orientation = int(r.uint(ifd0[tagOrientation]))
+
+	var exif map[uint16]tiffEntry
+	if e, ok := ifd0[tagExifIFD]; ok {
+		exif = r.readIFD(r.uint(e))
+	}
+
+	taken := r.str(exif[tagDateTimeOriginal])
+	if taken == "" {
+		taken = r.str(ifd0[tagDateTime])
+	}
+	if t, ok := parseExifTime(taken, r.str(exif[tagOffsetOriginal])); ok {
+		result.TakenAt = &t
+	}
+
+	result.Lens = r.str(exif[tagLensModel])
+	result.ISO = int(r.uint(exif[tagISO]))
+	result.Width = int(r.uint(exif[tagPixelWidth]))
+	result.Height = int(r.uint(exif[tagPixelHeight]))
+	if v, ok := r.rational(exif[tagFNumber], 0); ok {
+		result.FNumber = math.Round(v*10) / 10
+	}
+	if v, ok := r.rational(exif[tagFocalLength], 0); ok {
+		result.FocalLength = math.Round(v*10) / 10
+	}
+	if e, ok := exif[tagExposureTime]; ok && len(e.data) >= 8 {
+		num, den := r.order.Uint32(e.data[0:4]), r.order.Uint32(e.data[4:8])
+		switch {
+		case num == 0 || den == 0:
+		case num >= den:
+			result.ExposureTime = fmt.Sprintf("%g", float64(num)/float64(den))
+		default:
+			result.ExposureTime = fmt.Sprintf("1/%d", int(math.Round(float64(den)/float64(num))))
+		}
+	}
+
+	if e, ok := ifd0[tagGPSIFD]; ok {
+		gps := r.readIFD(r.uint(e))
+		if lat, ok := r.coordinate(gps[tagGPSLatitude], r.str(gps[tagGPSLatitudeRef]) == "S"); ok {
+			if lon, ok := r.coordinate(gps[tagGPSLongitude], r.str(gps[tagGPSLongitudeRef]) == "W"); ok {
+				result.Latitude, result.Longitude = &lat, &lon
+			}
+		}
+		if alt, ok := r.rational(gps[tagGPSAltitude], 0); ok {
+			if ref := gps[tagGPSAltitudeRef]; len(ref.data) > 0 && ref.data[0] == 1 {
+				alt = -alt
+			}
+			result.Altitude = &alt
+		}
+	}
+
+	return result, nil
+}
+
+// readIFD reads the entries of the directory at offset
+func (r *tiffReader) readIFD(offset uint32) map[uint16]tiffEntry {
+	entries := make(map[uint16]tiffEntry)
+	if offset == 0 || int(offset)+2 > len(r.buf) {
+		return entries
+	}
+
+	count := int(r.order.Uint16(r.buf[offset:]))
+	for i := 0; i < count; i++ {
+		pos := int(offset) + 2 + i*12
+		if pos+12 > len(r.buf) {
+			break
+		}
+		entry := r.buf[pos : pos+12]
+		tag := r.order.Uint16(entry[0:2])
+		typ := r.order.Uint16(entry[2:4])
+		n := r.order.Uint32(entry[4:8])
+
+		size := typeSize(typ) * int(n)
+		if size <= 0 || size > len(r.buf) {
+			continue
+		}
+		var data []byte
+		if size <= 4 {
+			data = entry[8 : 8+size]
+		} else {
+			start := int(r.order.Uint32(entry[8:12]))
+			if start+size > len(r.buf) {
+				continue
+			}
+			data = r.buf[start : start+size]
+		}
+		entries[tag] = tiffEntry{typ: typ, data: data}
+	}
+	return entries
+}
+
+// typeSize returns the size in bytes of one value of a TIFF field type
+func typeSize(typ uint16) int {
+	switch typ {
+	case 1, 2, 6, 7: // BYTE, ASCII, SBYTE, UNDEFINED
+		return 1
+	case 3, 8: // SHORT, SSHORT
+		return 2
+	case 4, 9, 11: // LONG, SLONG, FLOAT
+		return 4
+	case 5, 10, 12: // RATIONAL, SRATIONAL, DOUBLE
+		return 8
+	}
+	return 0
+}
+
+func (r *tiffReader) str(e tiffEntry) string {
+	if e.typ != 2 {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimRight(string(e.data), "\x00"))
+}
+
+func (r *tiffReader) uint(e tiffEntry) uint32 {
+	switch {
+	case e.typ == 3 && len(e.data) >= 2:
+		return uint32(r.order.Uint16(e.data))
+	case (e.typ == 4 || e.typ == 9) && len(e.data) >= 4:
+		return r.order.Uint32(e.data)
+	case e.typ == 1 && len(e.data) >= 1:
+		return uint32(e.data[0])
+	}
+	return 0
+}
+
+// rational returns the i-th value of a RATIONAL or SRATIONAL field
+func (r *tiffReader) rational(e tiffEntry, i int) (float64, bool) {
+	if (e.typ != 5 && e.typ != 10) || len(e.data) < (i+1)*8 {
+		return 0, false
+	}
+	num, den := r.order.Uint32(e.data[i*8:]), r.order.Uint32(e.data[i*8+4:])
+	if den == 0 {
+		return 0, false
+	}
+	if e.typ == 10 {
+		return float64(int32(num)) / float64(int32(den)), true
+	}
+	return float64(num) / float64(den), true
+}
+
+// coordinate converts degrees, minutes and seconds to decimal degrees
+func (r *tiffReader) coordinate(e tiffEntry, negative bool) (float64, bool) {
+	deg, ok1 := r.rational(e, 0)
+	mins, ok2 := r.rational(e, 1)
+	sec, ok3 := r.rational(e, 2)
+	if !ok1 || !ok2 || !ok3 {
+		return 0, false
+	}
+	value := deg + mins/60 + sec/3600
+	if negative {
+		value = -value
+	}
+	return value, true
+}
+
+// parseExifTime parses "2006:01:02 15:04:05". EXIF times are local to the
+// camera; the offset tag is used when the camera recorded one.
+func parseExifTime(value, offset string) (time.Time, bool) {
+	if value == "" || strings.HasPrefix(value, "0000") {
+		return time.Time{}, false
+	}
+	if offset != "" {
+		if t, err := time.Parse("2006:01:02 15:04:05-07:00", value+offset); err == nil {
+			return t, true
+		}
+	}
+	t, err := time.ParseInLocation("2006:01:02 15:04:05", value, time.Local)
+	return t, err == nil
+}
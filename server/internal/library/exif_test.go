@@ -0,0 +1,70 @@
+package library
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// tiffBlock is a little-endian TIFF block with one directory holding the
+// orientation
+func tiffBlock(orientation uint16) []byte {
+	var b bytes.Buffer
+	b.WriteString("II*\x00")
+	binary.Write(&b, binary.LittleEndian, uint32(8)) // first directory
+	binary.Write(&b, binary.LittleEndian, uint16(1)) // one entry
+	binary.Write(&b, binary.LittleEndian, uint16(tagOrientation))
+	binary.Write(&b, binary.LittleEndian, uint16(3)) // SHORT
+	binary.Write(&b, binary.LittleEndian, uint32(1))
+	binary.Write(&b, binary.LittleEndian, uint32(orientation))
+	binary.Write(&b, binary.LittleEndian, uint32(0)) // no next directory
+	return b.Bytes()
+}
+
+func TestFindTIFF(t *testing.T) {
+	jpeg := []byte("\xff\xd8\xff\xdb\x00\x43image data")
+	cr3 := []byte("\x00\x00\x00\x18ftypcrx \x00\x00\x00\x01crx isom")
+
+	tests := []struct {
+		name  string
+		data  []byte
+		found bool
+	}{
+		{"bare TIFF", tiffBlock(6), true},
+		{"JPEG APP1", append(append(append([]byte{}, jpeg...), "Exif\x00\x00"...), tiffBlock(6)...), true},
+		{"PNG eXIf", append([]byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x1aeXIf"), tiffBlock(6)...), true},
+		{"CR3", append(append([]byte{}, cr3...), tiffBlock(6)...), true},
+		{"JPEG without EXIF ending in a TIFF header", append(append([]byte{}, jpeg...), "II*\x00"...), false},
+		{"JPEG without EXIF with TIFF header bytes", append(append([]byte{}, jpeg...), tiffBlock(6)...), false},
+		{"CR3 ending in a TIFF header", append(append([]byte{}, cr3...), "II*\x00"...), false},
+		{"too short", []byte("II*\x00"), false},
+	}
+	for _, tt := range tests {
+		if tiff := findTIFF(tt.data); (tiff != nil) != tt.found {
+			t.Errorf("%s: findTIFF() found = %v, want %v", tt.name, tiff != nil, tt.found)
+		}
+	}
+}
+
+func TestReadExif(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, data []byte) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	result, err := readExif(write("rotated.jpg", append([]byte("\xff\xd8\xff\xe1\x00\x10Exif\x00\x00"), tiffBlock(6)...)))
+	if err != nil || result.Orientation != 6 {
+		t.Errorf("readExif() = %+v, %v, want orientation 6", result, err)
+	}
+
+	// Image data happening to end in a TIFF header is no EXIF data
+	if _, err := readExif(write("plain.jpg", []byte("\xff\xd8\xff\xdb\x00\x43II*\x00"))); err != errNoExif {
+		t.Errorf("readExif() error = %v, want errNoExif", err)
+	}
+}
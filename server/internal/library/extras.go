@@ -0,0 +1,188 @@
+package library
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/openflix/openflix-server/internal/logger"
+	"github.com/openflix/openflix-server/internal/models"
+)
+
+// ErrNoExtraOwner is returned for an extra whose movie or show is not in the
+// library (yet). It is tried again on the next scan.
+var ErrNoExtraOwner = errors.New("no movie or show found for extra")
+
+// Extra categories, named as Plex names them
+const (
+	ExtraTrailer         = "trailer"
+	ExtraBehindTheScenes = "behindTheScenes"
+	ExtraDeleted         = "deleted"
+	ExtraFeaturette      = "featurette"
+	ExtraInterview       = "interview"
+	ExtraScene           = "scene"
+	ExtraShort           = "short"
+	ExtraOther           = "other"
+)
+
+// extraFolders maps the folders extras are kept in to their category
+var extraFolders = map[string]string{
+	"trailers":          ExtraTrailer,
+	"behind the scenes": ExtraBehindTheScenes,
+	"deleted scenes":    ExtraDeleted,
+	"featurettes":       ExtraFeaturette,
+	"interviews":        ExtraInterview,
+	"scenes":            ExtraScene,
+	"shorts":            ExtraShort,
+	"other":             ExtraOther,
+	"extras":            ExtraOther,
+}
+
+// extraSuffixes maps the file name suffixes of extras kept next to their
+// movie, as in "Movie (2010)-trailer.mkv", to their category
+var extraSuffixes = map[string]string{
+	"-trailer":         ExtraTrailer,
+	"-behindthescenes": ExtraBehindTheScenes,
+	"-deleted":         ExtraDeleted,
+	"-featurette":      ExtraFeaturette,
+	"-interview":       ExtraInterview,
+	"-scene":           ExtraScene,
+	"-short":           ExtraShort,
+	"-other":           ExtraOther,
+}
+
+// extraInfo tells whether a file is an extra. It returns its category, its
+// title and the folder of the movie or show it belongs to.
+func extraInfo(filePath string) (category, title, ownerDir string, ok bool) {
+	dir := filepath.Dir(filePath)
+	name := strings.TrimSuffix(filepath.Base(filePath), filepath.Ext(filePath))
+
+	if category, ok := extraFolders[strings.ToLower(filepath.Base(dir))]; ok {
+		return category, name, filepath.Dir(dir), true
+	}
+
+	lower := strings.ToLower(name)
+	for suffix, category := range extraSuffixes {
+		if strings.HasSuffix(lower, suffix) {
+			return category, strings.TrimSpace(name[:len(name)-len(suffix)]), dir, true
+		}
+	}
+	return "", "", "", false
+}
+
+// isExtraFile tells whether a file is stored as an extra
+func (s *Scanner) isExtraFile(file *models.MediaFile) bool {
+	var count int64
+	s.db.Model(&models.MediaItem{}).Where("id = ? AND type = ?", file.MediaItemID, "extra").Count(&count)
+	return count > 0
+}
+
+// addExtra adds a trailer, featurette or other extra to the movie or show it
+// belongs to
+func (s *Scanner) addExtra(library *models.Library, filePath string, fileInfo os.FileInfo, mediaInfo MediaInfo) error {
+	category, title, ownerDir, _ := extraInfo(filePath)
+	owner := s.findExtraOwner(library, filePath, ownerDir)
+	if owner == nil {
+		return ErrNoExtraOwner
+	}
+	if title == "" {
+		title = owner.Title
+	}
+
+	item := models.MediaItem{
+		UUID:      uuid.New().String(),
+		LibraryID: library.ID,
+		Type:      "extra",
+		Subtype:   category,
+		Title:     title,
+		SortTitle: strings.ToLower(title),
+		ParentID:  &owner.ID,
+		Duration:  mediaInfo.Duration,
+		AddedAt:   time.Now(),
+	}
+	if err := s.db.Create(&item).Error; err != nil {
+		return err
+	}
+	return s.createMediaFile(&item, filePath, fileInfo, mediaInfo)
+}
+
+// findExtraOwner returns the movie or show an extra belongs to: the movie
+// with a file in ownerDir, or the show with episodes under it. When a folder
+// holds several movies, an extra named after one of them goes with it.
+func (s *Scanner) findExtraOwner(library *models.Library, filePath, ownerDir string) *models.MediaItem {
+	prefix := ownerDir + string(os.PathSeparator)
+
+	var files []models.MediaFile
+	s.db.Joins("JOIN media_items ON media_items.id = media_files.media_item_id").
+		Where("media_items.library_id = ? AND media_items.type IN ?", library.ID, []string{"movie", "episode"}).
+		Where("media_files.file_path LIKE ? ESCAPE '\\'", escapeLike(prefix)+"%").
+		Find(&files)
+
+	if library.Type == "show" {
+		for _, file := range files {
+			var episode models.MediaItem
+			if s.db.First(&episode, file.MediaItemID).Error == nil && episode.GrandparentID != nil {
+				var show models.MediaItem
+				if s.db.First(&show, *episode.GrandparentID).Error == nil {
+					return &show
+				}
+			}
+		}
+		return nil
+	}
+
+	_, title, _, _ := extraInfo(filePath)
+	wanted := s.parseFilename(filepath.Join(ownerDir, title+filepath.Ext(filePath)), library)
+	var movieIDs []uint
+	seen := make(map[uint]bool)
+	for _, file := range files {
+		if filepath.Dir(file.FilePath) != ownerDir {
+			continue
+		}
+		if !seen[file.MediaItemID] {
+			seen[file.MediaItemID] = true
+			movieIDs = append(movieIDs, file.MediaItemID)
+		}
+		parsed := s.parseFilename(file.FilePath, library)
+		if title != "" && strings.EqualFold(parsed.Title, wanted.Title) && parsed.Year == wanted.Year {
+			movieIDs = []uint{file.MediaItemID}
+			break
+		}
+	}
+	if len(movieIDs) != 1 {
+		return nil
+	}
+	var movie models.MediaItem
+	if s.db.First(&movie, movieIDs[0]).Error != nil {
+		return nil
+	}
+	return &movie
+}
+
+// rehomeExtras moves the extras of a removed movie or show to another one in
+// the same folder, as when a movie file was renamed, or removes them
+func (s *Scanner) rehomeExtras(library *models.Library, ownerID uint) {
+	var extras []models.MediaItem
+	s.db.Preload("MediaFiles").Where("parent_id = ? AND type = ?", ownerID, "extra").Find(&extras)
+	for _, extra := range extras {
+		var owner *models.MediaItem
+		if len(extra.MediaFiles) > 0 {
+			filePath := extra.MediaFiles[0].FilePath
+			_, _, ownerDir, _ := extraInfo(filePath)
+			owner = s.findExtraOwner(library, filePath, ownerDir)
+		}
+		if owner != nil && owner.ID != ownerID {
+			s.db.Model(&extra).Update("parent_id", owner.ID)
+			continue
+		}
+
+		logger.Debugf("Removing extra %q, its %s is gone", extra.Title, library.Type)
+		for i := range extra.MediaFiles {
+			s.removeMediaFileByID(&extra.MediaFiles[i])
+		}
+		s.removeItemIfEmpty(extra.ID)
+	}
+}
@@ -0,0 +1,543 @@
+package library
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Filter expressions are shared by smart collections, smart playlists and the
+// library content endpoint. An expression is a list of clauses joined by AND:
+//
+//	genre=Horror AND year>=2000 AND unwatched AND rating>7
+//
+// A clause is either a bare flag (watched, unwatched, inProgress) or a
+// field/operator/value triple. Operators are = != > >= < <= ~ (contains) and
+// !~ (does not contain). Values may be double-quoted, and = / != / ~ accept a
+// comma-separated list of alternatives (genre=Horror,Thriller).
+
+var (
+	ErrInvalidFilter = errors.New("invalid filter")
+	ErrInvalidSort   = errors.New("invalid sort")
+)
+
+type fieldKind int
+
+const (
+	kindString fieldKind = iota
+	kindExact
+	kindNumber
+	kindDate
+	kindDecade
+	kindGenre
+	kindResolution
+	kindCollection
+	kindWatch
+)
+
+type filterField struct {
+	kind   fieldKind
+	column string
+	scale  float64 // multiplier applied to numeric values (e.g. minutes to milliseconds)
+}
+
+// filterFields maps lower-cased field names to their columns
+var filterFields = map[string]filterField{
+	"title":          {kind: kindString, column: "title"},
+	"originaltitle":  {kind: kindString, column: "original_title"},
+	"studio":         {kind: kindString, column: "studio"},
+	"contentrating":  {kind: kindString, column: "content_rating"},
+	"summary":        {kind: kindString, column: "summary"},
+	"show":           {kind: kindString, column: "grandparent_title"},
+	"type":           {kind: kindExact, column: "type"},
+	"year":           {kind: kindNumber, column: "year", scale: 1},
+	"rating":         {kind: kindNumber, column: "rating", scale: 1},
+	"audiencerating": {kind: kindNumber, column: "audience_rating", scale: 1},
+	"duration":       {kind: kindNumber, column: "duration", scale: 60000},
+	"season":         {kind: kindNumber, column: "parent_index", scale: 1},
+	"episode":        {kind: kindNumber, column: "\"index\"", scale: 1},
+	"addedat":        {kind: kindDate, column: "added_at"},
+	"releasedate":    {kind: kindDate, column: "originally_available_at"},
+	"takenat":        {kind: kindDate, column: "originally_available_at"}, // photos
+	"decade":         {kind: kindDecade, column: "year"},
+	"genre":          {kind: kindGenre},
+	"resolution":     {kind: kindResolution},
+	"collection":     {kind: kindCollection},
+	"watched":        {kind: kindWatch},
+	"unwatched":      {kind: kindWatch},
+	"inprogress":     {kind: kindWatch},
+}
+
+// filterOperators is ordered so that two-character operators match first
+var filterOperators = []string{"!=", "!~", ">=", "<=", "=", ">", "<", "~"}
+
+// sortColumns maps sort keys to their columns
+var sortColumns = map[string]string{
+	"titlesort":             "sort_title",
+	"title":                 "title",
+	"addedat":               "added_at",
+	"updatedat":             "updated_at",
+	"year":                  "year",
+	"rating":                "rating",
+	"audiencerating":        "audience_rating",
+	"duration":              "duration",
+	"releasedate":           "originally_available_at",
+	"originallyavailableat": "originally_available_at",
+	"takenat":               "originally_available_at",
+	"index":                 "\"index\"",
+}
+
+// Condition is a single clause of a filter expression
+type Condition struct {
+	Field  string
+	Op     string
+	Values []string
+}
+
+// Filter is a parsed filter expression
+type Filter struct {
+	Conditions []Condition
+}
+
+// ParseFilter parses a filter expression. An empty expression matches everything.
+func ParseFilter(expr string) (*Filter, error) {
+	filter := &Filter{}
+	for _, clause := range splitClauses(expr) {
+		cond, err := parseCondition(clause)
+		if err != nil {
+			return nil, err
+		}
+		filter.Conditions = append(filter.Conditions, cond)
+	}
+	return filter, nil
+}
+
+// ParseSort converts a sort such as "addedAt:desc,titleSort" into an ORDER BY
+// clause. An empty sort orders by sort title.
+func ParseSort(sort string) (string, error) {
+	if strings.TrimSpace(sort) == "" {
+		return "media_items.sort_title ASC", nil
+	}
+
+	var orders []string
+	for _, key := range strings.Split(sort, ",") {
+		key = strings.TrimSpace(key)
+		if key == "" {
+			continue
+		}
+
+		dir := "ASC"
+		if name, d, ok := strings.Cut(key, ":"); ok {
+			key = name
+			switch strings.ToLower(d) {
+			case "asc":
+			case "desc":
+				dir = "DESC"
+			default:
+				return "", fmt.Errorf("%w: unknown direction %q", ErrInvalidSort, d)
+			}
+		}
+
+		if strings.EqualFold(key, "random") {
+			orders = append(orders, "RANDOM()")
+			continue
+		}
+		column, ok := sortColumns[strings.ToLower(key)]
+		if !ok {
+			return "", fmt.Errorf("%w: unknown key %q", ErrInvalidSort, key)
+		}
+		orders = append(orders, fmt.Sprintf("media_items.%s %s", column, dir))
+	}
+
+	if len(orders) == 0 {
+		return "media_items.sort_title ASC", nil
+	}
+	return strings.Join(orders, ", "), nil
+}
+
+// Apply adds the filter's conditions to a query on media_items. Watch state is
+// evaluated for the given user, and for the profile when one is set.
+func (f *Filter) Apply(query *gorm.DB, userID, profileID uint) *gorm.DB {
+	for _, cond := range f.Conditions {
+		sql, args := cond.sql(userID, profileID)
+		query = query.Where(sql, args...)
+	}
+	return query
+}
+
+// HasField reports whether the filter has a condition on the named field
+func (f *Filter) HasField(name string) bool {
+	for _, cond := range f.Conditions {
+		if strings.EqualFold(cond.Field, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// splitClauses splits an expression on the AND keyword, ignoring quoted text
+func splitClauses(expr string) []string {
+	var clauses []string
+	inQuote := false
+	start := 0
+	for i := 0; i < len(expr); i++ {
+		switch {
+		case expr[i] == '"':
+			inQuote = !inQuote
+		case !inQuote && i > 0 && isSpace(expr[i-1]) && i+3 <= len(expr) &&
+			strings.EqualFold(expr[i:i+3], "and") && (i+3 == len(expr) || isSpace(expr[i+3])):
+			clauses = append(clauses, expr[start:i])
+			start = i + 3
+			i += 2
+		}
+	}
+	clauses = append(clauses, expr[start:])
+
+	result := make([]string, 0, len(clauses))
+	for _, clause := range clauses {
+		if clause = strings.TrimSpace(clause); clause != "" {
+			result = append(result, clause)
+		}
+	}
+	return result
+}
+
+func isSpace(b byte) bool {
+	return b == ' ' || b == '\t' || b == '\n' || b == '\r'
+}
+
+func parseCondition(clause string) (Condition, error) {
+	// Field names never contain quotes, so the first operator character starts the operator
+	opIndex := strings.IndexAny(clause, "!=<>~\"")
+	if opIndex >= 0 && clause[opIndex] == '"' {
+		return Condition{}, fmt.Errorf("%w: unexpected quote in %q", ErrInvalidFilter, clause)
+	}
+
+	if opIndex < 0 {
+		// Bare flag such as "unwatched"
+		field, ok := filterFields[strings.ToLower(clause)]
+		if !ok || field.kind != kindWatch {
+			return Condition{}, fmt.Errorf("%w: %q is not a flag", ErrInvalidFilter, clause)
+		}
+		return Condition{Field: clause, Op: "=", Values: []string{"true"}}, nil
+	}
+
+	var op string
+	for _, candidate := range filterOperators {
+		if strings.HasPrefix(clause[opIndex:], candidate) {
+			op = candidate
+			break
+		}
+	}
+	if op == "" {
+		return Condition{}, fmt.Errorf("%w: missing operator in %q", ErrInvalidFilter, clause)
+	}
+
+	name := strings.TrimSpace(clause[:opIndex])
+	field, ok := filterFields[strings.ToLower(name)]
+	if !ok {
+		return Condition{}, fmt.Errorf("%w: unknown field %q", ErrInvalidFilter, name)
+	}
+
+	values, err := splitValues(strings.TrimSpace(clause[opIndex+len(op):]))
+	if err != nil {
+		return Condition{}, err
+	}
+	if len(values) == 0 {
+		return Condition{}, fmt.Errorf("%w: missing value for %q", ErrInvalidFilter, name)
+	}
+
+	cond := Condition{Field: name, Op: op, Values: values}
+	if err := cond.validate(field); err != nil {
+		return Condition{}, err
+	}
+	return cond, nil
+}
+
+// splitValues splits a comma-separated value list, honouring double quotes
+func splitValues(raw string) ([]string, error) {
+	var values []string
+	var current strings.Builder
+	inQuote := false
+	for i := 0; i < len(raw); i++ {
+		switch {
+		case raw[i] == '"':
+			inQuote = !inQuote
+		case raw[i] == ',' && !inQuote:
+			values = append(values, strings.TrimSpace(current.String()))
+			current.Reset()
+		default:
+			current.WriteByte(raw[i])
+		}
+	}
+	if inQuote {
+		return nil, fmt.Errorf("%w: unterminated quote in %q", ErrInvalidFilter, raw)
+	}
+	values = append(values, strings.TrimSpace(current.String()))
+
+	result := values[:0]
+	for _, v := range values {
+		if v != "" {
+			result = append(result, v)
+		}
+	}
+	return result, nil
+}
+
+func (c Condition) validate(field filterField) error {
+	allowed := map[fieldKind]string{
+		kindString:     "= != ~ !~",
+		kindExact:      "= !=",
+		kindNumber:     "= != > >= < <=",
+		kindDate:       "> >= < <=",
+		kindDecade:     "= !=",
+		kindGenre:      "= != ~ !~",
+		kindResolution: "= !=",
+		kindCollection: "= !=",
+		kindWatch:      "=",
+	}[field.kind]
+	if !containsOp(allowed, c.Op) {
+		return fmt.Errorf("%w: operator %s not supported for %q", ErrInvalidFilter, c.Op, c.Field)
+	}
+
+	isComparison := c.Op != "=" && c.Op != "!=" && c.Op != "~" && c.Op != "!~"
+	if isComparison && len(c.Values) > 1 {
+		return fmt.Errorf("%w: %q takes a single value with %s", ErrInvalidFilter, c.Field, c.Op)
+	}
+
+	for _, v := range c.Values {
+		switch field.kind {
+		case kindNumber, kindDecade, kindCollection:
+			if _, err := strconv.ParseFloat(v, 64); err != nil {
+				return fmt.Errorf("%w: %q is not a number", ErrInvalidFilter, v)
+			}
+		case kindDate:
+			if _, err := parseFilterDate(v, time.Now()); err != nil {
+				return err
+			}
+		case kindResolution:
+			if _, _, ok := resolutionRange(v); !ok {
+				return fmt.Errorf("%w: unknown resolution %q", ErrInvalidFilter, v)
+			}
+		case kindWatch:
+			if _, err := strconv.ParseBool(v); err != nil {
+				return fmt.Errorf("%w: %q is not a boolean", ErrInvalidFilter, v)
+			}
+		}
+	}
+	if field.kind == kindWatch && len(c.Values) > 1 {
+		return fmt.Errorf("%w: %q takes a single value", ErrInvalidFilter, c.Field)
+	}
+	return nil
+}
+
+func containsOp(allowed, op string) bool {
+	for _, candidate := range strings.Fields(allowed) {
+		if candidate == op {
+			return true
+		}
+	}
+	return false
+}
+
+func (c Condition) isTrue() bool {
+	b, _ := strconv.ParseBool(c.Values[0])
+	return b
+}
+
+// sql renders the condition as a WHERE fragment against media_items
+func (c Condition) sql(userID, profileID uint) (string, []interface{}) {
+	name := strings.ToLower(c.Field)
+	field := filterFields[name]
+	column := "media_items." + field.column
+	negate := c.Op == "!=" || c.Op == "!~"
+
+	switch field.kind {
+	case kindString:
+		lowered := make([]string, len(c.Values))
+		for i, v := range c.Values {
+			lowered[i] = strings.ToLower(v)
+		}
+		if c.Op == "~" || c.Op == "!~" {
+			return likeAny("LOWER("+column+")", lowered, negate)
+		}
+		return inList("LOWER("+column+")", lowered, negate)
+
+	case kindExact:
+		return inList(column, c.Values, negate)
+
+	case kindNumber:
+		nums := make([]interface{}, len(c.Values))
+		for i, v := range c.Values {
+			n, _ := strconv.ParseFloat(v, 64)
+			nums[i] = n * field.scale
+		}
+		if c.Op == "=" || c.Op == "!=" {
+			return inList(column, nums, negate)
+		}
+		return fmt.Sprintf("%s %s ?", column, c.Op), nums
+
+	case kindDate:
+		t, _ := parseFilterDate(c.Values[0], time.Now())
+		return fmt.Sprintf("%s %s ?", column, c.Op), []interface{}{t}
+
+	case kindDecade:
+		parts := make([]string, len(c.Values))
+		var args []interface{}
+		for i, v := range c.Values {
+			n, _ := strconv.ParseFloat(v, 64)
+			decade := int(n) / 10 * 10
+			parts[i] = fmt.Sprintf("(%s >= ? AND %s < ?)", column, column)
+			args = append(args, decade, decade+10)
+		}
+		return wrap(strings.Join(parts, " OR "), negate), args
+
+	case kindGenre:
+		lowered := make([]string, len(c.Values))
+		for i, v := range c.Values {
+			lowered[i] = strings.ToLower(v)
+		}
+		match, args := inList("LOWER(genres.tag)", lowered, false)
+		if c.Op == "~" || c.Op == "!~" {
+			match, args = likeAny("LOWER(genres.tag)", lowered, false)
+		}
+		return wrap("EXISTS (SELECT 1 FROM media_genres JOIN genres ON genres.id = media_genres.genre_id "+
+			"WHERE media_genres.media_item_id = media_items.id AND "+match+")", negate), args
+
+	case kindResolution:
+		parts := make([]string, len(c.Values))
+		var args []interface{}
+		for i, v := range c.Values {
+			min, max, _ := resolutionRange(v)
+			parts[i] = "(media_files.height >= ? AND media_files.height < ?)"
+			args = append(args, min, max)
+		}
+		return wrap("EXISTS (SELECT 1 FROM media_files WHERE media_files.media_item_id = media_items.id "+
+			"AND ("+strings.Join(parts, " OR ")+"))", negate), args
+
+	case kindCollection:
+		ids := make([]interface{}, len(c.Values))
+		for i, v := range c.Values {
+			n, _ := strconv.ParseFloat(v, 64)
+			ids[i] = uint(n)
+		}
+		return wrap("EXISTS (SELECT 1 FROM collection_items WHERE collection_items.media_item_id = media_items.id "+
+			"AND collection_items.collection_id IN ?)", negate), []interface{}{ids}
+
+	case kindWatch:
+		sql, args := watchStateSQL(name, userID, profileID)
+		return wrap(sql, !c.isTrue()), args
+	}
+
+	return "1 = 1", nil
+}
+
+// watchStateSQL renders the watched/unwatched/inprogress flags. Shows and
+// seasons are watched once every episode beneath them has been completed.
+func watchStateSQL(flag string, userID, profileID uint) (string, []interface{}) {
+	historyFor := func(itemColumn, extra string) (string, []interface{}) {
+		sql := "EXISTS (SELECT 1 FROM watch_histories WHERE watch_histories.media_item_id = " + itemColumn +
+			" AND watch_histories.user_id = ?"
+		args := []interface{}{userID}
+		if profileID > 0 {
+			sql += " AND watch_histories.profile_id = ?"
+			args = append(args, profileID)
+		}
+		return sql + extra + ")", args
+	}
+
+	completed := " AND watch_histories.completed = true"
+	episodesOf := "SELECT 1 FROM media_items episodes WHERE episodes.type = 'episode' AND episodes.deleted_at IS NULL " +
+		"AND (episodes.parent_id = media_items.id OR episodes.grandparent_id = media_items.id)"
+
+	leafDone, leafDoneArgs := historyFor("media_items.id", completed)
+	episodeDone, episodeDoneArgs := historyFor("episodes.id", completed)
+	allEpisodesDone := "NOT EXISTS (" + episodesOf + " AND NOT " + episodeDone + ")"
+
+	watched := "((media_items.type IN ('show', 'season') AND " + allEpisodesDone + ") OR " +
+		"(media_items.type NOT IN ('show', 'season') AND " + leafDone + "))"
+	watchedArgs := append(append([]interface{}{}, episodeDoneArgs...), leafDoneArgs...)
+
+	switch flag {
+	case "watched":
+		return watched, watchedArgs
+	case "unwatched":
+		return "NOT " + watched, watchedArgs
+	default: // inprogress
+		leafStarted, leafStartedArgs := historyFor("media_items.id",
+			" AND watch_histories.completed = false AND watch_histories.view_offset > 0")
+		episodeStarted, episodeStartedArgs := historyFor("episodes.id", "")
+		sql := "((media_items.type IN ('show', 'season') AND EXISTS (" + episodesOf + " AND " + episodeStarted + ") AND NOT " + allEpisodesDone + ") OR " +
+			"(media_items.type NOT IN ('show', 'season') AND " + leafStarted + "))"
+		args := append(append(append([]interface{}{}, episodeStartedArgs...), episodeDoneArgs...), leafStartedArgs...)
+		return sql, args
+	}
+}
+
+func inList[T any](column string, values []T, negate bool) (string, []interface{}) {
+	if negate {
+		return column + " NOT IN ?", []interface{}{values}
+	}
+	return column + " IN ?", []interface{}{values}
+}
+
+func likeAny(column string, values []string, negate bool) (string, []interface{}) {
+	parts := make([]string, len(values))
+	args := make([]interface{}, len(values))
+	for i, v := range values {
+		parts[i] = column + " LIKE ?"
+		args[i] = "%" + v + "%"
+	}
+	return wrap(strings.Join(parts, " OR "), negate), args
+}
+
+func wrap(sql string, negate bool) string {
+	if negate {
+		return "NOT (" + sql + ")"
+	}
+	return "(" + sql + ")"
+}
+
+// parseFilterDate accepts an absolute date (2006-01-02) or a relative age such
+// as 30d, 2w, 6m or 1y, which resolves to that long before now
+func parseFilterDate(value string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t, nil
+	}
+
+	if len(value) >= 2 {
+		n, err := strconv.Atoi(value[:len(value)-1])
+		if err == nil && n >= 0 {
+			switch value[len(value)-1] {
+			case 'd':
+				return now.AddDate(0, 0, -n), nil
+			case 'w':
+				return now.AddDate(0, 0, -7*n), nil
+			case 'm':
+				return now.AddDate(0, -n, 0), nil
+			case 'y':
+				return now.AddDate(-n, 0, 0), nil
+			}
+		}
+	}
+	return time.Time{}, fmt.Errorf("%w: %q is not a date", ErrInvalidFilter, value)
+}
+
+// resolutionRange returns the video height range for a resolution name
+func resolutionRange(value string) (int, int, bool) {
+	switch strings.ToLower(value) {
+	case "sd", "480", "480p":
+		return 0, 700, true
+	case "720", "720p", "hd":
+		return 700, 1000, true
+	case "1080", "1080p", "fhd":
+		return 1000, 1500, true
+	case "4k", "2160", "2160p", "uhd":
+		return 1500, 100000, true
+	}
+	return 0, 0, false
+}
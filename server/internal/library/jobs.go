@@ -0,0 +1,350 @@
+package library
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/openflix/openflix-server/internal/logger"
+	"github.com/openflix/openflix-server/internal/models"
+)
+
+// Scan job states
+const (
+	ScanQueued    = "queued"
+	ScanRunning   = "running"
+	ScanCompleted = "completed"
+	ScanCancelled = "cancelled"
+	ScanFailed    = "failed"
+)
+
+// Scan phases
+const (
+	ScanPhaseWalk     = "walk"     // looking for files
+	ScanPhaseProbe    = "probe"    // reading new and changed files
+	ScanPhaseMetadata = "metadata" // waiting for the metadata of new items
+)
+
+var (
+	ErrScanNotFound = errors.New("scan job not found")
+	ErrScanFinished = errors.New("scan job has already finished")
+)
+
+const (
+	finishedScansKept    = 20                     // finished jobs remembered
+	scanProgressInterval = 500 * time.Millisecond // between progress events
+)
+
+// ScanProgress is the state of a scan job
+type ScanProgress struct {
+	ID              string     `json:"id"`
+	LibraryID       uint       `json:"libraryId"`
+	State           string     `json:"state"`
+	Phase           string     `json:"phase,omitempty"`
+	FilesFound      int        `json:"filesFound"`
+	FilesProcessed  int        `json:"filesProcessed"`
+	FilesFailed     int        `json:"filesFailed"`
+	FilesAdded      int        `json:"filesAdded"`
+	FilesUpdated    int        `json:"filesUpdated"`
+	FilesRemoved    int        `json:"filesRemoved"`
+	MetadataPending int64      `json:"metadataPending,omitempty"`
+	CurrentPath     string     `json:"currentPath,omitempty"`
+	ETA             int        `json:"eta,omitempty"` // seconds, while probing
+	Error           string     `json:"error,omitempty"`
+	Errors          []string   `json:"errors,omitempty"`
+	StartedAt       time.Time  `json:"startedAt"`
+	FinishedAt      *time.Time `json:"finishedAt,omitempty"`
+}
+
+// ScanJob is a library scan running in the background. The scan functions
+// take a nil job for scans nobody follows.
+type ScanJob struct {
+	mu        sync.Mutex
+	progress  ScanProgress
+	probeFrom time.Time // start of the probe phase, for the ETA
+	published time.Time
+	cancel    context.CancelFunc
+	jobs      *scanJobs
+}
+
+// scanJobs keeps the recent scan jobs and the clients following them
+type scanJobs struct {
+	mu          sync.Mutex
+	jobs        []*ScanJob // oldest first
+	subscribers map[chan ScanProgress]bool
+}
+
+func newScanJobs() *scanJobs {
+	return &scanJobs{subscribers: make(map[chan ScanProgress]bool)}
+}
+
+// StartScan scans a library in the background as a job that can be followed
+// and cancelled. If the library is already being scanned, its job is
+// returned instead.
+func (s *Scanner) StartScan(library *models.Library) ScanProgress {
+	s.scans.mu.Lock()
+	for _, job := range s.scans.jobs {
+		if progress := job.Progress(); progress.LibraryID == library.ID && progress.FinishedAt == nil {
+			s.scans.mu.Unlock()
+			return progress
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &ScanJob{
+		progress: ScanProgress{
+			ID:        uuid.New().String(),
+			LibraryID: library.ID,
+			State:     ScanQueued,
+			StartedAt: time.Now(),
+		},
+		cancel: cancel,
+		jobs:   s.scans,
+	}
+	s.scans.add(job)
+	s.scans.mu.Unlock()
+
+	go s.runScan(ctx, library, job)
+	return job.Progress()
+}
+
+// runScan runs a scan job and waits for the metadata of what it added
+func (s *Scanner) runScan(ctx context.Context, library *models.Library, job *ScanJob) {
+	defer job.cancel()
+
+	result, err := s.scanLibrary(ctx, library, job)
+	if err == nil {
+		job.setPhase(ScanPhaseMetadata)
+		err = s.waitForMetadata(ctx, library.ID, job)
+	}
+	job.finish(result, err)
+
+	if result != nil {
+		logger.Infof("Scan of library %q %s: %d found, %d added, %d updated, %d removed, %d errors",
+			library.Title, job.Progress().State, result.FilesFound, result.FilesAdded,
+			result.FilesUpdated, result.FilesRemoved, len(result.Errors))
+	}
+}
+
+// waitForMetadata waits until no metadata fetches of a library are left
+// running. Scans of other libraries don't hold it up.
+func (s *Scanner) waitForMetadata(ctx context.Context, libraryID uint, job *ScanJob) error {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		pending := s.pendingMetadata(libraryID)
+		job.update(false, func(p *ScanProgress) {
+			p.MetadataPending = pending
+		})
+		if pending == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// CancelScan stops a scan job. Files it did not get to are left as they were.
+func (s *Scanner) CancelScan(id string) error {
+	job := s.scans.find(id)
+	if job == nil {
+		return ErrScanNotFound
+	}
+	if job.Progress().FinishedAt != nil {
+		return ErrScanFinished
+	}
+	job.cancel()
+	return nil
+}
+
+// ScanJobs returns the running and recently finished scan jobs, newest first
+func (s *Scanner) ScanJobs() []ScanProgress {
+	s.scans.mu.Lock()
+	defer s.scans.mu.Unlock()
+
+	list := make([]ScanProgress, len(s.scans.jobs))
+	for i, job := range s.scans.jobs {
+		list[len(list)-1-i] = job.Progress()
+	}
+	return list
+}
+
+// ScanJob returns the state of a scan job
+func (s *Scanner) ScanJob(id string) (ScanProgress, error) {
+	job := s.scans.find(id)
+	if job == nil {
+		return ScanProgress{}, ErrScanNotFound
+	}
+	return job.Progress(), nil
+}
+
+// SubscribeScans follows the progress of all scan jobs. The returned function
+// stops following and closes the channel.
+func (s *Scanner) SubscribeScans() (<-chan ScanProgress, func()) {
+	ch := make(chan ScanProgress, 64)
+	s.scans.mu.Lock()
+	s.scans.subscribers[ch] = true
+	s.scans.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			s.scans.mu.Lock()
+			delete(s.scans.subscribers, ch)
+			s.scans.mu.Unlock()
+			close(ch)
+		})
+	}
+}
+
+// add remembers a new job, forgetting the oldest finished ones. The caller
+// holds mu.
+func (j *scanJobs) add(job *ScanJob) {
+	finished := 0
+	for _, other := range j.jobs {
+		if other.Progress().FinishedAt != nil {
+			finished++
+		}
+	}
+	kept := j.jobs[:0]
+	for _, other := range j.jobs {
+		if finished > finishedScansKept-1 && other.Progress().FinishedAt != nil {
+			finished--
+			continue
+		}
+		kept = append(kept, other)
+	}
+	j.jobs = append(kept, job)
+}
+
+func (j *scanJobs) find(id string) *ScanJob {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for _, job := range j.jobs {
+		if job.progress.ID == id {
+			return job
+		}
+	}
+	return nil
+}
+
+// publish sends progress to everyone following. Slow followers miss events
+// rather than hold up the scan.
+func (j *scanJobs) publish(progress ScanProgress) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for ch := range j.subscribers {
+		select {
+		case ch <- progress:
+		default:
+		}
+	}
+}
+
+// Progress returns the state of the job
+func (j *ScanJob) Progress() ScanProgress {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.snapshot()
+}
+
+func (j *ScanJob) snapshot() ScanProgress {
+	progress := j.progress
+	progress.Errors = append([]string(nil), j.progress.Errors...)
+	return progress
+}
+
+// update changes the job's progress and publishes it, at most every
+// scanProgressInterval unless force is set
+func (j *ScanJob) update(force bool, change func(p *ScanProgress)) {
+	if j == nil {
+		return
+	}
+
+	j.mu.Lock()
+	change(&j.progress)
+	p := &j.progress
+	p.ETA = 0
+	if p.Phase == ScanPhaseProbe && p.FilesProcessed > 0 && p.FilesFound > p.FilesProcessed {
+		perFile := time.Since(j.probeFrom) / time.Duration(p.FilesProcessed)
+		p.ETA = int((perFile * time.Duration(p.FilesFound-p.FilesProcessed)).Seconds())
+	}
+	if !force && time.Since(j.published) < scanProgressInterval {
+		j.mu.Unlock()
+		return
+	}
+	j.published = time.Now()
+	progress := j.snapshot()
+	j.mu.Unlock()
+
+	j.jobs.publish(progress)
+}
+
+func (j *ScanJob) setPhase(phase string) {
+	j.update(true, func(p *ScanProgress) {
+		p.State = ScanRunning
+		p.Phase = phase
+		p.CurrentPath = ""
+		if phase == ScanPhaseProbe {
+			j.probeFrom = time.Now()
+		}
+	})
+}
+
+// walking reports the directory being looked through
+func (j *ScanJob) walking(dir string) {
+	j.update(false, func(p *ScanProgress) {
+		p.CurrentPath = dir
+	})
+}
+
+func (j *ScanJob) foundFile() {
+	j.update(false, func(p *ScanProgress) {
+		p.FilesFound++
+	})
+}
+
+// processing reports the file being read
+func (j *ScanJob) processing(path string) {
+	j.update(false, func(p *ScanProgress) {
+		p.CurrentPath = path
+	})
+}
+
+func (j *ScanJob) processed(failed bool) {
+	j.update(false, func(p *ScanProgress) {
+		p.FilesProcessed++
+		if failed {
+			p.FilesFailed++
+		}
+	})
+}
+
+// finish records the outcome of the scan
+func (j *ScanJob) finish(result *ScanResult, err error) {
+	j.update(true, func(p *ScanProgress) {
+		now := time.Now()
+		p.FinishedAt = &now
+		p.CurrentPath = ""
+		switch {
+		case errors.Is(err, context.Canceled):
+			p.State = ScanCancelled
+		case err != nil:
+			p.State = ScanFailed
+			p.Error = err.Error()
+		default:
+			p.State = ScanCompleted
+		}
+		if result != nil {
+			p.FilesAdded = result.FilesAdded
+			p.FilesUpdated = result.FilesUpdated
+			p.FilesRemoved = result.FilesRemoved
+			p.Errors = result.Errors
+		}
+	})
+}
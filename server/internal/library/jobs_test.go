@@ -0,0 +1,31 @@
+package library
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestWaitForMetadata(t *testing.T) {
+	s := &Scanner{scanState: &scanState{}}
+	s.addMetadataPending(1, 1)
+
+	// Another library's fetches don't hold a scan up
+	if err := s.waitForMetadata(context.Background(), 2, nil); err != nil {
+		t.Fatalf("waitForMetadata(2) error = %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := s.waitForMetadata(ctx, 1, nil); err != context.DeadlineExceeded {
+		t.Fatalf("waitForMetadata(1) error = %v, want it to wait", err)
+	}
+
+	s.addMetadataPending(1, -1)
+	if n := s.pendingMetadata(1); n != 0 {
+		t.Errorf("pendingMetadata(1) = %d, want 0", n)
+	}
+	if err := s.waitForMetadata(context.Background(), 1, nil); err != nil {
+		t.Errorf("waitForMetadata(1) error = %v", err)
+	}
+}
@@ -0,0 +1,61 @@
+package library
+
+import "strings"
+
+// language is an ISO 639-2/B code and its English name
+type language struct {
+	Code string
+	Name string
+}
+
+// languages maps the ISO 639-2/B code of common subtitle languages to their
+// English name
+var languages = map[string]string{
+	"ara": "Arabic", "bul": "Bulgarian", "cat": "Catalan", "chi": "Chinese",
+	"cze": "Czech", "dan": "Danish", "dut": "Dutch", "eng": "English",
+	"est": "Estonian", "fin": "Finnish", "fre": "French", "ger": "German",
+	"gre": "Greek", "heb": "Hebrew", "hin": "Hindi", "hrv": "Croatian",
+	"hun": "Hungarian", "ice": "Icelandic", "ind": "Indonesian", "ita": "Italian",
+	"jpn": "Japanese", "kor": "Korean", "lav": "Latvian", "lit": "Lithuanian",
+	"may": "Malay", "nor": "Norwegian", "per": "Persian", "pol": "Polish",
+	"por": "Portuguese", "pob": "Portuguese (Brazil)", "rum": "Romanian",
+	"rus": "Russian", "slo": "Slovak", "slv": "Slovenian", "spa": "Spanish",
+	"srp": "Serbian", "swe": "Swedish", "tha": "Thai", "tur": "Turkish",
+	"ukr": "Ukrainian", "vie": "Vietnamese",
+}
+
+// languageAliases maps ISO 639-1 codes, ISO 639-2/T codes and names that
+// show up in file names to an ISO 639-2/B code
+var languageAliases = map[string]string{
+	"ar": "ara", "bg": "bul", "ca": "cat", "zh": "chi", "zho": "chi",
+	"cs": "cze", "ces": "cze", "da": "dan", "nl": "dut", "nld": "dut",
+	"en": "eng", "et": "est", "fi": "fin", "fr": "fre", "fra": "fre",
+	"de": "ger", "deu": "ger", "el": "gre", "ell": "gre", "he": "heb",
+	"hi": "hin", "hr": "hrv", "hu": "hun", "is": "ice", "isl": "ice",
+	"id": "ind", "it": "ita", "ja": "jpn", "ko": "kor", "lv": "lav",
+	"lt": "lit", "ms": "may", "msa": "may", "no": "nor", "nb": "nor",
+	"nob": "nor", "fa": "per", "fas": "per", "pl": "pol", "pt": "por",
+	"pt-br": "pob", "ptbr": "pob", "ro": "rum", "ron": "rum", "ru": "rus",
+	"sk": "slo", "slk": "slo", "sl": "slv", "es": "spa", "sr": "srp",
+	"sv": "swe", "th": "tha", "tr": "tur", "uk": "ukr", "vi": "vie",
+	"brazilian": "pob", "castellano": "spa", "deutsch": "ger",
+	"español": "spa", "espanol": "spa", "français": "fre", "francais": "fre",
+	"italiano": "ita", "nederlands": "dut", "português": "por", "portugues": "por",
+}
+
+// lookupLanguage recognizes a language code or name, case-insensitively
+func lookupLanguage(token string) (language, bool) {
+	token = strings.ToLower(token)
+	if code, ok := languageAliases[token]; ok {
+		return language{Code: code, Name: languages[code]}, true
+	}
+	if name, ok := languages[token]; ok {
+		return language{Code: token, Name: name}, true
+	}
+	for code, name := range languages {
+		if strings.EqualFold(name, token) {
+			return language{Code: code, Name: name}, true
+		}
+	}
+	return language{}, false
+}
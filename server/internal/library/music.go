@@ -0,0 +1,375 @@
+package library
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/openflix/openflix-server/internal/metadata"
+	"github.com/openflix/openflix-server/internal/models"
+	"gorm.io/gorm"
+)
+
+// Audio file extensions
+var audioExtensions = map[string]bool{
+	".flac": true, ".mp3": true, ".m4a": true, ".opus": true,
+	".ogg": true, ".oga": true, ".aac": true, ".wav": true,
+}
+
+// Folder images used as album art when a file has no embedded cover
+var coverFilenames = []string{"cover.jpg", "cover.png", "folder.jpg", "folder.png", "front.jpg", "front.png"}
+
+// Leading track number in filenames such as "03 - Title.flac" or "1-03 Title.mp3"
+var trackNumberPattern = regexp.MustCompile(`^(?:(\d{1,2})[-.])?(\d{1,3})(?:\s*[-.]\s*|\s+)`)
+
+// isMusicLibrary reports whether a library type holds music. Libraries are
+// created as "music", older ones may use the Plex "artist" type.
+func isMusicLibrary(libraryType string) bool {
+	return libraryType == "music" || libraryType == "artist"
+}
+
+// AudioTags contains the embedded tags of a music file
+type AudioTags struct {
+	Title       string
+	Artist      string
+	AlbumArtist string
+	Album       string
+	Track       int
+	Disc        int
+	Year        int
+	Genre       string
+}
+
+// parseAudioTags reads music tags from ffprobe output, falling back to the
+// Artist/Album/NN - Title.ext folder layout for anything that is missing
+func parseAudioTags(filePath string, tags map[string]string) AudioTags {
+	first := func(keys ...string) string {
+		for _, k := range keys {
+			if v := strings.TrimSpace(tags[k]); v != "" {
+				return v
+			}
+		}
+		return ""
+	}
+
+	result := AudioTags{
+		Title:       first("title"),
+		Artist:      first("artist", "performer"),
+		AlbumArtist: first("album_artist", "albumartist", "album artist"),
+		Album:       first("album"),
+		Track:       leadingNumber(first("track", "tracknumber")),
+		Disc:        leadingNumber(first("disc", "discnumber")),
+		Year:        leadingNumber(first("date", "year", "originaldate")),
+		Genre:       first("genre"),
+	}
+	if result.Year < 1000 {
+		result.Year = 0
+	}
+
+	// Fill the gaps from the path
+	name := strings.TrimSuffix(filepath.Base(filePath), filepath.Ext(filePath))
+	if matches := trackNumberPattern.FindStringSubmatch(name); matches != nil {
+		if result.Track == 0 {
+			result.Track, _ = strconv.Atoi(matches[2])
+		}
+		if result.Disc == 0 && matches[1] != "" {
+			result.Disc, _ = strconv.Atoi(matches[1])
+		}
+		name = name[len(matches[0]):]
+	}
+	if result.Title == "" {
+		result.Title = strings.TrimSpace(name)
+	}
+
+	albumDir := filepath.Dir(filePath)
+	if strings.HasPrefix(strings.ToLower(filepath.Base(albumDir)), "disc") || strings.HasPrefix(strings.ToLower(filepath.Base(albumDir)), "cd") {
+		albumDir = filepath.Dir(albumDir)
+	}
+	if result.Album == "" {
+		result.Album = filepath.Base(albumDir)
+	}
+	if result.AlbumArtist == "" {
+		result.AlbumArtist = result.Artist
+	}
+	if result.AlbumArtist == "" {
+		result.AlbumArtist = filepath.Base(filepath.Dir(albumDir))
+	}
+	if result.Artist == "" {
+		result.Artist = result.AlbumArtist
+	}
+	if result.Disc == 0 {
+		result.Disc = 1
+	}
+
+	return result
+}
+
+// leadingNumber parses values such as "3", "3/12" or "2004-05-01"
+func leadingNumber(value string) int {
+	end := 0
+	for end < len(value) && value[end] >= '0' && value[end] <= '9' {
+		end++
+	}
+	n, _ := strconv.Atoi(value[:end])
+	return n
+}
+
+// addTrack adds a music track, creating its artist and album as needed
+func (s *Scanner) addTrack(library *models.Library, filePath string, fileInfo os.FileInfo, mediaInfo MediaInfo) error {
+	tags := parseAudioTags(filePath, mediaInfo.Tags)
+
+	artist, err := s.findOrCreateArtist(library, tags.AlbumArtist)
+	if err != nil {
+		return err
+	}
+
+	album, err := s.findOrCreateAlbum(library, artist, tags.Album, tags.Year)
+	if err != nil {
+		return err
+	}
+
+	// Album art comes from the first track that has it. It is extracted once
+	// the track is written, and then given to the album's tracks.
+	if album.Thumb == "" {
+		s.afterWrite(func(s *Scanner) {
+			go s.extractAlbumArt(album, artist, filePath, mediaInfo)
+		})
+	}
+
+	track := models.MediaItem{
+		UUID:             uuid.New().String(),
+		LibraryID:        library.ID,
+		Type:             "track",
+		Title:            tags.Title,
+		SortTitle:        strings.ToLower(tags.Title),
+		Year:             tags.Year,
+		ParentID:         &album.ID,
+		GrandparentID:    &artist.ID,
+		Index:            tags.Track,
+		ParentIndex:      tags.Disc,
+		ParentTitle:      album.Title,
+		GrandparentTitle: artist.Title,
+		ParentThumb:      album.Thumb,
+		GrandparentThumb: artist.Thumb,
+		Thumb:            album.Thumb,
+		Duration:         mediaInfo.Duration,
+		AddedAt:          time.Now(),
+	}
+	// Track artists that differ from the album artist, as on compilations
+	if tags.Artist != artist.Title {
+		track.OriginalTitle = tags.Artist
+	}
+
+	if err := s.db.Create(&track).Error; err != nil {
+		return err
+	}
+
+	if tags.Genre != "" {
+		s.addGenre(album, tags.Genre)
+	}
+
+	if err := s.createMediaFile(&track, filePath, fileInfo, mediaInfo); err != nil {
+		return err
+	}
+
+	s.refreshMusicCounts(album.ID, artist.ID)
+	return nil
+}
+
+// findOrCreateArtist finds or creates a music artist
+func (s *Scanner) findOrCreateArtist(library *models.Library, name string) (*models.MediaItem, error) {
+	var artist models.MediaItem
+
+	err := s.db.Where("library_id = ? AND type = ? AND title = ?", library.ID, "artist", name).First(&artist).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		artist = models.MediaItem{
+			UUID:      uuid.New().String(),
+			LibraryID: library.ID,
+			Type:      "artist",
+			Title:     name,
+			SortTitle: strings.ToLower(strings.TrimPrefix(name, "The ")),
+			AddedAt:   time.Now(),
+		}
+		if err := s.db.Create(&artist).Error; err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &artist, nil
+}
+
+// findOrCreateAlbum finds or creates an album under an artist
+func (s *Scanner) findOrCreateAlbum(library *models.Library, artist *models.MediaItem, title string, year int) (*models.MediaItem, error) {
+	var album models.MediaItem
+
+	err := s.db.Where("library_id = ? AND type = ? AND parent_id = ? AND title = ?",
+		library.ID, "album", artist.ID, title).First(&album).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		album = models.MediaItem{
+			UUID:        uuid.New().String(),
+			LibraryID:   library.ID,
+			Type:        "album",
+			Title:       title,
+			SortTitle:   strings.ToLower(title),
+			Year:        year,
+			ParentID:    &artist.ID,
+			ParentTitle: artist.Title,
+			AddedAt:     time.Now(),
+		}
+		if err := s.db.Create(&album).Error; err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	} else if album.Year == 0 && year > 0 {
+		album.Year = year
+		s.db.Model(&album).Update("year", year)
+	}
+
+	return &album, nil
+}
+
+// addGenre tags an album with a genre from its tracks
+func (s *Scanner) addGenre(album *models.MediaItem, name string) {
+	var genre models.Genre
+	if err := s.db.FirstOrCreate(&genre, models.Genre{Tag: name}).Error; err != nil {
+		return
+	}
+	s.db.Model(album).Association("Genres").Append(&genre)
+}
+
+// extractAlbumArt saves a track's embedded cover, or a cover image from the
+// album folder, as the album poster. Artists without artwork use it too.
+// A poster an admin locked is kept, as is one another track gave the album.
+func (s *Scanner) extractAlbumArt(album, artist *models.MediaItem, filePath string, mediaInfo MediaInfo) {
+	s.artworkMu.Lock()
+	defer s.artworkMu.Unlock()
+
+	if err := s.db.Select("id", "thumb", "locked_fields").First(album, album.ID).Error; err != nil ||
+		album.Thumb != "" || metadata.LockedFields(album)["thumb"] {
+		return
+	}
+	posterDir := filepath.Join(s.dataDir, "metadata", "posters")
+	if err := os.MkdirAll(posterDir, 0755); err != nil {
+		return
+	}
+	posterPath := filepath.Join(posterDir, fmt.Sprintf("%d.jpg", album.ID))
+
+	saved := false
+	if mediaInfo.CoverStream >= 0 {
+		cmd := exec.Command(s.ffmpegBin,
+			"-y", "-v", "quiet",
+			"-i", filePath,
+			"-map", fmt.Sprintf("0:%d", mediaInfo.CoverStream),
+			"-frames:v", "1",
+			posterPath,
+		)
+		saved = cmd.Run() == nil
+	}
+	if !saved {
+		for _, name := range coverFilenames {
+			if copyFile(filepath.Join(filepath.Dir(filePath), name), posterPath) == nil {
+				saved = true
+				break
+			}
+		}
+	}
+	if !saved {
+		return
+	}
+
+	album.Thumb = fmt.Sprintf("/library/metadata/%d/thumb", album.ID)
+	s.db.Model(album).Update("thumb", album.Thumb)
+	s.db.Model(&models.MediaItem{}).Where("parent_id = ? AND type = ?", album.ID, "track").
+		Update("parent_thumb", album.Thumb)
+	// Tracks show their album's poster, unless an admin locked their own
+	var tracks []models.MediaItem
+	s.db.Select("id", "locked_fields").Where("parent_id = ? AND type = ?", album.ID, "track").Find(&tracks)
+	var unlocked []uint
+	for i := range tracks {
+		if !metadata.LockedFields(&tracks[i])["thumb"] {
+			unlocked = append(unlocked, tracks[i].ID)
+		}
+	}
+	if len(unlocked) > 0 {
+		s.db.Model(&models.MediaItem{}).Where("id IN ?", unlocked).Update("thumb", album.Thumb)
+	}
+
+	s.db.Model(&models.MediaItem{}).Where("id = ? AND thumb = ?", artist.ID, "").Update("thumb", album.Thumb)
+}
+
+// copyFile copies src to dst
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// refreshMusicCounts updates the cached track and album counts of an album
+// and its artist
+func (s *Scanner) refreshMusicCounts(albumID, artistID uint) {
+	var tracks int64
+	s.db.Model(&models.MediaItem{}).Where("parent_id = ? AND type = ?", albumID, "track").Count(&tracks)
+	s.db.Model(&models.MediaItem{}).Where("id = ?", albumID).Updates(map[string]interface{}{
+		"child_count": tracks,
+		"leaf_count":  tracks,
+	})
+
+	var albums, artistTracks int64
+	s.db.Model(&models.MediaItem{}).Where("parent_id = ? AND type = ?", artistID, "album").Count(&albums)
+	s.db.Model(&models.MediaItem{}).Where("grandparent_id = ? AND type = ?", artistID, "track").Count(&artistTracks)
+	s.db.Model(&models.MediaItem{}).Where("id = ?", artistID).Updates(map[string]interface{}{
+		"child_count": albums,
+		"leaf_count":  artistTracks,
+	})
+}
+
+// pruneMusicParents deletes the album and artist of a removed track once they
+// have no tracks left, and refreshes their counts otherwise
+func (s *Scanner) pruneMusicParents(track *models.MediaItem) {
+	if track.ParentID == nil || track.GrandparentID == nil {
+		return
+	}
+	albumID, artistID := *track.ParentID, *track.GrandparentID
+
+	var count int64
+	s.db.Model(&models.MediaItem{}).Where("parent_id = ? AND type = ?", albumID, "track").Count(&count)
+	if count == 0 {
+		s.db.Delete(&models.MediaItem{}, albumID)
+		s.removeFromCollections(albumID)
+		os.Remove(filepath.Join(s.dataDir, "metadata", "posters", fmt.Sprintf("%d.jpg", albumID)))
+		// The artist may have borrowed this album's cover
+		s.db.Model(&models.MediaItem{}).Where("id = ? AND thumb = ?", artistID, track.ParentThumb).Update("thumb", "")
+	}
+
+	s.db.Model(&models.MediaItem{}).Where("parent_id = ? AND type = ?", artistID, "album").Count(&count)
+	if count == 0 {
+		s.db.Delete(&models.MediaItem{}, artistID)
+		s.removeFromCollections(artistID)
+		return
+	}
+
+	s.refreshMusicCounts(albumID, artistID)
+}
@@ -0,0 +1,161 @@
+package library
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// Events that can change what a directory contains. IN_MODIFY is included so
+// that files still being written keep pushing the scan back.
+const inotifyMask = unix.IN_CREATE | unix.IN_CLOSE_WRITE | unix.IN_MODIFY |
+	unix.IN_MOVED_FROM | unix.IN_MOVED_TO | unix.IN_DELETE | unix.IN_DELETE_SELF | unix.IN_ONLYDIR
+
+// Filesystem magic numbers of network and FUSE mounts, where inotify misses
+// changes made by other machines
+var networkFilesystems = map[uint32]bool{
+	0x6969:     true, // NFS
+	0x517B:     true, // SMB
+	0xFF534D42: true, // CIFS
+	0xFE534D42: true, // SMB2
+	0x65735546: true, // FUSE (sshfs, rclone, ...)
+	0x01021997: true, // 9P
+	0x5346414F: true, // AFS
+}
+
+// inotifyNotifier watches directories with inotify
+type inotifyNotifier struct {
+	file    *os.File
+	fd      int
+	mu      sync.Mutex
+	watches map[int]string // watch descriptor -> directory
+	dirs    map[string]int
+	events  chan string
+}
+
+func newDirNotifier() (dirNotifier, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+
+	// A non-blocking descriptor is handled by the runtime poller, so Close
+	// unblocks the reader
+	n := &inotifyNotifier{
+		file:    os.NewFile(uintptr(fd), "inotify"),
+		fd:      fd,
+		watches: make(map[int]string),
+		dirs:    make(map[string]int),
+		events:  make(chan string, 256),
+	}
+	go n.readEvents()
+	return n, nil
+}
+
+func (n *inotifyNotifier) Add(dir string) error {
+	wd, err := unix.InotifyAddWatch(n.fd, dir, inotifyMask)
+	if err != nil {
+		return err
+	}
+	n.mu.Lock()
+	n.watches[wd] = dir
+	n.dirs[dir] = wd
+	n.mu.Unlock()
+	return nil
+}
+
+func (n *inotifyNotifier) Remove(dir string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	prefix := dir + string(filepath.Separator)
+	for path, wd := range n.dirs {
+		if path == dir || strings.HasPrefix(path, prefix) {
+			unix.InotifyRmWatch(n.fd, uint32(wd))
+			delete(n.dirs, path)
+			delete(n.watches, wd)
+		}
+	}
+}
+
+func (n *inotifyNotifier) Watching(dir string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	_, ok := n.dirs[dir]
+	return ok
+}
+
+func (n *inotifyNotifier) Events() <-chan string {
+	return n.events
+}
+
+func (n *inotifyNotifier) Close() error {
+	return n.file.Close()
+}
+
+// readEvents turns inotify events into changed directory paths: the directory
+// a file changed in, or a directory that was created or removed
+func (n *inotifyNotifier) readEvents() {
+	defer close(n.events)
+
+	buf := make([]byte, 64*1024)
+	for {
+		count, err := n.file.Read(buf)
+		if err != nil {
+			return
+		}
+
+		for offset := 0; offset+unix.SizeofInotifyEvent <= count; {
+			wd := int(int32(binary.NativeEndian.Uint32(buf[offset:])))
+			mask := binary.NativeEndian.Uint32(buf[offset+4:])
+			nameLen := int(binary.NativeEndian.Uint32(buf[offset+12:]))
+			nameStart := offset + unix.SizeofInotifyEvent
+			if nameStart+nameLen > count {
+				break
+			}
+			name := strings.TrimRight(string(buf[nameStart:nameStart+nameLen]), "\x00")
+			offset = nameStart + nameLen
+
+			if mask&unix.IN_Q_OVERFLOW != 0 {
+				// Events were lost, the watcher rescans everything
+				n.events <- ""
+				continue
+			}
+
+			n.mu.Lock()
+			dir, ok := n.watches[wd]
+			if mask&unix.IN_IGNORED != 0 {
+				delete(n.watches, wd)
+				if n.dirs[dir] == wd {
+					delete(n.dirs, dir)
+				}
+			}
+			n.mu.Unlock()
+			if !ok || mask&unix.IN_IGNORED != 0 {
+				continue
+			}
+
+			switch {
+			case mask&unix.IN_DELETE_SELF != 0:
+				n.events <- dir
+			case mask&unix.IN_ISDIR != 0 && name != "":
+				n.events <- filepath.Join(dir, name)
+			default:
+				n.events <- dir
+			}
+		}
+	}
+}
+
+// isNetworkMount reports whether a path is on a filesystem inotify can't
+// fully observe
+func isNetworkMount(path string) bool {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(path, &stat); err != nil {
+		return false
+	}
+	return networkFilesystems[uint32(stat.Type)]
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package library
+
+import "errors"
+
+// Filesystem events are only implemented with inotify; other platforms poll
+func newDirNotifier() (dirNotifier, error) {
+	return nil, errors.New("filesystem notifications are not supported on this platform")
+}
+
+func isNetworkMount(path string) bool {
+	return false
+}
@@ -0,0 +1,434 @@
+package library
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/openflix/openflix-server/internal/models"
+	"gorm.io/gorm"
+)
+
+// Photo file extensions
+var photoExtensions = map[string]bool{
+	".jpg": true, ".jpeg": true, ".png": true, ".heic": true, ".heif": true,
+}
+
+// Camera RAW extensions. A RAW file next to a JPEG or HEIC with the same name
+// is treated as a sidecar and becomes a second part of that photo.
+var rawExtensions = map[string]bool{
+	".cr2": true, ".cr3": true, ".nef": true, ".arw": true, ".dng": true,
+	".orf": true, ".rw2": true, ".raf": true, ".pef": true, ".srw": true,
+}
+
+// PhotoThumbSizes are the widths, in pixels, of the cached photo thumbnails
+var PhotoThumbSizes = []int{240, 720, 1920}
+
+// PhotoThumbPath returns where the thumbnail of a photo is cached
+func PhotoThumbPath(dataDir string, itemID uint, size int) string {
+	return filepath.Join(dataDir, "metadata", "photos", fmt.Sprintf("%d", itemID), fmt.Sprintf("%d.jpg", size))
+}
+
+// isPhotoFile reports whether a path is a photo or RAW file
+func isPhotoFile(filePath string) bool {
+	ext := strings.ToLower(filepath.Ext(filePath))
+	return photoExtensions[ext] || rawExtensions[ext]
+}
+
+// photoSiblings returns files in the same folder with the same base name and
+// one of the given extensions
+func photoSiblings(filePath string, extensions map[string]bool) []string {
+	dir := filepath.Dir(filePath)
+	base := strings.TrimSuffix(filepath.Base(filePath), filepath.Ext(filePath))
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+
+	var siblings []string
+	for _, entry := range entries {
+		name := entry.Name()
+		ext := filepath.Ext(name)
+		if entry.IsDir() || !extensions[strings.ToLower(ext)] || !strings.EqualFold(strings.TrimSuffix(name, ext), base) {
+			continue
+		}
+		if path := filepath.Join(dir, name); path != filePath {
+			siblings = append(siblings, path)
+		}
+	}
+	return siblings
+}
+
+// photoProbe is what the probe read from a photo and the RAW sidecars added
+// with it, by path
+type photoProbe map[string]*exifResult
+
+// probePhoto reads the EXIF data of a new or changed photo, outside the
+// writer's transaction. A new photo's size is read too, and that of the files
+// grouped with it: its RAW sidecars, or the photo a RAW file is a sidecar of.
+func (s *Scanner) probePhoto(filePath string, isNew bool) photoProbe {
+	if !isNew {
+		return photoProbe{filePath: s.readPhoto(filePath, false)}
+	}
+
+	primary := filePath
+	if rawExtensions[strings.ToLower(filepath.Ext(filePath))] {
+		if primaries := photoSiblings(filePath, photoExtensions); len(primaries) > 0 {
+			primary = primaries[0]
+		}
+	}
+	probe := photoProbe{primary: s.readPhoto(primary, true)}
+	if !rawExtensions[strings.ToLower(filepath.Ext(primary))] {
+		for _, raw := range photoSiblings(primary, rawExtensions) {
+			probe[raw] = s.readPhoto(raw, true)
+		}
+	}
+	return probe
+}
+
+// readPhoto reads the EXIF data of a photo, and its size when wanted and
+// EXIF doesn't have it
+func (s *Scanner) readPhoto(filePath string, size bool) *exifResult {
+	exif, err := readExif(filePath)
+	if err != nil {
+		exif = &exifResult{}
+	}
+	if size && (exif.Width == 0 || exif.Height == 0) {
+		mediaInfo := s.getMediaInfo(filePath)
+		exif.Width, exif.Height = mediaInfo.Width, mediaInfo.Height
+	}
+	return exif
+}
+
+// exif returns what was probed from a file, or reads it now for a file the
+// probe didn't get to
+func (p photoProbe) exif(s *Scanner, filePath string, size bool) *exifResult {
+	if exif, ok := p[filePath]; ok {
+		return exif
+	}
+	return s.readPhoto(filePath, size)
+}
+
+// addPhoto adds a photo to the album for its folder
+func (s *Scanner) addPhoto(library *models.Library, filePath string, fileInfo os.FileInfo, probe photoProbe) error {
+	// Already added as the RAW sidecar of another photo
+	var count int64
+	s.db.Model(&models.MediaFile{}).Where("file_path = ?", filePath).Count(&count)
+	if count > 0 {
+		return nil
+	}
+
+	// RAW sidecars are added along with their JPEG/HEIC
+	isRaw := rawExtensions[strings.ToLower(filepath.Ext(filePath))]
+	if isRaw {
+		if primaries := photoSiblings(filePath, photoExtensions); len(primaries) > 0 {
+			info, err := os.Stat(primaries[0])
+			if err != nil {
+				return err
+			}
+			return s.addPhoto(library, primaries[0], info, probe)
+		}
+	}
+
+	exif := probe.exif(s, filePath, true)
+
+	// Date taken, or the file time for photos without EXIF
+	taken := fileInfo.ModTime()
+	if exif.TakenAt != nil {
+		taken = *exif.TakenAt
+	}
+
+	album, err := s.findOrCreatePhotoAlbum(library, filepath.Dir(filePath))
+	if err != nil {
+		return err
+	}
+
+	title := strings.TrimSuffix(filepath.Base(filePath), filepath.Ext(filePath))
+	item := models.MediaItem{
+		UUID:                  uuid.New().String(),
+		LibraryID:             library.ID,
+		Type:                  "photo",
+		Title:                 title,
+		SortTitle:             strings.ToLower(title),
+		Year:                  taken.Year(),
+		OriginallyAvailableAt: &taken,
+		AddedAt:               time.Now(),
+	}
+	if album != nil {
+		item.ParentID = &album.ID
+		item.ParentTitle = album.Title
+	}
+
+	if err := s.db.Create(&item).Error; err != nil {
+		return err
+	}
+
+	if err := s.createPhotoFile(&item, filePath, fileInfo, exif); err != nil {
+		return err
+	}
+	if !isRaw {
+		for _, raw := range photoSiblings(filePath, rawExtensions) {
+			if info, err := os.Stat(raw); err == nil {
+				// Only the size of a sidecar is kept
+				sidecar := probe.exif(s, raw, true)
+				s.createPhotoFile(&item, raw, info, &exifResult{Width: sidecar.Width, Height: sidecar.Height})
+			}
+		}
+	}
+
+	exif.MediaItemID = item.ID
+	s.db.Create(&exif.PhotoExif)
+
+	if album != nil {
+		s.refreshPhotoAlbums(album)
+	}
+
+	// Thumbnails are rendered once the photo is written, and the albums
+	// refreshed again to pick them up
+	orientation := exif.Orientation
+	s.afterWrite(func(s *Scanner) {
+		go func() {
+			s.generatePhotoThumbs(&item, filePath, orientation)
+			if album != nil {
+				s.refreshPhotoAlbums(album)
+			}
+		}()
+	})
+	return nil
+}
+
+// createPhotoFile creates the media file record for a photo or RAW sidecar,
+// with the size the probe read
+func (s *Scanner) createPhotoFile(item *models.MediaItem, filePath string, fileInfo os.FileInfo, exif *exifResult) error {
+	width, height := exif.Width, exif.Height
+	// Orientations 5-8 are rotated a quarter turn
+	if exif.Orientation >= 5 {
+		width, height = height, width
+	}
+
+	file := models.MediaFile{
+		MediaItemID: item.ID,
+		FilePath:    filePath,
+		FileSize:    fileInfo.Size(),
+		FileModTime: fileInfo.ModTime(),
+		Container:   strings.TrimPrefix(strings.ToLower(filepath.Ext(filePath)), "."),
+		Width:       width,
+		Height:      height,
+	}
+	if height > 0 {
+		file.AspectRatio = float64(width) / float64(height)
+	}
+
+	return s.db.Create(&file).Error
+}
+
+// updatePhoto re-reads a photo that changed on disk
+func (s *Scanner) updatePhoto(existingFile *models.MediaFile, filePath string, fileInfo os.FileInfo, probe photoProbe) error {
+	if err := s.db.Model(existingFile).Updates(map[string]interface{}{
+		"file_size":     fileInfo.Size(),
+		"file_mod_time": fileInfo.ModTime(),
+	}).Error; err != nil {
+		return err
+	}
+
+	// RAW sidecars don't drive the photo's metadata
+	if rawExtensions[strings.ToLower(filepath.Ext(filePath))] {
+		var primaries int64
+		s.db.Model(&models.MediaFile{}).Where("media_item_id = ? AND id <> ?", existingFile.MediaItemID, existingFile.ID).Count(&primaries)
+		if primaries > 0 {
+			return nil
+		}
+	}
+
+	var item models.MediaItem
+	if err := s.db.First(&item, existingFile.MediaItemID).Error; err != nil {
+		return err
+	}
+
+	exif := probe.exif(s, filePath, false)
+	taken := fileInfo.ModTime()
+	if exif.TakenAt != nil {
+		taken = *exif.TakenAt
+	}
+	s.db.Model(&item).Updates(map[string]interface{}{
+		"year":                    taken.Year(),
+		"originally_available_at": taken,
+	})
+
+	s.db.Where("media_item_id = ?", item.ID).Delete(&models.PhotoExif{})
+	exif.MediaItemID = item.ID
+	s.db.Create(&exif.PhotoExif)
+
+	orientation := exif.Orientation
+	s.afterWrite(func(s *Scanner) {
+		go s.generatePhotoThumbs(&item, filePath, orientation)
+	})
+	return nil
+}
+
+// findOrCreatePhotoAlbum returns the album for a folder, creating an album for
+// each folder between it and the library root. Photos at the root of a
+// library path have no album.
+func (s *Scanner) findOrCreatePhotoAlbum(library *models.Library, dir string) (*models.MediaItem, error) {
+	var paths []models.LibraryPath
+	s.db.Where("library_id = ?", library.ID).Find(&paths)
+
+	root := ""
+	for _, p := range paths {
+		clean := filepath.Clean(p.Path)
+		if (dir == clean || strings.HasPrefix(dir, clean+string(filepath.Separator))) && len(clean) > len(root) {
+			root = clean
+		}
+	}
+	if root == "" || dir == root {
+		return nil, nil
+	}
+
+	rel, err := filepath.Rel(root, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var album *models.MediaItem
+	for _, name := range strings.Split(rel, string(filepath.Separator)) {
+		var next models.MediaItem
+		query := s.db.Where("library_id = ? AND type = ? AND title = ?", library.ID, "photoalbum", name)
+		if album == nil {
+			query = query.Where("parent_id IS NULL")
+		} else {
+			query = query.Where("parent_id = ?", album.ID)
+		}
+
+		err := query.First(&next).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			next = models.MediaItem{
+				UUID:      uuid.New().String(),
+				LibraryID: library.ID,
+				Type:      "photoalbum",
+				Title:     name,
+				SortTitle: strings.ToLower(name),
+				AddedAt:   time.Now(),
+			}
+			if album != nil {
+				next.ParentID = &album.ID
+				next.ParentTitle = album.Title
+			}
+			if err := s.db.Create(&next).Error; err != nil {
+				return nil, err
+			}
+		} else if err != nil {
+			return nil, err
+		}
+		album = &next
+	}
+
+	return album, nil
+}
+
+// generatePhotoThumbs renders the cached thumbnails of a photo, upright
+// according to its EXIF orientation
+func (s *Scanner) generatePhotoThumbs(item *models.MediaItem, filePath string, orientation int) {
+	s.artworkMu.Lock()
+	defer s.artworkMu.Unlock()
+
+	dir := filepath.Dir(PhotoThumbPath(s.dataDir, item.ID, 0))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return
+	}
+
+	// EXIF orientation to ffmpeg filters
+	rotate := map[int]string{
+		2: "hflip,",
+		3: "hflip,vflip,",
+		4: "vflip,",
+		5: "transpose=0,",
+		6: "transpose=1,",
+		7: "transpose=3,",
+		8: "transpose=2,",
+	}[orientation]
+
+	// Decode once, then scale to every size
+	graph := fmt.Sprintf("[0:v]%ssplit=%d", rotate, len(PhotoThumbSizes))
+	for i := range PhotoThumbSizes {
+		graph += fmt.Sprintf("[s%d]", i)
+	}
+	var outputs []string
+	for i, size := range PhotoThumbSizes {
+		graph += fmt.Sprintf(";[s%d]scale='min(iw,%d)':'min(ih,%d)':force_original_aspect_ratio=decrease[t%d]", i, size, size, i)
+		outputs = append(outputs, "-map", fmt.Sprintf("[t%d]", i), "-frames:v", "1", "-q:v", "3", PhotoThumbPath(s.dataDir, item.ID, size))
+	}
+
+	args := append([]string{"-y", "-v", "quiet", "-noautorotate", "-i", filePath, "-filter_complex", graph}, outputs...)
+	if err := exec.Command(s.ffmpegBin, args...).Run(); err != nil {
+		return
+	}
+
+	item.Thumb = fmt.Sprintf("/library/metadata/%d/thumb", item.ID)
+	s.db.Model(item).Update("thumb", item.Thumb)
+}
+
+// refreshPhotoAlbums updates the counts and thumbnail of an album and of the
+// albums above it
+func (s *Scanner) refreshPhotoAlbums(album *models.MediaItem) {
+	for {
+		s.refreshPhotoAlbum(album.ID)
+		if album.ParentID == nil {
+			return
+		}
+		var parent models.MediaItem
+		if err := s.db.First(&parent, *album.ParentID).Error; err != nil {
+			return
+		}
+		album = &parent
+	}
+}
+
+// refreshPhotoAlbum updates an album's counts and uses its first photo, or the
+// thumbnail of its first sub-album, as the album thumbnail
+func (s *Scanner) refreshPhotoAlbum(albumID uint) {
+	var children, photos int64
+	s.db.Model(&models.MediaItem{}).Where("parent_id = ?", albumID).Count(&children)
+	s.db.Model(&models.MediaItem{}).Where("parent_id = ? AND type = ?", albumID, "photo").Count(&photos)
+
+	var first models.MediaItem
+	s.db.Where("parent_id = ? AND thumb <> ''", albumID).
+		Order("type ASC, originally_available_at ASC, sort_title ASC").First(&first)
+
+	s.db.Model(&models.MediaItem{}).Where("id = ?", albumID).Updates(map[string]interface{}{
+		"child_count": children,
+		"leaf_count":  photos,
+		"thumb":       first.Thumb,
+	})
+}
+
+// prunePhotoAlbums removes the cached data of a deleted photo and deletes
+// albums that are left empty, walking up the folder hierarchy
+func (s *Scanner) prunePhotoAlbums(photo *models.MediaItem) {
+	s.db.Where("media_item_id = ?", photo.ID).Delete(&models.PhotoExif{})
+	os.RemoveAll(filepath.Dir(PhotoThumbPath(s.dataDir, photo.ID, 0)))
+
+	parentID := photo.ParentID
+	for parentID != nil {
+		var album models.MediaItem
+		if err := s.db.First(&album, *parentID).Error; err != nil {
+			return
+		}
+
+		var count int64
+		s.db.Model(&models.MediaItem{}).Where("parent_id = ?", album.ID).Count(&count)
+		if count > 0 {
+			s.refreshPhotoAlbums(&album)
+			return
+		}
+
+		s.db.Delete(&album)
+		s.removeFromCollections(album.ID)
+		parentID = album.ParentID
+	}
+}
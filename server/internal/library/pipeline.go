@@ -0,0 +1,354 @@
+package library
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/openflix/openflix-server/internal/logger"
+	"github.com/openflix/openflix-server/internal/models"
+	"gorm.io/gorm"
+)
+
+// A scan runs as a pipeline: the walk of the library's folders feeds a pool
+// of workers running ffprobe on new and changed files, or reading the EXIF
+// data of photos, and a single writer stores what they found in batches, one
+// transaction per batch. Artwork is rendered once a batch is committed.
+
+// DefaultScanWorkers is how many files are probed at once by default
+const DefaultScanWorkers = 4
+
+const (
+	batchMaxFiles = 100         // files written per transaction
+	batchMaxTime  = time.Second // a transaction is committed at least this often
+)
+
+// SetScanWorkers sets how many files are probed at once during scans. In
+// I/O-friendly mode only one file per disk is probed at a time, so spinning
+// disks are read in order rather than seeking between files.
+func (s *Scanner) SetScanWorkers(workers int, ioFriendly bool) {
+	if workers <= 0 {
+		workers = DefaultScanWorkers
+	}
+	s.workers = workers
+	s.ioFriendly = ioFriendly
+}
+
+// foundFile is a media file found while walking a library
+type foundFile struct {
+	path string
+	info os.FileInfo
+}
+
+// scanTask is a found file on its way through the pipeline
+type scanTask struct {
+	foundFile
+	existing  *models.MediaFile // the file as the library knows it, if it does
+	replace   *models.MediaFile // an extra stored as something else, to add again
+	extra     bool
+	changed   bool       // new, or modified since it was last scanned
+	mediaInfo MediaInfo  // filled in by the probe
+	photo     photoProbe // filled in by the probe, for photos
+}
+
+// writeBatch collects the work a batch of files starts in the background.
+// It waits for the commit, as until then the rows it is for can't be seen.
+type writeBatch struct {
+	base     *Scanner
+	deferred []func()
+}
+
+// inBatch returns a copy of the scanner that writes in tx
+func (s *Scanner) inBatch(tx *gorm.DB, batch *writeBatch) *Scanner {
+	w := *s
+	w.db = tx
+	w.batch = batch
+	return &w
+}
+
+// afterWrite runs work once what the scanner has written can be seen by
+// others: straight away, or when the batch being written is committed
+func (s *Scanner) afterWrite(work func(s *Scanner)) {
+	if s.batch == nil {
+		work(s)
+		return
+	}
+	base := s.batch.base
+	s.batch.deferred = append(s.batch.deferred, func() { work(base) })
+}
+
+// scanFiles walks the roots, adding new files to the library and updating
+// changed ones, and returns the files found. Extras are added last, once the
+// movies and shows they belong to are.
+func (s *Scanner) scanFiles(ctx context.Context, library *models.Library, roots []string, existingFiles map[string]*models.MediaFile, result *ScanResult, job *ScanJob) map[string]bool {
+	found := make(chan foundFile, 256)
+	probes := make(chan *scanTask, 256)
+	writes := make(chan *scanTask, 256)
+
+	// Walk
+	var walkErrors []string
+	go func() {
+		defer close(found)
+		for _, root := range roots {
+			walkErrors = append(walkErrors, s.walkTree(ctx, library, root, found, job)...)
+		}
+	}()
+
+	// Sort the files found into those to probe and those to write straight away
+	foundFiles := make(map[string]bool)
+	var senders sync.WaitGroup
+	senders.Add(1)
+	go func() {
+		defer senders.Done()
+		defer close(probes)
+		for file := range found {
+			foundFiles[file.path] = true
+			if ctx.Err() != nil {
+				continue
+			}
+			task := s.newScanTask(library, file, existingFiles)
+			if task.changed {
+				probes <- task
+			} else {
+				writes <- task
+			}
+		}
+		job.setPhase(ScanPhaseProbe)
+	}()
+
+	// Probe
+	disks := newDiskSlots()
+	for i := 0; i < s.workers; i++ {
+		senders.Add(1)
+		go func() {
+			defer senders.Done()
+			for task := range probes {
+				if ctx.Err() != nil {
+					continue
+				}
+				release := func() {}
+				if s.ioFriendly {
+					release = disks.acquire(fileDevice(task.info))
+				}
+				// Photos carry EXIF data rather than stream info
+				if library.Type == "photo" {
+					task.photo = s.probePhoto(task.path, task.existing == nil)
+				} else {
+					task.mediaInfo = s.getMediaInfo(task.path)
+				}
+				release()
+				writes <- task
+			}
+		}()
+	}
+	go func() {
+		senders.Wait()
+		close(writes)
+	}()
+
+	// Write
+	var pending, extras []*scanTask
+	started := time.Now()
+	timer := time.NewTimer(batchMaxTime)
+	defer timer.Stop()
+	for done := false; !done; {
+		select {
+		case task, ok := <-writes:
+			switch {
+			case !ok:
+				done = true
+			case ctx.Err() != nil:
+			case task.extra && task.existing == nil:
+				extras = append(extras, task)
+			default:
+				if len(pending) == 0 {
+					started = time.Now()
+				}
+				pending = append(pending, task)
+			}
+		case <-timer.C:
+			timer.Reset(batchMaxTime)
+		}
+		if len(pending) >= batchMaxFiles || (len(pending) > 0 && (done || time.Since(started) >= batchMaxTime)) {
+			s.writeFiles(library, pending, result, job)
+			pending = nil
+		}
+	}
+	for len(extras) > 0 && ctx.Err() == nil {
+		n := min(len(extras), batchMaxFiles)
+		s.writeFiles(library, extras[:n], result, job)
+		extras = extras[n:]
+	}
+
+	// The walk has finished once writes is closed
+	result.FilesFound += len(foundFiles)
+	result.Errors = append(result.Errors, walkErrors...)
+	return foundFiles
+}
+
+// walkTree sends the media files under root to found and returns the errors
+// met on the way
+func (s *Scanner) walkTree(ctx context.Context, library *models.Library, root string, found chan<- foundFile, job *ScanJob) []string {
+	extensions := libraryExtensions(library.Type)
+	var errs []string
+
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if ctx.Err() != nil {
+			return filepath.SkipAll
+		}
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("Error accessing %s: %v", path, err))
+			return nil
+		}
+
+		if info.IsDir() {
+			job.walking(path)
+			return nil
+		}
+
+		ext := strings.ToLower(filepath.Ext(path))
+		if !extensions[ext] {
+			return nil
+		}
+
+		job.foundFile()
+		found <- foundFile{path: path, info: info}
+		return nil
+	})
+
+	if err != nil {
+		errs = append(errs, fmt.Sprintf("Error walking %s: %v", root, err))
+	}
+	return errs
+}
+
+// newScanTask works out what a found file needs
+func (s *Scanner) newScanTask(library *models.Library, file foundFile, existingFiles map[string]*models.MediaFile) *scanTask {
+	task := &scanTask{foundFile: file, existing: existingFiles[file.path]}
+	if library.Type == "movie" || library.Type == "show" {
+		_, _, _, task.extra = extraInfo(file.path)
+	}
+
+	// Extras scanned before they were recognized as such are added again
+	if task.existing != nil && task.extra && !s.isExtraFile(task.existing) {
+		task.replace = task.existing
+		task.existing = nil
+	}
+
+	task.changed = task.existing == nil ||
+		file.info.Size() != task.existing.FileSize || !file.info.ModTime().Equal(task.existing.FileModTime)
+	return task
+}
+
+// scanOutcome is what writing a scanned file did
+type scanOutcome int
+
+const (
+	scanUnchanged scanOutcome = iota
+	scanAdded
+	scanUpdated
+)
+
+// writeFiles writes a batch of scanned files in one transaction. Each file
+// gets a savepoint, so one that fails doesn't take the others with it.
+func (s *Scanner) writeFiles(library *models.Library, tasks []*scanTask, result *ScanResult, job *ScanJob) {
+	outcomes := make([]scanOutcome, len(tasks))
+	failures := make([]error, len(tasks))
+	batch := &writeBatch{base: s}
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		for i, task := range tasks {
+			job.processing(task.path)
+			fileBatch := &writeBatch{base: s}
+			failures[i] = tx.Transaction(func(tx *gorm.DB) error {
+				var err error
+				outcomes[i], err = s.inBatch(tx, fileBatch).writeFile(library, task)
+				return err
+			})
+			if failures[i] == nil {
+				batch.deferred = append(batch.deferred, fileBatch.deferred...)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		logger.Warnf("Failed to write a batch of %d scanned files: %v", len(tasks), err)
+		for i := range failures {
+			failures[i] = err
+		}
+	} else {
+		for _, work := range batch.deferred {
+			work()
+		}
+	}
+
+	for i, task := range tasks {
+		switch {
+		case failures[i] != nil && task.existing != nil:
+			result.Errors = append(result.Errors, fmt.Sprintf("Error updating %s: %v", task.path, failures[i]))
+		case failures[i] != nil:
+			result.Errors = append(result.Errors, fmt.Sprintf("Error adding %s: %v", task.path, failures[i]))
+		case outcomes[i] == scanAdded:
+			result.FilesAdded++
+		case outcomes[i] == scanUpdated:
+			result.FilesUpdated++
+		}
+		job.processed(failures[i] != nil)
+	}
+}
+
+// writeFile adds a new file to the library or updates a known one
+func (s *Scanner) writeFile(library *models.Library, task *scanTask) (scanOutcome, error) {
+	if task.replace != nil {
+		s.removeMediaFileByID(task.replace)
+	}
+
+	if task.existing != nil {
+		if task.changed && isPhotoFile(task.path) {
+			return scanUpdated, s.updatePhoto(task.existing, task.path, task.info, task.photo)
+		}
+		if task.changed {
+			return scanUpdated, s.updateMediaFile(task.existing, task.path, task.info, task.mediaInfo)
+		}
+		if videoExtensions[strings.ToLower(filepath.Ext(task.path))] && s.refreshSidecarSubtitles(task.existing) {
+			return scanUpdated, nil
+		}
+		return scanUnchanged, nil
+	}
+
+	if task.extra {
+		return scanAdded, s.addExtra(library, task.path, task.info, task.mediaInfo)
+	}
+	if library.Type == "photo" {
+		return scanAdded, s.addPhoto(library, task.path, task.info, task.photo)
+	}
+	return scanAdded, s.addMediaFile(library, task.path, task.info, task.mediaInfo)
+}
+
+// diskSlots lets one probe at a time read from each disk
+type diskSlots struct {
+	mu    sync.Mutex
+	slots map[uint64]*sync.Mutex
+}
+
+func newDiskSlots() *diskSlots {
+	return &diskSlots{slots: make(map[uint64]*sync.Mutex)}
+}
+
+// acquire waits for the disk to be free and returns the function freeing it
+func (d *diskSlots) acquire(device uint64) func() {
+	d.mu.Lock()
+	slot, ok := d.slots[device]
+	if !ok {
+		slot = &sync.Mutex{}
+		d.slots[device] = slot
+	}
+	d.mu.Unlock()
+
+	slot.Lock()
+	return slot.Unlock
+}
@@ -0,0 +1,168 @@
+package library
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/openflix/openflix-server/internal/db"
+	"github.com/openflix/openflix-server/internal/models"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// benchmarkFiles is how many media files the scan benchmarks add
+const benchmarkFiles = 200
+
+// fakeProbe is an ffprobe that takes a while to answer, as a real one does
+// reading a file's headers, and reports an hour-long H.264 video
+const fakeProbe = `#!/bin/sh
+sleep 0.02
+cat <<'JSON'
+{"format":{"duration":"3600.0","bit_rate":"8000000"},
+ "streams":[{"index":0,"codec_type":"video","codec_name":"h264","width":1920,"height":1080},
+            {"index":1,"codec_type":"audio","codec_name":"aac","channels":2}]}
+JSON
+`
+
+// installFakeTools puts a fake ffprobe, and an ffmpeg doing nothing, first on
+// PATH
+func installFakeTools(tb testing.TB) {
+	tb.Helper()
+	if runtime.GOOS == "windows" {
+		tb.Skip("the fake tools are shell scripts")
+	}
+	bin := tb.TempDir()
+	for name, script := range map[string]string{"ffprobe": fakeProbe, "ffmpeg": "#!/bin/sh\nexit 0\n"} {
+		if err := os.WriteFile(filepath.Join(bin, name), []byte(script), 0755); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	tb.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+// testLibrary creates a library of empty files, by their paths under its
+// root, in a new database
+func testLibrary(tb testing.TB, libraryType string, files []string) (*gorm.DB, *models.Library) {
+	tb.Helper()
+	dir := tb.TempDir()
+	gdb, err := gorm.Open(sqlite.Open(filepath.Join(dir, "openflix.db")+"?_journal_mode=WAL&_busy_timeout=5000&_txlock=immediate"),
+		&gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	sqlDB, err := gdb.DB()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { sqlDB.Close() })
+	if err := db.Migrate(gdb); err != nil {
+		tb.Fatal(err)
+	}
+
+	root := filepath.Join(dir, "media")
+	for _, file := range files {
+		path := filepath.Join(root, file)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			tb.Fatal(err)
+		}
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			tb.Fatal(err)
+		}
+	}
+
+	library := &models.Library{UUID: "test-" + libraryType, Title: "Test", Type: libraryType}
+	if err := gdb.Create(library).Error; err != nil {
+		tb.Fatal(err)
+	}
+	if err := gdb.Create(&models.LibraryPath{LibraryID: library.ID, Path: root}).Error; err != nil {
+		tb.Fatal(err)
+	}
+	return gdb, library
+}
+
+func TestScanPhotos(t *testing.T) {
+	installFakeTools(t)
+	gdb, library := testLibrary(t, "photo", []string{"Trip/beach.jpg", "Trip/beach.cr2", "Trip/hotel.jpg"})
+	scanner := NewScanner(gdb, t.TempDir())
+
+	result, err := scanner.ScanLibrary(library)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.FilesAdded != 3 || len(result.Errors) > 0 {
+		t.Fatalf("added %d files, errors %v", result.FilesAdded, result.Errors)
+	}
+
+	// The RAW file is a second part of its JPEG, and sizes come from the probe
+	var photos []models.MediaItem
+	gdb.Where("library_id = ? AND type = ?", library.ID, "photo").Order("title").Preload("MediaFiles").Find(&photos)
+	if len(photos) != 2 || photos[0].Title != "beach" || len(photos[0].MediaFiles) != 2 {
+		t.Fatalf("photos = %+v", photos)
+	}
+	for _, file := range photos[0].MediaFiles {
+		if file.Width != 1920 || file.Height != 1080 {
+			t.Errorf("%s is %dx%d, want 1920x1080", file.FilePath, file.Width, file.Height)
+		}
+	}
+
+	// Thumbnails are rendered after the scan has written the photos, and the
+	// album picks one up
+	var album models.MediaItem
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		var pending int64
+		gdb.Model(&models.MediaItem{}).Where("library_id = ? AND thumb = ''", library.ID).Count(&pending)
+		if pending == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d items still have no thumbnail", pending)
+		}
+	}
+	gdb.Where("library_id = ? AND type = ?", library.ID, "photoalbum").First(&album)
+	if album.Title != "Trip" || album.LeafCount != 2 {
+		t.Errorf("album = %q with %d photos, want Trip with 2", album.Title, album.LeafCount)
+	}
+}
+
+// BenchmarkScan scans a new library with one probe worker and with the
+// default number. ffprobe is faked, so it measures the pipeline rather than
+// the disk.
+func BenchmarkScan(b *testing.B) {
+	installFakeTools(b)
+
+	files := make([]string, benchmarkFiles)
+	for i := range files {
+		name := fmt.Sprintf("Movie %04d (%d)", i, 1950+i%70)
+		files[i] = filepath.Join(name, name+".mkv")
+	}
+
+	for _, workers := range []int{1, DefaultScanWorkers} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				gdb, library := testLibrary(b, "movie", files)
+				scanner := NewScanner(gdb, b.TempDir())
+				scanner.SetScanWorkers(workers, false)
+				b.StartTimer()
+
+				result, err := scanner.ScanLibrary(library)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if result.FilesAdded != benchmarkFiles {
+					b.Fatalf("added %d files, want %d: %v", result.FilesAdded, benchmarkFiles, result.Errors)
+				}
+
+				// Local metadata is read in the background
+				b.StopTimer()
+				scanner.waitForMetadata(b.Context(), library.ID, nil)
+				b.StartTimer()
+			}
+		})
+	}
+}
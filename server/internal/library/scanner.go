@@ -1,6 +1,7 @@
 package library
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -10,38 +11,83 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/openflix/openflix-server/internal/metadata"
 	"github.com/openflix/openflix-server/internal/models"
+	"github.com/openflix/openflix-server/internal/search"
 	"gorm.io/gorm"
 )
 
 // Scanner handles media file discovery and metadata extraction
 type Scanner struct {
 	db         *gorm.DB
+	dataDir    string
 	ffprobeBin string
+	ffmpegBin  string
 	tmdb       *metadata.TMDBAgent
+	local      *metadata.LocalAgent
+	batch      *writeBatch // set on the copies writing a batch of scanned files
+
+	*scanState
 }
 
-// NewScanner creates a new scanner
-func NewScanner(db *gorm.DB) *Scanner {
+// scanState is shared between a scanner and the copies it writes batches with
+type scanState struct {
+	scanMu     sync.Mutex // one scan at a time
+	scans      *scanJobs
+	chapterMu  sync.Mutex // one file's chapter thumbnails at a time
+	artworkMu  sync.Mutex // one photo's thumbnails or album's cover at a time
+	workers    int        // files probed at once
+	ioFriendly bool       // probe one file per disk at a time
+
+	agentMu sync.RWMutex
+	agents  map[string]metadata.MetadataAgent // online agents by name
+
+	pendingMu    sync.Mutex
+	pendingShows map[uint]bool // new shows whose metadata is being fetched
+
+	orderMu sync.Mutex
+	orders  map[string]*absoluteOrder // absolute episode orders by agent and show
+	placeMu sync.Mutex                // one episode moved between seasons at a time
+
+	metadataMu      sync.Mutex
+	metadataPending map[uint]int64 // metadata fetches running in the background, by library
+}
+
+// NewScanner creates a new scanner. Extracted artwork is stored under dataDir.
+func NewScanner(db *gorm.DB, dataDir string) *Scanner {
 	// Try to find ffprobe
 	ffprobeBin := "ffprobe"
 	if path, err := exec.LookPath("ffprobe"); err == nil {
 		ffprobeBin = path
 	}
 
+	// ffmpeg is used to extract embedded cover art and chapter thumbnails
+	ffmpegBin := "ffmpeg"
+	if path, err := exec.LookPath("ffmpeg"); err == nil {
+		ffmpegBin = path
+	}
+
 	return &Scanner{
 		db:         db,
+		dataDir:    dataDir,
 		ffprobeBin: ffprobeBin,
+		ffmpegBin:  ffmpegBin,
+		local:      metadata.NewLocalAgent(db, dataDir),
+		scanState: &scanState{
+			scans:   newScanJobs(),
+			workers: DefaultScanWorkers,
+		},
 	}
 }
 
 // SetTMDBAgent sets the TMDB agent for metadata fetching
 func (s *Scanner) SetTMDBAgent(agent *metadata.TMDBAgent) {
 	s.tmdb = agent
+	s.SetAgent(agent)
 }
 
 // GetTMDBAgent returns the TMDB agent for metadata operations
@@ -68,6 +114,20 @@ type ScanResult struct {
 
 // ScanLibrary scans a library for media files
 func (s *Scanner) ScanLibrary(library *models.Library) (*ScanResult, error) {
+	return s.scanLibrary(context.Background(), library, nil)
+}
+
+// scanLibrary scans a library, reporting its progress to job. A cancelled
+// scan stops where it is and removes nothing.
+func (s *Scanner) scanLibrary(ctx context.Context, library *models.Library, job *ScanJob) (*ScanResult, error) {
+	s.scanMu.Lock()
+	defer s.scanMu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	job.setPhase(ScanPhaseWalk)
+
 	result := &ScanResult{
 		LibraryID: library.ID,
 		Errors:    []string{},
@@ -89,54 +149,14 @@ func (s *Scanner) ScanLibrary(library *models.Library) (*ScanResult, error) {
 		existingFiles[existingItems[i].FilePath] = &existingItems[i]
 	}
 
-	foundFiles := make(map[string]bool)
-
 	// Scan each path
-	for _, libPath := range paths {
-		err := filepath.Walk(libPath.Path, func(path string, info os.FileInfo, err error) error {
-			if err != nil {
-				result.Errors = append(result.Errors, fmt.Sprintf("Error accessing %s: %v", path, err))
-				return nil
-			}
-
-			if info.IsDir() {
-				return nil
-			}
-
-			ext := strings.ToLower(filepath.Ext(path))
-			if !videoExtensions[ext] {
-				return nil
-			}
-
-			result.FilesFound++
-			foundFiles[path] = true
-
-			// Check if file already exists
-			if existingFile, exists := existingFiles[path]; exists {
-				// Check if file was modified (size or mod time changed)
-				if info.Size() != existingFile.FileSize || !info.ModTime().Equal(existingFile.FileModTime) {
-					if err := s.updateMediaFile(existingFile, path, info); err != nil {
-						result.Errors = append(result.Errors, fmt.Sprintf("Error updating %s: %v", path, err))
-					} else {
-						result.FilesUpdated++
-					}
-				}
-				return nil
-			}
-
-			// Add new file
-			if err := s.addMediaFile(library, path, info); err != nil {
-				result.Errors = append(result.Errors, fmt.Sprintf("Error adding %s: %v", path, err))
-			} else {
-				result.FilesAdded++
-			}
-
-			return nil
-		})
-
-		if err != nil {
-			result.Errors = append(result.Errors, fmt.Sprintf("Error walking %s: %v", libPath.Path, err))
-		}
+	roots := make([]string, len(paths))
+	for i, libPath := range paths {
+		roots[i] = libPath.Path
+	}
+	foundFiles := s.scanFiles(ctx, library, roots, existingFiles, result, job)
+	if err := ctx.Err(); err != nil {
+		return result, err
 	}
 
 	// Remove files that no longer exist
@@ -154,13 +174,83 @@ func (s *Scanner) ScanLibrary(library *models.Library) (*ScanResult, error) {
 	return result, nil
 }
 
-// addMediaFile adds a new media file to the library
-func (s *Scanner) addMediaFile(library *models.Library, filePath string, info os.FileInfo) error {
-	// Parse filename to extract title info
-	parsed := s.parseFilename(filePath, library.Type)
+// ScanDirectory scans a single directory of a library, and the directories
+// below it, without touching the rest of the library. Files that were under
+// the directory but are gone, including when the directory itself was
+// removed, are removed from the library.
+func (s *Scanner) ScanDirectory(library *models.Library, dir string) (*ScanResult, error) {
+	s.scanMu.Lock()
+	defer s.scanMu.Unlock()
 
-	// Get media info from ffprobe
-	mediaInfo := s.getMediaInfo(filePath)
+	result := &ScanResult{
+		LibraryID: library.ID,
+		Errors:    []string{},
+	}
+
+	// Subtitles belong to the videos a level or two up
+	dir = subtitleOwnerDir(filepath.Clean(dir))
+	prefix := dir + string(filepath.Separator)
+
+	// Only files under this directory are candidates for removal
+	existingFiles := make(map[string]*models.MediaFile)
+	var existingItems []models.MediaFile
+	s.db.Joins("JOIN media_items ON media_items.id = media_files.media_item_id").
+		Where("media_items.library_id = ? AND media_files.file_path LIKE ? ESCAPE '\\'", library.ID, escapeLike(prefix)+"%").
+		Find(&existingItems)
+	for i := range existingItems {
+		if strings.HasPrefix(existingItems[i].FilePath, prefix) {
+			existingFiles[existingItems[i].FilePath] = &existingItems[i]
+		}
+	}
+
+	foundFiles := make(map[string]bool)
+	if _, err := os.Stat(dir); err == nil {
+		foundFiles = s.scanFiles(context.Background(), library, []string{dir}, existingFiles, result, nil)
+	} else if !os.IsNotExist(err) {
+		// Leave the library alone if the directory can't be read right now
+		return nil, err
+	}
+
+	for path := range existingFiles {
+		if !foundFiles[path] {
+			s.removeMediaFile(path)
+			result.FilesRemoved++
+		}
+	}
+
+	return result, nil
+}
+
+// libraryExtensions returns the file extensions scanned for a library type.
+// Music libraries pick up audio files, photo libraries images, everything
+// else video files.
+func libraryExtensions(libraryType string) map[string]bool {
+	switch {
+	case isMusicLibrary(libraryType):
+		return audioExtensions
+	case libraryType == "photo":
+		extensions := make(map[string]bool, len(photoExtensions)+len(rawExtensions))
+		for ext := range photoExtensions {
+			extensions[ext] = true
+		}
+		for ext := range rawExtensions {
+			extensions[ext] = true
+		}
+		return extensions
+	}
+	return videoExtensions
+}
+
+// escapeLike escapes the wildcards of a LIKE pattern
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// addMediaFile adds a new media file to the library, with the media info
+// probed from it
+func (s *Scanner) addMediaFile(library *models.Library, filePath string, info os.FileInfo, mediaInfo MediaInfo) error {
+	// Parse filename to extract title info
+	parsed := s.parseFilename(filePath, library)
 
 	// Create media item based on library type
 	switch library.Type {
@@ -168,6 +258,8 @@ func (s *Scanner) addMediaFile(library *models.Library, filePath string, info os
 		return s.addMovie(library, filePath, info, parsed, mediaInfo)
 	case "show":
 		return s.addEpisode(library, filePath, info, parsed, mediaInfo)
+	case "music", "artist":
+		return s.addTrack(library, filePath, info, mediaInfo)
 	default:
 		return s.addGenericMedia(library, filePath, info, parsed, mediaInfo)
 	}
@@ -180,18 +272,26 @@ type ParsedFilename struct {
 	Season      int
 	Episode     int
 	EpisodeEnd  int // For multi-episode files
+	Absolute    int // Episode number counted from the start of the show
 	Resolution  string
 	Quality     string
 	ReleaseType string
+	Edition     string // e.g. "Director's Cut"
 }
 
 // parseFilename extracts information from a filename
-func (s *Scanner) parseFilename(filePath string, libraryType string) ParsedFilename {
+func (s *Scanner) parseFilename(filePath string, library *models.Library) ParsedFilename {
+	libraryType := library.Type
 	filename := filepath.Base(filePath)
 	name := strings.TrimSuffix(filename, filepath.Ext(filename))
 
 	parsed := ParsedFilename{}
 
+	// Editions: "{edition-Director's Cut}" or a " - Extended" suffix
+	if libraryType == "movie" {
+		name, parsed.Edition = parseEdition(name)
+	}
+
 	// Clean up common separators
 	name = strings.ReplaceAll(name, ".", " ")
 	name = strings.ReplaceAll(name, "_", " ")
@@ -215,6 +315,11 @@ func (s *Scanner) parseFilename(filePath string, libraryType string) ParsedFilen
 	}
 
 	if libraryType == "show" {
+		absolute := library.EpisodeOrder == EpisodeOrderAbsolute
+		if absolute {
+			name = stripReleaseTags(name)
+		}
+
 		// TV Show patterns: S01E01, 1x01, Season 1 Episode 1
 		patterns := []*regexp.Regexp{
 			regexp.MustCompile(`(?i)S(\d{1,2})E(\d{1,3})(?:-?E(\d{1,3}))?`), // S01E01 or S01E01-E02
@@ -235,9 +340,15 @@ func (s *Scanner) parseFilename(filePath string, libraryType string) ParsedFilen
 				if idx != nil {
 					parsed.Title = strings.TrimSpace(name[:idx[0]])
 				}
+				absolute = false
 				break
 			}
 		}
+
+		// Anime: "Show - 137", "Show - OVA"
+		if absolute {
+			parseAbsolute(name, &parsed)
+		}
 	}
 
 	// Extract year
@@ -275,22 +386,31 @@ type MediaInfo struct {
 	Width       int
 	Height      int
 	VideoCodec  string
+	ColorSpace  string
+	ColorTrc    string // color transfer
+	BitDepth    int
+	DOVIProfile int // Dolby Vision profile, 0 if none
 	AudioCodec  string
-	AudioLang   string
+	Audio       []StreamInfo // every audio stream, the first being AudioCodec
+	Subtitles   []StreamInfo // embedded subtitles
 	Container   string
 	Bitrate     int64
 	HasSubtitle bool
+	CoverStream int // index of an embedded cover art stream, -1 if none
+	Tags        map[string]string
+	Chapters    []ChapterInfo
 }
 
 // getMediaInfo uses ffprobe to get media information
 func (s *Scanner) getMediaInfo(filePath string) MediaInfo {
-	info := MediaInfo{}
+	info := MediaInfo{CoverStream: -1, Tags: map[string]string{}}
 
 	cmd := exec.Command(s.ffprobeBin,
 		"-v", "quiet",
 		"-print_format", "json",
 		"-show_format",
 		"-show_streams",
+		"-show_chapters",
 		filePath,
 	)
 
@@ -301,18 +421,38 @@ func (s *Scanner) getMediaInfo(filePath string) MediaInfo {
 
 	var probe struct {
 		Format struct {
-			Duration string `json:"duration"`
-			BitRate  string `json:"bit_rate"`
+			Duration string            `json:"duration"`
+			BitRate  string            `json:"bit_rate"`
+			Tags     map[string]string `json:"tags"`
 		} `json:"format"`
 		Streams []struct {
-			CodecType string `json:"codec_type"`
-			CodecName string `json:"codec_name"`
-			Width     int    `json:"width"`
-			Height    int    `json:"height"`
-			Tags      struct {
-				Language string `json:"language"`
-			} `json:"tags"`
+			Index      int    `json:"index"`
+			CodecType  string `json:"codec_type"`
+			CodecName  string `json:"codec_name"`
+			Width      int    `json:"width"`
+			Height     int    `json:"height"`
+			Channels   int    `json:"channels"`
+			PixFmt     string `json:"pix_fmt"`
+			ColorSpace string `json:"color_space"`
+			ColorTrc   string `json:"color_transfer"`
+			BitsPerRaw string `json:"bits_per_raw_sample"`
+			SideData   []struct {
+				Type      string `json:"side_data_type"`
+				DVProfile int    `json:"dv_profile"`
+			} `json:"side_data_list"`
+			Disposition struct {
+				Default         int `json:"default"`
+				Forced          int `json:"forced"`
+				HearingImpaired int `json:"hearing_impaired"`
+				AttachedPic     int `json:"attached_pic"`
+			} `json:"disposition"`
+			Tags map[string]string `json:"tags"`
 		} `json:"streams"`
+		Chapters []struct {
+			StartTime string            `json:"start_time"`
+			EndTime   string            `json:"end_time"`
+			Tags      map[string]string `json:"tags"`
+		} `json:"chapters"`
 	}
 
 	if err := json.Unmarshal(output, &probe); err != nil {
@@ -329,67 +469,123 @@ func (s *Scanner) getMediaInfo(filePath string) MediaInfo {
 		info.Bitrate = br
 	}
 
+	// Container tags; tag names vary in case between formats
+	for k, v := range probe.Format.Tags {
+		info.Tags[strings.ToLower(k)] = v
+	}
+
 	// Get stream info
 	for _, stream := range probe.Streams {
 		switch stream.CodecType {
 		case "video":
+			// Cover art is exposed as a single-frame video stream
+			if stream.Disposition.AttachedPic == 1 {
+				if info.CoverStream < 0 {
+					info.CoverStream = stream.Index
+				}
+				continue
+			}
 			info.VideoCodec = stream.CodecName
 			info.Width = stream.Width
 			info.Height = stream.Height
+			info.ColorSpace = stream.ColorSpace
+			info.ColorTrc = stream.ColorTrc
+			info.BitDepth = bitDepth(stream.BitsPerRaw, stream.PixFmt)
+			for _, side := range stream.SideData {
+				if side.Type == "DOVI configuration record" {
+					info.DOVIProfile = side.DVProfile
+				}
+			}
 		case "audio":
+			info.Audio = append(info.Audio, StreamInfo{
+				Index:    stream.Index,
+				Codec:    stream.CodecName,
+				Language: stream.Tags["language"],
+				Title:    stream.Tags["title"],
+				Channels: stream.Channels,
+				Default:  stream.Disposition.Default == 1,
+			})
 			if info.AudioCodec == "" {
 				info.AudioCodec = stream.CodecName
-				info.AudioLang = stream.Tags.Language
+				// Ogg and Opus keep their comments on the audio stream
+				for k, v := range stream.Tags {
+					if _, ok := info.Tags[strings.ToLower(k)]; !ok {
+						info.Tags[strings.ToLower(k)] = v
+					}
+				}
 			}
 		case "subtitle":
 			info.HasSubtitle = true
+			info.Subtitles = append(info.Subtitles, StreamInfo{
+				Index:           stream.Index,
+				Codec:           stream.CodecName,
+				Language:        stream.Tags["language"],
+				Title:           stream.Tags["title"],
+				Default:         stream.Disposition.Default == 1,
+				Forced:          stream.Disposition.Forced == 1,
+				HearingImpaired: stream.Disposition.HearingImpaired == 1,
+			})
+		}
+	}
+
+	for _, chapter := range probe.Chapters {
+		start, err1 := strconv.ParseFloat(chapter.StartTime, 64)
+		end, err2 := strconv.ParseFloat(chapter.EndTime, 64)
+		if err1 != nil || err2 != nil || end <= start {
+			continue
 		}
+		info.Chapters = append(info.Chapters, ChapterInfo{
+			Title: chapter.Tags["title"],
+			Start: int64(start * 1000),
+			End:   int64(end * 1000),
+		})
 	}
 
 	return info
 }
 
-// addMovie adds a movie to the library
-func (s *Scanner) addMovie(library *models.Library, filePath string, fileInfo os.FileInfo, parsed ParsedFilename, mediaInfo MediaInfo) error {
-	// Create media item
-	item := models.MediaItem{
-		UUID:      uuid.New().String(),
-		LibraryID: library.ID,
-		Type:      "movie",
-		Title:     parsed.Title,
-		SortTitle: strings.ToLower(parsed.Title),
-		Year:      parsed.Year,
-		Duration:  mediaInfo.Duration,
-		AddedAt:   time.Now(),
-	}
-
-	if err := s.db.Create(&item).Error; err != nil {
-		return err
-	}
+// bitDepth is the bit depth of a video stream, from what ffprobe reports
+// or its pixel format ("yuv420p10le")
+func bitDepth(bitsPerRawSample, pixFmt string) int {
+	if bits, err := strconv.Atoi(bitsPerRawSample); err == nil && bits > 0 {
+		return bits
+	}
+	switch {
+	case pixFmt == "":
+		return 0
+	case strings.Contains(pixFmt, "12"):
+		return 12
+	case strings.Contains(pixFmt, "10"):
+		return 10
+	}
+	return 8
+}
 
-	// Fetch TMDB metadata in background (don't block scanning)
-	if s.tmdb != nil {
-		go func() {
-			if err := s.tmdb.UpdateMovieMetadata(&item); err != nil {
-				fmt.Printf("TMDB metadata fetch failed for %s: %v\n", item.Title, err)
-			}
-		}()
+// addMovie adds a movie to the library. A file of a movie already in the
+// library, such as a 4K copy or another edition, is added as a version of it.
+func (s *Scanner) addMovie(library *models.Library, filePath string, fileInfo os.FileInfo, parsed ParsedFilename, mediaInfo MediaInfo) error {
+	item := s.findMovieVersion(library, filePath, parsed)
+	if item == nil {
+		var err error
+		if item, err = s.newMovie(library, filePath, parsed, mediaInfo.Duration); err != nil {
+			return err
+		}
 	}
 
 	// Create media file
-	return s.createMediaFile(&item, filePath, fileInfo, mediaInfo)
+	return s.createMediaFile(item, filePath, fileInfo, mediaInfo)
 }
 
 // addEpisode adds a TV episode to the library
 func (s *Scanner) addEpisode(library *models.Library, filePath string, fileInfo os.FileInfo, parsed ParsedFilename, mediaInfo MediaInfo) error {
 	// Find or create show
-	show, err := s.findOrCreateShow(library, parsed.Title, parsed.Year)
+	show, err := s.findOrCreateShow(library, parsed.Title, parsed.Year, filePath)
 	if err != nil {
 		return err
 	}
 
 	// Find or create season
-	season, err := s.findOrCreateSeason(library, show, parsed.Season)
+	season, err := s.findOrCreateSeason(library, show, parsed.Season, filePath)
 	if err != nil {
 		return err
 	}
@@ -403,6 +599,7 @@ func (s *Scanner) addEpisode(library *models.Library, filePath string, fileInfo
 		ParentID:      &season.ID,
 		GrandparentID: &show.ID,
 		Index:         parsed.Episode,
+		AbsoluteIndex: parsed.Absolute,
 		Duration:      mediaInfo.Duration,
 		AddedAt:       time.Now(),
 	}
@@ -410,12 +607,18 @@ func (s *Scanner) addEpisode(library *models.Library, filePath string, fileInfo
 	if err := s.db.Create(&episode).Error; err != nil {
 		return err
 	}
+	search.IndexMediaItem(s.db, &episode)
 
-	return s.createMediaFile(&episode, filePath, fileInfo, mediaInfo)
+	if err := s.createMediaFile(&episode, filePath, fileInfo, mediaInfo); err != nil {
+		return err
+	}
+	s.fetchEpisodeMetadata(library, show, season, &episode, filePath)
+	return nil
 }
 
-// findOrCreateShow finds or creates a TV show
-func (s *Scanner) findOrCreateShow(library *models.Library, title string, year int) (*models.MediaItem, error) {
+// findOrCreateShow finds or creates a TV show. filePath is the episode that
+// introduces it, used to find the show folder.
+func (s *Scanner) findOrCreateShow(library *models.Library, title string, year int, filePath string) (*models.MediaItem, error) {
 	var show models.MediaItem
 
 	query := s.db.Where("library_id = ? AND type = ? AND title = ?", library.ID, "show", title)
@@ -438,15 +641,10 @@ func (s *Scanner) findOrCreateShow(library *models.Library, title string, year i
 			if err := s.db.Create(&show).Error; err != nil {
 				return nil, err
 			}
+			search.IndexMediaItem(s.db, &show)
 
-			// Fetch TMDB metadata for new show in background
-			if s.tmdb != nil {
-				go func() {
-					if err := s.tmdb.UpdateShowMetadata(&show); err != nil {
-						fmt.Printf("TMDB metadata fetch failed for show %s: %v\n", show.Title, err)
-					}
-				}()
-			}
+			// Fetch metadata for new show in background
+			s.fetchShowMetadata(library, &show, filePath)
 		} else {
 			return nil, err
 		}
@@ -456,7 +654,7 @@ func (s *Scanner) findOrCreateShow(library *models.Library, title string, year i
 }
 
 // findOrCreateSeason finds or creates a TV season
-func (s *Scanner) findOrCreateSeason(library *models.Library, show *models.MediaItem, seasonNum int) (*models.MediaItem, error) {
+func (s *Scanner) findOrCreateSeason(library *models.Library, show *models.MediaItem, seasonNum int, filePath string) (*models.MediaItem, error) {
 	var season models.MediaItem
 
 	if err := s.db.Where("library_id = ? AND type = ? AND parent_id = ? AND `index` = ?",
@@ -475,6 +673,7 @@ func (s *Scanner) findOrCreateSeason(library *models.Library, show *models.Media
 			if err := s.db.Create(&season).Error; err != nil {
 				return nil, err
 			}
+			s.fetchSeasonMetadata(library, show, &season, filePath)
 		} else {
 			return nil, err
 		}
@@ -518,6 +717,9 @@ func (s *Scanner) createMediaFile(item *models.MediaItem, filePath string, fileI
 		VideoCodec:  mediaInfo.VideoCodec,
 		AudioCodec:  mediaInfo.AudioCodec,
 	}
+	if item.Type == "movie" {
+		file.Edition = editionOf(filePath)
+	}
 
 	if err := s.db.Create(&file).Error; err != nil {
 		return err
@@ -525,15 +727,14 @@ func (s *Scanner) createMediaFile(item *models.MediaItem, filePath string, fileI
 
 	// Create stream records
 	s.createStreamRecords(&file, mediaInfo)
+	s.createChapters(&file, mediaInfo)
 
 	return nil
 }
 
-// updateMediaFile updates an existing media file that was modified
-func (s *Scanner) updateMediaFile(existingFile *models.MediaFile, filePath string, fileInfo os.FileInfo) error {
-	// Re-scan media info
-	mediaInfo := s.getMediaInfo(filePath)
-
+// updateMediaFile updates an existing media file that was modified, with the
+// media info probed from it again
+func (s *Scanner) updateMediaFile(existingFile *models.MediaFile, filePath string, fileInfo os.FileInfo, mediaInfo MediaInfo) error {
 	// Update file record
 	updates := map[string]interface{}{
 		"file_size":     fileInfo.Size(),
@@ -550,9 +751,11 @@ func (s *Scanner) updateMediaFile(existingFile *models.MediaFile, filePath strin
 		return err
 	}
 
-	// Delete old streams and recreate
+	// Delete old streams and chapters and recreate
 	s.db.Where("media_file_id = ?", existingFile.ID).Delete(&models.MediaStream{})
 	s.createStreamRecords(existingFile, mediaInfo)
+	s.removeChapters(existingFile.ID)
+	s.createChapters(existingFile, mediaInfo)
 
 	// Update media item duration if changed
 	if mediaInfo.Duration > 0 {
@@ -574,20 +777,26 @@ func (s *Scanner) createStreamRecords(file *models.MediaFile, mediaInfo MediaInf
 			Index:       0,
 			Width:       mediaInfo.Width,
 			Height:      mediaInfo.Height,
+			BitDepth:    mediaInfo.BitDepth,
+			ColorSpace:  mediaInfo.ColorSpace,
+			ColorTrc:    mediaInfo.ColorTrc,
+			DOVIProfile: mediaInfo.DOVIProfile,
 		}
 		s.db.Create(&videoStream)
 	}
 
-	// Create audio stream record
-	if mediaInfo.AudioCodec != "" {
-		audioStream := models.MediaStream{
-			MediaFileID: file.ID,
-			StreamType:  2, // 2=audio
-			Codec:       mediaInfo.AudioCodec,
-			Index:       1,
-			Language:    mediaInfo.AudioLang,
-		}
-		s.db.Create(&audioStream)
+	// Create a record for each audio and embedded subtitle stream, indexed
+	// as ffmpeg numbers them so transcodes can pick them
+	for _, audio := range mediaInfo.Audio {
+		s.db.Create(audio.record(file.ID, 2)) // 2=audio
+	}
+	for _, sub := range mediaInfo.Subtitles {
+		s.db.Create(sub.record(file.ID, 3)) // 3=subtitle
+	}
+
+	// Subtitle files next to videos
+	if videoExtensions[strings.ToLower(filepath.Ext(file.FilePath))] {
+		s.createSidecarStreams(file, findSidecarSubtitles(file.FilePath))
 	}
 }
 
@@ -602,16 +811,66 @@ func (s *Scanner) removeMediaFile(filePath string) {
 
 // removeMediaFileByID removes a media file that no longer exists (by ID)
 func (s *Scanner) removeMediaFileByID(file *models.MediaFile) {
-	// Delete streams
+	// Delete streams and chapters
 	s.db.Where("media_file_id = ?", file.ID).Delete(&models.MediaStream{})
+	s.removeChapters(file.ID)
 
 	// Delete file
 	s.db.Delete(file)
 
-	// Check if media item has other files, if not delete it
+	s.removeItemIfEmpty(file.MediaItemID)
+}
+
+// removeItemIfEmpty deletes a media item that has no files left
+func (s *Scanner) removeItemIfEmpty(itemID uint) {
 	var count int64
-	s.db.Model(&models.MediaFile{}).Where("media_item_id = ?", file.MediaItemID).Count(&count)
-	if count == 0 {
-		s.db.Delete(&models.MediaItem{}, file.MediaItemID)
+	s.db.Model(&models.MediaFile{}).Where("media_item_id = ?", itemID).Count(&count)
+	if count > 0 {
+		return
+	}
+
+	var item models.MediaItem
+	found := s.db.First(&item, itemID).Error == nil
+	if found {
+		search.RemoveMediaItem(s.db, &item)
+	}
+	s.db.Delete(&models.MediaItem{}, itemID)
+	s.removeFromCollections(itemID)
+	s.local.RemoveArtwork(itemID)
+	if found && item.Type == "track" {
+		s.pruneMusicParents(&item)
+	}
+	if found && item.Type == "photo" {
+		s.prunePhotoAlbums(&item)
+	}
+	if found && (item.Type == "movie" || item.Type == "show") {
+		var library models.Library
+		if s.db.First(&library, item.LibraryID).Error == nil {
+			s.rehomeExtras(&library, item.ID)
+		}
+	}
+}
+
+// removeFromCollections drops a deleted media item from any collections it was
+// part of and refreshes their child counts. Empty TMDB franchise collections
+// are removed along with their last movie.
+func (s *Scanner) removeFromCollections(mediaItemID uint) {
+	var collectionIDs []uint
+	s.db.Model(&models.CollectionItem{}).Where("media_item_id = ?", mediaItemID).Pluck("collection_id", &collectionIDs)
+	if len(collectionIDs) == 0 {
+		return
+	}
+
+	s.db.Where("media_item_id = ?", mediaItemID).Delete(&models.CollectionItem{})
+
+	for _, collectionID := range collectionIDs {
+		var count int64
+		s.db.Model(&models.CollectionItem{}).Where("collection_id = ?", collectionID).Count(&count)
+		if count == 0 {
+			if s.db.Where("id = ? AND tmdb_collection_id > 0", collectionID).Delete(&models.Collection{}).RowsAffected > 0 {
+				continue
+			}
+		}
+		s.db.Model(&models.Collection{}).Where("id = ?", collectionID).Update("child_count", count)
 	}
 }
@@ -16,6 +16,8 @@ var (
 	ErrPathNotFound    = errors.New("path not found")
 	ErrInvalidPath     = errors.New("invalid path")
 	ErrPathExists      = errors.New("path already exists in library")
+	ErrInvalidAgent    = errors.New("unknown metadata agent")
+	ErrInvalidRule     = errors.New("invalid metadata merge rule")
 )
 
 // Service handles library operations
@@ -38,13 +40,22 @@ type CreateLibraryInput struct {
 	Type     string   `json:"type" binding:"required"` // movie, show, music, photo
 	Language string   `json:"language,omitempty"`
 	Paths    []string `json:"paths,omitempty"`
+	Agents   []string `json:"agents,omitempty"` // metadata agents, highest priority first
+	// Agents to take a field from, e.g. {"episode.title": ["tvdb"], "rating": ["omdb", "tmdb"]}
+	AgentRules map[string][]string `json:"agentRules,omitempty"`
+	// How episode files are numbered: "aired" (default) or "absolute"
+	EpisodeOrder string `json:"episodeOrder,omitempty"`
 }
 
 // UpdateLibraryInput contains library update data
 type UpdateLibraryInput struct {
-	Title    string `json:"title,omitempty"`
-	Language string `json:"language,omitempty"`
-	Hidden   *bool  `json:"hidden,omitempty"`
+	Title      string              `json:"title,omitempty"`
+	Language   string              `json:"language,omitempty"`
+	Hidden     *bool               `json:"hidden,omitempty"`
+	Agents     []string            `json:"agents,omitempty"`
+	AgentRules map[string][]string `json:"agentRules,omitempty"`
+	// Applies to files scanned from then on
+	EpisodeOrder string `json:"episodeOrder,omitempty"`
 }
 
 // CreateLibrary creates a new library
@@ -64,13 +75,29 @@ func (s *Service) CreateLibrary(input CreateLibraryInput) (*models.Library, erro
 	agent := "tv.openflix.agents." + input.Type
 	scanner := "OpenFlix " + strings.Title(input.Type)
 
+	agents, err := formatAgents(input.Agents)
+	if err != nil {
+		return nil, err
+	}
+	rules, err := formatRules(input.AgentRules)
+	if err != nil {
+		return nil, err
+	}
+	episodeOrder, err := formatEpisodeOrder(input.EpisodeOrder)
+	if err != nil {
+		return nil, err
+	}
+
 	library := models.Library{
-		UUID:     uuid.New().String(),
-		Title:    input.Title,
-		Type:     input.Type,
-		Agent:    agent,
-		Scanner:  scanner,
-		Language: input.Language,
+		UUID:         uuid.New().String(),
+		Title:        input.Title,
+		Type:         input.Type,
+		Agent:        agent,
+		Scanner:      scanner,
+		EpisodeOrder: episodeOrder,
+		Language:     input.Language,
+		Agents:       agents,
+		AgentRules:   rules,
 	}
 
 	if err := s.db.Create(&library).Error; err != nil {
@@ -129,6 +156,27 @@ func (s *Service) UpdateLibrary(id uint, input UpdateLibraryInput) (*models.Libr
 	if input.Hidden != nil {
 		updates["hidden"] = *input.Hidden
 	}
+	if input.Agents != nil {
+		agents, err := formatAgents(input.Agents)
+		if err != nil {
+			return nil, err
+		}
+		updates["agents"] = agents
+	}
+	if input.AgentRules != nil {
+		rules, err := formatRules(input.AgentRules)
+		if err != nil {
+			return nil, err
+		}
+		updates["agent_rules"] = rules
+	}
+	if input.EpisodeOrder != "" {
+		episodeOrder, err := formatEpisodeOrder(input.EpisodeOrder)
+		if err != nil {
+			return nil, err
+		}
+		updates["episode_order"] = episodeOrder
+	}
 
 	if len(updates) > 0 {
 		if err := s.db.Model(library).Updates(updates).Error; err != nil {
@@ -213,9 +261,10 @@ func (s *Service) GetLibraryPaths(libraryID uint) ([]models.LibraryPath, error)
 	return paths, nil
 }
 
-// GetMediaItemCount returns the number of media items in a library
+// GetMediaItemCount returns the number of media items in a library, not
+// counting extras
 func (s *Service) GetMediaItemCount(libraryID uint) int64 {
 	var count int64
-	s.db.Model(&models.MediaItem{}).Where("library_id = ?", libraryID).Count(&count)
+	s.db.Model(&models.MediaItem{}).Where("library_id = ? AND type <> ?", libraryID, "extra").Count(&count)
 	return count
 }
@@ -0,0 +1,96 @@
+package library
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/openflix/openflix-server/internal/models"
+)
+
+// StreamInfo is an audio or subtitle stream as ffprobe reports it
+type StreamInfo struct {
+	Index           int // the stream's index in the file, as ffmpeg maps it
+	Codec           string
+	Language        string // as tagged, usually ISO 639-2
+	Title           string
+	Channels        int
+	Default         bool
+	Forced          bool
+	HearingImpaired bool
+}
+
+// Embedded subtitle codecs under the names sidecar subtitles are recorded with
+var subtitleCodecNames = map[string]string{
+	"subrip":            "srt",
+	"webvtt":            "vtt",
+	"hdmv_pgs_subtitle": "pgs",
+	"dvd_subtitle":      "vobsub",
+	"dvb_subtitle":      "dvbsub",
+}
+
+// record makes the stream record of an embedded stream of a file
+func (info StreamInfo) record(fileID uint, streamType int) *models.MediaStream {
+	codec := info.Codec
+	if name, ok := subtitleCodecNames[codec]; ok && streamType == 3 {
+		codec = name
+	}
+	lang, _ := lookupLanguage(info.Language)
+	stream := &models.MediaStream{
+		MediaFileID:     fileID,
+		StreamType:      streamType,
+		Index:           info.Index,
+		Codec:           codec,
+		Language:        lang.Name,
+		LanguageCode:    lang.Code,
+		Title:           info.Title,
+		Default:         info.Default,
+		Forced:          info.Forced,
+		HearingImpaired: info.HearingImpaired,
+		Channels:        info.Channels,
+	}
+	if stream.Language == "" && info.Language != "und" {
+		stream.Language = info.Language
+	}
+
+	// "English (AC3 5.1)", "English Forced (PGS)"
+	parts := []string{"Unknown"}
+	if stream.Language != "" {
+		parts[0] = stream.Language
+	}
+	if info.Forced {
+		parts = append(parts, "Forced")
+	}
+	if info.HearingImpaired {
+		parts = append(parts, "SDH")
+	}
+	format := strings.ToUpper(codec)
+	if info.Channels > 0 {
+		format += " " + channelLayoutName(info.Channels)
+	}
+	stream.DisplayTitle = fmt.Sprintf("%s (%s)", strings.Join(parts, " "), format)
+	return stream
+}
+
+// channelLayoutName names a channel count the way players show it
+func channelLayoutName(channels int) string {
+	switch channels {
+	case 1:
+		return "Mono"
+	case 2:
+		return "Stereo"
+	case 6:
+		return "5.1"
+	case 8:
+		return "7.1"
+	}
+	return fmt.Sprintf("%dch", channels)
+}
+
+// LanguageCode returns the ISO 639-2/B code of a language code or name, or
+// the lowercased input when it isn't recognized
+func LanguageCode(token string) string {
+	if lang, ok := lookupLanguage(token); ok {
+		return lang.Code
+	}
+	return strings.ToLower(token)
+}
@@ -0,0 +1,274 @@
+package library
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/openflix/openflix-server/internal/models"
+)
+
+// Sidecar subtitle extensions and the codec recorded for them
+var subtitleExtensions = map[string]string{
+	".srt": "srt",
+	".ass": "ass",
+	".ssa": "ssa",
+	".vtt": "vtt",
+	".sup": "pgs",
+}
+
+// Folders next to a video that hold its subtitles
+var subtitleFolders = map[string]bool{"subs": true, "subtitles": true}
+
+// Separators in subtitle names from Subs folders, like "2_English_SDH.srt"
+var subtitleNameSeparators = regexp.MustCompile(`[._\s\-\[\]()]+`)
+
+// sidecarSubtitle is a subtitle file that belongs to a video
+type sidecarSubtitle struct {
+	Path            string
+	Codec           string
+	Language        language
+	Title           string
+	Forced          bool
+	HearingImpaired bool
+	Default         bool
+}
+
+// DisplayTitle describes the subtitle the way Plex clients show it, e.g.
+// "English Forced (SRT External)"
+func (s sidecarSubtitle) DisplayTitle() string {
+	parts := []string{"Unknown"}
+	if s.Language.Name != "" {
+		parts[0] = s.Language.Name
+	}
+	if s.Title != "" {
+		parts = append(parts, s.Title)
+	}
+	if s.Forced {
+		parts = append(parts, "Forced")
+	}
+	if s.HearingImpaired {
+		parts = append(parts, "SDH")
+	}
+	return fmt.Sprintf("%s (%s External)", strings.Join(parts, " "), strings.ToUpper(s.Codec))
+}
+
+// findSidecarSubtitles finds the subtitles of a video: files named after it
+// ("Movie.en.forced.srt") next to it or in a Subs folder, files in
+// Subs/<video name>/, and, when the video is alone in its folder, every
+// subtitle in Subs.
+func findSidecarSubtitles(videoPath string) []sidecarSubtitle {
+	dir := filepath.Dir(videoPath)
+	base := strings.TrimSuffix(filepath.Base(videoPath), filepath.Ext(videoPath))
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+
+	var sidecars []sidecarSubtitle
+	videos := 0
+	var subDirs []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() {
+			if subtitleFolders[strings.ToLower(name)] {
+				subDirs = append(subDirs, filepath.Join(dir, name))
+			}
+			continue
+		}
+		if videoExtensions[strings.ToLower(filepath.Ext(name))] {
+			videos++
+		}
+		if sidecar, ok := matchSidecar(dir, name, base); ok {
+			sidecars = append(sidecars, sidecar)
+		}
+	}
+
+	for _, subDir := range subDirs {
+		entries, err := os.ReadDir(subDir)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			name := entry.Name()
+			if entry.IsDir() {
+				if strings.EqualFold(name, base) {
+					sidecars = append(sidecars, folderSidecars(filepath.Join(subDir, name))...)
+				}
+				continue
+			}
+			if sidecar, ok := matchSidecar(subDir, name, base); ok {
+				sidecars = append(sidecars, sidecar)
+			} else if videos == 1 {
+				if sidecar, ok := folderSidecar(subDir, name); ok {
+					sidecars = append(sidecars, sidecar)
+				}
+			}
+		}
+	}
+
+	sort.Slice(sidecars, func(i, j int) bool { return sidecars[i].Path < sidecars[j].Path })
+	return sidecars
+}
+
+// matchSidecar accepts subtitles named after the video, with the language and
+// flags as extra dot separated parts
+func matchSidecar(dir, name, base string) (sidecarSubtitle, bool) {
+	ext := strings.ToLower(filepath.Ext(name))
+	codec, ok := subtitleExtensions[ext]
+	if !ok {
+		return sidecarSubtitle{}, false
+	}
+	stem := name[:len(name)-len(ext)]
+	if len(stem) < len(base) || !strings.EqualFold(stem[:len(base)], base) {
+		return sidecarSubtitle{}, false
+	}
+	rest := stem[len(base):]
+	if rest != "" && rest[0] != '.' {
+		return sidecarSubtitle{}, false
+	}
+
+	sidecar := sidecarSubtitle{Path: filepath.Join(dir, name), Codec: codec}
+	parseSidecarTokens(&sidecar, strings.Split(strings.TrimPrefix(rest, "."), "."))
+	return sidecar, true
+}
+
+// folderSidecars returns every subtitle in a folder of subtitles for one video
+func folderSidecars(dir string) []sidecarSubtitle {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	var sidecars []sidecarSubtitle
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		if sidecar, ok := folderSidecar(dir, entry.Name()); ok {
+			sidecars = append(sidecars, sidecar)
+		}
+	}
+	return sidecars
+}
+
+// folderSidecar reads the language and flags from the whole file name, as in
+// "2_English.srt" or "English [SDH].srt"
+func folderSidecar(dir, name string) (sidecarSubtitle, bool) {
+	ext := strings.ToLower(filepath.Ext(name))
+	codec, ok := subtitleExtensions[ext]
+	if !ok {
+		return sidecarSubtitle{}, false
+	}
+	sidecar := sidecarSubtitle{Path: filepath.Join(dir, name), Codec: codec}
+	tokens := subtitleNameSeparators.Split(name[:len(name)-len(ext)], -1)
+	// Drop the track number rippers put in front
+	if _, err := strconv.Atoi(tokens[0]); err == nil && len(tokens) > 1 {
+		tokens = tokens[1:]
+	}
+	parseSidecarTokens(&sidecar, tokens)
+	return sidecar, true
+}
+
+// parseSidecarTokens sets the language and flags from name parts. Anything
+// else becomes the title, e.g. "Commentary".
+func parseSidecarTokens(sidecar *sidecarSubtitle, tokens []string) {
+	var title []string
+	for _, token := range tokens {
+		if token == "" {
+			continue
+		}
+		switch strings.ToLower(token) {
+		case "forced", "foreign":
+			sidecar.Forced = true
+			continue
+		case "sdh", "cc", "hearing impaired":
+			sidecar.HearingImpaired = true
+			continue
+		case "default":
+			sidecar.Default = true
+			continue
+		case "hi":
+			// Hindi unless a language came first, as in "en.hi"
+			if sidecar.Language.Code != "" {
+				sidecar.HearingImpaired = true
+				continue
+			}
+		}
+		if sidecar.Language.Code == "" {
+			if lang, ok := lookupLanguage(token); ok {
+				sidecar.Language = lang
+				continue
+			}
+		}
+		title = append(title, token)
+	}
+	sidecar.Title = strings.Join(title, " ")
+}
+
+// createSidecarStreams records the sidecar subtitles of a video file
+func (s *Scanner) createSidecarStreams(file *models.MediaFile, sidecars []sidecarSubtitle) {
+	for _, sidecar := range sidecars {
+		stream := models.MediaStream{
+			MediaFileID:     file.ID,
+			StreamType:      3, // 3=subtitle
+			Codec:           sidecar.Codec,
+			Language:        sidecar.Language.Name,
+			LanguageCode:    sidecar.Language.Code,
+			Title:           sidecar.Title,
+			DisplayTitle:    sidecar.DisplayTitle(),
+			Default:         sidecar.Default,
+			Forced:          sidecar.Forced,
+			HearingImpaired: sidecar.HearingImpaired,
+			Key:             sidecar.Path,
+		}
+		s.db.Create(&stream)
+	}
+}
+
+// refreshSidecarSubtitles picks up subtitles added next to, or removed from
+// beside, a video that itself didn't change. It reports whether anything
+// changed.
+func (s *Scanner) refreshSidecarSubtitles(file *models.MediaFile) bool {
+	sidecars := findSidecarSubtitles(file.FilePath)
+
+	var existing []models.MediaStream
+	s.db.Where("media_file_id = ? AND stream_type = 3 AND key <> ''", file.ID).Find(&existing)
+
+	if len(existing) == len(sidecars) {
+		known := make(map[string]bool, len(existing))
+		for _, stream := range existing {
+			known[stream.Key] = true
+		}
+		same := true
+		for _, sidecar := range sidecars {
+			if !known[sidecar.Path] {
+				same = false
+				break
+			}
+		}
+		if same {
+			return false
+		}
+	}
+
+	s.db.Where("media_file_id = ? AND stream_type = 3 AND key <> ''", file.ID).Delete(&models.MediaStream{})
+	s.createSidecarStreams(file, sidecars)
+	return true
+}
+
+// subtitleOwnerDir maps a Subs folder, or a folder inside one, to the folder
+// of the videos it belongs to. Other folders are returned as they are.
+func subtitleOwnerDir(dir string) string {
+	if subtitleFolders[strings.ToLower(filepath.Base(dir))] {
+		return filepath.Dir(dir)
+	}
+	if parent := filepath.Dir(dir); subtitleFolders[strings.ToLower(filepath.Base(parent))] {
+		return filepath.Dir(parent)
+	}
+	return dir
+}
@@ -0,0 +1,179 @@
+package library
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/openflix/openflix-server/internal/models"
+	"github.com/openflix/openflix-server/internal/search"
+)
+
+var (
+	ErrNotMovie      = errors.New("only movies have versions")
+	ErrSingleVersion = errors.New("movie has a single version")
+	ErrMixedLibrary  = errors.New("movies are in different libraries")
+)
+
+var (
+	// "Movie (2010) {edition-Director's Cut}"
+	editionTagPattern = regexp.MustCompile(`(?i)\s*\{edition-([^}]+)\}`)
+	// "Movie (2010) - Extended Edition 1080p", stopping at the release info
+	editionSuffixPattern = regexp.MustCompile(`(?i)\s+-\s+([^\-\[\]()]+?)\s*(?:\b\d{3,4}p\b|\b4K\b|\bUHD\b|\[|\(|$)`)
+	editionKeywords      = regexp.MustCompile(`(?i)\b(extended|director'?s|unrated|uncut|theatrical|final|ultimate|special|remastered|imax|collector'?s|anniversary|edition|cut)\b`)
+)
+
+// parseEdition takes the edition out of a file name, returning the rest of
+// the name and the edition
+func parseEdition(name string) (string, string) {
+	if m := editionTagPattern.FindStringSubmatchIndex(name); m != nil {
+		edition := strings.TrimSpace(name[m[2]:m[3]])
+		return name[:m[0]] + name[m[1]:], edition
+	}
+	if m := editionSuffixPattern.FindStringSubmatchIndex(name); m != nil {
+		edition := strings.TrimSpace(name[m[2]:m[3]])
+		if editionKeywords.MatchString(edition) {
+			return name[:m[0]] + " " + name[m[3]:], edition
+		}
+	}
+	return name, ""
+}
+
+// editionOf returns the edition named in a file's name, if any
+func editionOf(filePath string) string {
+	name := strings.TrimSuffix(filepath.Base(filePath), filepath.Ext(filePath))
+	_, edition := parseEdition(name)
+	return edition
+}
+
+// findMovieVersion returns the movie a new file is another version of: a
+// movie with a file in the same folder whose name gives the same title and
+// year, or else one anywhere with that title and year. Without a year the
+// title alone says too little, as remakes and unrelated films share titles.
+func (s *Scanner) findMovieVersion(library *models.Library, filePath string, parsed ParsedFilename) *models.MediaItem {
+	dir := filepath.Dir(filePath)
+	var siblings []models.MediaFile
+	s.db.Joins("JOIN media_items ON media_items.id = media_files.media_item_id").
+		Where("media_items.library_id = ? AND media_items.type = ?", library.ID, "movie").
+		Where("media_files.file_path LIKE ? ESCAPE '\\'", escapeLike(dir+string(os.PathSeparator))+"%").
+		Find(&siblings)
+	for _, sibling := range siblings {
+		if filepath.Dir(sibling.FilePath) != dir {
+			continue
+		}
+		other := s.parseFilename(sibling.FilePath, library)
+		if strings.EqualFold(other.Title, parsed.Title) && other.Year == parsed.Year {
+			var item models.MediaItem
+			if s.db.First(&item, sibling.MediaItemID).Error == nil {
+				return &item
+			}
+		}
+	}
+
+	if parsed.Title == "" || parsed.Year == 0 {
+		return nil
+	}
+	var item models.MediaItem
+	err := s.db.Where("library_id = ? AND type = ? AND LOWER(title) = ? AND year = ?",
+		library.ID, "movie", strings.ToLower(parsed.Title), parsed.Year).
+		First(&item).Error
+	if err != nil {
+		return nil
+	}
+	return &item
+}
+
+// newMovie creates a movie from a file's name and fetches its metadata
+func (s *Scanner) newMovie(library *models.Library, filePath string, parsed ParsedFilename, duration int64) (*models.MediaItem, error) {
+	item := models.MediaItem{
+		UUID:      uuid.New().String(),
+		LibraryID: library.ID,
+		Type:      "movie",
+		Title:     parsed.Title,
+		SortTitle: strings.ToLower(parsed.Title),
+		Year:      parsed.Year,
+		Duration:  duration,
+		AddedAt:   time.Now(),
+	}
+
+	if err := s.db.Create(&item).Error; err != nil {
+		return nil, err
+	}
+	search.IndexMediaItem(s.db, &item)
+
+	// Fetch metadata in background (don't block scanning)
+	s.fetchMovieMetadata(library, &item, filePath)
+	return &item, nil
+}
+
+// SplitItem gives every version of a movie but the first a movie of its own,
+// named after its file. It returns the new movies.
+func (s *Scanner) SplitItem(itemID uint) ([]models.MediaItem, error) {
+	var item models.MediaItem
+	if err := s.db.Preload("MediaFiles").First(&item, itemID).Error; err != nil {
+		return nil, err
+	}
+	if item.Type != "movie" {
+		return nil, ErrNotMovie
+	}
+	if len(item.MediaFiles) < 2 {
+		return nil, ErrSingleVersion
+	}
+	var library models.Library
+	if err := s.db.First(&library, item.LibraryID).Error; err != nil {
+		return nil, err
+	}
+
+	var created []models.MediaItem
+	for _, file := range item.MediaFiles[1:] {
+		parsed := s.parseFilename(file.FilePath, &library)
+		movie, err := s.newMovie(&library, file.FilePath, parsed, file.Duration)
+		if err != nil {
+			return created, err
+		}
+		if err := s.db.Model(&file).Update("media_item_id", movie.ID).Error; err != nil {
+			return created, err
+		}
+		created = append(created, *movie)
+	}
+	return created, nil
+}
+
+// MergeItems moves the files of other movies into one, as versions of it,
+// and removes the emptied movies
+func (s *Scanner) MergeItems(targetID uint, otherIDs []uint) error {
+	var target models.MediaItem
+	if err := s.db.First(&target, targetID).Error; err != nil {
+		return err
+	}
+	if target.Type != "movie" {
+		return ErrNotMovie
+	}
+
+	var others []models.MediaItem
+	if err := s.db.Where("id IN ? AND id <> ?", otherIDs, targetID).Find(&others).Error; err != nil {
+		return err
+	}
+	for _, other := range others {
+		if other.Type != "movie" {
+			return ErrNotMovie
+		}
+		if other.LibraryID != target.LibraryID {
+			return ErrMixedLibrary
+		}
+	}
+
+	for _, other := range others {
+		err := s.db.Model(&models.MediaFile{}).Where("media_item_id = ?", other.ID).
+			Update("media_item_id", target.ID).Error
+		if err != nil {
+			return err
+		}
+		s.removeItemIfEmpty(other.ID)
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package library
+
+import (
+	"context"
+	"testing"
+
+	"github.com/openflix/openflix-server/internal/models"
+)
+
+func TestMovieVersions(t *testing.T) {
+	installFakeTools(t)
+	gdb, library := testLibrary(t, "movie", []string{
+		"Horror/Dracula.mkv",
+		"Classics/Dracula.mkv",
+		"Heat (1995)/Heat (1995).mkv",
+		"4K/Heat (1995)/Heat (1995).mkv",
+	})
+	scanner := NewScanner(gdb, t.TempDir())
+
+	result, err := scanner.ScanLibrary(library)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scanner.waitForMetadata(context.Background(), library.ID, nil)
+	if result.FilesAdded != 4 {
+		t.Fatalf("added %d files, errors %v", result.FilesAdded, result.Errors)
+	}
+
+	// Films of the same title without a year in different folders are kept
+	// apart; with the same year they are versions of one movie
+	files := map[string]int{}
+	var movies []models.MediaItem
+	gdb.Where("library_id = ? AND type = ?", library.ID, "movie").Preload("MediaFiles").Find(&movies)
+	for _, movie := range movies {
+		files[movie.Title] += len(movie.MediaFiles)
+		if movie.Title == "Heat" && len(movie.MediaFiles) != 2 {
+			t.Errorf("Heat has %d versions, want 2", len(movie.MediaFiles))
+		}
+	}
+	if len(movies) != 3 || files["Dracula"] != 2 || files["Heat"] != 2 {
+		t.Errorf("movies = %d, files by title %v; want 2 Draculas and one Heat", len(movies), files)
+	}
+}
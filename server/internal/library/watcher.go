@@ -0,0 +1,409 @@
+package library
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/openflix/openflix-server/internal/logger"
+	"github.com/openflix/openflix-server/internal/models"
+	"gorm.io/gorm"
+)
+
+// dirNotifier reports changed directories. It is implemented with inotify on
+// Linux; elsewhere newDirNotifier fails and every path is polled.
+type dirNotifier interface {
+	// Add watches a single directory, not the directories below it
+	Add(dir string) error
+	// Remove stops watching a directory and every directory below it
+	Remove(dir string)
+	Watching(dir string) bool
+	// Events delivers changed directories; "" means events were lost
+	Events() <-chan string
+	Close() error
+}
+
+// Watcher keeps libraries up to date as files change on disk. Changes are
+// collected until a directory has been quiet for the settle delay, then only
+// that directory is rescanned. Paths that can't be watched, such as network
+// mounts, are polled instead.
+type Watcher struct {
+	db           *gorm.DB
+	scanner      *Scanner
+	delay        time.Duration
+	pollInterval time.Duration
+	notifier     dirNotifier
+
+	mu       sync.Mutex
+	roots    map[string]uint              // library path -> library ID
+	polled   map[string]map[string]uint64 // polled library path -> directory signatures
+	offline  map[string]bool              // polled library paths that can't be reached
+	pending  map[string]time.Time         // directory -> when to scan it
+	running  bool
+	stopChan chan struct{}
+}
+
+// NewWatcher creates a watcher. delay is how long a directory must be quiet
+// before it is scanned; pollInterval is how often unwatchable paths are checked.
+func NewWatcher(db *gorm.DB, scanner *Scanner, delay, pollInterval time.Duration) *Watcher {
+	if delay <= 0 {
+		delay = 10 * time.Second
+	}
+	if pollInterval <= 0 {
+		pollInterval = 5 * time.Minute
+	}
+	return &Watcher{
+		db:           db,
+		scanner:      scanner,
+		delay:        delay,
+		pollInterval: pollInterval,
+		roots:        make(map[string]uint),
+		polled:       make(map[string]map[string]uint64),
+		offline:      make(map[string]bool),
+		pending:      make(map[string]time.Time),
+		stopChan:     make(chan struct{}),
+	}
+}
+
+// Start begins watching every library path
+func (w *Watcher) Start() {
+	w.mu.Lock()
+	if w.running {
+		w.mu.Unlock()
+		return
+	}
+	w.running = true
+
+	notifier, err := newDirNotifier()
+	if err != nil {
+		logger.Warnf("Filesystem watching unavailable, polling library paths every %s: %v", w.pollInterval, err)
+	} else {
+		w.notifier = notifier
+	}
+	w.mu.Unlock()
+
+	w.Refresh()
+
+	if w.notifier != nil {
+		go w.handleEvents()
+	}
+	go w.run()
+
+	logger.Info("Library filesystem watcher started")
+}
+
+// Stop stops watching
+func (w *Watcher) Stop() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.running {
+		return
+	}
+	w.running = false
+	close(w.stopChan)
+	if w.notifier != nil {
+		w.notifier.Close()
+	}
+}
+
+// Refresh picks up library paths that were added or removed. Call it after
+// changing libraries; it also runs on every poll.
+func (w *Watcher) Refresh() {
+	var paths []models.LibraryPath
+	w.db.Joins("JOIN libraries ON libraries.id = library_paths.library_id AND libraries.deleted_at IS NULL").
+		Find(&paths)
+
+	current := make(map[string]uint, len(paths))
+	for _, p := range paths {
+		current[filepath.Clean(p.Path)] = p.LibraryID
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for root := range w.roots {
+		if _, ok := current[root]; !ok {
+			if w.notifier != nil {
+				w.notifier.Remove(root)
+			}
+			delete(w.polled, root)
+			delete(w.offline, root)
+			delete(w.roots, root)
+		}
+	}
+
+	for root, libraryID := range current {
+		if _, ok := w.roots[root]; ok {
+			w.roots[root] = libraryID
+			continue
+		}
+		if _, err := os.Stat(root); err != nil {
+			// Not mounted yet; try again on the next refresh
+			continue
+		}
+		w.roots[root] = libraryID
+
+		if w.notifier == nil || isNetworkMount(root) {
+			w.polled[root] = snapshotTree(root)
+			logger.Infof("Polling %s for changes every %s", root, w.pollInterval)
+			continue
+		}
+		if err := w.watchTree(root); err != nil {
+			// Typically the inotify watch limit (fs.inotify.max_user_watches)
+			w.notifier.Remove(root)
+			w.polled[root] = snapshotTree(root)
+			logger.Warnf("Cannot watch %s, polling every %s instead: %v", root, w.pollInterval, err)
+		}
+	}
+}
+
+// watchTree adds a watch for dir and every directory below it
+func (w *Watcher) watchTree(dir string) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return nil
+		}
+		if w.notifier.Watching(path) {
+			return nil
+		}
+		return w.notifier.Add(path)
+	})
+}
+
+// handleEvents schedules scans for the directories the notifier reports
+func (w *Watcher) handleEvents() {
+	for dir := range w.notifier.Events() {
+		w.mu.Lock()
+		if dir == "" {
+			// Events were lost: rescan every watched path
+			for root := range w.roots {
+				if _, polled := w.polled[root]; !polled {
+					w.schedule(root)
+				}
+			}
+			w.mu.Unlock()
+			continue
+		}
+
+		// New directories need watches of their own
+		if info, err := os.Stat(dir); err == nil && info.IsDir() && !w.notifier.Watching(dir) {
+			if err := w.watchTree(dir); err != nil {
+				logger.Warnf("Cannot watch %s: %v", dir, err)
+			}
+		}
+		w.schedule(dir)
+		w.mu.Unlock()
+	}
+}
+
+// schedule queues a directory scan, pushing back any pending scan that covers
+// it. Callers hold w.mu.
+func (w *Watcher) schedule(dir string) {
+	due := time.Now().Add(w.delay)
+	for pending := range w.pending {
+		if dir == pending || strings.HasPrefix(dir, pending+string(filepath.Separator)) {
+			w.pending[pending] = due
+			return
+		}
+		// A pending subdirectory is covered by scanning its parent
+		if strings.HasPrefix(pending, dir+string(filepath.Separator)) {
+			delete(w.pending, pending)
+		}
+	}
+	w.pending[dir] = due
+}
+
+// run scans directories once they have settled and polls unwatched paths
+func (w *Watcher) run() {
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	poll := time.NewTicker(w.pollInterval)
+	defer poll.Stop()
+
+	for {
+		select {
+		case <-tick.C:
+			for _, dir := range w.dueDirectories() {
+				w.scanDirectory(dir)
+			}
+		case <-poll.C:
+			w.Refresh()
+			w.poll()
+		case <-w.stopChan:
+			logger.Info("Library filesystem watcher stopped")
+			return
+		}
+	}
+}
+
+// dueDirectories takes the pending directories whose settle delay has passed.
+// Directories with files modified within the delay are still being written to
+// and are pushed back.
+func (w *Watcher) dueDirectories() []string {
+	w.mu.Lock()
+	var due []string
+	now := time.Now()
+	for dir, at := range w.pending {
+		if now.After(at) {
+			due = append(due, dir)
+			delete(w.pending, dir)
+		}
+	}
+	w.mu.Unlock()
+
+	ready := due[:0]
+	for _, dir := range due {
+		if recentlyModified(dir, now.Add(-w.delay)) {
+			w.mu.Lock()
+			w.pending[dir] = now.Add(w.delay)
+			w.mu.Unlock()
+			continue
+		}
+		ready = append(ready, dir)
+	}
+	return ready
+}
+
+// recentlyModified reports whether any file under dir changed after since
+func recentlyModified(dir string, since time.Time) bool {
+	found := false
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil && info.ModTime().After(since) {
+			found = true
+			return filepath.SkipAll
+		}
+		return nil
+	})
+	return found
+}
+
+// scanDirectory runs a partial scan of dir in the library it belongs to
+func (w *Watcher) scanDirectory(dir string) {
+	w.mu.Lock()
+	var root string
+	var libraryID uint
+	for r, id := range w.roots {
+		if (dir == r || strings.HasPrefix(dir, r+string(filepath.Separator))) && len(r) > len(root) {
+			root, libraryID = r, id
+		}
+	}
+	w.mu.Unlock()
+	if root == "" {
+		return
+	}
+
+	// Files under a root that has gone away would be removed as deleted
+	if !rootReachable(root) {
+		logger.Warnf("Not scanning %s: %s can't be reached", dir, root)
+		return
+	}
+
+	var lib models.Library
+	if err := w.db.First(&lib, libraryID).Error; err != nil {
+		return
+	}
+
+	result, err := w.scanner.ScanDirectory(&lib, dir)
+	if err != nil {
+		logger.Warnf("Scan of %s failed: %v", dir, err)
+		return
+	}
+	if result.FilesAdded+result.FilesUpdated+result.FilesRemoved > 0 {
+		logger.Infof("Library %q: %s changed (%d added, %d updated, %d removed)",
+			lib.Title, dir, result.FilesAdded, result.FilesUpdated, result.FilesRemoved)
+	}
+}
+
+// poll compares polled paths with their last snapshot and schedules scans of
+// the directories that changed
+func (w *Watcher) poll() {
+	w.mu.Lock()
+	roots := make([]string, 0, len(w.polled))
+	for root := range w.polled {
+		roots = append(roots, root)
+	}
+	w.mu.Unlock()
+
+	for _, root := range roots {
+		// A share that went away keeps its last snapshot rather than
+		// having every directory in it scheduled as deleted
+		reachable := rootReachable(root)
+		w.mu.Lock()
+		if !reachable {
+			if !w.offline[root] {
+				logger.Warnf("%s can't be reached; its files are kept until it is back", root)
+			}
+			w.offline[root] = true
+			w.mu.Unlock()
+			continue
+		}
+		if w.offline[root] {
+			logger.Infof("%s is reachable again", root)
+			delete(w.offline, root)
+		}
+		w.mu.Unlock()
+
+		snapshot := snapshotTree(root)
+
+		w.mu.Lock()
+		previous, ok := w.polled[root]
+		if !ok {
+			w.mu.Unlock()
+			continue
+		}
+		for dir, sig := range snapshot {
+			if previous[dir] != sig {
+				w.schedule(dir)
+			}
+		}
+		for dir := range previous {
+			if _, ok := snapshot[dir]; !ok {
+				w.schedule(dir)
+			}
+		}
+		w.polled[root] = snapshot
+		w.mu.Unlock()
+	}
+}
+
+// rootReachable reports whether a library path can be read. An unmounted
+// network share often leaves an empty mount point behind, so an empty root
+// counts as unreachable too.
+func rootReachable(root string) bool {
+	entries, err := os.ReadDir(root)
+	return err == nil && len(entries) > 0
+}
+
+// snapshotTree returns a signature of the names, sizes and modification times
+// of the files in each directory under root
+func snapshotTree(root string) map[string]uint64 {
+	snapshot := make(map[string]uint64)
+	filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return nil
+		}
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil
+		}
+		h := fnv.New64a()
+		for _, entry := range entries {
+			h.Write([]byte(entry.Name()))
+			if info, err := entry.Info(); err == nil && !entry.IsDir() {
+				h.Write(binary.LittleEndian.AppendUint64(nil, uint64(info.ModTime().UnixNano())))
+				h.Write(binary.LittleEndian.AppendUint64(nil, uint64(info.Size())))
+			}
+		}
+		snapshot[path] = h.Sum64()
+		return nil
+	})
+	return snapshot
+}
@@ -13,6 +13,7 @@ import (
 	"github.com/openflix/openflix-server/internal/epg/gracenote"
 	"github.com/openflix/openflix-server/internal/logger"
 	"github.com/openflix/openflix-server/internal/models"
+	"github.com/openflix/openflix-server/internal/search"
 	"gorm.io/gorm"
 )
 
@@ -320,9 +321,18 @@ func (p *EPGParser) ImportPrograms(sourceID uint, xmltv *XMLTV) (int, error) {
 		}
 	}
 
+	p.syncSearchIndex()
+
 	return imported, nil
 }
 
+// syncSearchIndex refreshes the program search index after an import
+func (p *EPGParser) syncSearchIndex() {
+	if err := search.SyncPrograms(p.db); err != nil {
+		logger.Warnf("Failed to update program search index: %v", err)
+	}
+}
+
 // RefreshEPG refreshes EPG for a source with retry logic and conditional request support
 func (p *EPGParser) RefreshEPG(source *models.M3USource) error {
 	if source.EPGUrl == "" {
@@ -534,6 +544,8 @@ func (p *EPGParser) ImportProgramsFromEPGSource(source *models.EPGSource, xmltv
 		}
 	}
 
+	p.syncSearchIndex()
+
 	return imported, len(channelSet), nil
 }
 
@@ -688,6 +700,8 @@ func (p *EPGParser) ImportProgramsFromGracenote(source *models.EPGSource) (int,
 		}
 	}
 
+	p.syncSearchIndex()
+
 	return imported, len(channelSet), nil
 }
 
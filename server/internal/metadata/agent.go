@@ -0,0 +1,400 @@
+package metadata
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/openflix/openflix-server/internal/models"
+	"github.com/openflix/openflix-server/internal/search"
+	"gorm.io/gorm"
+)
+
+// Kinds of item an agent can search for
+const (
+	KindMovie = "movie"
+	KindShow  = "show"
+)
+
+// MetadataAgent is an online metadata database. IDs are the agent's own,
+// e.g. a TMDB ID for TMDB or an IMDb ID for OMDb.
+type MetadataAgent interface {
+	// Name identifies the agent in a library's agent order
+	Name() string
+	// Provider is the guid scheme of the agent's IDs, e.g. "imdb" for OMDb
+	Provider() string
+	IsConfigured() bool
+
+	Search(kind, title string, year int) ([]Match, error)
+	Details(kind, id string) (*Result, error)
+	Season(showID string, season int) (*Result, error)
+	Episode(showID string, season, episode int) (*Result, error)
+	Images(kind, id string) (*Images, error)
+	Credits(kind, id string) ([]Credit, error)
+}
+
+// Match is a search result
+type Match struct {
+	ID    string `json:"id"`
+	Title string `json:"title"`
+	Year  int    `json:"year,omitempty"`
+}
+
+// Result is what an agent knows about an item. Empty fields are unknown.
+type Result struct {
+	Guids         []string
+	Title         string
+	SortTitle     string
+	OriginalTitle string
+	Summary       string
+	Tagline       string
+	ContentRating string
+	Studio        string
+	Year          int
+	Released      *time.Time
+	Rating        float64
+	Duration      int64 // milliseconds
+	Genres        []string
+	Cast          []Credit
+	Thumb         string
+	Art           string
+	LeafCount     int // episodes of a show
+	ChildCount    int // seasons of a show
+
+	collection *tmdbCollectionRef
+}
+
+// Credit is a person in the cast or crew. Crew members have their job as
+// their role, e.g. "Director".
+type Credit struct {
+	Name  string `json:"name"`
+	Role  string `json:"role,omitempty"`
+	Thumb string `json:"thumb,omitempty"`
+	Order int    `json:"-"` // Position in the list
+}
+
+// Images are the posters and backdrops an agent has for an item, best first
+type Images struct {
+	Posters   []string `json:"posters"`
+	Backdrops []string `json:"backdrops"`
+}
+
+// Fields are the parts of a result merge rules can name
+var Fields = []string{
+	"title", "original_title", "summary", "tagline", "content_rating", "studio",
+	"year", "released", "rating", "duration", "genres", "cast", "thumb", "art",
+}
+
+// Lookup fetches an item's details from an agent, along with its credits
+// and images when the details leave out the cast or poster
+func Lookup(agent MetadataAgent, kind, id string) (*Result, error) {
+	result, err := agent.Details(kind, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Cast) == 0 {
+		if credits, err := agent.Credits(kind, id); err == nil {
+			result.Cast = credits
+		}
+	}
+	if result.Thumb == "" {
+		if images, err := agent.Images(kind, id); err == nil {
+			if result.Thumb == "" && len(images.Posters) > 0 {
+				result.Thumb = images.Posters[0]
+			}
+			if result.Art == "" && len(images.Backdrops) > 0 {
+				result.Art = images.Backdrops[0]
+			}
+		}
+	}
+	result.addGuid(agent.Provider(), id)
+	return result, nil
+}
+
+// addGuid records an ID unless the result already has one from the provider
+func (r *Result) addGuid(provider, id string) {
+	if id == "" {
+		return
+	}
+	for _, guid := range r.Guids {
+		if strings.HasPrefix(guid, provider+"://") {
+			return
+		}
+	}
+	r.Guids = append(r.Guids, provider+"://"+id)
+}
+
+// GuidMap returns guids by provider, e.g. {"tmdb": "603"}
+func GuidMap(guids []string) map[string]string {
+	ids := make(map[string]string, len(guids))
+	for _, guid := range guids {
+		if provider, id, ok := strings.Cut(guid, "://"); ok && id != "" {
+			if _, exists := ids[provider]; !exists {
+				ids[provider] = id
+			}
+		}
+	}
+	return ids
+}
+
+// Merge combines the results of several agents field by field. order returns
+// the agents a field is taken from, in order of preference; the first that
+// knows the field wins.
+func Merge(results map[string]*Result, order func(field string) []string) *Result {
+	pick := func(field string, known func(*Result) bool) *Result {
+		for _, name := range order(field) {
+			if r := results[name]; r != nil && known(r) {
+				return r
+			}
+		}
+		return nil
+	}
+
+	merged := &Result{}
+	if r := pick("title", func(r *Result) bool { return r.Title != "" }); r != nil {
+		merged.Title = r.Title
+		merged.SortTitle = r.SortTitle
+	}
+	if r := pick("original_title", func(r *Result) bool { return r.OriginalTitle != "" }); r != nil {
+		merged.OriginalTitle = r.OriginalTitle
+	}
+	if r := pick("summary", func(r *Result) bool { return r.Summary != "" }); r != nil {
+		merged.Summary = r.Summary
+	}
+	if r := pick("tagline", func(r *Result) bool { return r.Tagline != "" }); r != nil {
+		merged.Tagline = r.Tagline
+	}
+	if r := pick("content_rating", func(r *Result) bool { return r.ContentRating != "" }); r != nil {
+		merged.ContentRating = r.ContentRating
+	}
+	if r := pick("studio", func(r *Result) bool { return r.Studio != "" }); r != nil {
+		merged.Studio = r.Studio
+	}
+	if r := pick("year", func(r *Result) bool { return r.Year > 0 }); r != nil {
+		merged.Year = r.Year
+	}
+	if r := pick("released", func(r *Result) bool { return r.Released != nil }); r != nil {
+		merged.Released = r.Released
+	}
+	if r := pick("rating", func(r *Result) bool { return r.Rating > 0 }); r != nil {
+		merged.Rating = r.Rating
+	}
+	if r := pick("duration", func(r *Result) bool { return r.Duration > 0 }); r != nil {
+		merged.Duration = r.Duration
+	}
+	if r := pick("genres", func(r *Result) bool { return len(r.Genres) > 0 }); r != nil {
+		merged.Genres = r.Genres
+	}
+	if r := pick("cast", func(r *Result) bool { return len(r.Cast) > 0 }); r != nil {
+		merged.Cast = r.Cast
+	}
+	if r := pick("thumb", func(r *Result) bool { return r.Thumb != "" }); r != nil {
+		merged.Thumb = r.Thumb
+	}
+	if r := pick("art", func(r *Result) bool { return r.Art != "" }); r != nil {
+		merged.Art = r.Art
+	}
+
+	// Counts and IDs aren't merged by rules. Every agent's IDs are kept, the
+	// first agent's winning a conflict.
+	for _, name := range order("") {
+		if r := results[name]; r != nil {
+			if merged.LeafCount == 0 && merged.ChildCount == 0 {
+				merged.LeafCount, merged.ChildCount = r.LeafCount, r.ChildCount
+			}
+			for provider, id := range GuidMap(r.Guids) {
+				merged.addGuid(provider, id)
+			}
+		}
+	}
+	return merged
+}
+
+// ApplyResult stores the fields a result knows, leaving the others and any
+// locked fields alone
+func ApplyResult(db *gorm.DB, item *models.MediaItem, r *Result) error {
+	locked := currentLocks(db, item.ID)
+	updates := map[string]interface{}{}
+	if r.Title != "" && !locked["title"] {
+		updates["title"] = r.Title
+		if !locked["sort_title"] {
+			updates["sort_title"] = strings.ToLower(r.Title)
+		}
+	}
+	if r.SortTitle != "" && !locked["sort_title"] {
+		updates["sort_title"] = strings.ToLower(r.SortTitle)
+	}
+	if r.OriginalTitle != "" {
+		updates["original_title"] = r.OriginalTitle
+	}
+	if r.Summary != "" && !locked["summary"] {
+		updates["summary"] = r.Summary
+	}
+	if r.Tagline != "" {
+		updates["tagline"] = r.Tagline
+	}
+	if r.ContentRating != "" && !locked["content_rating"] {
+		updates["content_rating"] = r.ContentRating
+	}
+	if r.Studio != "" && !locked["studio"] {
+		updates["studio"] = r.Studio
+	}
+	setYear := item.Type != "episode" && item.Type != "season" && !locked["year"]
+	if r.Released != nil {
+		updates["originally_available_at"] = *r.Released
+		if setYear {
+			updates["year"] = r.Released.Year()
+		}
+	}
+	if r.Year > 0 && setYear {
+		updates["year"] = r.Year
+	}
+	if r.Rating > 0 {
+		updates["rating"] = r.Rating
+	}
+	if r.Duration > 0 {
+		updates["duration"] = r.Duration
+	}
+	if r.Thumb != "" && !locked["thumb"] {
+		updates["thumb"] = r.Thumb
+	}
+	if r.Art != "" && !locked["art"] {
+		updates["art"] = r.Art
+	}
+	if r.LeafCount > 0 {
+		updates["leaf_count"] = r.LeafCount
+	}
+	if r.ChildCount > 0 {
+		updates["child_count"] = r.ChildCount
+	}
+
+	if len(updates) > 0 {
+		if err := db.Model(item).Updates(updates).Error; err != nil {
+			return err
+		}
+	}
+
+	SaveGuids(db, item.ID, r.Guids)
+	if len(r.Genres) > 0 && !locked["genres"] {
+		updateGenres(db, item, r.Genres)
+	}
+	if len(r.Cast) > 0 && !locked["cast"] {
+		updateCast(db, item, r.Cast)
+	}
+
+	var fresh models.MediaItem
+	if err := db.First(&fresh, item.ID).Error; err == nil {
+		search.IndexMediaItem(db, &fresh)
+	}
+	return nil
+}
+
+// updateGenres replaces the genres of an item
+func updateGenres(db *gorm.DB, item *models.MediaItem, names []string) {
+	db.Model(item).Association("Genres").Clear()
+
+	var genres []models.Genre
+	for _, name := range names {
+		var genre models.Genre
+		db.FirstOrCreate(&genre, models.Genre{Tag: name})
+		genres = append(genres, genre)
+	}
+	db.Model(item).Association("Genres").Append(genres)
+}
+
+// updateCast replaces the cast and crew of an item
+func updateCast(db *gorm.DB, item *models.MediaItem, credits []Credit) {
+	db.Where("media_item_id = ?", item.ID).Delete(&models.CastMember{})
+
+	names := make([]string, 0, len(credits))
+	for _, credit := range credits {
+		names = append(names, credit.Name)
+		db.Create(&models.CastMember{
+			MediaItemID: item.ID,
+			Tag:         credit.Name,
+			Role:        credit.Role,
+			Thumb:       credit.Thumb,
+			Order:       credit.Order,
+		})
+	}
+	search.IndexPeople(db, names...)
+}
+
+// endpoint is the HTTP client and base URL an agent calls. Both can be
+// replaced, e.g. to replay recorded responses.
+type endpoint struct {
+	name       string
+	baseURL    string
+	httpClient *http.Client
+}
+
+func newEndpoint(name, baseURL string) endpoint {
+	return endpoint{
+		name:    name,
+		baseURL: baseURL,
+		httpClient: &http.Client{
+			Timeout: 30 * time.Second,
+		},
+	}
+}
+
+// SetEndpoint points the agent at another server and HTTP client. A nil
+// client keeps the current one.
+func (e *endpoint) SetEndpoint(baseURL string, client *http.Client) {
+	e.baseURL = strings.TrimSuffix(baseURL, "/")
+	if client != nil {
+		e.httpClient = client
+	}
+}
+
+// getJSON decodes the response to a GET request of path
+func (e *endpoint) getJSON(path string, params url.Values, header http.Header, v interface{}) error {
+	target := e.baseURL + path
+	if len(params) > 0 {
+		target += "?" + params.Encode()
+	}
+	req, err := http.NewRequest(http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := e.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return &apiError{agent: e.name, status: resp.StatusCode}
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// apiError is an unexpected HTTP status from an agent's API
+type apiError struct {
+	agent  string
+	status int
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("%s API error: %d", e.agent, e.status)
+}
+
+// parseDate reads a YYYY-MM-DD date, returning nil when it's missing
+func parseDate(s string) *time.Time {
+	if len(s) > 10 {
+		s = s[:10]
+	}
+	t, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		return nil
+	}
+	return &t
+}
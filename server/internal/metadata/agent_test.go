@@ -0,0 +1,348 @@
+package metadata
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/openflix/openflix-server/internal/models"
+	"github.com/openflix/openflix-server/internal/search"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// fixtureServer replays the responses recorded under testdata/dir. route
+// names the fixture answering a request; requests without one get a 404.
+func fixtureServer(t *testing.T, dir string, route func(r *http.Request) string) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := route(r)
+		if name == "" {
+			http.NotFound(w, r)
+			return
+		}
+		data, err := os.ReadFile(filepath.Join("testdata", dir, name+".json"))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// pathFixture names a fixture after the request's path, /movie/603/credits
+// being movie_603_credits
+func pathFixture(r *http.Request) string {
+	return strings.ReplaceAll(strings.Trim(r.URL.Path, "/"), "/", "_")
+}
+
+// date returns midnight UTC of a day
+func date(year int, month time.Month, day int) *time.Time {
+	t := time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+	return &t
+}
+
+// testDB opens an in-memory database with the tables ApplyResult writes
+func testDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every connection to :memory: is a database of its own
+	sqlDB.SetMaxOpenConns(1)
+	t.Cleanup(func() { sqlDB.Close() })
+
+	if err := db.AutoMigrate(&models.MediaItem{}, &models.Genre{}, &models.CastMember{}, &models.MediaGuid{}, &models.MetadataEdit{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := search.Migrate(db); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestMerge(t *testing.T) {
+	results := map[string]*Result{
+		"tmdb": {
+			Guids:      []string{"tmdb://1396", "imdb://tt0903747"},
+			Title:      "Pilot",
+			SortTitle:  "pilot",
+			Summary:    "TMDB summary",
+			Rating:     8.1,
+			Genres:     []string{"Drama"},
+			Thumb:      "tmdb.jpg",
+			LeafCount:  62,
+			ChildCount: 5,
+		},
+		"tvdb": {
+			Guids:   []string{"tvdb://81189", "tmdb://9999"},
+			Title:   "Pilot (1)",
+			Summary: "TVDB summary",
+			Studio:  "AMC",
+			Art:     "tvdb-art.jpg",
+		},
+		"omdb": {
+			Guids:         []string{"imdb://tt0959621"},
+			Rating:        9.0,
+			ContentRating: "TV-MA",
+		},
+	}
+
+	tests := []struct {
+		name  string
+		rules map[string][]string
+		want  *Result
+	}{
+		{
+			name: "first agent that knows a field wins",
+			want: &Result{
+				Title:         "Pilot",
+				SortTitle:     "pilot",
+				Summary:       "TMDB summary",
+				ContentRating: "TV-MA",
+				Studio:        "AMC",
+				Rating:        8.1,
+				Genres:        []string{"Drama"},
+				Thumb:         "tmdb.jpg",
+				Art:           "tvdb-art.jpg",
+			},
+		},
+		{
+			name: "episode titles from TVDB and ratings from OMDb",
+			rules: map[string][]string{
+				"title":  {"tvdb", "tmdb"},
+				"rating": {"omdb", "tmdb"},
+			},
+			want: &Result{
+				Title:         "Pilot (1)",
+				Summary:       "TMDB summary",
+				ContentRating: "TV-MA",
+				Studio:        "AMC",
+				Rating:        9.0,
+				Genres:        []string{"Drama"},
+				Thumb:         "tmdb.jpg",
+				Art:           "tvdb-art.jpg",
+			},
+		},
+		{
+			name: "agents left out of a rule aren't used for the field",
+			rules: map[string][]string{
+				"summary": {"omdb"},
+				"thumb":   {"tvdb"},
+			},
+			want: &Result{
+				Title:         "Pilot",
+				SortTitle:     "pilot",
+				ContentRating: "TV-MA",
+				Studio:        "AMC",
+				Rating:        8.1,
+				Genres:        []string{"Drama"},
+				Art:           "tvdb-art.jpg",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			merged := Merge(results, func(field string) []string {
+				if order, ok := tt.rules[field]; ok {
+					return order
+				}
+				return []string{"tmdb", "tvdb", "omdb"}
+			})
+
+			// Every agent's IDs are kept, the first agent's winning a conflict
+			wantGuids := []string{"tmdb://1396", "imdb://tt0903747", "tvdb://81189"}
+			if !sameElements(merged.Guids, wantGuids) {
+				t.Errorf("Guids = %v, want %v", merged.Guids, wantGuids)
+			}
+			if merged.LeafCount != 62 || merged.ChildCount != 5 {
+				t.Errorf("counts = %d/%d, want 62/5", merged.LeafCount, merged.ChildCount)
+			}
+			merged.Guids, merged.LeafCount, merged.ChildCount = nil, 0, 0
+			if !reflect.DeepEqual(merged, tt.want) {
+				t.Errorf("Merge() = %+v, want %+v", merged, tt.want)
+			}
+		})
+	}
+}
+
+// sameElements reports whether two lists hold the same strings in any order
+func sameElements(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	counts := make(map[string]int)
+	for _, s := range a {
+		counts[s]++
+	}
+	for _, s := range b {
+		counts[s]--
+	}
+	for _, n := range counts {
+		if n != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func TestApplyResult(t *testing.T) {
+	result := &Result{
+		Guids:         []string{"tmdb://603", "imdb://tt0133093"},
+		Title:         "The Matrix",
+		Summary:       "A hacker learns the truth.",
+		ContentRating: "R",
+		Studio:        "Village Roadshow Pictures",
+		Released:      date(1999, time.March, 31),
+		Rating:        8.2,
+		Genres:        []string{"Action", "Science Fiction"},
+		Cast:          []Credit{{Name: "Keanu Reeves", Role: "Neo"}},
+		Thumb:         "poster.jpg",
+		Art:           "backdrop.jpg",
+	}
+
+	tests := []struct {
+		name   string
+		item   models.MediaItem
+		want   models.MediaItem
+		genres []string
+		cast   []string
+	}{
+		{
+			name: "unlocked fields are filled in",
+			item: models.MediaItem{Type: "movie", Title: "matrix", Year: 1998},
+			want: models.MediaItem{
+				Title: "The Matrix", SortTitle: "the matrix", Summary: "A hacker learns the truth.",
+				ContentRating: "R", Studio: "Village Roadshow Pictures", Year: 1999, Rating: 8.2,
+				Thumb: "poster.jpg", Art: "backdrop.jpg",
+			},
+			genres: []string{"Action", "Science Fiction"},
+			cast:   []string{"Keanu Reeves"},
+		},
+		{
+			name: "locked fields are left alone",
+			item: models.MediaItem{
+				Type: "movie", Title: "Matrix (Director's Cut)", SortTitle: "matrix 1", Summary: "Our summary",
+				Year: 1998, Thumb: "custom.jpg", ContentRating: "NR", Studio: "Warner",
+				LockedFields: "content_rating,sort_title,studio,summary,thumb,title,year",
+			},
+			want: models.MediaItem{
+				Title: "Matrix (Director's Cut)", SortTitle: "matrix 1", Summary: "Our summary",
+				ContentRating: "NR", Studio: "Warner", Year: 1998, Rating: 8.2,
+				Thumb: "custom.jpg", Art: "backdrop.jpg",
+			},
+			genres: []string{"Action", "Science Fiction"},
+			cast:   []string{"Keanu Reeves"},
+		},
+		{
+			name: "locked genres and cast are kept",
+			item: models.MediaItem{Type: "movie", Title: "The Matrix", LockedFields: "cast,genres"},
+			want: models.MediaItem{
+				Title: "The Matrix", SortTitle: "the matrix", Summary: "A hacker learns the truth.",
+				ContentRating: "R", Studio: "Village Roadshow Pictures", Year: 1999, Rating: 8.2,
+				Thumb: "poster.jpg", Art: "backdrop.jpg",
+			},
+			genres: []string{"Kept"},
+			cast:   []string{"Kept Actor"},
+		},
+		{
+			name: "episodes keep their year",
+			item: models.MediaItem{Type: "episode", Title: "Episode 1", Year: 2000},
+			want: models.MediaItem{
+				Title: "The Matrix", SortTitle: "the matrix", Summary: "A hacker learns the truth.",
+				ContentRating: "R", Studio: "Village Roadshow Pictures", Year: 2000, Rating: 8.2,
+				Thumb: "poster.jpg", Art: "backdrop.jpg",
+			},
+			genres: []string{"Action", "Science Fiction"},
+			cast:   []string{"Keanu Reeves"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := testDB(t)
+			item := tt.item
+			if err := db.Create(&item).Error; err != nil {
+				t.Fatal(err)
+			}
+			updateGenres(db, &item, []string{"Kept"})
+			updateCast(db, &item, []Credit{{Name: "Kept Actor"}})
+
+			if err := ApplyResult(db, &item, result); err != nil {
+				t.Fatalf("ApplyResult() error = %v", err)
+			}
+
+			var got models.MediaItem
+			db.First(&got, item.ID)
+			fields := []struct {
+				name      string
+				got, want interface{}
+			}{
+				{"title", got.Title, tt.want.Title},
+				{"sort_title", got.SortTitle, tt.want.SortTitle},
+				{"summary", got.Summary, tt.want.Summary},
+				{"content_rating", got.ContentRating, tt.want.ContentRating},
+				{"studio", got.Studio, tt.want.Studio},
+				{"year", got.Year, tt.want.Year},
+				{"rating", got.Rating, tt.want.Rating},
+				{"thumb", got.Thumb, tt.want.Thumb},
+				{"art", got.Art, tt.want.Art},
+			}
+			for _, f := range fields {
+				if f.got != f.want {
+					t.Errorf("%s = %v, want %v", f.name, f.got, f.want)
+				}
+			}
+
+			var genres, cast []string
+			db.Model(&models.Genre{}).
+				Joins("JOIN media_genres ON media_genres.genre_id = genres.id").
+				Where("media_genres.media_item_id = ?", item.ID).
+				Order("genres.tag").
+				Pluck("genres.tag", &genres)
+			db.Model(&models.CastMember{}).Where("media_item_id = ?", item.ID).Order("tag").Pluck("tag", &cast)
+			if !reflect.DeepEqual(genres, tt.genres) {
+				t.Errorf("genres = %v, want %v", genres, tt.genres)
+			}
+			if !reflect.DeepEqual(cast, tt.cast) {
+				t.Errorf("cast = %v, want %v", cast, tt.cast)
+			}
+			if guids := ItemGuids(db, item.ID); !reflect.DeepEqual(guids, []string{"imdb://tt0133093", "tmdb://603"}) {
+				t.Errorf("guids = %v", guids)
+			}
+		})
+	}
+}
+
+func TestLookup(t *testing.T) {
+	server := fixtureServer(t, "tmdb", pathFixture)
+	agent := NewTMDBAgent("test-key", nil, "")
+	agent.SetEndpoint(server.URL, nil)
+
+	// The movie's details have no cast, so its credits are fetched too
+	result, err := Lookup(agent, KindMovie, "603")
+	if err != nil {
+		t.Fatalf("Lookup() error = %v", err)
+	}
+	if len(result.Cast) == 0 || result.Cast[0].Name != "Lilly Wachowski" {
+		t.Errorf("Cast = %+v, want the credits", result.Cast)
+	}
+	if !sameElements(result.Guids, []string{"tmdb://603", "imdb://tt0133093"}) {
+		t.Errorf("Guids = %v", result.Guids)
+	}
+}
@@ -0,0 +1,165 @@
+package metadata
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/openflix/openflix-server/internal/models"
+	"gorm.io/gorm"
+)
+
+// tmdbCollectionRef is the franchise a movie belongs to (belongs_to_collection)
+type tmdbCollectionRef struct {
+	ID           int    `json:"id"`
+	Name         string `json:"name"`
+	PosterPath   string `json:"poster_path"`
+	BackdropPath string `json:"backdrop_path"`
+}
+
+// tmdbCollection is a full TMDB collection
+type tmdbCollection struct {
+	ID           int    `json:"id"`
+	Name         string `json:"name"`
+	Overview     string `json:"overview"`
+	PosterPath   string `json:"poster_path"`
+	BackdropPath string `json:"backdrop_path"`
+}
+
+// GetCollection fetches a movie collection (franchise) by TMDB ID
+func (t *TMDBAgent) GetCollection(tmdbID int) (*tmdbCollection, error) {
+	if !t.IsConfigured() {
+		return nil, fmt.Errorf("TMDB API key not configured")
+	}
+
+	params := url.Values{}
+	params.Set("api_key", t.apiKey)
+
+	resp, err := t.httpClient.Get(fmt.Sprintf("%s/collection/%d?%s", t.baseURL, tmdbID, params.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("TMDB API error: %d", resp.StatusCode)
+	}
+
+	var collection tmdbCollection
+	if err := json.NewDecoder(resp.Body).Decode(&collection); err != nil {
+		return nil, err
+	}
+
+	return &collection, nil
+}
+
+// syncMovieCollection makes a movie a member of the collection for its TMDB
+// franchise, creating the collection if needed, and drops it from any other
+// franchise collection. Franchise collections that end up empty are deleted.
+func (t *TMDBAgent) syncMovieCollection(item *models.MediaItem, ref *tmdbCollectionRef) {
+	// Leave franchise collections the movie no longer belongs to
+	var stale []uint
+	query := t.db.Model(&models.CollectionItem{}).
+		Joins("JOIN collections ON collections.id = collection_items.collection_id AND collections.deleted_at IS NULL").
+		Where("collection_items.media_item_id = ? AND collections.tmdb_collection_id > 0", item.ID)
+	if ref != nil {
+		query = query.Where("collections.tmdb_collection_id <> ?", ref.ID)
+	}
+	query.Pluck("collection_items.collection_id", &stale)
+
+	for _, collectionID := range stale {
+		t.db.Where("collection_id = ? AND media_item_id = ?", collectionID, item.ID).Delete(&models.CollectionItem{})
+		t.refreshFranchiseCollection(collectionID)
+	}
+
+	if ref == nil || ref.ID == 0 || item.LibraryID == 0 {
+		return
+	}
+
+	var collection models.Collection
+	err := t.db.Where("library_id = ? AND tmdb_collection_id = ?", item.LibraryID, ref.ID).First(&collection).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		collection = models.Collection{
+			UUID:             uuid.New().String(),
+			LibraryID:        item.LibraryID,
+			TMDBCollectionID: ref.ID,
+			Title:            ref.Name,
+			AddedAt:          time.Now(),
+			UpdatedAt:        time.Now(),
+		}
+		if details, err := t.GetCollection(ref.ID); err == nil {
+			collection.Summary = details.Overview
+		}
+		if ref.PosterPath != "" {
+			collection.Thumb = fmt.Sprintf("%s/w500%s", tmdbImageURL, ref.PosterPath)
+		}
+		if ref.BackdropPath != "" {
+			collection.Art = fmt.Sprintf("%s/w1280%s", tmdbImageURL, ref.BackdropPath)
+		}
+		if err := t.db.Create(&collection).Error; err != nil {
+			return
+		}
+	} else if err != nil {
+		return
+	} else {
+		// Pick up renamed franchises and new artwork, keeping what an
+		// admin has set
+		locked := CollectionLockedFields(&collection)
+		updates := map[string]interface{}{}
+		if ref.Name != "" && !locked["title"] {
+			updates["title"] = ref.Name
+		}
+		if ref.PosterPath != "" && !locked["thumb"] {
+			updates["thumb"] = fmt.Sprintf("%s/w500%s", tmdbImageURL, ref.PosterPath)
+		}
+		if ref.BackdropPath != "" && !locked["art"] {
+			updates["art"] = fmt.Sprintf("%s/w1280%s", tmdbImageURL, ref.BackdropPath)
+		}
+		if len(updates) > 0 {
+			t.db.Model(&collection).Updates(updates)
+		}
+	}
+
+	var count int64
+	t.db.Model(&models.CollectionItem{}).
+		Where("collection_id = ? AND media_item_id = ?", collection.ID, item.ID).
+		Count(&count)
+	if count == 0 {
+		t.db.Create(&models.CollectionItem{
+			CollectionID: collection.ID,
+			MediaItemID:  item.ID,
+		})
+	}
+
+	t.refreshFranchiseCollection(collection.ID)
+}
+
+// refreshFranchiseCollection orders a franchise collection by release date and
+// updates its child count, deleting the collection once it is empty
+func (t *TMDBAgent) refreshFranchiseCollection(collectionID uint) {
+	var itemIDs []uint
+	t.db.Model(&models.CollectionItem{}).
+		Joins("JOIN media_items ON media_items.id = collection_items.media_item_id AND media_items.deleted_at IS NULL").
+		Where("collection_items.collection_id = ?", collectionID).
+		Order("media_items.year ASC, media_items.originally_available_at ASC, media_items.sort_title ASC").
+		Pluck("collection_items.id", &itemIDs)
+
+	if len(itemIDs) == 0 {
+		t.db.Where("collection_id = ?", collectionID).Delete(&models.CollectionItem{})
+		t.db.Delete(&models.Collection{}, collectionID)
+		return
+	}
+
+	for i, id := range itemIDs {
+		t.db.Model(&models.CollectionItem{}).Where("id = ?", id).Update("order", i)
+	}
+
+	t.db.Model(&models.Collection{}).Where("id = ?", collectionID).Updates(map[string]interface{}{
+		"child_count": len(itemIDs),
+		"updated_at":  time.Now(),
+	})
+}
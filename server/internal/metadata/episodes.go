@@ -0,0 +1,31 @@
+package metadata
+
+// EpisodeRef is an episode's place in a show's seasons
+type EpisodeRef struct {
+	Season  int
+	Episode int
+}
+
+// AbsoluteOrderer is an agent that knows a show's episodes in absolute order,
+// as anime is often numbered ("Show - 137"), and which season each is in
+type AbsoluteOrderer interface {
+	// AbsoluteOrder returns a show's episodes outside its specials, first to
+	// last: absolute episode n is at n-1
+	AbsoluteOrder(showID string) ([]EpisodeRef, error)
+}
+
+// seasonOrder numbers the episodes of seasons 1 and up one after the other,
+// given each season's episode count
+func seasonOrder(counts map[int]int) []EpisodeRef {
+	last := 0
+	for season := range counts {
+		last = max(last, season)
+	}
+	var refs []EpisodeRef
+	for season := 1; season <= last; season++ {
+		for episode := 1; episode <= counts[season]; episode++ {
+			refs = append(refs, EpisodeRef{Season: season, Episode: episode})
+		}
+	}
+	return refs
+}
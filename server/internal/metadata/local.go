@@ -0,0 +1,248 @@
+package metadata
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/openflix/openflix-server/internal/models"
+	"gorm.io/gorm"
+)
+
+// Artwork extensions, in order of preference
+var artworkExtensions = []string{".jpg", ".jpeg", ".png", ".webp"}
+
+// LocalAgent reads metadata from Kodi style .nfo files and artwork stored
+// next to the media. Artwork is copied into the data directory so it is
+// served like any other poster.
+type LocalAgent struct {
+	db      *gorm.DB
+	dataDir string
+}
+
+// NewLocalAgent creates a new local metadata agent
+func NewLocalAgent(db *gorm.DB, dataDir string) *LocalAgent {
+	return &LocalAgent{
+		db:      db,
+		dataDir: dataDir,
+	}
+}
+
+// MovieNFO reads the .nfo of a movie: <name>.nfo, or movie.nfo when the
+// movie has a folder of its own
+func (a *LocalAgent) MovieNFO(videoPath string) *NFO {
+	candidates := []string{strings.TrimSuffix(videoPath, filepath.Ext(videoPath)) + ".nfo"}
+	if ownFolder(videoPath) {
+		candidates = append(candidates, filepath.Join(filepath.Dir(videoPath), "movie.nfo"))
+	}
+	for _, path := range candidates {
+		if nfo, err := ReadNFO(path, 0); err == nil {
+			return nfo
+		}
+	}
+	return nil
+}
+
+// ShowNFO reads the tvshow.nfo in a show's folder
+func (a *LocalAgent) ShowNFO(showDir string) *NFO {
+	nfo, err := ReadNFO(filepath.Join(showDir, "tvshow.nfo"), 0)
+	if err != nil {
+		return nil
+	}
+	return nfo
+}
+
+// EpisodeNFO reads the <name>.nfo of an episode
+func (a *LocalAgent) EpisodeNFO(videoPath string, episode int) *NFO {
+	nfo, err := ReadNFO(strings.TrimSuffix(videoPath, filepath.Ext(videoPath))+".nfo", episode)
+	if err != nil {
+		return nil
+	}
+	return nfo
+}
+
+// MovieResult returns a movie's .nfo, poster and fanart as an agent result
+func (a *LocalAgent) MovieResult(item *models.MediaItem, nfo *NFO, videoPath string) *Result {
+	result := nfo.Result()
+	dir := filepath.Dir(videoPath)
+	base := strings.TrimSuffix(filepath.Base(videoPath), filepath.Ext(videoPath))
+	posters := []string{base + "-poster", base + "-cover"}
+	fanart := []string{base + "-fanart", base + "-backdrop"}
+	// Generic names only belong to this movie if it has a folder of its own
+	if ownFolder(videoPath) {
+		posters = append(posters, "poster", "folder", "cover", "movie")
+		fanart = append(fanart, "fanart", "backdrop", "background")
+	}
+	a.findArtwork(item, result, dir, posters, fanart)
+	return result
+}
+
+// ShowResult returns a show's tvshow.nfo, poster and fanart
+func (a *LocalAgent) ShowResult(item *models.MediaItem, nfo *NFO, showDir string) *Result {
+	result := nfo.Result()
+	a.findArtwork(item, result, showDir, []string{"poster", "folder", "show", "cover"}, []string{"fanart", "backdrop", "background"})
+	return result
+}
+
+// SeasonResult returns a season's poster and fanart, named
+// season01-poster.jpg in the show folder or poster.jpg in the season folder
+func (a *LocalAgent) SeasonResult(item *models.MediaItem, showDir, seasonDir string) *Result {
+	result := &Result{}
+	if seasonDir != showDir {
+		a.findArtwork(item, result, seasonDir, []string{"poster", "folder", "cover"}, []string{"fanart", "backdrop"})
+	}
+	prefix := fmt.Sprintf("season%02d", item.Index)
+	if item.Index == 0 {
+		prefix = "season-specials"
+	}
+	a.findArtwork(item, result, showDir, []string{prefix + "-poster"}, []string{prefix + "-fanart"})
+	return result
+}
+
+// EpisodeResult returns an episode's .nfo and thumbnail
+func (a *LocalAgent) EpisodeResult(item *models.MediaItem, nfo *NFO, videoPath string) *Result {
+	result := nfo.Result()
+	base := strings.TrimSuffix(filepath.Base(videoPath), filepath.Ext(videoPath))
+	a.findArtwork(item, result, filepath.Dir(videoPath), []string{base + "-thumb", base}, nil)
+	return result
+}
+
+// PruneArtwork removes copied artwork that another agent has since replaced.
+// Artwork an admin locked is kept, so the edit can be reverted.
+func (a *LocalAgent) PruneArtwork(item *models.MediaItem) {
+	var current models.MediaItem
+	if err := a.db.Select("id", "thumb", "art", "locked_fields").First(&current, item.ID).Error; err != nil {
+		return
+	}
+	locked := LockedFields(&current)
+	if current.Thumb != LocalThumb(item.ID) && !locked["thumb"] {
+		os.Remove(a.posterPath(item.ID))
+	}
+	if current.Art != LocalArt(item.ID) && !locked["art"] {
+		os.Remove(a.backdropPath(item.ID))
+	}
+}
+
+// RemoveArtwork removes the copied artwork of a deleted item
+func (a *LocalAgent) RemoveArtwork(itemID uint) {
+	os.Remove(a.posterPath(itemID))
+	os.Remove(a.backdropPath(itemID))
+}
+
+// LocalThumb is the thumb URL of an item whose poster is in the data directory
+func LocalThumb(itemID uint) string {
+	return fmt.Sprintf("/library/metadata/%d/thumb", itemID)
+}
+
+// LocalArt is the art URL of an item whose backdrop is in the data directory
+func LocalArt(itemID uint) string {
+	return fmt.Sprintf("/library/metadata/%d/art", itemID)
+}
+
+func (a *LocalAgent) posterPath(itemID uint) string {
+	return filepath.Join(a.dataDir, "metadata", "posters", fmt.Sprintf("%d.jpg", itemID))
+}
+
+func (a *LocalAgent) backdropPath(itemID uint) string {
+	return filepath.Join(a.dataDir, "metadata", "backdrops", fmt.Sprintf("%d.jpg", itemID))
+}
+
+// findArtwork copies the first poster and fanart found in dir, unless the
+// result already has them or they are locked
+func (a *LocalAgent) findArtwork(item *models.MediaItem, result *Result, dir string, posters, fanart []string) {
+	locked := currentLocks(a.db, item.ID)
+	if result.Thumb == "" && !locked["thumb"] {
+		if src := artworkFile(dir, posters); src != "" && copyArtwork(src, a.posterPath(item.ID)) == nil {
+			result.Thumb = LocalThumb(item.ID)
+		}
+	}
+	if result.Art == "" && !locked["art"] {
+		if src := artworkFile(dir, fanart); src != "" && copyArtwork(src, a.backdropPath(item.ID)) == nil {
+			result.Art = LocalArt(item.ID)
+		}
+	}
+}
+
+// artworkFile returns the first image in dir with one of the given names
+func artworkFile(dir string, names []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return ""
+	}
+	files := make(map[string]string, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			files[strings.ToLower(entry.Name())] = entry.Name()
+		}
+	}
+	for _, name := range names {
+		for _, ext := range artworkExtensions {
+			if file, ok := files[strings.ToLower(name+ext)]; ok {
+				return filepath.Join(dir, file)
+			}
+		}
+	}
+	return ""
+}
+
+// copyArtwork copies an image into the data directory
+func copyArtwork(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	return out.Close()
+}
+
+// ownFolder reports whether a video is the only one of its kind in its folder
+func ownFolder(videoPath string) bool {
+	entries, err := os.ReadDir(filepath.Dir(videoPath))
+	if err != nil {
+		return false
+	}
+	ext := strings.ToLower(filepath.Ext(videoPath))
+	count := 0
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.ToLower(filepath.Ext(entry.Name())) == ext {
+			count++
+		}
+	}
+	return count == 1
+}
+
+// SaveGuids records an item's IDs in other databases, replacing any earlier
+// ID from the same database
+func SaveGuids(db *gorm.DB, itemID uint, guids []string) {
+	for _, guid := range guids {
+		provider, _, _ := strings.Cut(guid, "://")
+		db.Where("media_item_id = ? AND guid LIKE ? AND guid <> ?", itemID, provider+"://%", guid).
+			Delete(&models.MediaGuid{})
+		db.FirstOrCreate(&models.MediaGuid{}, models.MediaGuid{MediaItemID: itemID, Guid: guid})
+	}
+}
+
+// ItemGuids returns an item's IDs in other databases
+func ItemGuids(db *gorm.DB, itemID uint) []string {
+	var guids []string
+	db.Model(&models.MediaGuid{}).Where("media_item_id = ?", itemID).Order("guid").Pluck("guid", &guids)
+	return guids
+}
@@ -0,0 +1,217 @@
+package metadata
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/openflix/openflix-server/internal/models"
+	"gorm.io/gorm"
+)
+
+// ErrUnknownField is returned for a field that can't be locked or edited
+var ErrUnknownField = errors.New("unknown metadata field")
+
+// LockableFields are the fields of a media item an admin can lock. Agents
+// leave locked fields alone.
+var LockableFields = []string{
+	"title", "sort_title", "summary", "thumb", "art", "genres", "cast",
+	"year", "content_rating", "studio",
+}
+
+// IsLockable reports whether a field can be locked
+func IsLockable(field string) bool {
+	for _, f := range LockableFields {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+// LockedFields returns the locked fields of an item
+func LockedFields(item *models.MediaItem) map[string]bool {
+	return parseLocks(item.LockedFields)
+}
+
+// CollectionLockedFields returns the locked fields of a collection
+func CollectionLockedFields(collection *models.Collection) map[string]bool {
+	return parseLocks(collection.LockedFields)
+}
+
+// parseLocks reads a comma separated list of locked fields
+func parseLocks(list string) map[string]bool {
+	locked := make(map[string]bool)
+	for _, field := range strings.Split(list, ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			locked[field] = true
+		}
+	}
+	return locked
+}
+
+// joinLocks writes locked fields as a sorted comma separated list
+func joinLocks(locked map[string]bool) string {
+	fields := make([]string, 0, len(locked))
+	for field := range locked {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	return strings.Join(fields, ",")
+}
+
+// LockedList returns the locked fields of an item in a stable order
+func LockedList(item *models.MediaItem) []string {
+	fields := make([]string, 0)
+	locked := LockedFields(item)
+	for _, field := range LockableFields {
+		if locked[field] {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+// SetLocks locks and unlocks fields of an item, e.g. {"title": true}
+func SetLocks(db *gorm.DB, item *models.MediaItem, locks map[string]bool) error {
+	locked := LockedFields(item)
+	for field, lock := range locks {
+		if !IsLockable(field) {
+			return ErrUnknownField
+		}
+		if lock {
+			locked[field] = true
+		} else {
+			delete(locked, field)
+		}
+	}
+
+	item.LockedFields = joinLocks(locked)
+	return db.Model(item).Update("locked_fields", item.LockedFields).Error
+}
+
+// LockCollectionFields locks fields of a collection an admin has set, so
+// franchise syncing leaves them alone
+func LockCollectionFields(db *gorm.DB, collection *models.Collection, fields ...string) error {
+	locked := CollectionLockedFields(collection)
+	for _, field := range fields {
+		locked[field] = true
+	}
+	collection.LockedFields = joinLocks(locked)
+	return db.Model(collection).Update("locked_fields", collection.LockedFields).Error
+}
+
+// currentLocks reads the locked fields of an item from the database, since
+// an admin may have locked a field while an agent was running
+func currentLocks(db *gorm.DB, itemID uint) map[string]bool {
+	var current models.MediaItem
+	if err := db.Select("id", "locked_fields").First(&current, itemID).Error; err != nil {
+		return map[string]bool{}
+	}
+	return LockedFields(&current)
+}
+
+// FieldValue returns the current value of an editable field as it is
+// recorded in the edit history
+func FieldValue(db *gorm.DB, item *models.MediaItem, field string) (string, error) {
+	switch field {
+	case "title":
+		return item.Title, nil
+	case "sort_title":
+		return item.SortTitle, nil
+	case "summary":
+		return item.Summary, nil
+	case "thumb":
+		return item.Thumb, nil
+	case "art":
+		return item.Art, nil
+	case "content_rating":
+		return item.ContentRating, nil
+	case "studio":
+		return item.Studio, nil
+	case "year":
+		return strconv.Itoa(item.Year), nil
+	case "genres":
+		var genres []string
+		db.Model(&models.Genre{}).
+			Joins("JOIN media_genres ON media_genres.genre_id = genres.id").
+			Where("media_genres.media_item_id = ?", item.ID).
+			Order("genres.tag").
+			Pluck("genres.tag", &genres)
+		if genres == nil {
+			genres = []string{}
+		}
+		data, err := json.Marshal(genres)
+		return string(data), err
+	case "cast":
+		var members []models.CastMember
+		db.Where("media_item_id = ?", item.ID).Order("id ASC").Find(&members)
+		cast := make([]Credit, 0, len(members))
+		for _, member := range members {
+			cast = append(cast, Credit{Name: member.Tag, Role: member.Role, Thumb: member.Thumb})
+		}
+		data, err := json.Marshal(cast)
+		return string(data), err
+	}
+	return "", ErrUnknownField
+}
+
+// SetField stores a value of an editable field, as returned by FieldValue
+func SetField(db *gorm.DB, item *models.MediaItem, field, value string) error {
+	switch field {
+	case "title", "sort_title", "summary", "thumb", "art", "content_rating", "studio":
+		return db.Model(item).Update(field, value).Error
+	case "year":
+		year, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		return db.Model(item).Update("year", year).Error
+	case "genres":
+		var genres []string
+		if err := json.Unmarshal([]byte(value), &genres); err != nil {
+			return err
+		}
+		updateGenres(db, item, genres)
+		return nil
+	case "cast":
+		var cast []Credit
+		if err := json.Unmarshal([]byte(value), &cast); err != nil {
+			return err
+		}
+		for i := range cast {
+			cast[i].Order = i
+		}
+		updateCast(db, item, cast)
+		return nil
+	}
+	return ErrUnknownField
+}
+
+// EditField changes a field on behalf of a user, records the change in the
+// item's edit history and locks the field so agents keep the new value
+func EditField(db *gorm.DB, item *models.MediaItem, field, value string, userID uint, username string) error {
+	old, err := FieldValue(db, item, field)
+	if err != nil {
+		return err
+	}
+	if old == value {
+		return nil
+	}
+	if err := SetField(db, item, field, value); err != nil {
+		return err
+	}
+	if err := SetLocks(db, item, map[string]bool{field: true}); err != nil {
+		return err
+	}
+	return db.Create(&models.MetadataEdit{
+		MediaItemID: item.ID,
+		UserID:      userID,
+		Username:    username,
+		Field:       field,
+		OldValue:    old,
+		NewValue:    value,
+	}).Error
+}
@@ -0,0 +1,76 @@
+package metadata
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/openflix/openflix-server/internal/models"
+)
+
+func TestEditField(t *testing.T) {
+	tests := []struct {
+		field, value string
+	}{
+		{"title", "The Matrix (1999)"},
+		{"year", "1999"},
+		{"genres", `["Action","Science Fiction"]`},
+		{"cast", `[{"name":"Keanu Reeves","role":"Neo"},{"name":"Carrie-Anne Moss","role":"Trinity","thumb":"moss.jpg"}]`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.field, func(t *testing.T) {
+			db := testDB(t)
+			item := models.MediaItem{Type: "movie", Title: "The Matrix"}
+			if err := db.Create(&item).Error; err != nil {
+				t.Fatal(err)
+			}
+			old, err := FieldValue(db, &item, tt.field)
+			if err != nil {
+				t.Fatalf("FieldValue() error = %v", err)
+			}
+
+			if err := EditField(db, &item, tt.field, tt.value, 1, "admin"); err != nil {
+				t.Fatalf("EditField() error = %v", err)
+			}
+			db.First(&item, item.ID)
+			if got, _ := FieldValue(db, &item, tt.field); got != tt.value {
+				t.Errorf("FieldValue() = %s, want %s", got, tt.value)
+			}
+			if !LockedFields(&item)[tt.field] {
+				t.Errorf("%s isn't locked after an edit", tt.field)
+			}
+
+			var edits []models.MetadataEdit
+			db.Where("media_item_id = ?", item.ID).Find(&edits)
+			if len(edits) != 1 || edits[0].OldValue != old || edits[0].NewValue != tt.value {
+				t.Errorf("history = %+v", edits)
+			}
+		})
+	}
+}
+
+func TestEditCastOrder(t *testing.T) {
+	db := testDB(t)
+	item := models.MediaItem{Type: "movie", Title: "The Matrix"}
+	db.Create(&item)
+
+	if err := SetField(db, &item, "cast", `[{"name":"Keanu Reeves"},{"name":"Laurence Fishburne"}]`); err != nil {
+		t.Fatalf("SetField() error = %v", err)
+	}
+	var members []models.CastMember
+	db.Where("media_item_id = ?", item.ID).Order("id ASC").Find(&members)
+	var orders []int
+	for _, member := range members {
+		orders = append(orders, member.Order)
+	}
+	if !reflect.DeepEqual(orders, []int{0, 1}) {
+		t.Errorf("orders = %v, want the list's", orders)
+	}
+
+	if err := SetField(db, &item, "cast", "not json"); err == nil {
+		t.Error("SetField() of an invalid cast succeeded")
+	}
+	if _, err := FieldValue(db, &item, "rating"); err != ErrUnknownField {
+		t.Errorf("FieldValue(rating) error = %v, want ErrUnknownField", err)
+	}
+}
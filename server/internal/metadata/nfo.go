@@ -0,0 +1,319 @@
+package metadata
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NFO is the metadata of a Kodi style .nfo file. Movies use a <movie> root,
+// shows <tvshow> and episodes <episodedetails>. Numbers are kept as text so
+// one malformed value doesn't discard the whole file.
+type NFO struct {
+	XMLName       xml.Name
+	Title         string        `xml:"title"`
+	OriginalTitle string        `xml:"originaltitle"`
+	SortTitle     string        `xml:"sorttitle"`
+	Plot          string        `xml:"plot"`
+	Outline       string        `xml:"outline"`
+	Tagline       string        `xml:"tagline"`
+	MPAA          string        `xml:"mpaa"`
+	Studios       []string      `xml:"studio"`
+	Year          string        `xml:"year"`
+	Premiered     string        `xml:"premiered"`
+	Aired         string        `xml:"aired"`
+	Season        string        `xml:"season"`
+	Episode       string        `xml:"episode"`
+	Rating        string        `xml:"rating"`
+	Ratings       []nfoRating   `xml:"ratings>rating"`
+	Genres        []string      `xml:"genre"`
+	Directors     []string      `xml:"director"`
+	Writers       []string      `xml:"credits"`
+	Actors        []nfoActor    `xml:"actor"`
+	UniqueIDs     []nfoUniqueID `xml:"uniqueid"`
+
+	// Older scrapers write the IDs as plain elements
+	ID     string `xml:"id"`
+	IMDBID string `xml:"imdbid"`
+	TMDBID string `xml:"tmdbid"`
+	TVDBID string `xml:"tvdbid"`
+}
+
+type nfoRating struct {
+	Name    string `xml:"name,attr"`
+	Max     string `xml:"max,attr"`
+	Default bool   `xml:"default,attr"`
+	Value   string `xml:"value"`
+}
+
+type nfoActor struct {
+	Name  string `xml:"name"`
+	Role  string `xml:"role"`
+	Order string `xml:"order"`
+	Thumb string `xml:"thumb"`
+}
+
+type nfoUniqueID struct {
+	Type    string `xml:"type,attr"`
+	Default bool   `xml:"default,attr"`
+	Value   string `xml:",chardata"`
+}
+
+// NFO files may also be just a link to the movie's page
+var (
+	nfoIMDBLink = regexp.MustCompile(`imdb\.com/title/(tt\d+)`)
+	nfoTMDBLink = regexp.MustCompile(`themoviedb\.org/(?:movie|tv)/(\d+)`)
+	nfoTVDBLink = regexp.MustCompile(`thetvdb\.com/.*?(?:id=|series/)(\d+)`)
+	imdbIDValue = regexp.MustCompile(`^tt\d+$`)
+)
+
+// ReadNFO parses an .nfo file. Files holding several <episodedetails>, as
+// written for multi-episode files, return the one for the given episode, or
+// the first when episode is 0.
+func ReadNFO(path string, episode int) (*NFO, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	nfo := &NFO{}
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	decoder.Strict = false
+	found := false
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			break
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		switch start.Name.Local {
+		case "movie", "tvshow", "episodedetails":
+			var candidate NFO
+			if err := decoder.DecodeElement(&candidate, &start); err != nil {
+				continue
+			}
+			if !found || (episode > 0 && number(candidate.Episode) == episode) {
+				*nfo = candidate
+				found = true
+			}
+		}
+		if found && (episode == 0 || number(nfo.Episode) == episode) {
+			break
+		}
+	}
+
+	// Anything after the XML, or a file without XML, may link to a database
+	text := string(data)
+	if m := nfoIMDBLink.FindStringSubmatch(text); m != nil && nfo.IMDBID == "" {
+		nfo.IMDBID = m[1]
+		found = true
+	}
+	if m := nfoTMDBLink.FindStringSubmatch(text); m != nil && nfo.TMDBID == "" {
+		nfo.TMDBID = m[1]
+		found = true
+	}
+	if m := nfoTVDBLink.FindStringSubmatch(text); m != nil && nfo.TVDBID == "" {
+		nfo.TVDBID = m[1]
+		found = true
+	}
+
+	if !found {
+		return nil, fmt.Errorf("%s: no metadata found", path)
+	}
+	nfo.trim()
+	return nfo, nil
+}
+
+func (n *NFO) trim() {
+	for _, s := range []*string{&n.Title, &n.OriginalTitle, &n.SortTitle, &n.Plot, &n.Outline,
+		&n.Tagline, &n.MPAA, &n.Premiered, &n.Aired, &n.ID, &n.IMDBID, &n.TMDBID, &n.TVDBID} {
+		*s = strings.TrimSpace(*s)
+	}
+}
+
+// Guids returns the item's IDs in other databases as Plex style guids, e.g.
+// "tmdb://603"
+func (n *NFO) Guids() []string {
+	ids := map[string]string{}
+	for _, u := range n.UniqueIDs {
+		provider := strings.ToLower(strings.TrimSpace(u.Type))
+		value := strings.TrimSpace(u.Value)
+		if provider == "themoviedb" {
+			provider = "tmdb"
+		}
+		if value != "" && (provider == "imdb" || provider == "tmdb" || provider == "tvdb") {
+			ids[provider] = value
+		}
+	}
+	legacy := map[string]string{"imdb": n.IMDBID, "tmdb": n.TMDBID, "tvdb": n.TVDBID}
+	// <id> holds the IMDb ID for movies and the TVDB ID for shows
+	if imdbIDValue.MatchString(n.ID) {
+		legacy["imdb"] = n.ID
+	} else if n.ID != "" && n.XMLName.Local == "tvshow" {
+		legacy["tvdb"] = n.ID
+	}
+	for provider, value := range legacy {
+		if _, ok := ids[provider]; !ok && value != "" {
+			ids[provider] = value
+		}
+	}
+
+	var guids []string
+	for _, provider := range []string{"imdb", "tmdb", "tvdb"} {
+		if value, ok := ids[provider]; ok {
+			guids = append(guids, provider+"://"+value)
+		}
+	}
+	return guids
+}
+
+// Result converts the .nfo into an agent result. A nil NFO gives an empty
+// result.
+func (n *NFO) Result() *Result {
+	if n == nil {
+		return &Result{}
+	}
+	result := &Result{
+		Guids:         n.Guids(),
+		Title:         n.Title,
+		SortTitle:     n.SortTitle,
+		OriginalTitle: n.OriginalTitle,
+		Summary:       n.Summary(),
+		Tagline:       n.Tagline,
+		ContentRating: n.ContentRating(),
+		Rating:        n.Score(),
+		Released:      n.Released(),
+		Year:          number(n.Year),
+	}
+	if len(n.Studios) > 0 {
+		result.Studio = strings.TrimSpace(n.Studios[0])
+	}
+	for _, tag := range n.Genres {
+		// Some scrapers put every genre in one element
+		for _, name := range strings.Split(tag, " / ") {
+			if name = strings.TrimSpace(name); name != "" {
+				result.Genres = append(result.Genres, name)
+			}
+		}
+	}
+	result.Cast = n.credits()
+	return result
+}
+
+// credits lists the directors and writers, followed by the actors
+func (n *NFO) credits() []Credit {
+	var credits []Credit
+	order := 0
+	for _, crew := range []struct {
+		role   string
+		people []string
+	}{{"Director", n.Directors}, {"Writer", n.Writers}} {
+		for _, name := range crew.people {
+			if name = strings.TrimSpace(name); name == "" {
+				continue
+			}
+			credits = append(credits, Credit{Name: name, Role: crew.role, Order: order})
+			order++
+		}
+	}
+
+	for i, actor := range n.Actors {
+		name := strings.TrimSpace(actor.Name)
+		if name == "" {
+			continue
+		}
+		// Only remote thumbs can be shown; local ones point into Kodi's cache
+		thumb := strings.TrimSpace(actor.Thumb)
+		if !strings.HasPrefix(thumb, "http") {
+			thumb = ""
+		}
+		position := i
+		if n, err := strconv.Atoi(strings.TrimSpace(actor.Order)); err == nil {
+			position = n
+		}
+		credits = append(credits, Credit{
+			Name:  name,
+			Role:  strings.TrimSpace(actor.Role),
+			Thumb: thumb,
+			Order: order + position,
+		})
+	}
+	return credits
+}
+
+// Summary returns the plot, or the outline when there is no plot
+func (n *NFO) Summary() string {
+	if n.Plot != "" {
+		return n.Plot
+	}
+	return n.Outline
+}
+
+// ContentRating returns the certification without the "Rated " or country
+// prefixes some scrapers write, e.g. "US:PG-13"
+func (n *NFO) ContentRating() string {
+	rating := strings.TrimPrefix(n.MPAA, "Rated ")
+	if i := strings.LastIndex(rating, ":"); i >= 0 {
+		rating = rating[i+1:]
+	}
+	return strings.TrimSpace(rating)
+}
+
+// Score returns the default rating on a scale of 10
+func (n *NFO) Score() float64 {
+	var chosen *nfoRating
+	for i := range n.Ratings {
+		if chosen == nil || n.Ratings[i].Default {
+			chosen = &n.Ratings[i]
+		}
+	}
+	if chosen == nil {
+		return decimal(n.Rating)
+	}
+	if scale := decimal(chosen.Max); scale > 0 && scale != 10 {
+		return decimal(chosen.Value) * 10 / scale
+	}
+	return decimal(chosen.Value)
+}
+
+// Released returns the premiere or air date
+func (n *NFO) Released() *time.Time {
+	for _, value := range []string{n.Premiered, n.Aired} {
+		if t, err := time.Parse("2006-01-02", value); err == nil {
+			return &t
+		}
+	}
+	return nil
+}
+
+// number parses an integer element, ignoring anything malformed
+func number(s string) int {
+	n, _ := strconv.Atoi(strings.TrimSpace(s))
+	return n
+}
+
+// decimal parses a decimal element, accepting a comma as the separator
+func decimal(s string) float64 {
+	f, _ := strconv.ParseFloat(strings.Replace(strings.TrimSpace(s), ",", ".", 1), 64)
+	return f
+}
+
+// tmdbID returns the TMDB ID from a list of guids
+func tmdbID(guids []string) int {
+	for _, guid := range guids {
+		if strings.HasPrefix(guid, "tmdb://") {
+			if id, err := strconv.Atoi(strings.TrimPrefix(guid, "tmdb://")); err == nil {
+				return id
+			}
+		}
+	}
+	return 0
+}
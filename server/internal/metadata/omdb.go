@@ -0,0 +1,256 @@
+package metadata
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const omdbBaseURL = "https://www.omdbapi.com"
+
+// OMDbAgent fetches metadata from the Open Movie Database. Its IDs are IMDb
+// IDs, and it is mostly useful for IMDb ratings.
+type OMDbAgent struct {
+	endpoint
+	apiKey string
+}
+
+// NewOMDbAgent creates a new OMDb metadata agent
+func NewOMDbAgent(apiKey string) *OMDbAgent {
+	return &OMDbAgent{
+		endpoint: newEndpoint("OMDb", omdbBaseURL),
+		apiKey:   apiKey,
+	}
+}
+
+// omdbTitle is a movie, series or episode. OMDb reports missing values as
+// "N/A".
+type omdbTitle struct {
+	Title      string `json:"Title"`
+	Year       string `json:"Year"`
+	Rated      string `json:"Rated"`
+	Released   string `json:"Released"`
+	Runtime    string `json:"Runtime"`
+	Genre      string `json:"Genre"`
+	Director   string `json:"Director"`
+	Writer     string `json:"Writer"`
+	Actors     string `json:"Actors"`
+	Plot       string `json:"Plot"`
+	Poster     string `json:"Poster"`
+	IMDbRating string `json:"imdbRating"`
+	IMDbID     string `json:"imdbID"`
+	Production string `json:"Production"`
+	Response   string `json:"Response"`
+	Error      string `json:"Error"`
+}
+
+// IsConfigured returns true if the OMDb API key is set
+func (o *OMDbAgent) IsConfigured() bool {
+	return o.apiKey != ""
+}
+
+// Name implements MetadataAgent
+func (o *OMDbAgent) Name() string {
+	return "omdb"
+}
+
+// Provider implements MetadataAgent
+func (o *OMDbAgent) Provider() string {
+	return "imdb"
+}
+
+// get calls the API. OMDb answers errors with status 200 and Response
+// "False", so they are returned as errors here.
+func (o *OMDbAgent) get(params url.Values, v interface{}) error {
+	if !o.IsConfigured() {
+		return fmt.Errorf("OMDb API key not configured")
+	}
+	params.Set("apikey", o.apiKey)
+	return o.getJSON("/", params, nil, v)
+}
+
+// title fetches a movie, series or episode and checks the response
+func (o *OMDbAgent) title(params url.Values) (*omdbTitle, error) {
+	var title omdbTitle
+	if err := o.get(params, &title); err != nil {
+		return nil, err
+	}
+	if title.Response == "False" {
+		return nil, errors.New("OMDb: " + title.Error)
+	}
+	return &title, nil
+}
+
+// Search finds movies or series by title and optional year
+func (o *OMDbAgent) Search(kind, title string, year int) ([]Match, error) {
+	params := url.Values{}
+	params.Set("s", title)
+	params.Set("type", omdbType(kind))
+	if year > 0 {
+		params.Set("y", strconv.Itoa(year))
+	}
+
+	var result struct {
+		Search []struct {
+			Title  string `json:"Title"`
+			Year   string `json:"Year"`
+			IMDbID string `json:"imdbID"`
+		} `json:"Search"`
+		Response string `json:"Response"`
+		Error    string `json:"Error"`
+	}
+	if err := o.get(params, &result); err != nil {
+		return nil, err
+	}
+	// "Movie not found!" is an empty result rather than a failure
+	if result.Response == "False" && !strings.Contains(result.Error, "not found") {
+		return nil, errors.New("OMDb: " + result.Error)
+	}
+
+	var matches []Match
+	for _, r := range result.Search {
+		matches = append(matches, Match{ID: r.IMDbID, Title: r.Title, Year: omdbYear(r.Year)})
+	}
+	return matches, nil
+}
+
+// Details fetches a movie or series
+func (o *OMDbAgent) Details(kind, id string) (*Result, error) {
+	params := url.Values{}
+	params.Set("i", id)
+	params.Set("plot", "full")
+	title, err := o.title(params)
+	if err != nil {
+		return nil, err
+	}
+	return title.result(), nil
+}
+
+// Season has nothing OMDb doesn't already give per episode
+func (o *OMDbAgent) Season(showID string, season int) (*Result, error) {
+	return &Result{}, nil
+}
+
+// Episode fetches an episode of a series
+func (o *OMDbAgent) Episode(showID string, season, episode int) (*Result, error) {
+	params := url.Values{}
+	params.Set("i", showID)
+	params.Set("Season", strconv.Itoa(season))
+	params.Set("Episode", strconv.Itoa(episode))
+	params.Set("plot", "full")
+	title, err := o.title(params)
+	if err != nil {
+		return nil, err
+	}
+	result := title.result()
+	// An episode's IMDb ID is its own, not the show's
+	result.Guids = nil
+	return result, nil
+}
+
+// Images returns the poster, the only image OMDb has
+func (o *OMDbAgent) Images(kind, id string) (*Images, error) {
+	result, err := o.Details(kind, id)
+	if err != nil {
+		return nil, err
+	}
+	images := &Images{}
+	if result.Thumb != "" {
+		images.Posters = []string{result.Thumb}
+	}
+	return images, nil
+}
+
+// Credits returns the directors, writers and actors, without their roles
+func (o *OMDbAgent) Credits(kind, id string) ([]Credit, error) {
+	result, err := o.Details(kind, id)
+	if err != nil {
+		return nil, err
+	}
+	return result.Cast, nil
+}
+
+// omdbType is the type OMDb uses for a kind of item
+func omdbType(kind string) string {
+	if kind == KindShow {
+		return "series"
+	}
+	return "movie"
+}
+
+// omdbYear reads a year, or the first year of a range such as "2008–2013"
+func omdbYear(s string) int {
+	if len(s) >= 4 {
+		s = s[:4]
+	}
+	return number(s)
+}
+
+// omdbValue returns a value, or "" for "N/A"
+func omdbValue(s string) string {
+	if s = strings.TrimSpace(s); s == "N/A" {
+		return ""
+	}
+	return s
+}
+
+// omdbList splits a comma separated list of names
+func omdbList(s string) []string {
+	var names []string
+	for _, name := range strings.Split(omdbValue(s), ",") {
+		// Writers come with their part, e.g. "Lilly Wachowski (written by)"
+		if i := strings.Index(name, "("); i >= 0 {
+			name = name[:i]
+		}
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// result converts a title
+func (t *omdbTitle) result() *Result {
+	result := &Result{
+		Title:         omdbValue(t.Title),
+		Summary:       omdbValue(t.Plot),
+		ContentRating: omdbValue(t.Rated),
+		Studio:        omdbValue(t.Production),
+		Thumb:         omdbValue(t.Poster),
+		Year:          omdbYear(omdbValue(t.Year)),
+		Rating:        decimal(omdbValue(t.IMDbRating)),
+		Genres:        omdbList(t.Genre),
+	}
+	if result.ContentRating == "Not Rated" || result.ContentRating == "Unrated" {
+		result.ContentRating = ""
+	}
+	if released, err := time.Parse("02 Jan 2006", omdbValue(t.Released)); err == nil {
+		result.Released = &released
+	}
+	if minutes := number(strings.TrimSuffix(omdbValue(t.Runtime), " min")); minutes > 0 {
+		result.Duration = int64(minutes) * 60 * 1000
+	}
+	if id := omdbValue(t.IMDbID); id != "" {
+		result.Guids = []string{"imdb://" + id}
+	}
+
+	seen := map[string]bool{}
+	for _, crew := range []struct {
+		role   string
+		people []string
+	}{{"Director", omdbList(t.Director)}, {"Writer", omdbList(t.Writer)}} {
+		for _, name := range crew.people {
+			if !seen[crew.role+name] {
+				seen[crew.role+name] = true
+				result.Cast = append(result.Cast, Credit{Name: name, Role: crew.role, Order: len(result.Cast)})
+			}
+		}
+	}
+	for _, name := range omdbList(t.Actors) {
+		result.Cast = append(result.Cast, Credit{Name: name, Order: len(result.Cast)})
+	}
+	return result
+}
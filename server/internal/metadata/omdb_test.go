@@ -0,0 +1,137 @@
+package metadata
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// omdbTestAgent returns an OMDb agent replaying the recorded responses.
+// Everything is a query of /, so fixtures are named after the query.
+func omdbTestAgent(t *testing.T) *OMDbAgent {
+	server := fixtureServer(t, "omdb", func(r *http.Request) string {
+		query := r.URL.Query()
+		switch {
+		case r.URL.Path != "/" || query.Get("apikey") != "test-key":
+			return ""
+		case query.Get("s") == "The Matrix":
+			return "search_the_matrix"
+		case query.Get("s") != "":
+			return "search_not_found"
+		case query.Get("Season") != "":
+			return "episode_" + query.Get("i") + "_" + query.Get("Season") + "_" + query.Get("Episode")
+		case query.Get("i") == "tt0133093":
+			return "title_tt0133093"
+		}
+		return "title_not_found"
+	})
+	agent := NewOMDbAgent("test-key")
+	agent.SetEndpoint(server.URL, nil)
+	return agent
+}
+
+func TestOMDbSearch(t *testing.T) {
+	agent := omdbTestAgent(t)
+
+	matches, err := agent.Search(KindMovie, "The Matrix", 0)
+	if err != nil {
+		t.Fatalf("Search() error = %v", err)
+	}
+	want := []Match{
+		{ID: "tt0133093", Title: "The Matrix", Year: 1999},
+		{ID: "tt0234215", Title: "The Matrix Reloaded", Year: 2003},
+	}
+	if !reflect.DeepEqual(matches, want) {
+		t.Errorf("Search() = %+v, want %+v", matches, want)
+	}
+
+	// "Movie not found!" is no match rather than an error
+	matches, err = agent.Search(KindMovie, "Nothing Like It", 0)
+	if err != nil || len(matches) != 0 {
+		t.Errorf("Search() = %+v, %v, want no matches", matches, err)
+	}
+}
+
+func TestOMDbDetails(t *testing.T) {
+	agent := omdbTestAgent(t)
+
+	movie, err := agent.Details(KindMovie, "tt0133093")
+	if err != nil {
+		t.Fatalf("Details() error = %v", err)
+	}
+	want := &Result{
+		Guids:         []string{"imdb://tt0133093"},
+		Title:         "The Matrix",
+		Summary:       "When a beautiful stranger leads computer hacker Neo to a forbidding underworld, he discovers the shocking truth--the life he knows is the elaborate deception of an evil cyber-intelligence.",
+		ContentRating: "R",
+		Year:          1999,
+		Released:      date(1999, time.March, 31),
+		Rating:        8.7,
+		Duration:      136 * 60 * 1000,
+		Genres:        []string{"Action", "Sci-Fi"},
+		Cast: []Credit{
+			{Name: "Lana Wachowski", Role: "Director", Order: 0},
+			{Name: "Lilly Wachowski", Role: "Director", Order: 1},
+			{Name: "Lilly Wachowski", Role: "Writer", Order: 2},
+			{Name: "Lana Wachowski", Role: "Writer", Order: 3},
+			{Name: "Keanu Reeves", Order: 4},
+			{Name: "Laurence Fishburne", Order: 5},
+			{Name: "Carrie-Anne Moss", Order: 6},
+		},
+		Thumb: "https://m.media-amazon.com/images/M/MV5BNzQzOTk3OTAtNDQ0Zi00ZTVkLWI0MTEtMDllZjNkYzNjNTc4L2ltYWdlXkEyXkFqcGdeQXVyNjU0OTQ0OTY@._V1_SX300.jpg",
+	}
+	if !reflect.DeepEqual(movie, want) {
+		t.Errorf("Details() = %+v, want %+v", movie, want)
+	}
+
+	if _, err := agent.Details(KindMovie, "tt0000000"); err == nil {
+		t.Error("Details() of an incorrect ID succeeded")
+	}
+}
+
+func TestOMDbSeasonAndEpisode(t *testing.T) {
+	agent := omdbTestAgent(t)
+
+	season, err := agent.Season("tt0903747", 1)
+	if err != nil || !reflect.DeepEqual(season, &Result{}) {
+		t.Errorf("Season() = %+v, %v, want an empty result", season, err)
+	}
+
+	// The episode's own IMDb ID isn't the show's
+	episode, err := agent.Episode("tt0903747", 1, 1)
+	if err != nil {
+		t.Fatalf("Episode() error = %v", err)
+	}
+	if episode.Title != "Pilot" || episode.Rating != 9.0 || episode.ContentRating != "TV-MA" || episode.Guids != nil ||
+		!reflect.DeepEqual(episode.Released, date(2008, time.January, 20)) {
+		t.Errorf("Episode() = %+v", episode)
+	}
+	if _, err := agent.Episode("tt0903747", 1, 2); err == nil {
+		t.Error("Episode() of an unrecorded episode succeeded")
+	}
+}
+
+func TestOMDbImagesAndCredits(t *testing.T) {
+	agent := omdbTestAgent(t)
+
+	images, err := agent.Images(KindMovie, "tt0133093")
+	if err != nil {
+		t.Fatalf("Images() error = %v", err)
+	}
+	if len(images.Posters) != 1 || len(images.Backdrops) != 0 {
+		t.Errorf("Images() = %+v, want the poster only", images)
+	}
+
+	credits, err := agent.Credits(KindMovie, "tt0133093")
+	if err != nil {
+		t.Fatalf("Credits() error = %v", err)
+	}
+	if len(credits) != 7 || credits[0].Role != "Director" || credits[4].Name != "Keanu Reeves" {
+		t.Errorf("Credits() = %+v", credits)
+	}
+
+	if _, err := NewOMDbAgent("").Details(KindMovie, "tt0133093"); err == nil {
+		t.Error("Details() without an API key succeeded")
+	}
+}
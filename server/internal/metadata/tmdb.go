@@ -6,8 +6,8 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"sort"
 	"strconv"
-	"time"
 
 	"github.com/openflix/openflix-server/internal/models"
 	"gorm.io/gorm"
@@ -20,21 +20,19 @@ const (
 
 // TMDBAgent handles metadata fetching from The Movie Database
 type TMDBAgent struct {
-	apiKey     string
-	httpClient *http.Client
-	db         *gorm.DB
-	dataDir    string
+	endpoint
+	apiKey  string
+	db      *gorm.DB
+	dataDir string
 }
 
 // NewTMDBAgent creates a new TMDB metadata agent
 func NewTMDBAgent(apiKey string, db *gorm.DB, dataDir string) *TMDBAgent {
 	return &TMDBAgent{
-		apiKey: apiKey,
-		httpClient: &http.Client{
-			Timeout: 30 * time.Second,
-		},
-		db:      db,
-		dataDir: dataDir,
+		endpoint: newEndpoint("TMDB", tmdbBaseURL),
+		apiKey:   apiKey,
+		db:       db,
+		dataDir:  dataDir,
 	}
 }
 
@@ -72,10 +70,12 @@ type tmdbMovie struct {
 	Popularity       float64 `json:"popularity"`
 	Adult            bool    `json:"adult"`
 	Runtime          int     `json:"runtime"`
+	IMDbID           string  `json:"imdb_id"`
 	Status           string  `json:"status"`
 	Budget           int64   `json:"budget"`
 	Revenue          int64   `json:"revenue"`
 	Genres           []tmdbGenre `json:"genres"`
+	BelongsToCollection *tmdbCollectionRef `json:"belongs_to_collection"`
 	ProductionCompanies []struct {
 		ID   int    `json:"id"`
 		Name string `json:"name"`
@@ -119,6 +119,10 @@ type tmdbShow struct {
 			Rating    string `json:"rating"`
 		} `json:"results"`
 	} `json:"content_ratings"`
+	Seasons []struct {
+		SeasonNumber int `json:"season_number"`
+		EpisodeCount int `json:"episode_count"`
+	} `json:"seasons"`
 }
 
 type tmdbSeason struct {
@@ -179,7 +183,7 @@ func (t *TMDBAgent) SearchMovie(title string, year int) (*tmdbMovie, error) {
 		params.Set("year", strconv.Itoa(year))
 	}
 
-	resp, err := t.httpClient.Get(fmt.Sprintf("%s/search/movie?%s", tmdbBaseURL, params.Encode()))
+	resp, err := t.httpClient.Get(fmt.Sprintf("%s/search/movie?%s", t.baseURL, params.Encode()))
 	if err != nil {
 		return nil, err
 	}
@@ -212,7 +216,7 @@ func (t *TMDBAgent) GetMovieDetails(tmdbID int) (*tmdbMovie, error) {
 	params.Set("api_key", t.apiKey)
 	params.Set("append_to_response", "release_dates") // Get certifications
 
-	resp, err := t.httpClient.Get(fmt.Sprintf("%s/movie/%d?%s", tmdbBaseURL, tmdbID, params.Encode()))
+	resp, err := t.httpClient.Get(fmt.Sprintf("%s/movie/%d?%s", t.baseURL, tmdbID, params.Encode()))
 	if err != nil {
 		return nil, err
 	}
@@ -239,7 +243,7 @@ func (t *TMDBAgent) GetMovieCredits(tmdbID int) (*tmdbCredits, error) {
 	params := url.Values{}
 	params.Set("api_key", t.apiKey)
 
-	resp, err := t.httpClient.Get(fmt.Sprintf("%s/movie/%d/credits?%s", tmdbBaseURL, tmdbID, params.Encode()))
+	resp, err := t.httpClient.Get(fmt.Sprintf("%s/movie/%d/credits?%s", t.baseURL, tmdbID, params.Encode()))
 	if err != nil {
 		return nil, err
 	}
@@ -270,7 +274,7 @@ func (t *TMDBAgent) SearchTV(title string, year int) (*tmdbShow, error) {
 		params.Set("first_air_date_year", strconv.Itoa(year))
 	}
 
-	resp, err := t.httpClient.Get(fmt.Sprintf("%s/search/tv?%s", tmdbBaseURL, params.Encode()))
+	resp, err := t.httpClient.Get(fmt.Sprintf("%s/search/tv?%s", t.baseURL, params.Encode()))
 	if err != nil {
 		return nil, err
 	}
@@ -302,7 +306,7 @@ func (t *TMDBAgent) GetTVDetails(tmdbID int) (*tmdbShow, error) {
 	params.Set("api_key", t.apiKey)
 	params.Set("append_to_response", "content_ratings")
 
-	resp, err := t.httpClient.Get(fmt.Sprintf("%s/tv/%d?%s", tmdbBaseURL, tmdbID, params.Encode()))
+	resp, err := t.httpClient.Get(fmt.Sprintf("%s/tv/%d?%s", t.baseURL, tmdbID, params.Encode()))
 	if err != nil {
 		return nil, err
 	}
@@ -329,7 +333,7 @@ func (t *TMDBAgent) GetTVCredits(tmdbID int) (*tmdbCredits, error) {
 	params := url.Values{}
 	params.Set("api_key", t.apiKey)
 
-	resp, err := t.httpClient.Get(fmt.Sprintf("%s/tv/%d/credits?%s", tmdbBaseURL, tmdbID, params.Encode()))
+	resp, err := t.httpClient.Get(fmt.Sprintf("%s/tv/%d/credits?%s", t.baseURL, tmdbID, params.Encode()))
 	if err != nil {
 		return nil, err
 	}
@@ -356,7 +360,7 @@ func (t *TMDBAgent) GetSeason(tmdbID int, seasonNumber int) (*tmdbSeason, error)
 	params := url.Values{}
 	params.Set("api_key", t.apiKey)
 
-	resp, err := t.httpClient.Get(fmt.Sprintf("%s/tv/%d/season/%d?%s", tmdbBaseURL, tmdbID, seasonNumber, params.Encode()))
+	resp, err := t.httpClient.Get(fmt.Sprintf("%s/tv/%d/season/%d?%s", t.baseURL, tmdbID, seasonNumber, params.Encode()))
 	if err != nil {
 		return nil, err
 	}
@@ -380,290 +384,467 @@ func (t *TMDBAgent) UpdateMovieMetadata(item *models.MediaItem) error {
 		return nil // Silently skip if not configured
 	}
 
-	// Search for the movie
-	result, err := t.SearchMovie(item.Title, item.Year)
-	if err != nil {
-		return err
+	// Use the TMDB ID when it's already known, otherwise search for the movie
+	tmdbID := t.knownTMDBID(item)
+	if tmdbID == 0 {
+		result, err := t.SearchMovie(item.Title, item.Year)
+		if err != nil {
+			return err
+		}
+		tmdbID = result.ID
 	}
 
-	// Get full details
-	movie, err := t.GetMovieDetails(result.ID)
+	result, err := Lookup(t, KindMovie, strconv.Itoa(tmdbID))
 	if err != nil {
 		return err
 	}
 
-	// Update the media item
-	updates := map[string]interface{}{
-		"summary":        movie.Overview,
-		"tagline":        movie.Tagline,
-		"rating":         movie.VoteAverage,
-		"original_title": movie.OriginalTitle,
+	// Keep the title the movie was scanned with
+	result.Title = ""
+	if err := ApplyResult(t.db, item, result); err != nil {
+		return err
 	}
 
-	if movie.PosterPath != "" {
-		updates["thumb"] = fmt.Sprintf("%s/w500%s", tmdbImageURL, movie.PosterPath)
-	}
-	if movie.BackdropPath != "" {
-		updates["art"] = fmt.Sprintf("%s/w1280%s", tmdbImageURL, movie.BackdropPath)
-	}
-	if movie.Runtime > 0 {
-		updates["duration"] = int64(movie.Runtime) * 60 * 1000 // Convert minutes to milliseconds
-	}
-	if len(movie.ProductionCompanies) > 0 {
-		updates["studio"] = movie.ProductionCompanies[0].Name
-	}
+	// Keep franchise collections in sync
+	t.SyncCollection(item, result)
 
-	// Parse release date for year
-	if movie.ReleaseDate != "" {
-		if releaseTime, err := time.Parse("2006-01-02", movie.ReleaseDate); err == nil {
-			updates["year"] = releaseTime.Year()
-			updates["originally_available_at"] = releaseTime
-		}
+	return nil
+}
+
+// UpdateShowMetadata fetches and updates metadata for a TV show
+func (t *TMDBAgent) UpdateShowMetadata(item *models.MediaItem) error {
+	if !t.IsConfigured() {
+		return nil
 	}
 
-	// Get content rating (US certification from release_dates)
-	for _, rd := range movie.ReleaseDates.Results {
-		if rd.ISO3166_1 == "US" {
-			// Find the theatrical or digital release certification
-			for _, release := range rd.ReleaseDates {
-				if release.Certification != "" {
-					updates["content_rating"] = release.Certification
-					break
-				}
-			}
-			break
+	// Use the TMDB ID when it's already known, otherwise search for the show
+	tmdbID := t.knownTMDBID(item)
+	if tmdbID == 0 {
+		result, err := t.SearchTV(item.Title, item.Year)
+		if err != nil {
+			return err
 		}
+		tmdbID = result.ID
 	}
 
-	if err := t.db.Model(item).Updates(updates).Error; err != nil {
+	result, err := Lookup(t, KindShow, strconv.Itoa(tmdbID))
+	if err != nil {
 		return err
 	}
 
-	// Update genres
-	if len(movie.Genres) > 0 {
-		t.updateGenres(item, movie.Genres)
+	result.Title = ""
+	if err := ApplyResult(t.db, item, result); err != nil {
+		return err
 	}
 
-	// Get and update credits
-	if credits, err := t.GetMovieCredits(result.ID); err == nil {
-		t.updateCast(item, credits)
-	}
+	// Store TMDB ID for season/episode lookups (in UUID field with prefix)
+	t.db.Model(item).Update("uuid", fmt.Sprintf("tmdb://%d", tmdbID))
 
 	return nil
 }
 
-// UpdateShowMetadata fetches and updates metadata for a TV show
-func (t *TMDBAgent) UpdateShowMetadata(item *models.MediaItem) error {
-	if !t.IsConfigured() {
+// UpdateSeasonMetadata fetches and updates metadata for a season
+func (t *TMDBAgent) UpdateSeasonMetadata(item *models.MediaItem, showTMDBID int) error {
+	if !t.IsConfigured() || showTMDBID == 0 {
 		return nil
 	}
 
-	// Search for the show
-	result, err := t.SearchTV(item.Title, item.Year)
+	result, err := t.Season(strconv.Itoa(showTMDBID), item.Index)
 	if err != nil {
 		return err
 	}
+	return ApplyResult(t.db, item, result)
+}
+
+// UpdateEpisodeMetadata fetches and updates metadata for an episode
+func (t *TMDBAgent) UpdateEpisodeMetadata(item *models.MediaItem, showTMDBID int, seasonNumber int) error {
+	if !t.IsConfigured() || showTMDBID == 0 {
+		return nil
+	}
 
-	// Get full details
-	show, err := t.GetTVDetails(result.ID)
+	result, err := t.Episode(strconv.Itoa(showTMDBID), seasonNumber, item.Index)
 	if err != nil {
 		return err
 	}
+	return ApplyResult(t.db, item, result)
+}
 
-	// Update the media item
-	updates := map[string]interface{}{
-		"summary":        show.Overview,
-		"tagline":        show.Tagline,
-		"rating":         show.VoteAverage,
-		"original_title": show.OriginalName,
-		"leaf_count":     show.NumberOfEpisodes,
-		"child_count":    show.NumberOfSeasons,
-	}
+// SyncCollection files a movie under the franchise collection of its TMDB
+// result
+func (t *TMDBAgent) SyncCollection(item *models.MediaItem, result *Result) {
+	t.syncMovieCollection(item, result.collection)
+}
 
-	if show.PosterPath != "" {
-		updates["thumb"] = fmt.Sprintf("%s/w500%s", tmdbImageURL, show.PosterPath)
-	}
-	if show.BackdropPath != "" {
-		updates["art"] = fmt.Sprintf("%s/w1280%s", tmdbImageURL, show.BackdropPath)
+// knownTMDBID returns the TMDB ID recorded for an item, from a local .nfo or
+// a manual match, or 0
+func (t *TMDBAgent) knownTMDBID(item *models.MediaItem) int {
+	if id := tmdbID(ItemGuids(t.db, item.ID)); id > 0 {
+		return id
 	}
-	if len(show.Networks) > 0 {
-		updates["studio"] = show.Networks[0].Name
+	return tmdbID([]string{item.UUID})
+}
+
+// ============ MetadataAgent ============
+
+// Name implements MetadataAgent
+func (t *TMDBAgent) Name() string {
+	return "tmdb"
+}
+
+// Provider implements MetadataAgent
+func (t *TMDBAgent) Provider() string {
+	return "tmdb"
+}
+
+// Search finds movies or shows by title and optional year
+func (t *TMDBAgent) Search(kind, title string, year int) ([]Match, error) {
+	if !t.IsConfigured() {
+		return nil, fmt.Errorf("TMDB API key not configured")
 	}
 
-	// Get content rating (US)
-	for _, cr := range show.ContentRatings.Results {
-		if cr.ISO3166_1 == "US" {
-			updates["content_rating"] = cr.Rating
-			break
+	params := url.Values{}
+	params.Set("api_key", t.apiKey)
+	params.Set("query", title)
+
+	var matches []Match
+	if kind == KindShow {
+		if year > 0 {
+			params.Set("first_air_date_year", strconv.Itoa(year))
+		}
+		var result tmdbTVSearchResult
+		if err := t.getJSON("/search/tv", params, nil, &result); err != nil {
+			return nil, err
 		}
+		for _, show := range result.Results {
+			matches = append(matches, Match{ID: strconv.Itoa(show.ID), Title: show.Name, Year: yearOf(show.FirstAirDate)})
+		}
+		return matches, nil
 	}
 
-	// Parse first air date
-	if show.FirstAirDate != "" {
-		if airTime, err := time.Parse("2006-01-02", show.FirstAirDate); err == nil {
-			updates["year"] = airTime.Year()
-			updates["originally_available_at"] = airTime
-		}
+	params.Set("include_adult", "false")
+	if year > 0 {
+		params.Set("year", strconv.Itoa(year))
+	}
+	var result tmdbSearchResult
+	if err := t.getJSON("/search/movie", params, nil, &result); err != nil {
+		return nil, err
+	}
+	for _, movie := range result.Results {
+		matches = append(matches, Match{ID: strconv.Itoa(movie.ID), Title: movie.Title, Year: yearOf(movie.ReleaseDate)})
 	}
+	return matches, nil
+}
 
-	if err := t.db.Model(item).Updates(updates).Error; err != nil {
-		return err
+// Details fetches a movie or show
+func (t *TMDBAgent) Details(kind, id string) (*Result, error) {
+	tmdbID, err := strconv.Atoi(id)
+	if err != nil {
+		return nil, fmt.Errorf("invalid TMDB ID %q", id)
+	}
+	if kind == KindShow {
+		show, err := t.GetTVDetails(tmdbID)
+		if err != nil {
+			return nil, err
+		}
+		return show.result(), nil
+	}
+	movie, err := t.GetMovieDetails(tmdbID)
+	if err != nil {
+		return nil, err
 	}
+	return movie.result(), nil
+}
 
-	// Update genres
-	if len(show.Genres) > 0 {
-		t.updateGenres(item, show.Genres)
+// Season fetches a season of a show
+func (t *TMDBAgent) Season(showID string, season int) (*Result, error) {
+	tmdbID, err := strconv.Atoi(showID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid TMDB ID %q", showID)
+	}
+	s, err := t.GetSeason(tmdbID, season)
+	if err != nil {
+		return nil, err
 	}
 
-	// Get and update credits
-	if credits, err := t.GetTVCredits(result.ID); err == nil {
-		t.updateCast(item, credits)
+	result := &Result{
+		Title:    s.Name,
+		Summary:  s.Overview,
+		Released: parseDate(s.AirDate),
+	}
+	if s.PosterPath != "" {
+		result.Thumb = fmt.Sprintf("%s/w500%s", tmdbImageURL, s.PosterPath)
 	}
+	return result, nil
+}
 
-	// Store TMDB ID for season/episode lookups (in UUID field with prefix)
-	t.db.Model(item).Update("uuid", fmt.Sprintf("tmdb://%d", result.ID))
+// Episode fetches an episode of a show
+func (t *TMDBAgent) Episode(showID string, season, episode int) (*Result, error) {
+	if !t.IsConfigured() {
+		return nil, fmt.Errorf("TMDB API key not configured")
+	}
 
-	return nil
-}
+	params := url.Values{}
+	params.Set("api_key", t.apiKey)
 
-// UpdateSeasonMetadata fetches and updates metadata for a season
-func (t *TMDBAgent) UpdateSeasonMetadata(item *models.MediaItem, showTMDBID int) error {
-	if !t.IsConfigured() || showTMDBID == 0 {
-		return nil
+	var ep tmdbEpisode
+	if err := t.getJSON(fmt.Sprintf("/tv/%s/season/%d/episode/%d", url.PathEscape(showID), season, episode), params, nil, &ep); err != nil {
+		return nil, err
 	}
 
-	season, err := t.GetSeason(showTMDBID, item.Index)
-	if err != nil {
-		return err
+	result := &Result{
+		Title:    ep.Name,
+		Summary:  ep.Overview,
+		Rating:   ep.VoteAverage,
+		Duration: int64(ep.Runtime) * 60 * 1000,
+		Released: parseDate(ep.AirDate),
+	}
+	if ep.StillPath != "" {
+		result.Thumb = fmt.Sprintf("%s/w500%s", tmdbImageURL, ep.StillPath)
 	}
+	return result, nil
+}
+
+// TMDB episode group types
+const tmdbAbsoluteGroup = 2
 
-	updates := map[string]interface{}{
-		"title":   season.Name,
-		"summary": season.Overview,
+// AbsoluteOrder lists a show's episodes in the order of its absolute episode
+// group, or else season by season
+func (t *TMDBAgent) AbsoluteOrder(showID string) ([]EpisodeRef, error) {
+	if !t.IsConfigured() {
+		return nil, fmt.Errorf("TMDB API key not configured")
 	}
 
-	if season.PosterPath != "" {
-		updates["thumb"] = fmt.Sprintf("%s/w500%s", tmdbImageURL, season.PosterPath)
+	params := url.Values{}
+	params.Set("api_key", t.apiKey)
+
+	var groups struct {
+		Results []struct {
+			ID           string `json:"id"`
+			Type         int    `json:"type"`
+			EpisodeCount int    `json:"episode_count"`
+		} `json:"results"`
+	}
+	if err := t.getJSON(fmt.Sprintf("/tv/%s/episode_groups", url.PathEscape(showID)), params, nil, &groups); err != nil {
+		return nil, err
+	}
+	groupID, most := "", 0
+	for _, group := range groups.Results {
+		if group.Type == tmdbAbsoluteGroup && group.EpisodeCount > most {
+			groupID, most = group.ID, group.EpisodeCount
+		}
 	}
 
-	if season.AirDate != "" {
-		if airTime, err := time.Parse("2006-01-02", season.AirDate); err == nil {
-			updates["originally_available_at"] = airTime
+	if groupID == "" {
+		var show tmdbShow
+		if err := t.getJSON(fmt.Sprintf("/tv/%s", url.PathEscape(showID)), params, nil, &show); err != nil {
+			return nil, err
+		}
+		counts := make(map[int]int)
+		for _, season := range show.Seasons {
+			counts[season.SeasonNumber] = season.EpisodeCount
 		}
+		return seasonOrder(counts), nil
 	}
 
-	return t.db.Model(item).Updates(updates).Error
+	var group struct {
+		Groups []struct {
+			Order    int `json:"order"`
+			Episodes []struct {
+				SeasonNumber  int `json:"season_number"`
+				EpisodeNumber int `json:"episode_number"`
+				Order         int `json:"order"`
+			} `json:"episodes"`
+		} `json:"groups"`
+	}
+	if err := t.getJSON("/tv/episode_group/"+url.PathEscape(groupID), params, nil, &group); err != nil {
+		return nil, err
+	}
+	sort.Slice(group.Groups, func(i, j int) bool { return group.Groups[i].Order < group.Groups[j].Order })
+	var refs []EpisodeRef
+	for _, g := range group.Groups {
+		sort.Slice(g.Episodes, func(i, j int) bool { return g.Episodes[i].Order < g.Episodes[j].Order })
+		for _, ep := range g.Episodes {
+			if ep.SeasonNumber > 0 {
+				refs = append(refs, EpisodeRef{Season: ep.SeasonNumber, Episode: ep.EpisodeNumber})
+			}
+		}
+	}
+	return refs, nil
 }
 
-// UpdateEpisodeMetadata fetches and updates metadata for an episode
-func (t *TMDBAgent) UpdateEpisodeMetadata(item *models.MediaItem, showTMDBID int, seasonNumber int) error {
-	if !t.IsConfigured() || showTMDBID == 0 {
-		return nil
+// Images lists the posters and backdrops of a movie or show
+func (t *TMDBAgent) Images(kind, id string) (*Images, error) {
+	if !t.IsConfigured() {
+		return nil, fmt.Errorf("TMDB API key not configured")
 	}
 
-	season, err := t.GetSeason(showTMDBID, seasonNumber)
-	if err != nil {
-		return err
-	}
+	params := url.Values{}
+	params.Set("api_key", t.apiKey)
 
-	// Find the episode in the season
-	var episode *tmdbEpisode
-	for _, ep := range season.Episodes {
-		if ep.EpisodeNumber == item.Index {
-			episode = &ep
-			break
-		}
+	var response struct {
+		Posters []struct {
+			FilePath string `json:"file_path"`
+		} `json:"posters"`
+		Backdrops []struct {
+			FilePath string `json:"file_path"`
+		} `json:"backdrops"`
+	}
+	if err := t.getJSON(fmt.Sprintf("/%s/%s/images", tmdbKind(kind), url.PathEscape(id)), params, nil, &response); err != nil {
+		return nil, err
 	}
 
-	if episode == nil {
-		return fmt.Errorf("episode %d not found in season %d", item.Index, seasonNumber)
+	images := &Images{}
+	for _, p := range response.Posters {
+		images.Posters = append(images.Posters, fmt.Sprintf("%s/w500%s", tmdbImageURL, p.FilePath))
+	}
+	for _, b := range response.Backdrops {
+		images.Backdrops = append(images.Backdrops, fmt.Sprintf("%s/w1280%s", tmdbImageURL, b.FilePath))
 	}
+	return images, nil
+}
 
-	updates := map[string]interface{}{
-		"title":   episode.Name,
-		"summary": episode.Overview,
-		"rating":  episode.VoteAverage,
+// Credits fetches the cast and crew of a movie or show
+func (t *TMDBAgent) Credits(kind, id string) ([]Credit, error) {
+	tmdbID, err := strconv.Atoi(id)
+	if err != nil {
+		return nil, fmt.Errorf("invalid TMDB ID %q", id)
+	}
+	var credits *tmdbCredits
+	if kind == KindShow {
+		credits, err = t.GetTVCredits(tmdbID)
+	} else {
+		credits, err = t.GetMovieCredits(tmdbID)
+	}
+	if err != nil {
+		return nil, err
 	}
+	return credits.list(), nil
+}
 
-	if episode.StillPath != "" {
-		updates["thumb"] = fmt.Sprintf("%s/w500%s", tmdbImageURL, episode.StillPath)
+// tmdbKind is the path segment TMDB uses for a kind of item
+func tmdbKind(kind string) string {
+	if kind == KindShow {
+		return "tv"
 	}
+	return "movie"
+}
 
-	if episode.Runtime > 0 {
-		updates["duration"] = int64(episode.Runtime) * 60 * 1000
+// result converts a movie's details
+func (movie *tmdbMovie) result() *Result {
+	result := &Result{
+		Title:         movie.Title,
+		OriginalTitle: movie.OriginalTitle,
+		Summary:       movie.Overview,
+		Tagline:       movie.Tagline,
+		Rating:        movie.VoteAverage,
+		Duration:      int64(movie.Runtime) * 60 * 1000, // Convert minutes to milliseconds
+		Released:      parseDate(movie.ReleaseDate),
+		Guids:         []string{fmt.Sprintf("tmdb://%d", movie.ID)},
+		collection:    movie.BelongsToCollection,
+	}
+	if movie.IMDbID != "" {
+		result.Guids = append(result.Guids, "imdb://"+movie.IMDbID)
+	}
+	if movie.PosterPath != "" {
+		result.Thumb = fmt.Sprintf("%s/w500%s", tmdbImageURL, movie.PosterPath)
+	}
+	if movie.BackdropPath != "" {
+		result.Art = fmt.Sprintf("%s/w1280%s", tmdbImageURL, movie.BackdropPath)
+	}
+	if len(movie.ProductionCompanies) > 0 {
+		result.Studio = movie.ProductionCompanies[0].Name
+	}
+	for _, g := range movie.Genres {
+		result.Genres = append(result.Genres, g.Name)
 	}
 
-	if episode.AirDate != "" {
-		if airTime, err := time.Parse("2006-01-02", episode.AirDate); err == nil {
-			updates["originally_available_at"] = airTime
+	// Get content rating (US certification from release_dates)
+	for _, rd := range movie.ReleaseDates.Results {
+		if rd.ISO3166_1 == "US" {
+			// Find the theatrical or digital release certification
+			for _, release := range rd.ReleaseDates {
+				if release.Certification != "" {
+					result.ContentRating = release.Certification
+					break
+				}
+			}
+			break
 		}
 	}
-
-	return t.db.Model(item).Updates(updates).Error
+	return result
 }
 
-// updateGenres updates the genres for a media item
-func (t *TMDBAgent) updateGenres(item *models.MediaItem, tmdbGenres []tmdbGenre) {
-	// Clear existing genres
-	t.db.Model(item).Association("Genres").Clear()
-
-	var genres []models.Genre
-	for _, g := range tmdbGenres {
-		var genre models.Genre
-		t.db.FirstOrCreate(&genre, models.Genre{Tag: g.Name})
-		genres = append(genres, genre)
+// result converts a show's details
+func (show *tmdbShow) result() *Result {
+	result := &Result{
+		Title:         show.Name,
+		OriginalTitle: show.OriginalName,
+		Summary:       show.Overview,
+		Tagline:       show.Tagline,
+		Rating:        show.VoteAverage,
+		Released:      parseDate(show.FirstAirDate),
+		LeafCount:     show.NumberOfEpisodes,
+		ChildCount:    show.NumberOfSeasons,
+		Guids:         []string{fmt.Sprintf("tmdb://%d", show.ID)},
+	}
+	if show.PosterPath != "" {
+		result.Thumb = fmt.Sprintf("%s/w500%s", tmdbImageURL, show.PosterPath)
+	}
+	if show.BackdropPath != "" {
+		result.Art = fmt.Sprintf("%s/w1280%s", tmdbImageURL, show.BackdropPath)
+	}
+	if len(show.Networks) > 0 {
+		result.Studio = show.Networks[0].Name
+	}
+	for _, g := range show.Genres {
+		result.Genres = append(result.Genres, g.Name)
 	}
 
-	t.db.Model(item).Association("Genres").Append(genres)
+	// Get content rating (US)
+	for _, cr := range show.ContentRatings.Results {
+		if cr.ISO3166_1 == "US" {
+			result.ContentRating = cr.Rating
+			break
+		}
+	}
+	return result
 }
 
-// updateCast updates the cast for a media item
-func (t *TMDBAgent) updateCast(item *models.MediaItem, credits *tmdbCredits) {
-	// Clear existing cast
-	t.db.Where("media_item_id = ?", item.ID).Delete(&models.CastMember{})
-
+// list returns directors and writers, followed by the top 10 actors
+func (credits *tmdbCredits) list() []Credit {
+	var list []Credit
 	order := 0
-
-	// Add directors and writers from crew (they come before cast in display)
 	for _, crew := range credits.Crew {
 		if crew.Job == "Director" || crew.Job == "Writer" || crew.Job == "Screenplay" || crew.Job == "Story" {
 			var thumb string
 			if crew.ProfilePath != "" {
 				thumb = fmt.Sprintf("%s/w185%s", tmdbImageURL, crew.ProfilePath)
 			}
-
-			member := models.CastMember{
-				MediaItemID: item.ID,
-				Tag:         crew.Name,
-				Role:        crew.Job, // Use job as role (Director, Writer, etc.)
-				Thumb:       thumb,
-				Order:       order,
-			}
-			t.db.Create(&member)
+			// Use job as role (Director, Writer, etc.)
+			list = append(list, Credit{Name: crew.Name, Role: crew.Job, Thumb: thumb, Order: order})
 			order++
 		}
 	}
 
-	// Add top 10 cast members (actors)
 	for i, cast := range credits.Cast {
 		if i >= 10 {
 			break
 		}
-
 		var thumb string
 		if cast.ProfilePath != "" {
 			thumb = fmt.Sprintf("%s/w185%s", tmdbImageURL, cast.ProfilePath)
 		}
+		list = append(list, Credit{Name: cast.Name, Role: cast.Character, Thumb: thumb, Order: order + cast.Order})
+	}
+	return list
+}
 
-		member := models.CastMember{
-			MediaItemID: item.ID,
-			Tag:         cast.Name,
-			Role:        cast.Character,
-			Thumb:       thumb,
-			Order:       order + cast.Order,
-		}
-		t.db.Create(&member)
+// yearOf returns the year of a YYYY-MM-DD date, or 0
+func yearOf(date string) int {
+	if t := parseDate(date); t != nil {
+		return t.Year()
 	}
+	return 0
 }
 
 // DownloadImage downloads an image from TMDB and returns the bytes
@@ -722,7 +903,7 @@ func (t *TMDBAgent) GetTrending(mediaType string, timeWindow string) (*TrendingR
 	params := url.Values{}
 	params.Set("api_key", t.apiKey)
 
-	resp, err := t.httpClient.Get(fmt.Sprintf("%s/trending/%s/%s?%s", tmdbBaseURL, mediaType, timeWindow, params.Encode()))
+	resp, err := t.httpClient.Get(fmt.Sprintf("%s/trending/%s/%s?%s", t.baseURL, mediaType, timeWindow, params.Encode()))
 	if err != nil {
 		return nil, err
 	}
@@ -754,7 +935,7 @@ func (t *TMDBAgent) GetPopularMovies(page int) (*TrendingResponse, error) {
 	params.Set("api_key", t.apiKey)
 	params.Set("page", strconv.Itoa(page))
 
-	resp, err := t.httpClient.Get(fmt.Sprintf("%s/movie/popular?%s", tmdbBaseURL, params.Encode()))
+	resp, err := t.httpClient.Get(fmt.Sprintf("%s/movie/popular?%s", t.baseURL, params.Encode()))
 	if err != nil {
 		return nil, err
 	}
@@ -791,7 +972,7 @@ func (t *TMDBAgent) GetPopularTV(page int) (*TrendingResponse, error) {
 	params.Set("api_key", t.apiKey)
 	params.Set("page", strconv.Itoa(page))
 
-	resp, err := t.httpClient.Get(fmt.Sprintf("%s/tv/popular?%s", tmdbBaseURL, params.Encode()))
+	resp, err := t.httpClient.Get(fmt.Sprintf("%s/tv/popular?%s", t.baseURL, params.Encode()))
 	if err != nil {
 		return nil, err
 	}
@@ -828,7 +1009,7 @@ func (t *TMDBAgent) GetTopRatedMovies(page int) (*TrendingResponse, error) {
 	params.Set("api_key", t.apiKey)
 	params.Set("page", strconv.Itoa(page))
 
-	resp, err := t.httpClient.Get(fmt.Sprintf("%s/movie/top_rated?%s", tmdbBaseURL, params.Encode()))
+	resp, err := t.httpClient.Get(fmt.Sprintf("%s/movie/top_rated?%s", t.baseURL, params.Encode()))
 	if err != nil {
 		return nil, err
 	}
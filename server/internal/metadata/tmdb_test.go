@@ -0,0 +1,220 @@
+package metadata
+
+import (
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// tmdbTestAgent returns a TMDB agent replaying the recorded responses, and
+// the queries of the requests it makes
+func tmdbTestAgent(t *testing.T) (*TMDBAgent, *[]url.Values) {
+	var queries []url.Values
+	server := fixtureServer(t, "tmdb", func(r *http.Request) string {
+		queries = append(queries, r.URL.Query())
+		if r.URL.Query().Get("api_key") != "test-key" {
+			return ""
+		}
+		return pathFixture(r)
+	})
+	agent := NewTMDBAgent("test-key", nil, "")
+	agent.SetEndpoint(server.URL, nil)
+	return agent, &queries
+}
+
+func TestTMDBSearch(t *testing.T) {
+	agent, queries := tmdbTestAgent(t)
+
+	tests := []struct {
+		kind, title string
+		year        int
+		param       string
+		want        []Match
+	}{
+		{KindMovie, "The Matrix", 1999, "year", []Match{
+			{ID: "603", Title: "The Matrix", Year: 1999},
+			{ID: "684731", Title: "The Matrix Revisited", Year: 2001},
+		}},
+		{KindShow, "Breaking Bad", 2008, "first_air_date_year", []Match{
+			{ID: "1396", Title: "Breaking Bad", Year: 2008},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.kind, func(t *testing.T) {
+			matches, err := agent.Search(tt.kind, tt.title, tt.year)
+			if err != nil {
+				t.Fatalf("Search() error = %v", err)
+			}
+			if !reflect.DeepEqual(matches, tt.want) {
+				t.Errorf("Search() = %+v, want %+v", matches, tt.want)
+			}
+			query := (*queries)[len(*queries)-1]
+			if query.Get("query") != tt.title || query.Get(tt.param) != "1999" && query.Get(tt.param) != "2008" {
+				t.Errorf("query = %v", query)
+			}
+		})
+	}
+}
+
+func TestTMDBDetails(t *testing.T) {
+	agent, _ := tmdbTestAgent(t)
+
+	movie, err := agent.Details(KindMovie, "603")
+	if err != nil {
+		t.Fatalf("Details(movie) error = %v", err)
+	}
+	want := &Result{
+		Guids:         []string{"tmdb://603", "imdb://tt0133093"},
+		Title:         "The Matrix",
+		OriginalTitle: "The Matrix",
+		Summary:       "Set in the 22nd century, The Matrix tells the story of a computer hacker who joins a group of underground insurgents fighting the vast and powerful computers who now rule the earth.",
+		Tagline:       "Welcome to the Real World.",
+		ContentRating: "R",
+		Studio:        "Village Roadshow Pictures",
+		Released:      date(1999, time.March, 31),
+		Rating:        8.2,
+		Duration:      136 * 60 * 1000,
+		Genres:        []string{"Action", "Science Fiction"},
+		Thumb:         "https://image.tmdb.org/t/p/w500/f89U3ADr1oiB1s9GkdPOEpXUk5H.jpg",
+		Art:           "https://image.tmdb.org/t/p/w1280/icmmSD4vTTDKOq2vvdulafOGw93.jpg",
+		collection: &tmdbCollectionRef{
+			ID:           2344,
+			Name:         "The Matrix Collection",
+			PosterPath:   "/bV9qTVHTVf0gkW0j7p7M0ILD4pG.jpg",
+			BackdropPath: "/bRm2DEgUiYciDw3myHuYFInD7la.jpg",
+		},
+	}
+	if !reflect.DeepEqual(movie, want) {
+		t.Errorf("Details(movie) = %+v, want %+v", movie, want)
+	}
+
+	show, err := agent.Details(KindShow, "1396")
+	if err != nil {
+		t.Fatalf("Details(show) error = %v", err)
+	}
+	if show.Title != "Breaking Bad" || show.Studio != "AMC" || show.ContentRating != "TV-MA" ||
+		show.Tagline != "Remember my name" || show.LeafCount != 62 || show.ChildCount != 5 {
+		t.Errorf("Details(show) = %+v", show)
+	}
+	if !reflect.DeepEqual(show.Genres, []string{"Drama", "Crime"}) || !reflect.DeepEqual(show.Released, date(2008, time.January, 20)) {
+		t.Errorf("Details(show) genres %v, released %v", show.Genres, show.Released)
+	}
+
+	if _, err := agent.Details(KindMovie, "1"); err == nil {
+		t.Error("Details() of an unknown movie succeeded")
+	}
+	if _, err := agent.Details(KindMovie, "tt0133093"); err == nil {
+		t.Error("Details() of a non-TMDB ID succeeded")
+	}
+}
+
+func TestTMDBSeasonAndEpisode(t *testing.T) {
+	agent, _ := tmdbTestAgent(t)
+
+	season, err := agent.Season("1396", 1)
+	if err != nil {
+		t.Fatalf("Season() error = %v", err)
+	}
+	want := &Result{
+		Title:    "Season 1",
+		Summary:  "High school chemistry teacher Walter White's life is suddenly transformed by a dire medical diagnosis.",
+		Released: date(2008, time.January, 20),
+		Thumb:    "https://image.tmdb.org/t/p/w500/1BP4xYv9ZG4ZVHkL7ocOziBbSYH.jpg",
+	}
+	if !reflect.DeepEqual(season, want) {
+		t.Errorf("Season() = %+v, want %+v", season, want)
+	}
+
+	episode, err := agent.Episode("1396", 1, 1)
+	if err != nil {
+		t.Fatalf("Episode() error = %v", err)
+	}
+	if episode.Title != "Pilot" || episode.Rating != 8.1 || episode.Duration != 59*60*1000 ||
+		episode.Thumb != "https://image.tmdb.org/t/p/w500/ydlY3iPfeOAvu8gVqrxPoMvzNCn.jpg" ||
+		!reflect.DeepEqual(episode.Released, date(2008, time.January, 20)) {
+		t.Errorf("Episode() = %+v", episode)
+	}
+
+	if _, err := agent.Episode("1396", 1, 2); err == nil {
+		t.Error("Episode() of an unrecorded episode succeeded")
+	}
+}
+
+func TestTMDBImages(t *testing.T) {
+	agent, _ := tmdbTestAgent(t)
+
+	tests := []struct {
+		kind, id string
+		want     *Images
+	}{
+		{KindMovie, "603", &Images{
+			Posters: []string{"https://image.tmdb.org/t/p/w500/f89U3ADr1oiB1s9GkdPOEpXUk5H.jpg"},
+			Backdrops: []string{
+				"https://image.tmdb.org/t/p/w1280/icmmSD4vTTDKOq2vvdulafOGw93.jpg",
+				"https://image.tmdb.org/t/p/w1280/ncEsesgOJDNrTUED89hYbA117wo.jpg",
+			},
+		}},
+		{KindShow, "1396", &Images{
+			Posters: []string{
+				"https://image.tmdb.org/t/p/w500/ggFHVNu6YYI5L9pCfOacjizRGt.jpg",
+				"https://image.tmdb.org/t/p/w500/eSzpy96DwBujGFj0xMbXBcGcfxX.jpg",
+			},
+			Backdrops: []string{"https://image.tmdb.org/t/p/w1280/tsRy63Mu5cu8etL1X7ZLyf7UP1M.jpg"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.kind, func(t *testing.T) {
+			images, err := agent.Images(tt.kind, tt.id)
+			if err != nil {
+				t.Fatalf("Images() error = %v", err)
+			}
+			if !reflect.DeepEqual(images, tt.want) {
+				t.Errorf("Images() = %+v, want %+v", images, tt.want)
+			}
+		})
+	}
+}
+
+func TestTMDBCredits(t *testing.T) {
+	agent, _ := tmdbTestAgent(t)
+
+	// Directors and writers first, then the actors; producers are left out
+	credits, err := agent.Credits(KindMovie, "603")
+	if err != nil {
+		t.Fatalf("Credits(movie) error = %v", err)
+	}
+	want := []Credit{
+		{Name: "Lilly Wachowski", Role: "Director", Thumb: "https://image.tmdb.org/t/p/w185/9HVKrDKHx9LXSozBkyjDTg2K1rG.jpg", Order: 0},
+		{Name: "Lana Wachowski", Role: "Director", Thumb: "https://image.tmdb.org/t/p/w185/4mFrpYc8C2Pl5Cjsl1A8Dc6oqje.jpg", Order: 1},
+		{Name: "Keanu Reeves", Role: "Thomas A. Anderson / Neo", Thumb: "https://image.tmdb.org/t/p/w185/4D0PpNI0kmP58hgrwGC3wCjxhnm.jpg", Order: 2},
+		{Name: "Laurence Fishburne", Role: "Morpheus", Thumb: "https://image.tmdb.org/t/p/w185/8suOhUmPbfKqDQ17jQ1Gy0mI3P4.jpg", Order: 3},
+		{Name: "Carrie-Anne Moss", Role: "Trinity", Order: 4},
+	}
+	if !reflect.DeepEqual(credits, want) {
+		t.Errorf("Credits(movie) = %+v, want %+v", credits, want)
+	}
+
+	credits, err = agent.Credits(KindShow, "1396")
+	if err != nil {
+		t.Fatalf("Credits(show) error = %v", err)
+	}
+	if len(credits) != 2 || credits[0].Name != "Bryan Cranston" || credits[1].Role != "Jesse Pinkman" {
+		t.Errorf("Credits(show) = %+v", credits)
+	}
+}
+
+func TestTMDBNotConfigured(t *testing.T) {
+	agent := NewTMDBAgent("", nil, "")
+	if _, err := agent.Search(KindMovie, "The Matrix", 0); err == nil {
+		t.Error("Search() without an API key succeeded")
+	}
+
+	// A wrong key is refused by the API
+	agent, _ = tmdbTestAgent(t)
+	agent.apiKey = "wrong-key"
+	if _, err := agent.Search(KindMovie, "The Matrix", 0); err == nil {
+		t.Error("Search() with a wrong API key succeeded")
+	}
+}
@@ -0,0 +1,482 @@
+package metadata
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const tvdbBaseURL = "https://api4.thetvdb.com/v4"
+
+// TVDB artwork types
+const (
+	tvdbSeriesPoster     = 2
+	tvdbSeriesBackground = 3
+	tvdbMoviePoster      = 14
+	tvdbMovieBackground  = 15
+)
+
+// Three letter codes TVDB uses for common metadata languages
+var tvdbLanguages = map[string]string{
+	"en": "eng", "de": "deu", "fr": "fra", "es": "spa", "it": "ita", "nl": "nld",
+	"pt": "por", "sv": "swe", "da": "dan", "no": "nor", "fi": "fin", "pl": "pol",
+	"ru": "rus", "ja": "jpn", "ko": "kor", "zh": "zho",
+}
+
+// TVDBAgent fetches metadata from TheTVDB API v4
+type TVDBAgent struct {
+	endpoint
+	apiKey   string
+	language string
+
+	mu    sync.Mutex
+	token string
+}
+
+// NewTVDBAgent creates a new TVDB metadata agent. language is a two or three
+// letter code and defaults to English.
+func NewTVDBAgent(apiKey, language string) *TVDBAgent {
+	if code, ok := tvdbLanguages[strings.ToLower(language)]; ok {
+		language = code
+	} else if len(language) != 3 {
+		language = "eng"
+	}
+	return &TVDBAgent{
+		endpoint: newEndpoint("TVDB", tvdbBaseURL),
+		apiKey:   apiKey,
+		language: strings.ToLower(language),
+	}
+}
+
+// TVDB API response structures
+type tvdbTranslations struct {
+	NameTranslations []struct {
+		Language string `json:"language"`
+		Name     string `json:"name"`
+	} `json:"nameTranslations"`
+	OverviewTranslations []struct {
+		Language string `json:"language"`
+		Overview string `json:"overview"`
+	} `json:"overviewTranslations"`
+}
+
+type tvdbRecord struct {
+	ID              int              `json:"id"`
+	Name            string           `json:"name"`
+	Overview        string           `json:"overview"`
+	Image           string           `json:"image"`
+	Year            string           `json:"year"`
+	FirstAired      string           `json:"firstAired"`
+	Runtime         int              `json:"runtime"`
+	OriginalNetwork *tvdbName        `json:"originalNetwork"`
+	Studios         []tvdbName       `json:"studios"`
+	Genres          []tvdbName       `json:"genres"`
+	Translations    tvdbTranslations `json:"translations"`
+	ContentRatings  []struct {
+		Name    string `json:"name"`
+		Country string `json:"country"`
+	} `json:"contentRatings"`
+	Releases []struct {
+		Country string `json:"country"`
+		Date    string `json:"date"`
+	} `json:"releases"`
+	RemoteIDs []struct {
+		ID         string `json:"id"`
+		SourceName string `json:"sourceName"`
+	} `json:"remoteIds"`
+	Artworks   []tvdbArtwork   `json:"artworks"`
+	Characters []tvdbCharacter `json:"characters"`
+	Seasons    []struct {
+		Number int    `json:"number"`
+		Image  string `json:"image"`
+		Type   struct {
+			Type string `json:"type"`
+		} `json:"type"`
+	} `json:"seasons"`
+}
+
+type tvdbName struct {
+	Name string `json:"name"`
+}
+
+type tvdbArtwork struct {
+	Image string  `json:"image"`
+	Type  int     `json:"type"`
+	Score float64 `json:"score"`
+}
+
+type tvdbCharacter struct {
+	Name         string `json:"name"`
+	PersonName   string `json:"personName"`
+	PersonImgURL string `json:"personImgURL"`
+	PeopleType   string `json:"peopleType"`
+	Sort         int    `json:"sort"`
+}
+
+type tvdbEpisode struct {
+	Name           string `json:"name"`
+	Overview       string `json:"overview"`
+	Aired          string `json:"aired"`
+	Runtime        int    `json:"runtime"`
+	Image          string `json:"image"`
+	SeasonNumber   int    `json:"seasonNumber"`
+	Number         int    `json:"number"`
+	AbsoluteNumber int    `json:"absoluteNumber"`
+}
+
+// IsConfigured returns true if the TVDB API key is set
+func (t *TVDBAgent) IsConfigured() bool {
+	return t.apiKey != ""
+}
+
+// Name implements MetadataAgent
+func (t *TVDBAgent) Name() string {
+	return "tvdb"
+}
+
+// Provider implements MetadataAgent
+func (t *TVDBAgent) Provider() string {
+	return "tvdb"
+}
+
+// login exchanges the API key for a bearer token, which lasts a month
+func (t *TVDBAgent) login() (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.token != "" {
+		return t.token, nil
+	}
+
+	body, _ := json.Marshal(map[string]string{"apikey": t.apiKey})
+	resp, err := t.httpClient.Post(t.baseURL+"/login", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", &apiError{agent: t.endpoint.name, status: resp.StatusCode}
+	}
+
+	var result struct {
+		Data struct {
+			Token string `json:"token"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", err
+	}
+	if result.Data.Token == "" {
+		return "", errors.New("TVDB login returned no token")
+	}
+	t.token = result.Data.Token
+	return t.token, nil
+}
+
+// get calls the API, logging in again once if the token has expired
+func (t *TVDBAgent) get(path string, params url.Values, v interface{}) error {
+	if !t.IsConfigured() {
+		return fmt.Errorf("TVDB API key not configured")
+	}
+
+	for attempt := 0; ; attempt++ {
+		token, err := t.login()
+		if err != nil {
+			return err
+		}
+		err = t.getJSON(path, params, http.Header{"Authorization": {"Bearer " + token}}, v)
+		var apiErr *apiError
+		if attempt == 0 && errors.As(err, &apiErr) && apiErr.status == http.StatusUnauthorized {
+			t.mu.Lock()
+			t.token = ""
+			t.mu.Unlock()
+			continue
+		}
+		return err
+	}
+}
+
+// Search finds shows or movies by title and optional year
+func (t *TVDBAgent) Search(kind, title string, year int) ([]Match, error) {
+	params := url.Values{}
+	params.Set("query", title)
+	params.Set("type", "series")
+	if kind == KindMovie {
+		params.Set("type", "movie")
+	}
+	if year > 0 {
+		params.Set("year", strconv.Itoa(year))
+	}
+
+	var result struct {
+		Data []struct {
+			TVDBID string `json:"tvdb_id"`
+			Name   string `json:"name"`
+			Year   string `json:"year"`
+		} `json:"data"`
+	}
+	if err := t.get("/search", params, &result); err != nil {
+		return nil, err
+	}
+
+	var matches []Match
+	for _, r := range result.Data {
+		matches = append(matches, Match{ID: r.TVDBID, Title: r.Name, Year: number(r.Year)})
+	}
+	return matches, nil
+}
+
+// record fetches the extended record of a series or movie
+func (t *TVDBAgent) record(kind, id string) (*tvdbRecord, error) {
+	params := url.Values{}
+	params.Set("meta", "translations")
+
+	var result struct {
+		Data tvdbRecord `json:"data"`
+	}
+	if err := t.get(fmt.Sprintf("/%s/%s/extended", tvdbKind(kind), url.PathEscape(id)), params, &result); err != nil {
+		return nil, err
+	}
+	return &result.Data, nil
+}
+
+// Details fetches a show or movie
+func (t *TVDBAgent) Details(kind, id string) (*Result, error) {
+	record, err := t.record(kind, id)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Result{
+		Title:    record.Name,
+		Summary:  record.Overview,
+		Year:     number(record.Year),
+		Released: parseDate(record.FirstAired),
+		Thumb:    record.Image,
+		Cast:     tvdbCredits(record.Characters),
+	}
+	for _, name := range record.Translations.NameTranslations {
+		if name.Language == t.language && name.Name != "" {
+			result.Title = name.Name
+		}
+	}
+	for _, overview := range record.Translations.OverviewTranslations {
+		if overview.Language == t.language && overview.Overview != "" {
+			result.Summary = overview.Overview
+		}
+	}
+
+	if kind == KindShow {
+		if record.OriginalNetwork != nil {
+			result.Studio = record.OriginalNetwork.Name
+		}
+	} else {
+		result.Duration = int64(record.Runtime) * 60 * 1000
+		if len(record.Studios) > 0 {
+			result.Studio = record.Studios[0].Name
+		}
+		// Prefer the US release
+		for _, release := range record.Releases {
+			if release.Country == "usa" || result.Released == nil {
+				result.Released = parseDate(release.Date)
+			}
+		}
+	}
+
+	for _, g := range record.Genres {
+		result.Genres = append(result.Genres, g.Name)
+	}
+	for _, rating := range record.ContentRatings {
+		if rating.Country == "usa" {
+			result.ContentRating = rating.Name
+			break
+		}
+	}
+	for _, remote := range record.RemoteIDs {
+		switch {
+		case remote.SourceName == "IMDB":
+			result.addGuid("imdb", remote.ID)
+		case strings.HasPrefix(remote.SourceName, "TheMovieDB"):
+			result.addGuid("tmdb", remote.ID)
+		}
+	}
+
+	images := tvdbImages(kind, record.Artworks)
+	if len(images.Backdrops) > 0 {
+		result.Art = images.Backdrops[0]
+	}
+	if result.Thumb == "" && len(images.Posters) > 0 {
+		result.Thumb = images.Posters[0]
+	}
+	return result, nil
+}
+
+// Season fetches the poster of a season in the official order
+func (t *TVDBAgent) Season(showID string, season int) (*Result, error) {
+	record, err := t.record(KindShow, showID)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range record.Seasons {
+		if s.Number == season && s.Type.Type == "official" {
+			return &Result{Thumb: s.Image}, nil
+		}
+	}
+	return nil, fmt.Errorf("season %d not found", season)
+}
+
+// Episode fetches an episode in the official order
+func (t *TVDBAgent) Episode(showID string, season, episode int) (*Result, error) {
+	params := url.Values{}
+	params.Set("page", "0")
+	params.Set("season", strconv.Itoa(season))
+	params.Set("episodeNumber", strconv.Itoa(episode))
+
+	var result struct {
+		Data struct {
+			Episodes []tvdbEpisode `json:"episodes"`
+		} `json:"data"`
+	}
+	path := fmt.Sprintf("/series/%s/episodes/default/%s", url.PathEscape(showID), t.language)
+	if err := t.get(path, params, &result); err != nil {
+		return nil, err
+	}
+
+	for _, ep := range result.Data.Episodes {
+		if ep.SeasonNumber == season && ep.Number == episode {
+			return &Result{
+				Title:    ep.Name,
+				Summary:  ep.Overview,
+				Released: parseDate(ep.Aired),
+				Duration: int64(ep.Runtime) * 60 * 1000,
+				Thumb:    ep.Image,
+			}, nil
+		}
+	}
+	return nil, fmt.Errorf("episode %d not found in season %d", episode, season)
+}
+
+// AbsoluteOrder lists a show's episodes by their absolute numbers, or season
+// by season in the official order when TVDB has none
+func (t *TVDBAgent) AbsoluteOrder(showID string) ([]EpisodeRef, error) {
+	var episodes []tvdbEpisode
+	path := fmt.Sprintf("/series/%s/episodes/default", url.PathEscape(showID))
+	for page := 0; ; page++ {
+		params := url.Values{}
+		params.Set("page", strconv.Itoa(page))
+
+		var result struct {
+			Data struct {
+				Episodes []tvdbEpisode `json:"episodes"`
+			} `json:"data"`
+			Links struct {
+				Next *string `json:"next"`
+			} `json:"links"`
+		}
+		if err := t.get(path, params, &result); err != nil {
+			return nil, err
+		}
+		episodes = append(episodes, result.Data.Episodes...)
+		if result.Links.Next == nil || *result.Links.Next == "" || len(result.Data.Episodes) == 0 {
+			break
+		}
+	}
+
+	byNumber := make(map[int]EpisodeRef)
+	counts := make(map[int]int)
+	last := 0
+	for _, ep := range episodes {
+		if ep.SeasonNumber == 0 {
+			continue
+		}
+		counts[ep.SeasonNumber] = max(counts[ep.SeasonNumber], ep.Number)
+		if ep.AbsoluteNumber > 0 {
+			byNumber[ep.AbsoluteNumber] = EpisodeRef{Season: ep.SeasonNumber, Episode: ep.Number}
+			last = max(last, ep.AbsoluteNumber)
+		}
+	}
+	if len(byNumber) == 0 {
+		return seasonOrder(counts), nil
+	}
+
+	refs := make([]EpisodeRef, last)
+	for number, ref := range byNumber {
+		refs[number-1] = ref
+	}
+	return refs, nil
+}
+
+// Images lists the posters and backdrops of a show or movie
+func (t *TVDBAgent) Images(kind, id string) (*Images, error) {
+	record, err := t.record(kind, id)
+	if err != nil {
+		return nil, err
+	}
+	return tvdbImages(kind, record.Artworks), nil
+}
+
+// Credits fetches the cast and crew of a show or movie
+func (t *TVDBAgent) Credits(kind, id string) ([]Credit, error) {
+	record, err := t.record(kind, id)
+	if err != nil {
+		return nil, err
+	}
+	return tvdbCredits(record.Characters), nil
+}
+
+// tvdbKind is the path segment TVDB uses for a kind of item
+func tvdbKind(kind string) string {
+	if kind == KindMovie {
+		return "movies"
+	}
+	return "series"
+}
+
+// tvdbImages sorts artwork into posters and backdrops, highest score first
+func tvdbImages(kind string, artworks []tvdbArtwork) *Images {
+	sorted := append([]tvdbArtwork(nil), artworks...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Score > sorted[j].Score })
+
+	poster, background := tvdbSeriesPoster, tvdbSeriesBackground
+	if kind == KindMovie {
+		poster, background = tvdbMoviePoster, tvdbMovieBackground
+	}
+	images := &Images{}
+	for _, artwork := range sorted {
+		switch artwork.Type {
+		case poster:
+			images.Posters = append(images.Posters, artwork.Image)
+		case background:
+			images.Backdrops = append(images.Backdrops, artwork.Image)
+		}
+	}
+	return images
+}
+
+// tvdbCredits lists directors and writers, followed by the actors
+func tvdbCredits(characters []tvdbCharacter) []Credit {
+	var crew, cast []Credit
+	for _, c := range characters {
+		if c.PersonName == "" {
+			continue
+		}
+		switch c.PeopleType {
+		case "Director", "Writer":
+			crew = append(crew, Credit{Name: c.PersonName, Role: c.PeopleType, Thumb: c.PersonImgURL, Order: len(crew)})
+		case "Actor", "Guest Star":
+			cast = append(cast, Credit{Name: c.PersonName, Role: c.Name, Thumb: c.PersonImgURL, Order: c.Sort})
+		}
+	}
+	sort.SliceStable(cast, func(i, j int) bool { return cast[i].Order < cast[j].Order })
+	for i := range cast {
+		cast[i].Order = len(crew) + i
+	}
+	return append(crew, cast...)
+}
@@ -0,0 +1,204 @@
+package metadata
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// tvdbTestToken is the token recorded in testdata/tvdb/login.json
+const tvdbTestToken = "eyJhbGciOiJSUzI1NiIsInR5cCI6IkpXVCJ9.recorded"
+
+// tvdbTestAgent returns a TVDB agent replaying the recorded responses. The
+// server checks the API key at login and the token on every other request.
+func tvdbTestAgent(t *testing.T) *TVDBAgent {
+	server := fixtureServer(t, "tvdb", func(r *http.Request) string {
+		if r.URL.Path == "/login" {
+			var body struct {
+				APIKey string `json:"apikey"`
+			}
+			if r.Method != http.MethodPost || json.NewDecoder(r.Body).Decode(&body) != nil || body.APIKey != "test-key" {
+				return ""
+			}
+			return "login"
+		}
+		if r.Header.Get("Authorization") != "Bearer "+tvdbTestToken {
+			return ""
+		}
+		return pathFixture(r)
+	})
+	agent := NewTVDBAgent("test-key", "en")
+	agent.SetEndpoint(server.URL, nil)
+	return agent
+}
+
+func TestTVDBSearch(t *testing.T) {
+	agent := tvdbTestAgent(t)
+
+	matches, err := agent.Search(KindShow, "Breaking Bad", 2008)
+	if err != nil {
+		t.Fatalf("Search() error = %v", err)
+	}
+	want := []Match{
+		{ID: "81189", Title: "Breaking Bad", Year: 2008},
+		{ID: "273181", Title: "Breaking Bad: Original Minisodes", Year: 2009},
+	}
+	if !reflect.DeepEqual(matches, want) {
+		t.Errorf("Search() = %+v, want %+v", matches, want)
+	}
+}
+
+func TestTVDBDetails(t *testing.T) {
+	agent := tvdbTestAgent(t)
+
+	show, err := agent.Details(KindShow, "81189")
+	if err != nil {
+		t.Fatalf("Details() error = %v", err)
+	}
+	want := &Result{
+		Guids:         []string{"imdb://tt0903747", "tmdb://1396"},
+		Title:         "Breaking Bad",
+		Summary:       "When Walter White, a New Mexico chemistry teacher, is diagnosed with Stage III cancer, he turns to making meth to secure his family's future.",
+		ContentRating: "TV-MA",
+		Studio:        "AMC",
+		Year:          2008,
+		Released:      date(2008, time.January, 20),
+		Genres:        []string{"Drama", "Crime"},
+		Cast: []Credit{
+			{Name: "Vince Gilligan", Role: "Writer", Order: 0},
+			{Name: "Bryan Cranston", Role: "Walter White", Thumb: "https://artworks.thetvdb.com/banners/person/290151/primary.jpg", Order: 1},
+			{Name: "Aaron Paul", Role: "Jesse Pinkman", Thumb: "https://artworks.thetvdb.com/banners/person/290152/primary.jpg", Order: 2},
+		},
+		Thumb: "https://artworks.thetvdb.com/banners/posters/81189-10.jpg",
+		Art:   "https://artworks.thetvdb.com/banners/fanart/original/81189-21.jpg",
+	}
+	if !reflect.DeepEqual(show, want) {
+		t.Errorf("Details() = %+v, want %+v", show, want)
+	}
+
+	// The translation in the agent's language wins over the record's
+	agent.language = "deu"
+	show, err = agent.Details(KindShow, "81189")
+	if err != nil {
+		t.Fatalf("Details() error = %v", err)
+	}
+	if !strings.HasPrefix(show.Summary, "Walter White ist") {
+		t.Errorf("Summary = %q, want the German overview", show.Summary)
+	}
+
+	if _, err := agent.Details(KindShow, "1"); err == nil {
+		t.Error("Details() of an unknown series succeeded")
+	}
+}
+
+func TestTVDBSeasonAndEpisode(t *testing.T) {
+	agent := tvdbTestAgent(t)
+
+	// The official order's poster, not the DVD order's
+	season, err := agent.Season("81189", 1)
+	if err != nil {
+		t.Fatalf("Season() error = %v", err)
+	}
+	if season.Thumb != "https://artworks.thetvdb.com/banners/seasons/81189-1.jpg" {
+		t.Errorf("Season() thumb = %q", season.Thumb)
+	}
+	if _, err := agent.Season("81189", 9); err == nil {
+		t.Error("Season() of a missing season succeeded")
+	}
+
+	episode, err := agent.Episode("81189", 1, 1)
+	if err != nil {
+		t.Fatalf("Episode() error = %v", err)
+	}
+	want := &Result{
+		Title:    "Pilot",
+		Summary:  "Walter White, a 50-year-old chemistry teacher, secretly begins making crystal methamphetamine to support his family after learning that he has terminal lung cancer.",
+		Released: date(2008, time.January, 20),
+		Duration: 58 * 60 * 1000,
+		Thumb:    "https://artworks.thetvdb.com/banners/episodes/81189/349232.jpg",
+	}
+	if !reflect.DeepEqual(episode, want) {
+		t.Errorf("Episode() = %+v, want %+v", episode, want)
+	}
+	if _, err := agent.Episode("81189", 1, 2); err == nil {
+		t.Error("Episode() of an episode missing from the response succeeded")
+	}
+}
+
+func TestTVDBImagesAndCredits(t *testing.T) {
+	agent := tvdbTestAgent(t)
+
+	// Posters by score; banners are neither posters nor backdrops
+	images, err := agent.Images(KindShow, "81189")
+	if err != nil {
+		t.Fatalf("Images() error = %v", err)
+	}
+	want := &Images{
+		Posters: []string{
+			"https://artworks.thetvdb.com/banners/posters/81189-10.jpg",
+			"https://artworks.thetvdb.com/banners/posters/81189-7.jpg",
+		},
+		Backdrops: []string{"https://artworks.thetvdb.com/banners/fanart/original/81189-21.jpg"},
+	}
+	if !reflect.DeepEqual(images, want) {
+		t.Errorf("Images() = %+v, want %+v", images, want)
+	}
+
+	// Writers before actors, actors by their sort order; producers left out
+	credits, err := agent.Credits(KindShow, "81189")
+	if err != nil {
+		t.Fatalf("Credits() error = %v", err)
+	}
+	var names []string
+	for _, credit := range credits {
+		names = append(names, credit.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"Vince Gilligan", "Bryan Cranston", "Aaron Paul"}) {
+		t.Errorf("Credits() = %v", names)
+	}
+}
+
+func TestTVDBLogin(t *testing.T) {
+	// The first token has expired by the first request; the agent logs in
+	// again once and keeps the new token
+	var logins atomic.Int32
+	search, err := os.ReadFile(filepath.Join("testdata", "tvdb", "search.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/login" {
+			fmt.Fprintf(w, `{"status":"success","data":{"token":"token-%d"}}`, logins.Add(1))
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer token-2" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write(search)
+	}))
+	t.Cleanup(server.Close)
+	agent := NewTVDBAgent("test-key", "")
+	agent.SetEndpoint(server.URL, nil)
+
+	for i := 0; i < 2; i++ {
+		if _, err := agent.Search(KindShow, "Breaking Bad", 0); err != nil {
+			t.Fatalf("Search() error = %v", err)
+		}
+	}
+	if n := logins.Load(); n != 2 {
+		t.Errorf("logins = %d, want 2", n)
+	}
+
+	if _, err := NewTVDBAgent("", "").Search(KindShow, "Breaking Bad", 0); err == nil {
+		t.Error("Search() without an API key succeeded")
+	}
+}
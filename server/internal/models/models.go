@@ -47,19 +47,22 @@ type UserProfile struct {
 
 // Library represents a media library (Movies, TV Shows, Music, etc.)
 type Library struct {
-	ID         uint           `gorm:"primaryKey" json:"key"`
-	UUID       string         `gorm:"uniqueIndex;size:36" json:"uuid"`
-	Title      string         `gorm:"size:255" json:"title"`
-	Type       string         `gorm:"size:50;index" json:"type"` // movie, show, artist, photo
-	Agent      string         `gorm:"size:100" json:"agent,omitempty"`
-	Scanner    string         `gorm:"size:100" json:"scanner,omitempty"`
-	Language   string         `gorm:"size:10" json:"language,omitempty"`
-	Paths      []LibraryPath  `gorm:"foreignKey:LibraryID" json:"locations,omitempty"`
-	Hidden     bool           `gorm:"default:false" json:"hidden"`
-	CreatedAt  time.Time      `json:"createdAt"`
-	UpdatedAt  time.Time      `json:"updatedAt"`
-	ScannedAt  *time.Time     `json:"scannedAt,omitempty"`
-	DeletedAt  gorm.DeletedAt `gorm:"index" json:"-"`
+	ID           uint           `gorm:"primaryKey" json:"key"`
+	UUID         string         `gorm:"uniqueIndex;size:36" json:"uuid"`
+	Title        string         `gorm:"size:255" json:"title"`
+	Type         string         `gorm:"size:50;index" json:"type"` // movie, show, artist, photo
+	Agent        string         `gorm:"size:100" json:"agent,omitempty"`
+	Agents       string         `gorm:"size:255" json:"agents,omitempty"`      // Comma separated metadata agents, highest priority first
+	AgentRules   string         `gorm:"type:text" json:"agentRules,omitempty"` // JSON map of field to the agents it is taken from
+	Scanner      string         `gorm:"size:100" json:"scanner,omitempty"`
+	EpisodeOrder string         `gorm:"size:20" json:"episodeOrder,omitempty"` // How episode files are numbered: aired (S01E01) or absolute ("Show - 137")
+	Language     string         `gorm:"size:10" json:"language,omitempty"`
+	Paths        []LibraryPath  `gorm:"foreignKey:LibraryID" json:"locations,omitempty"`
+	Hidden       bool           `gorm:"default:false" json:"hidden"`
+	CreatedAt    time.Time      `json:"createdAt"`
+	UpdatedAt    time.Time      `json:"updatedAt"`
+	ScannedAt    *time.Time     `json:"scannedAt,omitempty"`
+	DeletedAt    gorm.DeletedAt `gorm:"index" json:"-"`
 }
 
 // LibraryPath represents a filesystem path for a library
@@ -74,7 +77,8 @@ type MediaItem struct {
 	ID               uint           `gorm:"primaryKey" json:"ratingKey"`
 	UUID             string         `gorm:"uniqueIndex;size:36" json:"guid"`
 	LibraryID        uint           `gorm:"index" json:"librarySectionID"`
-	Type             string         `gorm:"size:50;index" json:"type"` // movie, show, season, episode, artist, album, track
+	Type             string         `gorm:"size:50;index" json:"type"` // movie, show, season, episode, artist, album, track, photoalbum, photo, extra
+	Subtype          string         `gorm:"size:50" json:"subtype,omitempty"` // Category of an extra: trailer, featurette, deleted...
 	Title            string         `gorm:"size:500" json:"title"`
 	OriginalTitle    string         `gorm:"size:500" json:"originalTitle,omitempty"`
 	SortTitle        string         `gorm:"size:500;index" json:"titleSort,omitempty"`
@@ -88,6 +92,7 @@ type MediaItem struct {
 	Duration         int64          `json:"duration,omitempty"` // milliseconds
 	Thumb            string         `gorm:"size:500" json:"thumb,omitempty"`
 	Art              string         `gorm:"size:500" json:"art,omitempty"`
+	LockedFields     string         `gorm:"size:255" json:"lockedFields,omitempty"` // Comma separated fields agents must not change
 
 	// Provider tracking (for VOD content)
 	ProviderType       string `gorm:"size:20;index" json:"providerType,omitempty"`        // local, m3u, xtream
@@ -112,6 +117,7 @@ type MediaItem struct {
 	GrandparentID       *uint  `gorm:"index" json:"grandparentRatingKey,omitempty"`
 	Index               int    `json:"index,omitempty"`        // Episode number or track number
 	ParentIndex         int    `json:"parentIndex,omitempty"`  // Season number
+	AbsoluteIndex       int    `json:"absoluteIndex,omitempty"` // Episode number counted from the start of the show
 	ParentTitle         string `gorm:"size:255" json:"parentTitle,omitempty"`
 	GrandparentTitle    string `gorm:"size:255" json:"grandparentTitle,omitempty"`
 	ParentThumb         string `gorm:"size:500" json:"parentThumb,omitempty"`
@@ -153,6 +159,7 @@ type MediaFile struct {
 	VideoFrameRate string `gorm:"size:20" json:"videoFrameRate,omitempty"`
 	AudioCodec  string `gorm:"size:50" json:"audioCodec"`
 	AudioChannels int   `json:"audioChannels"`
+	Edition     string `gorm:"size:100" json:"edition,omitempty"` // e.g. "Director's Cut", from the file name
 
 	// Remote stream support (for VOD)
 	IsRemote        bool   `gorm:"default:false" json:"isRemote"`                   // True for VOD streams
@@ -162,6 +169,12 @@ type MediaFile struct {
 	// Streams
 	Streams []MediaStream `gorm:"foreignKey:MediaFileID" json:"Part,omitempty"`
 
+	// Chapters
+	Chapters []MediaChapter `gorm:"foreignKey:MediaFileID" json:"Chapter,omitempty"`
+
+	// When intros and credits were last looked for
+	MarkersScannedAt *time.Time `json:"-"`
+
 	CreatedAt time.Time
 	UpdatedAt time.Time
 }
@@ -186,6 +199,8 @@ type MediaStream struct {
 	Height       int     `json:"height,omitempty"`
 	BitDepth     int     `json:"bitDepth,omitempty"`
 	ColorSpace   string  `gorm:"size:50" json:"colorSpace,omitempty"`
+	ColorTrc     string  `gorm:"size:50" json:"colorTrc,omitempty"` // transfer: smpte2084 for HDR10, arib-std-b67 for HLG
+	DOVIProfile  int     `json:"DOVIProfile,omitempty"`             // Dolby Vision profile, 0 if none
 	FrameRate    float64 `json:"frameRate,omitempty"`
 
 	// Audio specific
@@ -195,6 +210,7 @@ type MediaStream struct {
 
 	// Subtitle specific
 	Key          string `gorm:"size:500" json:"key,omitempty"` // Path for external subtitles
+	HearingImpaired bool `json:"hearingImpaired"`
 }
 
 // Genre represents a genre tag
@@ -213,6 +229,68 @@ type CastMember struct {
 	Order       int    `json:"order"`
 }
 
+// MediaGuid links a media item to an external database, e.g. "imdb://tt0111161"
+type MediaGuid struct {
+	ID          uint   `gorm:"primaryKey" json:"-"`
+	MediaItemID uint   `gorm:"uniqueIndex:idx_media_guid" json:"-"`
+	Guid        string `gorm:"uniqueIndex:idx_media_guid;size:255" json:"id"`
+}
+
+// MetadataEdit records a change an admin made to a field of a media item.
+// Values are stored as text; genres as a JSON array.
+type MetadataEdit struct {
+	ID          uint      `gorm:"primaryKey" json:"id"`
+	MediaItemID uint      `gorm:"index" json:"mediaItemId"`
+	UserID      uint      `json:"userId"`
+	Username    string    `gorm:"size:100" json:"username"`
+	Field       string    `gorm:"size:50" json:"field"`
+	OldValue    string    `gorm:"type:text" json:"oldValue"`
+	NewValue    string    `gorm:"type:text" json:"newValue"`
+	CreatedAt   time.Time `gorm:"index" json:"createdAt"`
+}
+
+// MediaChapter is a chapter read from a media file
+type MediaChapter struct {
+	ID          uint   `gorm:"primaryKey" json:"id"`
+	MediaFileID uint   `gorm:"index" json:"mediaFileId"`
+	Index       int    `json:"index"` // from 1
+	Title       string `gorm:"size:500" json:"tag,omitempty"`
+	StartTime   int64  `json:"startTimeOffset"`                 // milliseconds
+	EndTime     int64  `json:"endTimeOffset"`                   // milliseconds
+	Thumb       string `gorm:"size:500" json:"thumb,omitempty"` // set once the thumbnail is extracted
+}
+
+// MediaMarker marks a part of a media file or recording players offer to
+// skip: the intro, or the credits at which they offer the next episode
+type MediaMarker struct {
+	ID          uint      `gorm:"primaryKey" json:"id"`
+	MediaFileID uint      `gorm:"index" json:"mediaFileId,omitempty"`
+	RecordingID uint      `gorm:"index" json:"recordingId,omitempty"`
+	Type        string    `gorm:"size:20" json:"type"`   // intro, credits
+	StartTime   int64     `json:"startTimeOffset"`       // milliseconds
+	EndTime     int64     `json:"endTimeOffset"`         // milliseconds
+	Method      string    `gorm:"size:20" json:"method"` // fingerprint, blackframe
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+// PhotoExif holds the EXIF data read from a photo
+type PhotoExif struct {
+	ID           uint       `gorm:"primaryKey" json:"id"`
+	MediaItemID  uint       `gorm:"uniqueIndex" json:"mediaItemId"`
+	Make         string     `gorm:"size:100" json:"make,omitempty"`
+	Model        string     `gorm:"size:100" json:"model,omitempty"`
+	Lens         string     `gorm:"size:255" json:"lens,omitempty"`
+	TakenAt      *time.Time `gorm:"index" json:"takenAt,omitempty"`
+	Orientation  int        `json:"orientation,omitempty"` // EXIF orientation, 1-8
+	Latitude     *float64   `json:"latitude,omitempty"`
+	Longitude    *float64   `json:"longitude,omitempty"`
+	Altitude     *float64   `json:"altitude,omitempty"`
+	ExposureTime string     `gorm:"size:20" json:"exposure,omitempty"` // e.g. "1/250"
+	FNumber      float64    `json:"aperture,omitempty"`
+	ISO          int        `json:"iso,omitempty"`
+	FocalLength  float64    `json:"focalLength,omitempty"` // millimetres
+}
+
 // WatchHistory tracks what users have watched
 type WatchHistory struct {
 	ID          uint      `gorm:"primaryKey" json:"id"`
@@ -236,6 +314,10 @@ type Playlist struct {
 	PlaylistType string         `gorm:"size:20" json:"playlistType"` // video, audio, photo
 	Smart        bool           `gorm:"default:false" json:"smart"`
 	Composite    string         `gorm:"size:500" json:"composite,omitempty"`
+	LibraryID    uint           `gorm:"index" json:"librarySectionID,omitempty"` // Smart playlists: restrict to one library (0 = all)
+	Filter       string         `gorm:"type:text" json:"filter,omitempty"`        // Smart playlists: filter expression
+	Sort         string         `gorm:"size:100" json:"sort,omitempty"`           // Smart playlists: sort keys
+	Limit        int            `json:"limit,omitempty"`                          // Smart playlists: max items (0 = unlimited)
 	Duration     int64          `json:"duration,omitempty"`
 	LeafCount    int            `json:"leafCount"`
 	AddedAt      time.Time      `json:"addedAt"`
@@ -263,6 +345,12 @@ type Collection struct {
 	Thumb       string         `gorm:"size:500" json:"thumb,omitempty"`
 	Art         string         `gorm:"size:500" json:"art,omitempty"`
 	ChildCount  int            `json:"childCount"`
+	TMDBCollectionID int       `gorm:"index" json:"tmdbCollectionId,omitempty"` // Set for collections created from TMDB franchise data
+	LockedFields string        `gorm:"size:255" json:"lockedFields,omitempty"`  // Comma separated fields franchise syncing must not change
+	Smart       bool           `gorm:"default:false" json:"smart"`
+	Filter      string         `gorm:"type:text" json:"filter,omitempty"` // Smart collections: filter expression
+	Sort        string         `gorm:"size:100" json:"sort,omitempty"`    // Smart collections: sort keys
+	Limit       int            `json:"limit,omitempty"`                   // Smart collections: max items (0 = unlimited)
 	AddedAt     time.Time      `json:"addedAt"`
 	UpdatedAt   time.Time      `json:"updatedAt"`
 	DeletedAt   gorm.DeletedAt `gorm:"index" json:"-"`
@@ -275,6 +363,7 @@ type CollectionItem struct {
 	ID           uint `gorm:"primaryKey" json:"id"`
 	CollectionID uint `gorm:"index" json:"collectionId"`
 	MediaItemID  uint `gorm:"index" json:"ratingKey"`
+	Order        int  `json:"order"`
 }
 
 // WatchlistItem represents an item in a user's watchlist
@@ -516,6 +605,8 @@ type Recording struct {
 	// Conflict handling
 	Priority        int        `gorm:"default:50" json:"priority"`               // 0-100, higher = more important
 	ConflictGroupID *uint      `gorm:"index" json:"conflictGroupId,omitempty"`   // Groups conflicting recordings
+	// When intros and credits were last looked for
+	MarkersScannedAt *time.Time `json:"-"`
 	CreatedAt       time.Time  `json:"createdAt"`
 	UpdatedAt       time.Time  `json:"updatedAt"`
 
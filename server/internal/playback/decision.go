@@ -69,10 +69,15 @@ type PlaybackDecision struct {
 	AudioDecision   string `json:"audioDecision"`   // copy, transcode
 	ContainerChange bool   `json:"containerChange"` // need to remux
 
+	// HDR video is tone mapped to SDR when transcoded for a client without HDR
+	SupportsHDR bool `json:"supportsHdr"`
+	ToneMap     bool `json:"toneMap"`
+
 	// Recommended settings for transcode
 	SuggestedCodec      string `json:"suggestedCodec,omitempty"`
 	SuggestedResolution string `json:"suggestedResolution,omitempty"`
 	SuggestedBitrate    int    `json:"suggestedBitrate,omitempty"`
+	SuggestedAudioCodec string `json:"suggestedAudioCodec,omitempty"`
 }
 
 // DefaultClientCapabilities returns sensible defaults for common platforms
@@ -171,6 +176,8 @@ func DecidePlayback(media *MediaInfo, client *ClientCapabilities) *PlaybackDecis
 		Mode:          ModeDirectPlay,
 		VideoDecision: "copy",
 		AudioDecision: "copy",
+		SupportsHDR:   client.SupportsHDR,
+		ToneMap:       (media.HasHDR || media.HasDolbyVision) && !client.SupportsHDR,
 	}
 
 	// Check video codec compatibility
@@ -232,11 +239,13 @@ func DecidePlayback(media *MediaInfo, client *ClientCapabilities) *PlaybackDecis
 		decision.SuggestedBitrate = suggestBitrate(media, client, decision.SuggestedResolution)
 
 	} else if audioNeedsTranscode {
-		// Video is OK but audio needs transcode
-		decision.Mode = ModeTranscode
+		// Video is OK, so it is copied and only the audio is converted
+		decision.Mode = ModeDirectStream
 		decision.AudioDecision = "transcode"
+		decision.ContainerChange = true
 		decision.Reason = "Audio requires transcoding"
 		decision.TranscodeReason = "unsupported audio codec (" + media.AudioCodec + ")"
+		decision.SuggestedAudioCodec = suggestAudioCodec(media, client)
 
 	} else if !containerSupported {
 		// Both video and audio are OK but container needs remux
@@ -253,6 +262,51 @@ func DecidePlayback(media *MediaInfo, client *ClientCapabilities) *PlaybackDecis
 	return decision
 }
 
+// modeRank orders playback modes from least to most work for the server
+var modeRank = map[PlaybackMode]int{
+	ModeDirectPlay:   0,
+	ModeDirectStream: 1,
+	ModeTranscode:    2,
+}
+
+// DecideVersion picks the version of an item that plays best on the client
+// and returns its index with its decision. Versions that play without
+// transcoding win; among those the highest quality is chosen. When every
+// version needs transcoding, the one closest to what the client can show
+// is chosen, so a 1080p copy is preferred over scaling down a 4K one.
+func DecideVersion(versions []*MediaInfo, client *ClientCapabilities) (int, *PlaybackDecision) {
+	best := -1
+	var bestDecision *PlaybackDecision
+	for i, media := range versions {
+		decision := DecidePlayback(media, client)
+		if best < 0 || betterVersion(media, decision, versions[best], bestDecision, client) {
+			best, bestDecision = i, decision
+		}
+	}
+	return best, bestDecision
+}
+
+// betterVersion reports whether version a is better for the client than b
+func betterVersion(a *MediaInfo, da *PlaybackDecision, b *MediaInfo, db *PlaybackDecision, client *ClientCapabilities) bool {
+	if modeRank[da.Mode] != modeRank[db.Mode] {
+		return modeRank[da.Mode] < modeRank[db.Mode]
+	}
+	if da.Mode == ModeTranscode {
+		_, maxHeight := parseResolution(client.MaxResolution)
+		aFits, bFits := a.Height <= maxHeight, b.Height <= maxHeight
+		if aFits != bFits {
+			return aFits
+		}
+		if !aFits {
+			return a.Height < b.Height
+		}
+	}
+	if a.Height != b.Height {
+		return a.Height > b.Height
+	}
+	return a.Bitrate > b.Bitrate
+}
+
 // Helper functions
 
 func containsIgnoreCase(slice []string, item string) bool {
@@ -302,6 +356,18 @@ func suggestVideoCodec(client *ClientCapabilities) string {
 	return "h264"
 }
 
+// suggestAudioCodec keeps surround sound as Dolby Digital when the client
+// plays it, and otherwise converts to AAC
+func suggestAudioCodec(media *MediaInfo, client *ClientCapabilities) string {
+	switch strings.ToLower(media.AudioCodec) {
+	case "dts", "truehd", "eac3", "mlp":
+		if containsIgnoreCase(client.AudioCodecs, "ac3") {
+			return "ac3"
+		}
+	}
+	return "aac"
+}
+
 func suggestResolution(media *MediaInfo, client *ClientCapabilities) string {
 	maxWidth, maxHeight := parseResolution(client.MaxResolution)
 
@@ -0,0 +1,234 @@
+package search
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/openflix/openflix-server/internal/logger"
+	"github.com/openflix/openflix-server/internal/models"
+	"gorm.io/gorm"
+)
+
+// batchSize bounds the number of documents written per transaction during rebuilds
+const batchSize = 500
+
+// mediaKinds are the media item types that are searchable
+var mediaKinds = map[string]bool{
+	KindMovie:   true,
+	KindShow:    true,
+	KindEpisode: true,
+}
+
+// mediaEntry builds the document for a movie, show or episode
+func mediaEntry(item *models.MediaItem) (Entry, bool) {
+	if !mediaKinds[item.Type] {
+		return Entry{}, false
+	}
+
+	entry := Entry{
+		Kind:  item.Type,
+		Ref:   strconv.FormatUint(uint64(item.ID), 10),
+		Title: item.Title,
+		Body:  item.Summary,
+	}
+	if item.OriginalTitle != "" && item.OriginalTitle != item.Title {
+		entry.Subtitle = item.OriginalTitle
+	}
+	if item.Type == KindEpisode {
+		entry.Subtitle = strings.TrimSpace(item.GrandparentTitle + " " + entry.Subtitle)
+	}
+	return entry, true
+}
+
+// fillShowTitles sets the show title on episodes that only carry the show's ID
+func fillShowTitles(db *gorm.DB, items []models.MediaItem) {
+	var showIDs []uint
+	for _, item := range items {
+		if item.Type == KindEpisode && item.GrandparentTitle == "" && item.GrandparentID != nil {
+			showIDs = append(showIDs, *item.GrandparentID)
+		}
+	}
+	if len(showIDs) == 0 {
+		return
+	}
+
+	var shows []models.MediaItem
+	db.Select("id", "title").Where("id IN ?", showIDs).Find(&shows)
+	titles := make(map[uint]string, len(shows))
+	for _, show := range shows {
+		titles[show.ID] = show.Title
+	}
+	for i := range items {
+		if items[i].Type == KindEpisode && items[i].GrandparentTitle == "" && items[i].GrandparentID != nil {
+			items[i].GrandparentTitle = titles[*items[i].GrandparentID]
+		}
+	}
+}
+
+// IndexMediaItem adds or refreshes a movie, show or episode. Other types are ignored.
+func IndexMediaItem(db *gorm.DB, item *models.MediaItem) {
+	items := []models.MediaItem{*item}
+	fillShowTitles(db, items)
+	entry, ok := mediaEntry(&items[0])
+	if !ok {
+		return
+	}
+	if err := Upsert(db, entry); err != nil {
+		logger.Warnf("Failed to index %s %d: %v", item.Type, item.ID, err)
+	}
+}
+
+// RemoveMediaItem drops a media item from the index
+func RemoveMediaItem(db *gorm.DB, item *models.MediaItem) {
+	if !mediaKinds[item.Type] {
+		return
+	}
+	if err := Remove(db, item.Type, strconv.FormatUint(uint64(item.ID), 10)); err != nil {
+		logger.Warnf("Failed to remove %s %d from search index: %v", item.Type, item.ID, err)
+	}
+}
+
+// IndexPeople adds cast and crew names to the index
+func IndexPeople(db *gorm.DB, names ...string) {
+	entries := make([]Entry, 0, len(names))
+	seen := make(map[string]bool)
+	for _, name := range names {
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		entries = append(entries, Entry{Kind: KindPerson, Ref: name, Title: name})
+	}
+	if err := Upsert(db, entries...); err != nil {
+		logger.Warnf("Failed to index people: %v", err)
+	}
+}
+
+// recordingEntry builds the document for a DVR recording
+func recordingEntry(rec *models.Recording) Entry {
+	body := rec.Description
+	if rec.Summary != "" {
+		body = rec.Summary
+	}
+	return Entry{
+		Kind:     KindRecording,
+		Ref:      strconv.FormatUint(uint64(rec.ID), 10),
+		Title:    rec.Title,
+		Subtitle: rec.Subtitle,
+		Body:     strings.TrimSpace(body + " " + rec.Genres + " " + rec.ChannelName),
+	}
+}
+
+// IndexRecording adds or refreshes a DVR recording
+func IndexRecording(db *gorm.DB, rec *models.Recording) {
+	if err := Upsert(db, recordingEntry(rec)); err != nil {
+		logger.Warnf("Failed to index recording %d: %v", rec.ID, err)
+	}
+}
+
+// RemoveRecording drops a DVR recording from the index
+func RemoveRecording(db *gorm.DB, id uint) {
+	if err := Remove(db, KindRecording, strconv.FormatUint(uint64(id), 10)); err != nil {
+		logger.Warnf("Failed to remove recording %d from search index: %v", id, err)
+	}
+}
+
+// SyncPrograms replaces the indexed EPG programs with every program that has
+// not yet ended. EPG importers call this after each import.
+func SyncPrograms(db *gorm.DB) error {
+	if !Available(db) {
+		return nil
+	}
+
+	if err := RemoveKind(db, KindProgram); err != nil {
+		return err
+	}
+
+	var programs []models.Program
+	return db.Select("id", "title", "subtitle", "description", "category", "teams").
+		Where("end > ?", time.Now()).
+		FindInBatches(&programs, batchSize, func(tx *gorm.DB, batch int) error {
+			entries := make([]Entry, len(programs))
+			for i, p := range programs {
+				entries[i] = Entry{
+					Kind:     KindProgram,
+					Ref:      strconv.FormatUint(uint64(p.ID), 10),
+					Title:    p.Title,
+					Subtitle: p.Subtitle,
+					Body:     strings.TrimSpace(p.Description + " " + p.Category + " " + p.Teams),
+				}
+			}
+			return Upsert(db, entries...)
+		}).Error
+}
+
+// Rebuild re-indexes everything from the database
+func Rebuild(db *gorm.DB) error {
+	if !Available(db) {
+		return nil
+	}
+	start := time.Now()
+
+	for _, kind := range []string{KindMovie, KindShow, KindEpisode, KindPerson, KindRecording} {
+		if err := RemoveKind(db, kind); err != nil {
+			return err
+		}
+	}
+
+	var items []models.MediaItem
+	err := db.Select("id", "type", "title", "original_title", "summary", "grandparent_id", "grandparent_title").
+		Where("type IN ?", []string{KindMovie, KindShow, KindEpisode}).
+		FindInBatches(&items, batchSize, func(tx *gorm.DB, batch int) error {
+			fillShowTitles(db, items)
+			entries := make([]Entry, 0, len(items))
+			for i := range items {
+				if entry, ok := mediaEntry(&items[i]); ok {
+					entries = append(entries, entry)
+				}
+			}
+			return Upsert(db, entries...)
+		}).Error
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	db.Model(&models.CastMember{}).Distinct("tag").Pluck("tag", &names)
+	for i := 0; i < len(names); i += batchSize {
+		end := i + batchSize
+		if end > len(names) {
+			end = len(names)
+		}
+		IndexPeople(db, names[i:end]...)
+	}
+
+	var recordings []models.Recording
+	err = db.FindInBatches(&recordings, batchSize, func(tx *gorm.DB, batch int) error {
+		entries := make([]Entry, len(recordings))
+		for i := range recordings {
+			entries[i] = recordingEntry(&recordings[i])
+		}
+		return Upsert(db, entries...)
+	}).Error
+	if err != nil {
+		return err
+	}
+
+	if err := SyncPrograms(db); err != nil {
+		return err
+	}
+
+	logger.Infof("Search index rebuilt with %d documents in %s", Count(db), time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// RebuildIfEmpty builds the index on first start, or after switching backends
+func RebuildIfEmpty(db *gorm.DB) {
+	if !Available(db) || Count(db) > 0 {
+		return
+	}
+	if err := Rebuild(db); err != nil {
+		logger.Errorf("Failed to build search index: %v", err)
+	}
+}
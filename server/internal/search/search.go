@@ -0,0 +1,254 @@
+// Package search maintains a full-text index over the library, EPG, DVR
+// recordings and people. SQLite uses an FTS5 virtual table (FTS4 when the
+// driver is built without the sqlite_fts5 tag) and Postgres uses a tsvector
+// column with a GIN index. Text is case and accent folded before indexing, and
+// queries match on word prefixes.
+package search
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"unicode"
+
+	"github.com/openflix/openflix-server/internal/logger"
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+	"gorm.io/gorm"
+)
+
+// Document kinds
+const (
+	KindMovie     = "movie"
+	KindShow      = "show"
+	KindEpisode   = "episode"
+	KindPerson    = "person"
+	KindProgram   = "program"
+	KindRecording = "recording"
+)
+
+const tableName = "search_index"
+
+// Entry is a document in the search index, identified by kind and ref
+type Entry struct {
+	Kind     string
+	Ref      string
+	Title    string
+	Subtitle string
+	Body     string
+}
+
+// Hit is a search result, in rank order
+type Hit struct {
+	Kind string
+	Ref  string
+}
+
+type backend int
+
+const (
+	backendNone backend = iota
+	backendFTS5
+	backendFTS4
+	backendPostgres
+)
+
+// Migrate creates the search index for the connected database
+func Migrate(db *gorm.DB) error {
+	switch db.Dialector.Name() {
+	case "postgres":
+		err := db.Exec(`CREATE TABLE IF NOT EXISTS ` + tableName + ` (
+			kind VARCHAR(20) NOT NULL,
+			ref VARCHAR(500) NOT NULL,
+			title TEXT NOT NULL DEFAULT '',
+			subtitle TEXT NOT NULL DEFAULT '',
+			body TEXT NOT NULL DEFAULT '',
+			document TSVECTOR GENERATED ALWAYS AS (
+				setweight(to_tsvector('simple', title), 'A') ||
+				setweight(to_tsvector('simple', subtitle), 'B') ||
+				setweight(to_tsvector('simple', body), 'C')
+			) STORED,
+			PRIMARY KEY (kind, ref)
+		)`).Error
+		if err != nil {
+			return err
+		}
+		return db.Exec(`CREATE INDEX IF NOT EXISTS idx_search_index_document ON ` + tableName + ` USING GIN (document)`).Error
+
+	case "sqlite":
+		if detectBackend(db) != backendNone {
+			return nil
+		}
+		err := db.Exec(`CREATE VIRTUAL TABLE IF NOT EXISTS ` + tableName + ` USING fts5(
+			kind UNINDEXED, ref UNINDEXED, title, subtitle, body,
+			tokenize = 'unicode61 remove_diacritics 2', prefix = '2 3')`).Error
+		if err == nil {
+			return nil
+		}
+		// FTS5 needs the sqlite_fts5 build tag, FTS4 is always compiled in
+		logger.Warnf("FTS5 unavailable (%v), falling back to FTS4 for search", err)
+		return db.Exec(`CREATE VIRTUAL TABLE IF NOT EXISTS ` + tableName + ` USING fts4(
+			kind, ref, title, subtitle, body,
+			notindexed=kind, notindexed=ref, tokenize=unicode61 "remove_diacritics=1", prefix="2,3")`).Error
+	}
+	return nil
+}
+
+// detectBackend reports which kind of index exists in the database
+func detectBackend(db *gorm.DB) backend {
+	switch db.Dialector.Name() {
+	case "postgres":
+		return backendPostgres
+	case "sqlite":
+		var sql string
+		db.Raw("SELECT sql FROM sqlite_master WHERE type = 'table' AND name = ?", tableName).Scan(&sql)
+		switch {
+		case strings.Contains(strings.ToLower(sql), "fts5"):
+			return backendFTS5
+		case strings.Contains(strings.ToLower(sql), "fts4"):
+			return backendFTS4
+		}
+	}
+	return backendNone
+}
+
+// Available reports whether the database has a search index
+func Available(db *gorm.DB) bool {
+	return detectBackend(db) != backendNone
+}
+
+// Upsert adds or replaces documents in the index
+func Upsert(db *gorm.DB, entries ...Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	b := detectBackend(db)
+	if b == backendNone {
+		return nil
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		for _, e := range entries {
+			title, subtitle, body := Fold(e.Title), Fold(e.Subtitle), Fold(e.Body)
+			var err error
+			if b == backendPostgres {
+				err = tx.Exec(`INSERT INTO `+tableName+` (kind, ref, title, subtitle, body) VALUES (?, ?, ?, ?, ?)
+					ON CONFLICT (kind, ref) DO UPDATE SET title = EXCLUDED.title, subtitle = EXCLUDED.subtitle, body = EXCLUDED.body`,
+					e.Kind, e.Ref, title, subtitle, body).Error
+			} else {
+				rowID := docID(e.Kind, e.Ref)
+				if err = tx.Exec(`DELETE FROM `+tableName+` WHERE rowid = ?`, rowID).Error; err == nil {
+					err = tx.Exec(`INSERT INTO `+tableName+` (rowid, kind, ref, title, subtitle, body) VALUES (?, ?, ?, ?, ?, ?)`,
+						rowID, e.Kind, e.Ref, title, subtitle, body).Error
+				}
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Remove deletes documents from the index
+func Remove(db *gorm.DB, kind string, refs ...string) error {
+	b := detectBackend(db)
+	if b == backendNone || len(refs) == 0 {
+		return nil
+	}
+
+	if b == backendPostgres {
+		return db.Exec(`DELETE FROM `+tableName+` WHERE kind = ? AND ref IN ?`, kind, refs).Error
+	}
+
+	rowIDs := make([]int64, len(refs))
+	for i, ref := range refs {
+		rowIDs[i] = docID(kind, ref)
+	}
+	return db.Exec(`DELETE FROM `+tableName+` WHERE rowid IN ?`, rowIDs).Error
+}
+
+// RemoveKind deletes every document of a kind
+func RemoveKind(db *gorm.DB, kind string) error {
+	if detectBackend(db) == backendNone {
+		return nil
+	}
+	return db.Exec(`DELETE FROM `+tableName+` WHERE kind = ?`, kind).Error
+}
+
+// Count returns the number of documents in the index
+func Count(db *gorm.DB) int64 {
+	if detectBackend(db) == backendNone {
+		return 0
+	}
+	var count int64
+	db.Raw(`SELECT COUNT(*) FROM ` + tableName).Scan(&count)
+	return count
+}
+
+// Query searches documents of one kind. Every word in the query must match the
+// start of a word in the document; results are ordered best match first.
+func Query(db *gorm.DB, query, kind string, limit int) ([]Hit, error) {
+	terms := Terms(query)
+	if len(terms) == 0 {
+		return nil, nil
+	}
+
+	var hits []Hit
+	var err error
+	switch detectBackend(db) {
+	case backendFTS5:
+		// bm25 weights: kind, ref, title, subtitle, body
+		match := strings.Join(quoteTerms(terms, `"%s"*`), " ")
+		err = db.Raw(`SELECT kind, ref FROM `+tableName+` WHERE `+tableName+` MATCH ? AND kind = ?
+			ORDER BY bm25(`+tableName+`, 0.0, 0.0, 10.0, 4.0, 1.0) LIMIT ?`, match, kind, limit).Scan(&hits).Error
+	case backendFTS4:
+		// FTS4 has no built-in ranking: prefer title matches, then shorter titles
+		match := strings.Join(quoteTerms(terms, `%s*`), " ")
+		titleMatch := "title:" + strings.Join(quoteTerms(terms, `%s*`), " title:")
+		err = db.Raw(`SELECT kind, ref FROM `+tableName+` WHERE `+tableName+` MATCH ? AND kind = ?
+			ORDER BY CASE WHEN rowid IN (SELECT rowid FROM `+tableName+` WHERE `+tableName+` MATCH ?) THEN 0 ELSE 1 END,
+			length(title) LIMIT ?`, match, kind, titleMatch, limit).Scan(&hits).Error
+	case backendPostgres:
+		tsquery := strings.Join(quoteTerms(terms, `%s:*`), " & ")
+		err = db.Raw(`SELECT kind, ref FROM `+tableName+` WHERE kind = ? AND document @@ to_tsquery('simple', ?)
+			ORDER BY ts_rank(document, to_tsquery('simple', ?)) DESC LIMIT ?`, kind, tsquery, tsquery, limit).Scan(&hits).Error
+	}
+	return hits, err
+}
+
+// Fold lower-cases text and strips accents so "Amélie" matches "amelie"
+func Fold(s string) string {
+	folded, _, err := transform.String(transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC), s)
+	if err != nil {
+		folded = s
+	}
+	return strings.ToLower(folded)
+}
+
+// Terms splits a query into folded words, dropping punctuation
+func Terms(query string) []string {
+	return strings.FieldsFunc(Fold(query), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+func quoteTerms(terms []string, format string) []string {
+	quoted := make([]string, len(terms))
+	for i, t := range terms {
+		quoted[i] = fmt.Sprintf(format, t)
+	}
+	return quoted
+}
+
+// docID derives a stable SQLite rowid for a document so it can be replaced
+// without scanning the unindexed kind/ref columns
+func docID(kind, ref string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(kind))
+	h.Write([]byte{0})
+	h.Write([]byte(ref))
+	return int64(h.Sum64() >> 2)
+}
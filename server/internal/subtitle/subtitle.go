@@ -0,0 +1,270 @@
+// Package subtitle converts text subtitles between SubRip, WebVTT and
+// ASS/SSA.
+package subtitle
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// ErrUnsupported is returned for formats that can't be read as text, such as
+// image based PGS subtitles
+var ErrUnsupported = errors.New("subtitle format can't be converted to text")
+
+// Cue is a single subtitle. Text may span several lines and keep <i>, <b>
+// and <u> tags.
+type Cue struct {
+	Start time.Duration
+	End   time.Duration
+	Text  string
+}
+
+// Parse reads subtitles in the given format: srt, vtt (or webvtt), ass or ssa.
+// Files that aren't valid UTF-8 are read as Latin-1.
+func Parse(data []byte, format string) ([]Cue, error) {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	if !utf8.Valid(data) {
+		runes := make([]rune, len(data))
+		for i, b := range data {
+			runes[i] = rune(b)
+		}
+		data = []byte(string(runes))
+	}
+	text := strings.ReplaceAll(string(data), "\r\n", "\n")
+	text = strings.ReplaceAll(text, "\r", "\n")
+
+	var cues []Cue
+	switch strings.ToLower(format) {
+	case "srt", "subrip":
+		cues = parseBlocks(text, false)
+	case "vtt", "webvtt":
+		cues = parseBlocks(text, true)
+	case "ass", "ssa":
+		cues = parseASS(text)
+	default:
+		return nil, ErrUnsupported
+	}
+
+	sort.SliceStable(cues, func(i, j int) bool { return cues[i].Start < cues[j].Start })
+	return cues, nil
+}
+
+// parseBlocks reads SubRip and WebVTT, which both separate cues with blank
+// lines and start each cue with an optional identifier and a timing line
+func parseBlocks(text string, vtt bool) []Cue {
+	var cues []Cue
+	for i, block := range strings.Split(text, "\n\n") {
+		lines := strings.Split(strings.Trim(block, "\n"), "\n")
+		if vtt && i == 0 && strings.HasPrefix(lines[0], "WEBVTT") {
+			continue
+		}
+
+		timing := -1
+		for j, line := range lines {
+			if strings.Contains(line, "-->") {
+				timing = j
+				break
+			}
+		}
+		// NOTE, STYLE and REGION blocks have no timing line
+		if timing < 0 || timing > 1 {
+			continue
+		}
+
+		times := strings.SplitN(lines[timing], "-->", 2)
+		start, err := parseTimestamp(times[0])
+		if err != nil {
+			continue
+		}
+		// Cue settings and SRT coordinates follow the end time
+		endFields := strings.Fields(times[1])
+		if len(endFields) == 0 {
+			continue
+		}
+		end, err := parseTimestamp(endFields[0])
+		if err != nil {
+			continue
+		}
+
+		body := strings.TrimSpace(strings.Join(lines[timing+1:], "\n"))
+		if body == "" {
+			continue
+		}
+		cues = append(cues, Cue{Start: start, End: end, Text: body})
+	}
+	return cues
+}
+
+var (
+	assOverride = regexp.MustCompile(`\{[^}]*\}`)
+	assDrawing  = regexp.MustCompile(`\\p[1-9]`)
+)
+
+// parseASS reads the Dialogue lines of the [Events] section
+func parseASS(text string) []Cue {
+	var cues []Cue
+	inEvents := false
+	// Default v4+ field order, replaced by the section's Format line
+	fields := []string{"layer", "start", "end", "style", "name", "marginl", "marginr", "marginv", "effect", "text"}
+
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "[") {
+			inEvents = strings.EqualFold(line, "[Events]")
+			continue
+		}
+		if !inEvents {
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		switch strings.TrimSpace(key) {
+		case "Format":
+			fields = fields[:0]
+			for _, f := range strings.Split(value, ",") {
+				fields = append(fields, strings.ToLower(strings.TrimSpace(f)))
+			}
+		case "Dialogue":
+			// The text is always last and may itself contain commas
+			values := strings.SplitN(strings.TrimSpace(value), ",", len(fields))
+			if len(values) != len(fields) {
+				continue
+			}
+			var cue Cue
+			var err1, err2 error
+			for i, f := range fields {
+				switch f {
+				case "start":
+					cue.Start, err1 = parseTimestamp(values[i])
+				case "end":
+					cue.End, err2 = parseTimestamp(values[i])
+				case "text":
+					cue.Text = assText(values[i])
+				}
+			}
+			if err1 != nil || err2 != nil || cue.Text == "" {
+				continue
+			}
+			cues = append(cues, cue)
+		}
+	}
+	return cues
+}
+
+// assText turns ASS markup into plain text, keeping italics and bold
+func assText(s string) string {
+	if assDrawing.MatchString(s) {
+		return ""
+	}
+	s = assOverride.ReplaceAllStringFunc(s, func(tags string) string {
+		var out strings.Builder
+		for _, tag := range strings.Split(strings.Trim(tags, "{}"), `\`) {
+			switch tag {
+			case "i1":
+				out.WriteString("<i>")
+			case "i0":
+				out.WriteString("</i>")
+			case "b1":
+				out.WriteString("<b>")
+			case "b0":
+				out.WriteString("</b>")
+			}
+		}
+		return out.String()
+	})
+	s = strings.NewReplacer(`\N`, "\n", `\n`, "\n", `\h`, " ").Replace(s)
+	return strings.TrimSpace(s)
+}
+
+// parseTimestamp reads H:MM:SS,mmm (SubRip), [H:]MM:SS.mmm (WebVTT) and
+// H:MM:SS.cc (ASS)
+func parseTimestamp(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	parts := strings.Split(s, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return 0, fmt.Errorf("invalid timestamp %q", s)
+	}
+
+	secs, frac, _ := strings.Cut(strings.Replace(parts[len(parts)-1], ",", ".", 1), ".")
+	var total time.Duration
+	for i, p := range append(parts[:len(parts)-1], secs) {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			return 0, fmt.Errorf("invalid timestamp %q", s)
+		}
+		unit := time.Second
+		switch len(parts) - 1 - i {
+		case 1:
+			unit = time.Minute
+		case 2:
+			unit = time.Hour
+		}
+		total += time.Duration(n) * unit
+	}
+
+	if frac != "" {
+		if len(frac) > 3 {
+			frac = frac[:3]
+		}
+		n, err := strconv.Atoi(frac)
+		if err != nil {
+			return 0, fmt.Errorf("invalid timestamp %q", s)
+		}
+		for i := len(frac); i < 3; i++ {
+			n *= 10
+		}
+		total += time.Duration(n) * time.Millisecond
+	}
+	return total, nil
+}
+
+// formatTimestamp writes HH:MM:SS followed by sep and milliseconds
+func formatTimestamp(d time.Duration, sep string) string {
+	if d < 0 {
+		d = 0
+	}
+	ms := d.Milliseconds()
+	return fmt.Sprintf("%02d:%02d:%02d%s%03d", ms/3600000, ms/60000%60, ms/1000%60, sep, ms%1000)
+}
+
+// Tags WebVTT doesn't understand, such as SubRip's <font>
+var unsupportedTag = regexp.MustCompile(`(?i)</?(font|span)[^>]*>`)
+
+// WriteVTT writes cues as WebVTT
+func WriteVTT(w io.Writer, cues []Cue) error {
+	bw := bufio.NewWriter(w)
+	bw.WriteString("WEBVTT\n\n")
+	for _, cue := range cues {
+		text := unsupportedTag.ReplaceAllString(cue.Text, "")
+		// A blank line would end the cue early
+		text = strings.ReplaceAll(text, "\n\n", "\n")
+		fmt.Fprintf(bw, "%s --> %s\n%s\n\n",
+			formatTimestamp(cue.Start, "."), formatTimestamp(cue.End, "."), text)
+	}
+	return bw.Flush()
+}
+
+// WriteSRT writes cues as SubRip
+func WriteSRT(w io.Writer, cues []Cue) error {
+	bw := bufio.NewWriter(w)
+	for i, cue := range cues {
+		text := strings.ReplaceAll(cue.Text, "\n\n", "\n")
+		fmt.Fprintf(bw, "%d\n%s --> %s\n%s\n\n", i+1,
+			formatTimestamp(cue.Start, ","), formatTimestamp(cue.End, ","), text)
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,303 @@
+package transcode
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// QualityAuto is adaptive bitrate: a ladder of renditions players switch
+// between as their bandwidth changes
+const QualityAuto = "auto"
+
+// abrLadder is the qualities an adaptive session is encoded at, best first
+var abrLadder = []string{Quality1080p, Quality720p, Quality480p, Quality360p}
+
+// abrAudioRate is the audio bitrate of each rendition, in kbps
+const abrAudioRate = 128
+
+// Rendition is one quality of an adaptive bitrate session
+type Rendition struct {
+	Quality string
+	Width   int
+	Height  int
+	Bitrate int // peak video bitrate, bits per second
+}
+
+// SourceInfo is what is known of the file a session reads. Zero sizes give
+// an adaptive session the whole ladder at 16:9.
+type SourceInfo struct {
+	Width      int
+	Height     int
+	HasAudio   bool
+	VideoCodec string
+	Bitrate    int   // bits per second
+	ToneMap    bool  // HDR video the client can't show, mapped to SDR
+	Duration   int64 // milliseconds; a session knowing it can seek
+}
+
+// StartABRSession starts an adaptive bitrate session. One ffmpeg decodes the
+// file once and encodes it at each quality of the ladder up to the source's,
+// and MasterPlaylist lists the renditions for players to choose from. The
+// session counts against the maximum by how much encoding it does.
+func (t *Transcoder) StartABRSession(fileID uint, filePath string, offset int64, source SourceInfo, tracks Tracks) (*Session, error) {
+	renditions := abrRenditions(source)
+	return t.startSession(&Session{
+		FileID:     fileID,
+		FilePath:   filePath,
+		Quality:    QualityAuto,
+		Offset:     offset,
+		AudioRate:  fmt.Sprintf("%dk", abrAudioRate),
+		Renditions: renditions,
+		Weight:     min(ladderWeight(renditions), t.maxSessions),
+		Tracks:     tracks,
+		source:     source,
+	})
+}
+
+// abrRenditions picks the qualities of the ladder a source is encoded at,
+// never upscaling unless the source is smaller than the lowest. Renditions
+// keep the source's shape, fitting inside the quality's frame.
+func abrRenditions(source SourceInfo) []Rendition {
+	var renditions []Rendition
+	for i, quality := range abrLadder {
+		width, height, bitrate := getQualitySettings(quality)
+		lowest := i == len(abrLadder)-1
+		if source.Width > 0 && source.Height > 0 {
+			if source.Width < width && source.Height < height && !lowest {
+				continue
+			}
+			if source.Width*height > source.Height*width {
+				height = even(width * source.Height / source.Width)
+			} else {
+				width = even(height * source.Width / source.Height)
+			}
+		} else if source.Height > 0 && source.Height < height && !lowest {
+			continue
+		}
+		renditions = append(renditions, Rendition{
+			Quality: quality,
+			Width:   width,
+			Height:  height,
+			Bitrate: parseBitrate(bitrate),
+		})
+	}
+	return renditions
+}
+
+// even rounds a size to the nearest even number, as encoders need
+func even(n int) int {
+	return (n + 1) &^ 1
+}
+
+// ladderWeight is how many sessions a ladder counts as: the decode is shared,
+// so it is weighed by the pixels encoded, a 1080p rendition counting as one
+func ladderWeight(renditions []Rendition) int {
+	pixels := 0
+	for _, rendition := range renditions {
+		pixels += rendition.Width * rendition.Height
+	}
+	full := 1920 * 1080
+	return max(1, (pixels+full-1)/full)
+}
+
+// parseBitrate reads an ffmpeg bitrate such as "8M" or "192k"
+func parseBitrate(bitrate string) int {
+	multiplier := 1
+	switch {
+	case strings.HasSuffix(bitrate, "M"):
+		multiplier = 1000000
+	case strings.HasSuffix(bitrate, "k"):
+		multiplier = 1000
+	}
+	n, _ := strconv.Atoi(strings.TrimRight(bitrate, "Mk"))
+	return n * multiplier
+}
+
+// HasMasterPlaylist reports whether a session is started through a master
+// playlist, its own playlists being fetched from the session like segments
+func (s *Session) HasMasterPlaylist() bool {
+	return len(s.Renditions) > 0 || s.Mode == ModeDirectStream || s.Tracks.webVTT() || s.Seekable()
+}
+
+// MasterPlaylist lists the renditions of an adaptive session, or the one
+// stream of another session, with its WebVTT subtitle. base is put in front
+// of the playlists' names, which are in the session's directory.
+func (s *Session) MasterPlaylist(base string) string {
+	var b strings.Builder
+	version := 3
+	if s.Mode == ModeDirectStream {
+		version = 7 // fMP4 segments
+	}
+	fmt.Fprintf(&b, "#EXTM3U\n#EXT-X-VERSION:%d\n#EXT-X-INDEPENDENT-SEGMENTS\n", version)
+
+	subtitles := ""
+	if s.Tracks.webVTT() {
+		b.WriteString(s.subtitleMedia(base))
+		subtitles = ",SUBTITLES=\"subs\""
+	}
+
+	if len(s.Renditions) == 0 {
+		fmt.Fprintf(&b, "%s%s\n%splaylist.m3u8\n", s.streamInf(), subtitles, base)
+		return b.String()
+	}
+	for i, rendition := range s.Renditions {
+		bandwidth := rendition.Bitrate
+		codecs := renditionCodecs(rendition)
+		if s.source.HasAudio {
+			bandwidth += abrAudioRate * 1000
+			codecs += ",mp4a.40.2"
+		}
+		fmt.Fprintf(&b, "#EXT-X-STREAM-INF:BANDWIDTH=%d,RESOLUTION=%dx%d,CODECS=\"%s\"%s\n",
+			bandwidth, rendition.Width, rendition.Height, codecs, subtitles)
+		fmt.Fprintf(&b, "%sstream_%d.m3u8\n", base, i)
+	}
+	return b.String()
+}
+
+// streamInf is the master playlist entry of a session without renditions
+func (s *Session) streamInf() string {
+	width, height, bitrate := getQualitySettings(s.Quality)
+	bandwidth := parseBitrate(bitrate) + parseBitrate(s.AudioRate)
+	if s.Quality == QualityOriginal {
+		width, height = s.source.Width, s.source.Height
+	}
+	if s.Mode == ModeDirectStream {
+		bandwidth = directStreamBandwidth(s.source)
+	}
+	entry := fmt.Sprintf("#EXT-X-STREAM-INF:BANDWIDTH=%d", bandwidth)
+	if width > 0 && height > 0 {
+		entry += fmt.Sprintf(",RESOLUTION=%dx%d", width, height)
+	}
+	return entry
+}
+
+// renditionCodecs is the RFC 6381 codec of a rendition: H.264 High profile
+// at the level its size needs
+func renditionCodecs(rendition Rendition) string {
+	level := 30
+	switch {
+	case rendition.Height > 1080:
+		level = 51
+	case rendition.Height > 720:
+		level = 40
+	case rendition.Height > 480:
+		level = 31
+	}
+	return fmt.Sprintf("avc1.6400%02x", level)
+}
+
+// buildABRArgs builds the arguments of an adaptive session: the video is
+// split after decoding and each copy scaled and encoded on its own, with
+// keyframes lined up so players can switch at any segment
+func (t *Transcoder) buildABRArgs(session *Session) []string {
+	args := []string{
+		"-y",
+		"-hide_banner",
+		"-loglevel", "warning",
+	}
+	software := t.decodesInSoftware(session)
+	if software {
+		args = append(args, t.getSoftwareDecodeArgs()...)
+	} else {
+		args = append(args, t.getHWAccelInputArgs()...)
+	}
+	args = append(args, session.seekArgs()...)
+	args = append(args, "-i", session.FilePath)
+	args = append(args, session.subtitleInputArgs()...)
+
+	// Tone mapping and a burned subtitle go before the split, once for
+	// every rendition
+	n := len(session.Renditions)
+	graph := fmt.Sprintf("[0:v]split=%d", n)
+	if session.filtersVideo() {
+		graph = fmt.Sprintf("%s,split=%d", t.videoGraph(session, software), n)
+	}
+	for i := range session.Renditions {
+		graph += fmt.Sprintf("[s%d]", i)
+	}
+	for i, rendition := range session.Renditions {
+		scale := strings.TrimPrefix(t.getGraphScaleFilter(rendition.Width, rendition.Height, software), ",")
+		graph += fmt.Sprintf(";[s%d]%s[v%d]", i, scale, i)
+	}
+	args = append(args, "-filter_complex", graph)
+
+	streams := make([]string, n)
+	for i, rendition := range session.Renditions {
+		args = append(args, "-map", fmt.Sprintf("[v%d]", i))
+		args = append(args, t.getRenditionEncodingArgs(i, rendition)...)
+		streams[i] = fmt.Sprintf("v:%d", i)
+		if session.source.HasAudio {
+			args = append(args, "-map", session.audioMap())
+			streams[i] += fmt.Sprintf(",a:%d", i)
+		}
+	}
+
+	// A WebVTT subtitle goes with the first rendition
+	if session.Tracks.webVTT() {
+		args = append(args, session.subtitleOutputArgs()...)
+		streams[0] += ",s:0"
+	}
+	args = append(args, session.keyframeArgs()...)
+	if session.source.HasAudio {
+		args = append(args,
+			"-c:a", "aac",
+			"-b:a", session.AudioRate,
+			"-ac", "2",
+		)
+	}
+
+	args = append(args, session.hlsSeekArgs()...)
+	args = append(args,
+		"-f", "hls",
+		"-hls_time", strconv.Itoa(segmentDuration),
+		"-hls_list_size", "0",
+		"-hls_playlist_type", "event",
+		"-hls_flags", "independent_segments+temp_file",
+		"-hls_segment_filename", filepath.Join(session.OutputDir, "stream_%v_%05d.ts"),
+		"-var_stream_map", strings.Join(streams, " "),
+		filepath.Join(session.OutputDir, "stream_%v.m3u8"),
+	)
+	return args
+}
+
+// getScaleFilter returns the filter scaling decoded video with the hardware
+// it was decoded on
+func (t *Transcoder) getScaleFilter(width, height int) string {
+	switch t.hwAccel {
+	case HWAccelNVENC:
+		return fmt.Sprintf("scale_cuda=%d:%d", width, height)
+	case HWAccelQSV:
+		return fmt.Sprintf("scale_qsv=%d:%d", width, height)
+	case HWAccelVAAPI:
+		return fmt.Sprintf("scale_vaapi=%d:%d", width, height)
+	default:
+		return fmt.Sprintf("scale=%d:%d", width, height)
+	}
+}
+
+// getRenditionEncodingArgs returns the encoder arguments of the i-th video
+// stream of an adaptive session
+func (t *Transcoder) getRenditionEncodingArgs(i int, rendition Rendition) []string {
+	bitrate := strconv.Itoa(rendition.Bitrate)
+	bufsize := strconv.Itoa(rendition.Bitrate * 2)
+	stream := func(option string) string {
+		return fmt.Sprintf("-%s:v:%d", option, i)
+	}
+
+	switch t.hwAccel {
+	case HWAccelNVENC:
+		return []string{stream("c"), "h264_nvenc", stream("preset"), "p4", stream("b"), bitrate, stream("maxrate"), bitrate, stream("bufsize"), bufsize}
+	case HWAccelQSV:
+		return []string{stream("c"), "h264_qsv", stream("preset"), "faster", stream("b"), bitrate, stream("maxrate"), bitrate}
+	case HWAccelVAAPI:
+		return []string{stream("c"), "h264_vaapi", stream("b"), bitrate, stream("maxrate"), bitrate}
+	case HWAccelVideoToolbox:
+		return []string{stream("c"), "h264_videotoolbox", stream("b"), bitrate, stream("realtime"), "true"}
+	default:
+		return []string{stream("c"), "libx264", stream("preset"), "veryfast", stream("profile"), "high",
+			stream("pix_fmt"), "yuv420p", stream("crf"), "23",
+			stream("maxrate"), bitrate, stream("bufsize"), bufsize, stream("sc_threshold"), "0"}
+	}
+}
@@ -0,0 +1,118 @@
+package transcode
+
+import (
+	"errors"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Session modes
+const (
+	ModeTranscode    = "transcode"     // video encoded again
+	ModeDirectStream = "direct_stream" // video copied, audio and container converted
+)
+
+// Audio codecs a direct stream can convert to. AudioCopy keeps the source's.
+const (
+	AudioCopy = "copy"
+	AudioAAC  = "aac"
+	AudioAC3  = "ac3"
+	AudioEAC3 = "eac3"
+)
+
+// ErrNeedsTranscode is returned for direct streams of video that has to be
+// filtered: tone mapped, or with a subtitle burned in
+var ErrNeedsTranscode = errors.New("tone mapping or burning in a subtitle needs the video transcoded")
+
+// StartDirectStreamSession starts a session copying the video of a file
+// into HLS fMP4 segments, converting its audio to audioCodec. Segments are
+// cut at the source's keyframes, so they run about hls_time long.
+func (t *Transcoder) StartDirectStreamSession(fileID uint, filePath string, offset int64, source SourceInfo, audioCodec string, tracks Tracks) (*Session, error) {
+	if source.ToneMap || tracks.BurnsSubtitle() {
+		return nil, ErrNeedsTranscode
+	}
+	if audioCodec == "" {
+		audioCodec = AudioAAC
+	}
+	return t.startSession(&Session{
+		FileID:     fileID,
+		FilePath:   filePath,
+		Quality:    QualityOriginal,
+		Mode:       ModeDirectStream,
+		Offset:     offset,
+		AudioCodec: audioCodec,
+		Tracks:     tracks,
+		source:     source,
+	})
+}
+
+// buildDirectStreamArgs builds the arguments of a direct stream: the first
+// video stream copied and the first audio stream converted, in fMP4
+// segments that each start on a keyframe
+func (t *Transcoder) buildDirectStreamArgs(session *Session) []string {
+	args := []string{
+		"-y",
+		"-hide_banner",
+		"-loglevel", "warning",
+	}
+
+	// Seeking a copied stream lands on the keyframe before the offset
+	if session.Offset > 0 {
+		args = append(args, "-ss", strconv.FormatInt(session.Offset/1000, 10))
+	}
+	args = append(args, "-i", session.FilePath)
+	args = append(args, session.subtitleInputArgs()...)
+
+	args = append(args, "-map", "0:v:0", "-c:v", "copy")
+	if strings.EqualFold(session.source.VideoCodec, "hevc") {
+		// Apple players need HEVC tagged as hvc1
+		args = append(args, "-tag:v", "hvc1")
+	}
+
+	if session.source.HasAudio {
+		args = append(args, "-map", session.audioMap())
+		args = append(args, directStreamAudioArgs(session.AudioCodec)...)
+	}
+	args = append(args, session.subtitleOutputArgs()...)
+
+	args = append(args,
+		"-avoid_negative_ts", "make_zero",
+		"-f", "hls",
+		"-hls_time", "4",
+		"-hls_list_size", "0",
+		"-hls_playlist_type", "event",
+		"-hls_segment_type", "fmp4",
+		"-hls_fmp4_init_filename", "init.mp4",
+		"-hls_flags", "independent_segments+temp_file",
+		"-hls_segment_filename", filepath.Join(session.OutputDir, "segment%05d.m4s"),
+		filepath.Join(session.OutputDir, "playlist.m3u8"),
+	)
+	return args
+}
+
+// directStreamAudioArgs converts audio for a direct stream. Dolby Digital
+// keeps up to 5.1 channels; AAC is mixed down to stereo.
+func directStreamAudioArgs(codec string) []string {
+	surround := "aformat=channel_layouts=5.1(side)|5.1|5.0|quad|stereo|mono"
+	switch codec {
+	case AudioCopy:
+		return []string{"-c:a", "copy"}
+	case AudioAC3:
+		return []string{"-c:a", "ac3", "-b:a", "640k", "-af", surround}
+	case AudioEAC3:
+		return []string{"-c:a", "eac3", "-b:a", "768k", "-af", surround}
+	default:
+		return []string{"-c:a", "aac", "-b:a", "192k", "-ac", "2"}
+	}
+}
+
+// directStreamBandwidth estimates the peak bitrate of a direct stream from
+// the source's, in bits per second
+func directStreamBandwidth(source SourceInfo) int {
+	if source.Bitrate > 0 {
+		return source.Bitrate
+	}
+	_, _, bitrate := getQualitySettings(QualityOriginal)
+	return parseBitrate(bitrate)
+}
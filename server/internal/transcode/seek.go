@@ -0,0 +1,278 @@
+package transcode
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// segmentDuration is how long the segments of a seekable session run, in
+// seconds. Keyframes are forced on its multiples, so segment n always starts
+// n*segmentDuration into the file, whichever run of ffmpeg cut it.
+const segmentDuration = 4
+
+// seekAhead is how many segments past the last one written a request has to
+// be for ffmpeg to be restarted there rather than waited for
+const seekAhead = 5
+
+// Errors waiting for the segment of a seekable session
+var (
+	ErrSegmentNotFound = errors.New("segment not found")
+	ErrSegmentTimeout  = errors.New("segment not ready in time")
+	ErrSessionStopped  = errors.New("transcode session stopped")
+)
+
+// segmentNumberPattern matches the number of a video segment,
+// segment00012.ts or stream_1_00012.ts, or of a WebVTT segment. The HLS
+// muxer names those after the stream's playlist without padding the number:
+// playlist12.vtt, or stream_012.vtt with the first rendition, where the
+// rendition's 0 reads as a leading zero.
+var segmentNumberPattern = regexp.MustCompile(`(\d{5})\.ts$|(\d+)\.vtt$`)
+
+// Seekable reports whether a session can seek within itself: it encodes
+// video of a known length, so its segments are cut at fixed times and its
+// playlists list the whole file up front
+func (s *Session) Seekable() bool {
+	return s.Mode == ModeTranscode && !s.AudioOnly && s.source.Duration > 0
+}
+
+// segmentCount is the number of segments of a seekable session
+func (s *Session) segmentCount() int {
+	length := int64(segmentDuration * 1000)
+	return int((s.source.Duration + length - 1) / length)
+}
+
+// segmentPrefix is what the segment names of a session's stream start with:
+// its rendition's for an adaptive session
+func (s *Session) segmentPrefix(rendition int) string {
+	if len(s.Renditions) > 0 {
+		return fmt.Sprintf("stream_%d_", rendition)
+	}
+	return "segment"
+}
+
+// subtitleSegmentPrefix is what the WebVTT segment names of a session start
+// with: the name of the playlist of the stream carrying the subtitle
+func (s *Session) subtitleSegmentPrefix() string {
+	if len(s.Renditions) > 0 {
+		return "stream_0"
+	}
+	return "playlist"
+}
+
+// segmentNumber reads the number of a video or WebVTT segment from its name
+func segmentNumber(name string) (int, bool) {
+	match := segmentNumberPattern.FindStringSubmatch(name)
+	if match == nil {
+		return 0, false
+	}
+	n, err := strconv.Atoi(match[1] + match[2])
+	return n, err == nil
+}
+
+// seekSeconds is where in the file ffmpeg starts: the segment a seekable
+// session's running ffmpeg started at, or the offset of another session
+func (s *Session) seekSeconds() int64 {
+	if s.Seekable() {
+		return int64(s.startSegment * segmentDuration)
+	}
+	return s.Offset / 1000
+}
+
+// seekArgs are the input arguments seeking a session. A seekable session
+// keeps the file's timestamps, so the segments of every run line up.
+func (s *Session) seekArgs() []string {
+	var args []string
+	if s.Seekable() {
+		args = append(args, "-copyts", "-start_at_zero")
+	}
+	if seconds := s.seekSeconds(); seconds > 0 {
+		args = append(args, "-ss", strconv.FormatInt(seconds, 10))
+	}
+	return args
+}
+
+// keyframeArgs force a keyframe at the start of every segment. A seekable
+// session's timestamps start where ffmpeg seeked to.
+func (s *Session) keyframeArgs() []string {
+	var start int64
+	if s.Seekable() {
+		start = s.seekSeconds()
+	}
+	return []string{"-force_key_frames", fmt.Sprintf("expr:gte(t,%d+n_forced*%d)", start, segmentDuration)}
+}
+
+// hlsSeekArgs are the HLS output arguments of a seekable session, numbering
+// segments from where ffmpeg started
+func (s *Session) hlsSeekArgs() []string {
+	if !s.Seekable() {
+		return nil
+	}
+	return []string{"-avoid_negative_ts", "disabled", "-start_number", strconv.Itoa(s.startSegment)}
+}
+
+// MediaPlaylist returns the playlist of a seekable session's stream,
+// playlist.m3u8 or the stream_N.m3u8 of a rendition, or of its WebVTT
+// subtitle. It lists every segment of the file, written yet or not, so
+// players can seek anywhere in it and the numbering never changes.
+func (s *Session) MediaPlaylist(name string) (string, bool) {
+	if !s.Seekable() {
+		return "", false
+	}
+	rendition, subtitle := 0, false
+	switch {
+	case s.Tracks.webVTT() && name == s.subtitlePlaylist():
+		subtitle = true
+	case len(s.Renditions) > 0:
+		if _, err := fmt.Sscanf(name, "stream_%d.m3u8", &rendition); err != nil ||
+			rendition < 0 || rendition >= len(s.Renditions) || name != fmt.Sprintf("stream_%d.m3u8", rendition) {
+			return "", false
+		}
+	case name != "playlist.m3u8":
+		return "", false
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:%d\n", segmentDuration)
+	b.WriteString("#EXT-X-MEDIA-SEQUENCE:0\n#EXT-X-PLAYLIST-TYPE:VOD\n#EXT-X-INDEPENDENT-SEGMENTS\n")
+	if s.Offset > 0 {
+		// Players start where the session was asked to
+		fmt.Fprintf(&b, "#EXT-X-START:TIME-OFFSET=%.3f,PRECISE=YES\n", float64(s.Offset)/1000)
+	}
+	count := s.segmentCount()
+	for n := 0; n < count; n++ {
+		length := float64(segmentDuration)
+		if n == count-1 {
+			length = float64(s.source.Duration)/1000 - float64(n*segmentDuration)
+		}
+		segment := fmt.Sprintf("%s%05d.ts", s.segmentPrefix(rendition), n)
+		if subtitle {
+			segment = fmt.Sprintf("%s%d.vtt", s.subtitleSegmentPrefix(), n)
+		}
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\n%s\n", length, segment)
+	}
+	b.WriteString("#EXT-X-ENDLIST\n")
+	return b.String(), true
+}
+
+// lastSegment is the last segment written in a row from where the running
+// ffmpeg started, or the one before when it has written none yet
+func (s *Session) lastSegment() int {
+	n := s.startSegment
+	for n < s.segmentCount() {
+		name := fmt.Sprintf("%s%05d.ts", s.segmentPrefix(0), n)
+		if _, err := os.Stat(filepath.Join(s.OutputDir, name)); err != nil {
+			break
+		}
+		n++
+	}
+	return n - 1
+}
+
+// segmentWritten reports whether a segment is whole. ffmpeg writes video
+// segments under a temporary name and renames them when they're complete,
+// so one that exists is whole. WebVTT segments are written in place, and are
+// whole once the video segment cut at the same time is.
+func (s *Session) segmentWritten(name string) bool {
+	if _, err := os.Stat(filepath.Join(s.OutputDir, name)); err != nil {
+		return false
+	}
+	if n, ok := segmentNumber(name); ok && strings.HasSuffix(name, ".vtt") {
+		video := fmt.Sprintf("%s%05d.ts", s.segmentPrefix(0), n)
+		_, err := os.Stat(filepath.Join(s.OutputDir, video))
+		return err == nil
+	}
+	return true
+}
+
+// AwaitSegment waits until a video or WebVTT segment of a seekable session
+// is written and returns its path. A segment far ahead of ffmpeg, or before
+// where it started, restarts ffmpeg there in the same session; the segments
+// already written are kept.
+func (t *Transcoder) AwaitSegment(session *Session, name string, timeout time.Duration) (string, error) {
+	path := filepath.Join(session.OutputDir, name)
+	n, numbered := segmentNumber(name)
+	if numbered && n >= session.segmentCount() {
+		return "", ErrSegmentNotFound
+	}
+
+	deadline := time.After(timeout)
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		session.runMutex.Lock()
+		if session.segmentWritten(name) {
+			session.runMutex.Unlock()
+			return path, nil
+		}
+		if numbered && (n < session.startSegment || n > session.lastSegment()+seekAhead) {
+			if err := t.restart(session, n); err != nil {
+				session.runMutex.Unlock()
+				return "", err
+			}
+		}
+		done := session.Done
+		session.runMutex.Unlock()
+
+		select {
+		case <-deadline:
+			return "", ErrSegmentTimeout
+		case <-ticker.C:
+		case <-done:
+			// What a finished ffmpeg hasn't written isn't coming, unless
+			// it has been restarted since
+			session.runMutex.Lock()
+			current, failed := session.Done == done, session.Error
+			session.runMutex.Unlock()
+			if !current {
+				continue
+			}
+			if _, err := os.Stat(path); err == nil {
+				return path, nil
+			}
+			if failed != nil {
+				return "", failed
+			}
+			return "", ErrSegmentNotFound
+		}
+	}
+}
+
+// restart stops a seekable session's ffmpeg and starts it again at segment
+// n. The caller holds runMutex.
+func (t *Transcoder) restart(session *Session, n int) error {
+	if session.stopped {
+		return ErrSessionStopped
+	}
+	if session.Process != nil && session.Process.Process != nil {
+		session.Process.Process.Kill()
+	}
+	<-session.Done
+
+	// The segment being written when ffmpeg stopped is left incomplete
+	if partial, err := filepath.Glob(filepath.Join(session.OutputDir, "*.tmp")); err == nil {
+		for _, file := range partial {
+			os.Remove(file)
+		}
+	}
+
+	session.startSegment = n
+	t.runTranscode(session)
+	return nil
+}
+
+// kill stops a session's ffmpeg for good
+func (s *Session) kill() {
+	s.runMutex.Lock()
+	defer s.runMutex.Unlock()
+	s.stopped = true
+	if s.Process != nil && s.Process.Process != nil {
+		s.Process.Process.Kill()
+	}
+}
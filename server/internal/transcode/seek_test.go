@@ -0,0 +1,103 @@
+package transcode
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSegmentNumber(t *testing.T) {
+	tests := []struct {
+		name string
+		n    int
+		ok   bool
+	}{
+		{"segment00012.ts", 12, true},
+		{"stream_1_00012.ts", 12, true},
+		{"playlist12.vtt", 12, true},
+		{"stream_012.vtt", 12, true},
+		{"stream_00.vtt", 0, true},
+		{"playlist.m3u8", 0, false},
+		{"segment12.ts", 0, false},
+	}
+	for _, tt := range tests {
+		n, ok := segmentNumber(tt.name)
+		if n != tt.n || ok != tt.ok {
+			t.Errorf("segmentNumber(%q) = %d, %v, want %d, %v", tt.name, n, ok, tt.n, tt.ok)
+		}
+	}
+}
+
+func TestMediaPlaylist(t *testing.T) {
+	subtitle := Tracks{Subtitle: &SubtitleTrack{Codec: "subrip"}}
+	ladder := []Rendition{{Quality: "1080p"}, {Quality: "720p"}}
+
+	// 10.5 seconds is two whole segments and a short one
+	tests := []struct {
+		name       string
+		tracks     Tracks
+		renditions []Rendition
+		playlist   string
+		segments   []string // nil for no playlist
+	}{
+		{"video", Tracks{}, nil, "playlist.m3u8", []string{"segment00000.ts", "segment00001.ts", "segment00002.ts"}},
+		{"rendition", Tracks{}, ladder, "stream_1.m3u8", []string{"stream_1_00000.ts", "stream_1_00001.ts", "stream_1_00002.ts"}},
+		{"missing rendition", Tracks{}, ladder, "stream_2.m3u8", nil},
+		{"subtitle", subtitle, nil, "playlist_vtt.m3u8", []string{"playlist0.vtt", "playlist1.vtt", "playlist2.vtt"}},
+		{"rendition subtitle", subtitle, ladder, "stream_0_vtt.m3u8", []string{"stream_00.vtt", "stream_01.vtt", "stream_02.vtt"}},
+		{"no subtitle", Tracks{}, nil, "playlist_vtt.m3u8", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session := &Session{
+				Mode:       ModeTranscode,
+				Tracks:     tt.tracks,
+				Renditions: tt.renditions,
+				source:     SourceInfo{Duration: 10500},
+			}
+			playlist, ok := session.MediaPlaylist(tt.playlist)
+			if ok != (tt.segments != nil) {
+				t.Fatalf("MediaPlaylist(%q) ok = %v", tt.playlist, ok)
+			}
+			if !ok {
+				return
+			}
+
+			var segments []string
+			for _, line := range strings.Split(playlist, "\n") {
+				if line != "" && !strings.HasPrefix(line, "#") {
+					segments = append(segments, line)
+				}
+			}
+			if strings.Join(segments, " ") != strings.Join(tt.segments, " ") {
+				t.Errorf("segments = %v, want %v", segments, tt.segments)
+			}
+			if !strings.Contains(playlist, "#EXTINF:2.500,\n"+tt.segments[2]) || !strings.HasSuffix(playlist, "#EXT-X-ENDLIST\n") {
+				t.Errorf("playlist = %q", playlist)
+			}
+		})
+	}
+}
+
+func TestSegmentWritten(t *testing.T) {
+	session := &Session{Mode: ModeTranscode, OutputDir: t.TempDir(), source: SourceInfo{Duration: 10500}}
+	write := func(name string) {
+		if err := os.WriteFile(filepath.Join(session.OutputDir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A WebVTT segment is whole once its video segment is
+	write("playlist0.vtt")
+	if session.segmentWritten("playlist0.vtt") {
+		t.Error("WebVTT segment written before its video segment")
+	}
+	write("segment00000.ts")
+	if !session.segmentWritten("playlist0.vtt") || !session.segmentWritten("segment00000.ts") {
+		t.Error("segments not written")
+	}
+	if session.segmentWritten("segment00001.ts") {
+		t.Error("missing segment written")
+	}
+}
@@ -0,0 +1,66 @@
+package transcode
+
+// Tone mapping from the software filters: linearize, map the brightness down
+// with hable, and convert to BT.709
+const softwareToneMap = "zscale=t=linear:npl=100,format=gbrpf32le,zscale=p=bt709," +
+	"tonemap=tonemap=hable:desat=0,zscale=t=bt709:m=bt709:r=tv,format=yuv420p"
+
+// filtersVideo reports whether a session's video goes through filters before
+// scaling: tone mapping, or a burned subtitle
+func (s *Session) filtersVideo() bool {
+	return s.source.ToneMap || s.Tracks.BurnsSubtitle()
+}
+
+// decodesInSoftware reports whether a session decodes into memory rather
+// than onto the hardware, as a burned subtitle needs, and tone mapping
+// where the hardware has no filter for it
+func (t *Transcoder) decodesInSoftware(session *Session) bool {
+	if session.Tracks.BurnsSubtitle() {
+		return true
+	}
+	return session.source.ToneMap && t.hwAccel == HWAccelNVENC
+}
+
+// getToneMapFilter returns the filter mapping HDR video to SDR, on the
+// hardware the frames are on where it has one
+func (t *Transcoder) getToneMapFilter(software bool) string {
+	switch {
+	case !software && t.hwAccel == HWAccelVAAPI:
+		return "tonemap_vaapi=format=nv12:t=bt709:m=bt709:p=bt709"
+	case !software && t.hwAccel == HWAccelQSV:
+		return "vpp_qsv=tonemap=1:format=nv12"
+	default:
+		return softwareToneMap
+	}
+}
+
+// videoGraph returns the start of the filtergraph a session's video goes
+// through before scaling, or "" when it needs none. HDR is tone mapped
+// before a subtitle is burned in, so the subtitle keeps its colors.
+func (t *Transcoder) videoGraph(session *Session, software bool) string {
+	graph, input := "", "[0:v]"
+	if session.source.ToneMap {
+		graph = input + t.getToneMapFilter(software)
+		if !session.Tracks.BurnsSubtitle() {
+			return graph
+		}
+		graph += "[sdr];"
+		input = "[sdr]"
+	}
+	if session.Tracks.BurnsSubtitle() {
+		graph += session.burnFilter(input)
+	}
+	return graph
+}
+
+// getGraphScaleFilter continues a filtergraph by scaling to width by height
+// (zero keeps the size) where the frames are
+func (t *Transcoder) getGraphScaleFilter(width, height int, software bool) string {
+	if software {
+		return t.getSoftwareScaleFilter(width, height)
+	}
+	if width == 0 || height == 0 {
+		return ""
+	}
+	return "," + t.getScaleFilter(width, height)
+}
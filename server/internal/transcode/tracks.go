@@ -0,0 +1,143 @@
+package transcode
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Tracks is the audio and subtitle a session plays
+type Tracks struct {
+	Audio    int            // stream index of the audio in the file, 0 for the first audio
+	Subtitle *SubtitleTrack // nil for none
+}
+
+// SubtitleTrack is the subtitle a session shows. Image subtitles are always
+// burned into the video; text subtitles are sent as a WebVTT rendition
+// unless Burn is set.
+type SubtitleTrack struct {
+	Index    int    // stream index in the file of an embedded subtitle
+	Position int    // among the file's subtitles, as the subtitles filter counts them
+	Path     string // the file of a sidecar subtitle
+	Codec    string
+	Language string
+	Name     string
+	Burn     bool
+}
+
+// Image-based subtitle codecs, under ffmpeg's names and the library's
+var imageSubtitleCodecs = map[string]bool{
+	"pgs": true, "hdmv_pgs_subtitle": true,
+	"vobsub": true, "dvd_subtitle": true,
+	"dvbsub": true, "dvb_subtitle": true,
+}
+
+// ImageBased reports whether a subtitle is pictures rather than text, as
+// PGS and VobSub are
+func (s *SubtitleTrack) ImageBased() bool {
+	return imageSubtitleCodecs[strings.ToLower(s.Codec)]
+}
+
+// BurnsSubtitle reports whether a subtitle is burned into the video, which
+// then has to be encoded
+func (t Tracks) BurnsSubtitle() bool {
+	return t.Subtitle != nil && (t.Subtitle.Burn || t.Subtitle.ImageBased())
+}
+
+// webVTT reports whether a subtitle is sent as a WebVTT rendition
+func (t Tracks) webVTT() bool {
+	return t.Subtitle != nil && !t.BurnsSubtitle()
+}
+
+// audioMap is the map argument of a session's audio
+func (s *Session) audioMap() string {
+	if s.Tracks.Audio > 0 {
+		return fmt.Sprintf("0:%d", s.Tracks.Audio)
+	}
+	return "0:a:0?"
+}
+
+// subtitleStream is the map argument of a session's subtitle: the second
+// input when it's a sidecar
+func (s *Session) subtitleStream() string {
+	if s.Tracks.Subtitle.Path != "" {
+		return "1:0"
+	}
+	return fmt.Sprintf("0:%d", s.Tracks.Subtitle.Index)
+}
+
+// subtitleInputArgs adds a sidecar subtitle as the second input, seeked like
+// the file. Text burned in is read by the subtitles filter instead.
+func (s *Session) subtitleInputArgs() []string {
+	sub := s.Tracks.Subtitle
+	if sub == nil || sub.Path == "" || (sub.Burn && !sub.ImageBased()) {
+		return nil
+	}
+	var args []string
+	if seconds := s.seekSeconds(); seconds > 0 {
+		args = append(args, "-ss", strconv.FormatInt(seconds, 10))
+	}
+	return append(args, "-i", sub.Path)
+}
+
+// subtitleOutputArgs sends a text subtitle along as WebVTT, which the HLS
+// muxer segments into a playlist of its own next to the video's
+func (s *Session) subtitleOutputArgs() []string {
+	if !s.Tracks.webVTT() {
+		return nil
+	}
+	return []string{"-map", s.subtitleStream(), "-c:s", "webvtt"}
+}
+
+// burnFilter is the part of a filtergraph burning a session's subtitle into
+// the decoded video labeled input
+func (s *Session) burnFilter(input string) string {
+	sub := s.Tracks.Subtitle
+	if sub.ImageBased() {
+		return fmt.Sprintf("%s[%s]overlay", input, s.subtitleStream())
+	}
+
+	source, options := sub.Path, ""
+	if source == "" {
+		source, options = s.FilePath, fmt.Sprintf(":si=%d", sub.Position)
+	}
+	filter := fmt.Sprintf("subtitles=filename=%s%s", escapeFilterValue(source), options)
+
+	// The subtitles filter reads from the start, so a seeked video is
+	// shifted back to the file's time while it runs. A seekable session
+	// keeps the file's time.
+	if seconds := s.seekSeconds(); seconds > 0 && !s.Seekable() {
+		filter = fmt.Sprintf("setpts=PTS+%d/TB,%s,setpts=PTS-STARTPTS", seconds, filter)
+	}
+	return input + filter
+}
+
+// subtitlePlaylist is the name of the WebVTT playlist the HLS muxer writes
+// for a session's subtitle
+func (s *Session) subtitlePlaylist() string {
+	if len(s.Renditions) > 0 {
+		return "stream_0_vtt.m3u8"
+	}
+	return "playlist_vtt.m3u8"
+}
+
+// subtitleMedia is the master playlist entry of a session's WebVTT subtitle
+func (s *Session) subtitleMedia(base string) string {
+	sub := s.Tracks.Subtitle
+	name := strings.ReplaceAll(sub.Name, `"`, "'")
+	if name == "" {
+		name = "Subtitles"
+	}
+	entry := fmt.Sprintf("#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID=\"subs\",NAME=\"%s\",DEFAULT=YES,AUTOSELECT=YES", name)
+	if sub.Language != "" {
+		entry += fmt.Sprintf(",LANGUAGE=\"%s\"", sub.Language)
+	}
+	return entry + fmt.Sprintf(",URI=\"%s%s\"\n", base, s.subtitlePlaylist())
+}
+
+// escapeFilterValue escapes a filter option's value, and then the
+// filtergraph it is written in
+func escapeFilterValue(value string) string {
+	value = strings.NewReplacer(`\`, `\\`, `'`, `\'`, `:`, `\:`).Replace(value)
+	return strings.NewReplacer(`\`, `\\`, `'`, `\'`, `[`, `\[`, `]`, `\]`, `,`, `\,`, `;`, `\;`).Replace(value)
+}
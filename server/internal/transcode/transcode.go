@@ -50,12 +50,25 @@ type Session struct {
 	FilePath   string
 	OutputDir  string
 	Quality    string
+	Mode       string // ModeTranscode or ModeDirectStream
 	Offset     int64
+	AudioOnly  bool        // music transcodes drop video and cover art
+	AudioRate  string      // audio bitrate, e.g. "192k"
+	AudioCodec string      // what a direct stream converts audio to
+	Tracks     Tracks      // the audio and subtitle played
+	Renditions []Rendition // the ladder of an adaptive bitrate session
+	Weight     int         // how many sessions it counts as against the maximum
+	source     SourceInfo  // the file, for adaptive sessions and direct streams
 	Process    *exec.Cmd
 	Done       chan struct{}
 	Error      error
 	StartTime  time.Time
 	LastAccess time.Time
+
+	// Restarting ffmpeg where a seekable session seeked to
+	startSegment int        // the segment the running ffmpeg started at
+	runMutex     sync.Mutex // held while ffmpeg is checked on or restarted
+	stopped      bool       // the session is over; ffmpeg isn't restarted
 }
 
 // NewTranscoder creates a new transcoder instance
@@ -145,11 +158,46 @@ func DetectHardwareAccel(ffmpegPath string) string {
 }
 
 // StartSession starts a new transcoding session
-func (t *Transcoder) StartSession(fileID uint, filePath string, offset int64, quality string) (*Session, error) {
+func (t *Transcoder) StartSession(fileID uint, filePath string, offset int64, quality string, source SourceInfo, tracks Tracks) (*Session, error) {
+	return t.startSession(&Session{
+		FileID:    fileID,
+		FilePath:  filePath,
+		Quality:   quality,
+		Offset:    offset,
+		AudioRate: "192k",
+		Tracks:    tracks,
+		source:    source,
+	})
+}
+
+// StartAudioSession starts an audio-only transcoding session at the given
+// bitrate in kbps (192 if zero)
+func (t *Transcoder) StartAudioSession(fileID uint, filePath string, offset int64, bitrate int) (*Session, error) {
+	if bitrate <= 0 {
+		bitrate = 192
+	}
+	return t.startSession(&Session{
+		FileID:    fileID,
+		FilePath:  filePath,
+		Quality:   QualityOriginal,
+		Offset:    offset,
+		AudioOnly: true,
+		AudioRate: fmt.Sprintf("%dk", bitrate),
+	})
+}
+
+func (t *Transcoder) startSession(session *Session) (*Session, error) {
+	if session.Weight <= 0 {
+		session.Weight = 1
+	}
+	if session.Mode == "" {
+		session.Mode = ModeTranscode
+	}
+
 	t.mutex.Lock()
 
-	// Check max sessions
-	if len(t.sessions) >= t.maxSessions {
+	// Check max sessions, counting each by its weight
+	if t.load()+session.Weight > t.maxSessions {
 		t.mutex.Unlock()
 		return nil, fmt.Errorf("maximum number of transcode sessions reached (%d)", t.maxSessions)
 	}
@@ -164,27 +212,34 @@ func (t *Transcoder) StartSession(fileID uint, filePath string, offset int64, qu
 		return nil, fmt.Errorf("failed to create session directory: %w", err)
 	}
 
-	session := &Session{
-		ID:         sessionID,
-		FileID:     fileID,
-		FilePath:   filePath,
-		OutputDir:  outputDir,
-		Quality:    quality,
-		Offset:     offset,
-		Done:       make(chan struct{}),
-		StartTime:  time.Now(),
-		LastAccess: time.Now(),
-	}
+	session.ID = sessionID
+	session.OutputDir = outputDir
+	session.StartTime = time.Now()
+	session.LastAccess = time.Now()
 
 	t.sessions[sessionID] = session
 	t.mutex.Unlock()
 
+	// A seekable session starts at the segment holding the offset
+	if session.Seekable() {
+		session.startSegment = int(session.Offset / (segmentDuration * 1000))
+	}
+
 	// Start transcoding in background
-	go t.runTranscode(session)
+	t.runTranscode(session)
 
 	return session, nil
 }
 
+// load is the weight of the running sessions. The caller holds mutex.
+func (t *Transcoder) load() int {
+	total := 0
+	for _, session := range t.sessions {
+		total += session.Weight
+	}
+	return total
+}
+
 // GetSession returns a session by ID
 func (t *Transcoder) GetSession(sessionID string) *Session {
 	t.mutex.RLock()
@@ -223,9 +278,7 @@ func (t *Transcoder) StopSession(sessionID string) {
 	t.mutex.Unlock()
 
 	// Kill process
-	if session.Process != nil && session.Process.Process != nil {
-		session.Process.Process.Kill()
-	}
+	session.kill()
 
 	// Cleanup files
 	os.RemoveAll(session.OutputDir)
@@ -239,40 +292,60 @@ func (t *Transcoder) Stop() {
 	defer t.mutex.Unlock()
 
 	for id, session := range t.sessions {
-		if session.Process != nil && session.Process.Process != nil {
-			session.Process.Process.Kill()
-		}
+		session.kill()
 		os.RemoveAll(session.OutputDir)
 		delete(t.sessions, id)
 	}
 }
 
-// runTranscode runs the actual FFmpeg transcoding
+// runTranscode starts FFmpeg for a session in the background, from where it
+// seeks to. The caller has the session to itself: it is new, or the caller
+// holds runMutex.
 func (t *Transcoder) runTranscode(session *Session) {
-	defer close(session.Done)
+	done := make(chan struct{})
+	session.Done = done
+	session.Error = nil
 
 	playlistPath := filepath.Join(session.OutputDir, "playlist.m3u8")
 	segmentPattern := filepath.Join(session.OutputDir, "segment%05d.ts")
 
 	// Build FFmpeg arguments
-	args := t.buildFFmpegArgs(session, playlistPath, segmentPattern)
+	var args []string
+	switch {
+	case session.Mode == ModeDirectStream:
+		args = t.buildDirectStreamArgs(session)
+	case len(session.Renditions) > 0:
+		args = t.buildABRArgs(session)
+	default:
+		args = t.buildFFmpegArgs(session, playlistPath, segmentPattern)
+	}
 
 	// Create command
-	session.Process = exec.Command(t.ffmpegPath, args...)
+	cmd := exec.Command(t.ffmpegPath, args...)
+	session.Process = cmd
 
 	// Capture stderr for debugging
-	session.Process.Stderr = os.Stderr
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Start(); err != nil {
+		session.Error = err
+		close(done)
+		return
+	}
 
 	// Run transcoding
-	if err := session.Process.Run(); err != nil {
-		// Check if it was killed intentionally
-		select {
-		case <-t.cleanupStop:
-			return
-		default:
-			session.Error = err
+	go func() {
+		defer close(done)
+		if err := cmd.Wait(); err != nil {
+			// Check if it was killed intentionally
+			select {
+			case <-t.cleanupStop:
+				return
+			default:
+				session.Error = err
+			}
 		}
-	}
+	}()
 }
 
 // buildFFmpegArgs builds FFmpeg arguments based on settings
@@ -283,34 +356,62 @@ func (t *Transcoder) buildFFmpegArgs(session *Session, playlistPath, segmentPatt
 		"-loglevel", "warning",
 	}
 
-	// Add hardware acceleration input options
-	args = append(args, t.getHWAccelInputArgs()...)
+	// Add hardware acceleration input options. Frames are decoded into
+	// memory for filters the hardware doesn't have.
+	software := !session.AudioOnly && t.decodesInSoftware(session)
+	if software {
+		args = append(args, t.getSoftwareDecodeArgs()...)
+	} else if !session.AudioOnly {
+		args = append(args, t.getHWAccelInputArgs()...)
+	}
 
 	// Seek to offset if specified
-	if session.Offset > 0 {
-		args = append(args, "-ss", strconv.FormatInt(session.Offset/1000, 10))
-	}
+	args = append(args, session.seekArgs()...)
 
-	// Input file
+	// Input file, and a sidecar subtitle
 	args = append(args, "-i", session.FilePath)
-
-	// Video encoding
-	args = append(args, t.getVideoEncodingArgs(session.Quality)...)
+	if !session.AudioOnly {
+		args = append(args, session.subtitleInputArgs()...)
+	}
+
+	// Video encoding; tone mapping and burned subtitles need a filtergraph
+	switch {
+	case session.AudioOnly:
+		args = append(args, "-vn")
+	case session.filtersVideo():
+		width, height, _ := getQualitySettings(session.Quality)
+		graph := t.videoGraph(session, software) + t.getGraphScaleFilter(width, height, software) + "[v]"
+		args = append(args, "-filter_complex", graph, "-map", "[v]", "-map", session.audioMap())
+		args = append(args, t.getVideoEncoderArgs(session.Quality)...)
+	default:
+		args = append(args, "-map", "0:v:0", "-map", session.audioMap())
+		args = append(args, t.getVideoEncodingArgs(session.Quality)...)
+	}
+	if !session.AudioOnly {
+		args = append(args, session.keyframeArgs()...)
+	}
 
 	// Audio encoding (AAC for compatibility)
 	args = append(args,
 		"-c:a", "aac",
-		"-b:a", "192k",
+		"-b:a", session.AudioRate,
 		"-ac", "2",
 	)
 
-	// HLS output options
+	// A text subtitle goes along as WebVTT
+	if !session.AudioOnly {
+		args = append(args, session.subtitleOutputArgs()...)
+	}
+
+	// HLS output options; segments are written under a temporary name until
+	// they're complete
+	args = append(args, session.hlsSeekArgs()...)
 	args = append(args,
 		"-f", "hls",
-		"-hls_time", "4",
+		"-hls_time", strconv.Itoa(segmentDuration),
 		"-hls_list_size", "0",
 		"-hls_segment_filename", segmentPattern,
-		"-hls_flags", "independent_segments",
+		"-hls_flags", "independent_segments+temp_file",
 		playlistPath,
 	)
 
@@ -333,54 +434,76 @@ func (t *Transcoder) getHWAccelInputArgs() []string {
 	}
 }
 
+// getSoftwareDecodeArgs returns the input arguments of a session decoding in
+// software, for filters that don't run on the hardware, while still encoding
+// on it
+func (t *Transcoder) getSoftwareDecodeArgs() []string {
+	if t.hwAccel == HWAccelVAAPI {
+		return []string{"-vaapi_device", "/dev/dri/renderD128"}
+	}
+	return []string{}
+}
+
 // getVideoEncodingArgs returns video encoding arguments based on quality and hw accel
 func (t *Transcoder) getVideoEncodingArgs(quality string) []string {
-	// Get resolution and bitrate for quality
-	width, height, bitrate := getQualitySettings(quality)
-
-	// Build video filter for scaling if needed
-	var scaleFilter string
-	if quality != QualityOriginal {
-		scaleFilter = fmt.Sprintf("scale=%d:%d", width, height)
+	args := t.getVideoEncoderArgs(quality)
+	if filter := t.getVideoScaleFilter(quality); filter != "" {
+		args = append(args, "-vf", filter)
 	}
+	return args
+}
+
+// getVideoEncoderArgs returns the encoder arguments of a quality
+func (t *Transcoder) getVideoEncoderArgs(quality string) []string {
+	_, _, bitrate := getQualitySettings(quality)
 
 	switch t.hwAccel {
 	case HWAccelNVENC:
-		args := []string{"-c:v", "h264_nvenc", "-preset", "p4", "-tune", "ll", "-b:v", bitrate}
-		if scaleFilter != "" {
-			args = append(args, "-vf", fmt.Sprintf("scale_cuda=%d:%d", width, height))
-		}
-		return args
-
+		return []string{"-c:v", "h264_nvenc", "-preset", "p4", "-tune", "ll", "-b:v", bitrate}
 	case HWAccelQSV:
-		args := []string{"-c:v", "h264_qsv", "-preset", "faster", "-b:v", bitrate}
-		if scaleFilter != "" {
-			args = append(args, "-vf", fmt.Sprintf("scale_qsv=%d:%d", width, height))
-		}
-		return args
-
+		return []string{"-c:v", "h264_qsv", "-preset", "faster", "-b:v", bitrate}
 	case HWAccelVAAPI:
-		args := []string{"-c:v", "h264_vaapi", "-b:v", bitrate}
-		if scaleFilter != "" {
-			args = append(args, "-vf", fmt.Sprintf("scale_vaapi=%d:%d,format=nv12|vaapi,hwupload", width, height))
-		}
-		return args
-
+		return []string{"-c:v", "h264_vaapi", "-b:v", bitrate}
 	case HWAccelVideoToolbox:
-		args := []string{"-c:v", "h264_videotoolbox", "-b:v", bitrate, "-realtime", "true"}
-		if scaleFilter != "" {
-			args = append(args, "-vf", scaleFilter)
-		}
-		return args
-
+		return []string{"-c:v", "h264_videotoolbox", "-b:v", bitrate, "-realtime", "true"}
 	default:
 		// Software encoding with libx264
-		args := []string{"-c:v", "libx264", "-preset", "veryfast", "-crf", "23", "-maxrate", bitrate, "-bufsize", bitrate}
-		if scaleFilter != "" {
-			args = append(args, "-vf", scaleFilter)
-		}
-		return args
+		return []string{"-c:v", "libx264", "-preset", "veryfast", "-crf", "23", "-maxrate", bitrate, "-bufsize", bitrate}
+	}
+}
+
+// getVideoScaleFilter returns the filter scaling video decoded on the
+// hardware to a quality, or "" to keep its size
+func (t *Transcoder) getVideoScaleFilter(quality string) string {
+	if quality == QualityOriginal {
+		return ""
+	}
+	width, height, _ := getQualitySettings(quality)
+
+	switch t.hwAccel {
+	case HWAccelNVENC:
+		return fmt.Sprintf("scale_cuda=%d:%d", width, height)
+	case HWAccelQSV:
+		return fmt.Sprintf("scale_qsv=%d:%d", width, height)
+	case HWAccelVAAPI:
+		return fmt.Sprintf("scale_vaapi=%d:%d,format=nv12|vaapi,hwupload", width, height)
+	default:
+		return fmt.Sprintf("scale=%d:%d", width, height)
+	}
+}
+
+// getSoftwareScaleFilter continues a filtergraph run in software, scaling to
+// width by height (zero keeps the size) and handing the frames to the
+// encoder's hardware where it needs them there
+func (t *Transcoder) getSoftwareScaleFilter(width, height int) string {
+	filter := ""
+	if width > 0 && height > 0 {
+		filter = fmt.Sprintf(",scale=%d:%d", width, height)
+	}
+	if t.hwAccel == HWAccelVAAPI {
+		filter += ",format=nv12,hwupload"
 	}
+	return filter
 }
 
 // getQualitySettings returns width, height, and bitrate for a quality preset
@@ -425,9 +548,7 @@ func (t *Transcoder) cleanupStaleSessions() {
 	for id, session := range t.sessions {
 		if now.Sub(session.LastAccess) > staleThreshold {
 			// Kill process if running
-			if session.Process != nil && session.Process.Process != nil {
-				session.Process.Process.Kill()
-			}
+			session.kill()
 			// Remove files
 			os.RemoveAll(session.OutputDir)
 			delete(t.sessions, id)
@@ -443,6 +564,14 @@ func (t *Transcoder) GetActiveSessions() int {
 	return len(t.sessions)
 }
 
+// GetSessionLoad returns the weight of the active sessions, which the
+// maximum number of sessions limits
+func (t *Transcoder) GetSessionLoad() int {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	return t.load()
+}
+
 // GetSessionInfo returns information about active sessions (for monitoring)
 func (t *Transcoder) GetSessionInfo() []map[string]interface{} {
 	t.mutex.RLock()
@@ -450,13 +579,24 @@ func (t *Transcoder) GetSessionInfo() []map[string]interface{} {
 
 	info := make([]map[string]interface{}, 0, len(t.sessions))
 	for _, session := range t.sessions {
-		info = append(info, map[string]interface{}{
+		sessionInfo := map[string]interface{}{
 			"id":         session.ID,
 			"fileId":     session.FileID,
 			"quality":    session.Quality,
+			"mode":       session.Mode,
+			"seekable":   session.Seekable(),
+			"weight":     session.Weight,
 			"startTime":  session.StartTime,
 			"lastAccess": session.LastAccess,
-		})
+		}
+		if len(session.Renditions) > 0 {
+			qualities := make([]string, len(session.Renditions))
+			for i, rendition := range session.Renditions {
+				qualities[i] = rendition.Quality
+			}
+			sessionInfo["renditions"] = qualities
+		}
+		info = append(info, sessionInfo)
 	}
 	return info
 }
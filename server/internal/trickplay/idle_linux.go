@@ -0,0 +1,27 @@
+package trickplay
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// lowerPriority makes a process yield the CPU to everything else
+func lowerPriority(pid int) {
+	syscall.Setpriority(syscall.PRIO_PROCESS, pid, 19)
+}
+
+// loadAverage returns the one minute load average
+func loadAverage() (float64, bool) {
+	data, err := os.ReadFile("/proc/loadavg")
+	if err != nil {
+		return 0, false
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0, false
+	}
+	load, err := strconv.ParseFloat(fields[0], 64)
+	return load, err == nil
+}
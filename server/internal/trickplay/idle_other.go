@@ -0,0 +1,12 @@
+//go:build !linux
+
+package trickplay
+
+// lowerPriority is only implemented on Linux; elsewhere generation relies on
+// waiting for the server to be idle
+func lowerPriority(pid int) {}
+
+// loadAverage is unknown on other platforms
+func loadAverage() (float64, bool) {
+	return 0, false
+}
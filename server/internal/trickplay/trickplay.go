@@ -0,0 +1,481 @@
+// Package trickplay makes the seek preview thumbnails clients show while
+// scrubbing. Frames are tiled into JPEG sprite sheets and described by a
+// WebVTT thumbnail track.
+package trickplay
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/openflix/openflix-server/internal/logger"
+	"github.com/openflix/openflix-server/internal/models"
+	"gorm.io/gorm"
+)
+
+// Kinds of source thumbnails are made for
+const (
+	KindPart      = "parts"      // a models.MediaFile
+	KindRecording = "recordings" // a completed models.Recording
+)
+
+const (
+	thumbWidth = 320
+	columns    = 10
+	rows       = 10
+	// pollInterval is how long the generator rests once everything is done
+	pollInterval = 10 * time.Minute
+	// idleCheck is how often a busy server is checked again
+	idleCheck = 30 * time.Second
+)
+
+// ErrNotReady is returned for sources whose thumbnails aren't finished
+var ErrNotReady = errors.New("trickplay thumbnails are not ready")
+
+// Manifest describes the sprite sheets of a source. It is written before the
+// first sheet and marked complete after the last, so an interrupted source is
+// picked up where it stopped.
+type Manifest struct {
+	Interval      int     `json:"interval"` // seconds between thumbnails
+	Width         int     `json:"width"`
+	Height        int     `json:"height"`
+	Columns       int     `json:"columns"`
+	Rows          int     `json:"rows"`
+	Count         int     `json:"count"`    // thumbnails
+	Duration      float64 `json:"duration"` // seconds
+	SourceSize    int64   `json:"sourceSize"`
+	SourceModTime int64   `json:"sourceModTime"`
+	Complete      bool    `json:"complete"`
+}
+
+// Sheets returns the number of sprite sheets
+func (m *Manifest) Sheets() int {
+	perSheet := m.Columns * m.Rows
+	return (m.Count + perSheet - 1) / perSheet
+}
+
+// job is a source waiting for thumbnails
+type job struct {
+	kind   string
+	id     uint
+	path   string
+	width  int
+	height int
+	// duration in seconds, 0 if it has to be probed
+	duration float64
+}
+
+// Generator makes thumbnails in the background, one sheet at a time and only
+// while the server is otherwise idle
+type Generator struct {
+	db         *gorm.DB
+	dir        string
+	ffmpegBin  string
+	ffprobeBin string
+	interval   int
+	busy       func() bool
+	failed     map[string]int64 // source modification times of sources that failed
+	running    bool
+	stopChan   chan struct{}
+	cancel     context.CancelFunc
+	mu         sync.Mutex
+}
+
+// NewGenerator creates a generator that takes a thumbnail every interval
+// seconds
+func NewGenerator(db *gorm.DB, dataDir, ffmpegBin string, interval int) *Generator {
+	if ffmpegBin == "" {
+		ffmpegBin = "ffmpeg"
+	}
+	ffprobeBin := "ffprobe"
+	if path, err := exec.LookPath("ffprobe"); err == nil {
+		ffprobeBin = path
+	}
+	if interval < 1 {
+		interval = 10
+	}
+	return &Generator{
+		db:         db,
+		dir:        filepath.Join(dataDir, "trickplay"),
+		ffmpegBin:  ffmpegBin,
+		ffprobeBin: ffprobeBin,
+		interval:   interval,
+		failed:     make(map[string]int64),
+		stopChan:   make(chan struct{}),
+	}
+}
+
+// SetBusy sets a check for work that should have the CPU first, such as
+// transcodes and recordings
+func (g *Generator) SetBusy(busy func() bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.busy = busy
+}
+
+// Start begins generating thumbnails in the background
+func (g *Generator) Start() {
+	g.mu.Lock()
+	if g.running {
+		g.mu.Unlock()
+		return
+	}
+	g.running = true
+	ctx, cancel := context.WithCancel(context.Background())
+	g.cancel = cancel
+	g.mu.Unlock()
+
+	logger.Info("Trickplay thumbnail generator started")
+	go g.run(ctx)
+}
+
+// Stop stops the generator, abandoning the sheet in progress
+func (g *Generator) Stop() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.running {
+		close(g.stopChan)
+		g.cancel()
+		g.running = false
+	}
+}
+
+func (g *Generator) run(ctx context.Context) {
+	for {
+		g.removeOrphans()
+		for _, j := range g.pending() {
+			if err := g.generate(ctx, j); err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				logger.Debugf("Failed to generate trickplay thumbnails for %s: %v", j.path, err)
+			}
+		}
+
+		select {
+		case <-time.After(pollInterval):
+		case <-g.stopChan:
+			logger.Info("Trickplay thumbnail generator stopped")
+			return
+		}
+	}
+}
+
+// pending returns the local video files and completed recordings without
+// finished thumbnails
+func (g *Generator) pending() []job {
+	var jobs []job
+
+	var files []models.MediaFile
+	g.db.Select("id", "file_path", "width", "height", "duration").
+		Where("is_remote = ? AND width > 0 AND height > 0 AND duration > 0", false).
+		Order("id DESC").
+		Find(&files)
+	for _, f := range files {
+		if !g.complete(KindPart, f.ID) {
+			jobs = append(jobs, job{
+				kind:     KindPart,
+				id:       f.ID,
+				path:     f.FilePath,
+				width:    f.Width,
+				height:   f.Height,
+				duration: float64(f.Duration) / 1000,
+			})
+		}
+	}
+
+	var recordings []models.Recording
+	g.db.Select("id", "file_path").
+		Where("status = ? AND file_path <> ''", "completed").
+		Order("id DESC").
+		Find(&recordings)
+	for _, r := range recordings {
+		if !g.complete(KindRecording, r.ID) {
+			jobs = append(jobs, job{kind: KindRecording, id: r.ID, path: r.FilePath})
+		}
+	}
+	return jobs
+}
+
+func (g *Generator) complete(kind string, id uint) bool {
+	m, err := g.readManifest(kind, id)
+	return err == nil && m.Complete
+}
+
+// Dir is where the thumbnails of a source are kept
+func (g *Generator) Dir(kind string, id uint) string {
+	return filepath.Join(g.dir, kind, strconv.FormatUint(uint64(id), 10))
+}
+
+// SheetPath is the path of a sprite sheet, numbered from 1
+func (g *Generator) SheetPath(kind string, id uint, sheet int) string {
+	return filepath.Join(g.Dir(kind, id), fmt.Sprintf("%d.jpg", sheet))
+}
+
+func (g *Generator) readManifest(kind string, id uint) (*Manifest, error) {
+	data, err := os.ReadFile(filepath.Join(g.Dir(kind, id), "manifest.json"))
+	if err != nil {
+		return nil, err
+	}
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func (g *Generator) writeManifest(kind string, id uint, m *Manifest) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(g.Dir(kind, id), "manifest.json")
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// Manifest returns the manifest of a source whose thumbnails are finished
+func (g *Generator) Manifest(kind string, id uint) (*Manifest, error) {
+	m, err := g.readManifest(kind, id)
+	if err != nil || !m.Complete {
+		return nil, ErrNotReady
+	}
+	return m, nil
+}
+
+// generate makes the missing sheets of a source. Sheets already on disk from
+// an earlier run are kept unless the source has changed since. A source that
+// failed isn't tried again until it changes.
+func (g *Generator) generate(ctx context.Context, j job) error {
+	info, err := os.Stat(j.path)
+	if err != nil {
+		return err
+	}
+	key := j.kind + "/" + strconv.FormatUint(uint64(j.id), 10)
+	if modTime, failed := g.failed[key]; failed && modTime == info.ModTime().Unix() {
+		return nil
+	}
+	if err := g.generateSheets(ctx, j, info); err != nil {
+		if ctx.Err() == nil {
+			g.failed[key] = info.ModTime().Unix()
+		}
+		return err
+	}
+	delete(g.failed, key)
+	return nil
+}
+
+func (g *Generator) generateSheets(ctx context.Context, j job, info os.FileInfo) error {
+
+	dir := g.Dir(j.kind, j.id)
+	m, err := g.readManifest(j.kind, j.id)
+	if err != nil || m.SourceSize != info.Size() || m.SourceModTime != info.ModTime().Unix() || m.Interval != g.interval {
+		if !g.waitIdle() {
+			return ctx.Err()
+		}
+		if m, err = g.newManifest(j, info); err != nil {
+			return err
+		}
+		os.RemoveAll(dir)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		if err := g.writeManifest(j.kind, j.id, m); err != nil {
+			return err
+		}
+	}
+
+	for sheet := 1; sheet <= m.Sheets(); sheet++ {
+		path := g.SheetPath(j.kind, j.id, sheet)
+		if _, err := os.Stat(path); err == nil {
+			continue
+		}
+		if !g.waitIdle() {
+			return context.Canceled
+		}
+		if err := g.makeSheet(ctx, j.path, m, sheet, path); err != nil {
+			return err
+		}
+	}
+
+	m.Complete = true
+	logger.Debugf("Generated trickplay thumbnails for %s", j.path)
+	return g.writeManifest(j.kind, j.id, m)
+}
+
+// newManifest lays out the thumbnails of a source, probing recordings for
+// their length and size
+func (g *Generator) newManifest(j job, info os.FileInfo) (*Manifest, error) {
+	if j.duration <= 0 || j.width <= 0 || j.height <= 0 {
+		if err := g.probe(&j); err != nil {
+			return nil, err
+		}
+	}
+
+	// Keep the aspect ratio, with an even height as encoders require
+	height := int(math.Round(float64(thumbWidth)*float64(j.height)/float64(j.width)/2)) * 2
+	if height < 2 {
+		height = 2
+	}
+	return &Manifest{
+		Interval:      g.interval,
+		Width:         thumbWidth,
+		Height:        height,
+		Columns:       columns,
+		Rows:          rows,
+		Count:         int(math.Ceil(j.duration / float64(g.interval))),
+		Duration:      j.duration,
+		SourceSize:    info.Size(),
+		SourceModTime: info.ModTime().Unix(),
+	}, nil
+}
+
+// probe reads the duration and frame size of a file
+func (g *Generator) probe(j *job) error {
+	out, err := exec.Command(g.ffprobeBin,
+		"-v", "quiet",
+		"-print_format", "json",
+		"-select_streams", "v:0",
+		"-show_entries", "format=duration:stream=width,height",
+		j.path,
+	).Output()
+	if err != nil {
+		return err
+	}
+
+	var probe struct {
+		Streams []struct {
+			Width  int `json:"width"`
+			Height int `json:"height"`
+		} `json:"streams"`
+		Format struct {
+			Duration string `json:"duration"`
+		} `json:"format"`
+	}
+	if err := json.Unmarshal(out, &probe); err != nil {
+		return err
+	}
+	if len(probe.Streams) == 0 || probe.Streams[0].Width == 0 || probe.Streams[0].Height == 0 {
+		return errors.New("no video stream")
+	}
+	j.width, j.height = probe.Streams[0].Width, probe.Streams[0].Height
+	j.duration, _ = strconv.ParseFloat(probe.Format.Duration, 64)
+	if j.duration <= 0 {
+		return errors.New("unknown duration")
+	}
+	return nil
+}
+
+// makeSheet tiles the frames of one sheet at low priority
+func (g *Generator) makeSheet(ctx context.Context, source string, m *Manifest, sheet int, path string) error {
+	span := m.Columns * m.Rows * m.Interval
+	start := (sheet - 1) * span
+	tmp := strings.TrimSuffix(path, ".jpg") + ".tmp.jpg"
+
+	cmd := exec.CommandContext(ctx, g.ffmpegBin,
+		"-y", "-v", "quiet",
+		"-ss", strconv.Itoa(start),
+		"-i", source,
+		"-t", strconv.Itoa(span),
+		"-an", "-sn", "-dn",
+		"-vf", fmt.Sprintf("fps=1/%d,scale=%d:%d,tile=%dx%d", m.Interval, m.Width, m.Height, m.Columns, m.Rows),
+		"-frames:v", "1",
+		"-q:v", "5",
+		tmp,
+	)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	lowerPriority(cmd.Process.Pid)
+	if err := cmd.Wait(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// waitIdle blocks until nothing more important needs the CPU. It returns
+// false if the generator was stopped while waiting.
+func (g *Generator) waitIdle() bool {
+	for {
+		g.mu.Lock()
+		busy := g.busy
+		g.mu.Unlock()
+
+		load, ok := loadAverage()
+		idle := (busy == nil || !busy()) && (!ok || load < 0.75*float64(runtime.NumCPU()))
+		if idle {
+			return true
+		}
+
+		select {
+		case <-time.After(idleCheck):
+		case <-g.stopChan:
+			return false
+		}
+	}
+}
+
+// removeOrphans deletes the thumbnails of deleted files and recordings
+func (g *Generator) removeOrphans() {
+	for _, source := range []struct {
+		kind  string
+		model interface{}
+	}{{KindPart, &models.MediaFile{}}, {KindRecording, &models.Recording{}}} {
+		entries, err := os.ReadDir(filepath.Join(g.dir, source.kind))
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			id, err := strconv.ParseUint(entry.Name(), 10, 64)
+			if err != nil {
+				continue
+			}
+			var count int64
+			g.db.Model(source.model).Where("id = ?", id).Count(&count)
+			if count == 0 {
+				os.RemoveAll(filepath.Join(g.dir, source.kind, entry.Name()))
+			}
+		}
+	}
+}
+
+// WebVTT returns the thumbnail track of a manifest. sheetURL gives the URL of
+// each sheet, numbered from 1.
+func WebVTT(m *Manifest, sheetURL func(sheet int) string) string {
+	var b strings.Builder
+	b.WriteString("WEBVTT\n\n")
+
+	perSheet := m.Columns * m.Rows
+	for i := 0; i < m.Count; i++ {
+		start := float64(i * m.Interval)
+		end := math.Min(float64((i+1)*m.Interval), m.Duration)
+		if end <= start {
+			break
+		}
+		tile := i % perSheet
+		x := (tile % m.Columns) * m.Width
+		y := (tile / m.Columns) * m.Height
+		fmt.Fprintf(&b, "%s --> %s\n%s#xywh=%d,%d,%d,%d\n\n",
+			timestamp(start), timestamp(end), sheetURL(i/perSheet+1), x, y, m.Width, m.Height)
+	}
+	return b.String()
+}
+
+// timestamp formats seconds as a WebVTT timestamp
+func timestamp(seconds float64) string {
+	ms := int64(math.Round(seconds * 1000))
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}